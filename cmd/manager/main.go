@@ -33,12 +33,6 @@ import (
 	_ "sigs.k8s.io/controller-runtime/pkg/scheme"
 )
 
-// Change below variables to serve metrics on different host or port.
-var (
-	metricsHost               = "0.0.0.0"
-	metricsPort         int32 = 8383
-	operatorMetricsPort int32 = 8686
-)
 var log = logf.Log.WithName("cmd")
 
 func printVersion() {
@@ -53,6 +47,9 @@ func main() {
 	// be added before calling pflag.Parse().
 	pflag.CommandLine.AddFlagSet(zap.FlagSet())
 
+	// Add the qliksense controller flags
+	pflag.CommandLine.AddFlagSet(qliksense.FlagSet())
+
 	// Add flags registered by imported packages (e.g. glog and
 	// controller-runtime)
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
@@ -71,6 +68,13 @@ func main() {
 
 	printVersion()
 
+	// Load the operator config, the metrics ports and the kustomize server are configured by it
+	operatorConfig, err := qliksense.LoadOperatorConfig()
+	if err != nil {
+		log.Error(err, "Invalid operator config")
+		os.Exit(1)
+	}
+
 	namespace, err := k8sutil.GetWatchNamespace()
 	if err != nil {
 		log.Error(err, "Failed to get watch namespace")
@@ -95,7 +99,7 @@ func main() {
 	// Create a new Cmd to provide shared dependencies and start components
 	mgr, err := manager.New(cfg, manager.Options{
 		Namespace:          namespace,
-		MetricsBindAddress: fmt.Sprintf("%s:%d", metricsHost, metricsPort),
+		MetricsBindAddress: fmt.Sprintf("%s:%d", operatorConfig.Metrics.Host, operatorConfig.Metrics.Port),
 	})
 	if err != nil {
 		log.Error(err, "")
@@ -119,7 +123,7 @@ func main() {
 	}
 
 	// Add the Metrics Service
-	addMetrics(ctx, cfg, namespace)
+	addMetrics(ctx, cfg, namespace, operatorConfig.Metrics)
 
 	log.Info("Starting the Cmd.")
 
@@ -148,8 +152,8 @@ func shutdownHttpServer(srv *http.Server, timeout time.Duration) {
 
 // addMetrics will create the Services and Service Monitors to allow the operator export the metrics by using
 // the Prometheus operator
-func addMetrics(ctx context.Context, cfg *rest.Config, namespace string) {
-	if err := serveCRMetrics(cfg); err != nil {
+func addMetrics(ctx context.Context, cfg *rest.Config, namespace string, metricsConfig qliksense.MetricsConfig) {
+	if err := serveCRMetrics(cfg, metricsConfig); err != nil {
 		if errors.Is(err, k8sutil.ErrRunLocal) {
 			log.Info("Skipping CR metrics server creation; not running in a cluster.")
 			return
@@ -159,8 +163,8 @@ func addMetrics(ctx context.Context, cfg *rest.Config, namespace string) {
 
 	// Add to the below struct any other metrics ports you want to expose.
 	servicePorts := []v1.ServicePort{
-		{Port: metricsPort, Name: metrics.OperatorPortName, Protocol: v1.ProtocolTCP, TargetPort: intstr.IntOrString{Type: intstr.Int, IntVal: metricsPort}},
-		{Port: operatorMetricsPort, Name: metrics.CRPortName, Protocol: v1.ProtocolTCP, TargetPort: intstr.IntOrString{Type: intstr.Int, IntVal: operatorMetricsPort}},
+		{Port: metricsConfig.Port, Name: metrics.OperatorPortName, Protocol: v1.ProtocolTCP, TargetPort: intstr.IntOrString{Type: intstr.Int, IntVal: metricsConfig.Port}},
+		{Port: metricsConfig.OperatorPort, Name: metrics.CRPortName, Protocol: v1.ProtocolTCP, TargetPort: intstr.IntOrString{Type: intstr.Int, IntVal: metricsConfig.OperatorPort}},
 	}
 
 	// Create Service object to expose the metrics port(s).
@@ -184,8 +188,8 @@ func addMetrics(ctx context.Context, cfg *rest.Config, namespace string) {
 }
 
 // serveCRMetrics gets the Operator/CustomResource GVKs and generates metrics based on those types.
-// It serves those metrics on "http://metricsHost:operatorMetricsPort".
-func serveCRMetrics(cfg *rest.Config) error {
+// It serves those metrics on "http://metrics.host:metrics.operatorPort" of the operator config.
+func serveCRMetrics(cfg *rest.Config, metricsConfig qliksense.MetricsConfig) error {
 	// Below function returns filtered operator/CustomResource specific GVKs.
 	// For more control override the below GVK list with your own custom logic.
 	filteredGVK, err := k8sutil.GetGVKsFromAddToScheme(apis.AddToScheme)
@@ -200,7 +204,7 @@ func serveCRMetrics(cfg *rest.Config) error {
 	// To generate metrics in other namespaces, add the values below.
 	ns := []string{operatorNs}
 	// Generate and serve custom resource specific metrics.
-	err = kubemetrics.GenerateAndServeCRMetrics(cfg, ns, filteredGVK, metricsHost, operatorMetricsPort)
+	err = kubemetrics.GenerateAndServeCRMetrics(cfg, ns, filteredGVK, metricsConfig.Host, metricsConfig.OperatorPort)
 	if err != nil {
 		return err
 	}
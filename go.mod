@@ -4,22 +4,25 @@ go 1.13
 
 require (
 	github.com/banzaicloud/k8s-objectmatcher v1.3.0
+	github.com/docker/distribution v2.7.1+incompatible
+	github.com/go-git/go-git/v5 v5.1.0
 	github.com/go-logr/logr v0.1.0
 	github.com/google/uuid v1.1.1
 	github.com/gorilla/mux v1.7.2
 	github.com/mholt/archiver/v3 v3.3.0
 	github.com/operator-framework/operator-sdk v0.16.0
+	github.com/prometheus/client_golang v1.2.1
 	github.com/qlik-oss/k-apis v0.1.17
-
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/spf13/pflag v1.0.5
-	gopkg.in/yaml.v2 v2.2.8
+	gopkg.in/yaml.v2 v2.3.0
 	k8s.io/api v0.17.4
 	k8s.io/apimachinery v0.17.4
 	k8s.io/client-go v12.0.0+incompatible
 	k8s.io/kube-openapi v0.0.0-20191107075043-30be4d16710a
 	sigs.k8s.io/controller-runtime v0.4.0
 	sigs.k8s.io/kustomize/api v0.3.2
-	sigs.k8s.io/yaml v1.1.0
+	sigs.k8s.io/yaml v1.2.0
 )
 
 // Pinned to kubernetes-1.16.2
@@ -3,6 +3,8 @@ package v1
 import (
 	"github.com/operator-framework/operator-sdk/pkg/status"
 	kapis "github.com/qlik-oss/k-apis/pkg/config"
+	batch_v1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -15,6 +17,125 @@ type QliksenseSpec struct {
 	// Important: Run "operator-sdk generate k8s" to regenerate code after modifying this file
 	// Add custom validation using kubebuilder tags: https://book-v1.book.kubebuilder.io/beyond_basics/generating_crd.html
 	kapis.CRSpec `json:",inline"`
+
+	// Git shadows the k-apis git to add the settings that are only used by the operator
+	Git *GitSpec `json:"git,omitempty"`
+	// OpsRunner shadows the k-apis opsRunner to add the settings that are only used by the operator
+	OpsRunner *OpsRunnerSpec `json:"opsRunner,omitempty"`
+	// SyncWindows restrict when the ops runner and the git poller apply changes
+	SyncWindows []SyncWindow `json:"syncWindows,omitempty"`
+	// Operations are scheduled operations of the CR, each run by its own CronJob next to the ops runner
+	Operations []ScheduledOperation `json:"operations,omitempty"`
+}
+
+// ScheduledOperation defines a named operation run on a schedule, e.g. a backup or a log cleanup
+type ScheduledOperation struct {
+	// Name identifies the operation, its CronJob is named <CR name>-<name>
+	// +kubebuilder:validation:Pattern=^[a-z0-9]([-a-z0-9]*[a-z0-9])?$
+	Name string `json:"name"`
+	// Schedule is the cron schedule of the operation
+	Schedule string `json:"schedule"`
+	// Image runs the operation
+	Image string `json:"image"`
+	// Command overrides the entrypoint of the image
+	Command []string `json:"command,omitempty"`
+	// Args are the arguments of the command
+	Args []string `json:"args,omitempty"`
+	// Env are added to the environment of the operation container
+	Env []corev1.EnvVar `json:"env,omitempty"`
+	// Suspend stops scheduling the operation, without deleting its CronJob
+	Suspend bool `json:"suspend,omitempty"`
+	// PodTemplate is strategic merged into the pod template generated for the operation.
+	// A container named after the operation or without a name refers to the generated operation container.
+	PodTemplate *corev1.PodTemplateSpec `json:"podTemplate,omitempty"`
+	// ServiceAccountName runs the operation, the ServiceAccount of the ops runner by default
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	JobPolicySpec `json:",inline"`
+}
+
+// SyncWindowKind tells whether changes are applied during a sync window
+type SyncWindowKind string
+
+const (
+	// SyncWindowAllow only applies changes during the window, and the other allow windows
+	SyncWindowAllow SyncWindowKind = "allow"
+	// SyncWindowDeny does not apply changes during the window, even during an allow window
+	SyncWindowDeny SyncWindowKind = "deny"
+)
+
+// SyncWindow defines a recurring period of time during which changes are, or are not, applied
+type SyncWindow struct {
+	// Kind is allow or deny
+	// +kubebuilder:validation:Enum=allow;deny
+	Kind SyncWindowKind `json:"kind"`
+	// Schedule is the cron schedule of the start of the window
+	Schedule string `json:"schedule"`
+	// Duration is how long the window lasts after every start
+	Duration metav1.Duration `json:"duration"`
+	// TimeZone is the IANA time zone of the schedule, UTC by default
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// GitSpec defines the git repository of the manifests
+type GitSpec struct {
+	kapis.Repo `json:",inline"`
+
+	// AccessTokenSecretKeyRef selects the access token from a Secret in the namespace of the CR, instead of the inline accessToken
+	AccessTokenSecretKeyRef *corev1.SecretKeySelector `json:"accessTokenSecretKeyRef,omitempty"`
+	// WebhookSecretKeyRef selects the secret the push webhooks of the repository are signed with, from a Secret
+	// in the namespace of the CR. Webhooks only trigger a sync of the CRs setting it.
+	WebhookSecretKeyRef *corev1.SecretKeySelector `json:"webhookSecretKeyRef,omitempty"`
+}
+
+// OpsRunnerMode selects how the git repository of the CR is watched
+type OpsRunnerMode string
+
+const (
+	// OpsRunnerModeCronJob runs the ops runner image in a CronJob, or in a regular job without a schedule
+	OpsRunnerModeCronJob OpsRunnerMode = "CronJob"
+	// OpsRunnerModePoller fetches the git repository from the operator and applies the new commits of watchBranch
+	OpsRunnerModePoller OpsRunnerMode = "Poller"
+)
+
+// OpsRunnerSpec defines the ops runner job created by the operator
+type OpsRunnerSpec struct {
+	kapis.OpsRunner `json:",inline"`
+
+	// Mode is CronJob by default, Poller replaces the ops runner job with the git poller of the operator
+	// +kubebuilder:validation:Enum=CronJob;Poller
+	Mode OpsRunnerMode `json:"mode,omitempty"`
+	// PollInterval is how often the git poller fetches the repository, one minute by default
+	PollInterval *metav1.Duration `json:"pollInterval,omitempty"`
+
+	// PodTemplate is strategic merged into the pod template generated for the ops runner job.
+	// A container named "ops-runner" or without a name refers to the generated ops runner container.
+	PodTemplate *corev1.PodTemplateSpec `json:"podTemplate,omitempty"`
+	// ServiceAccountName is an existing ServiceAccount to run the ops runner job with. When it is not set
+	// the operator creates a ServiceAccount, Role and RoleBinding for the ops runner of the CR.
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	JobPolicySpec `json:",inline"`
+}
+
+// JobPolicySpec defines the policies of a CronJob created by the operator, and of the jobs it spawns
+type JobPolicySpec struct {
+	// ConcurrencyPolicy of the CronJob, Forbid by default
+	// +kubebuilder:validation:Enum=Allow;Forbid;Replace
+	ConcurrencyPolicy batch_v1beta1.ConcurrencyPolicy `json:"concurrencyPolicy,omitempty"`
+	// SuccessfulJobsHistoryLimit is the number of successful jobs the CronJob keeps
+	SuccessfulJobsHistoryLimit *int32 `json:"successfulJobsHistoryLimit,omitempty"`
+	// FailedJobsHistoryLimit is the number of failed jobs the CronJob keeps
+	FailedJobsHistoryLimit *int32 `json:"failedJobsHistoryLimit,omitempty"`
+	// StartingDeadlineSeconds is the deadline for starting a job of the CronJob that missed its scheduled time
+	StartingDeadlineSeconds *int64 `json:"startingDeadlineSeconds,omitempty"`
+	// BackoffLimit is the number of retries before a job is marked as failed
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+	// ActiveDeadlineSeconds is how long a job may be active before it is terminated
+	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
+	// TTLSecondsAfterFinished is how long the finished jobs of the CronJob are kept before they are deleted.
+	// It is not applied to the regular ops runner job, which would be recreated by the operator after it is deleted.
+	TTLSecondsAfterFinished *int32 `json:"ttlSecondsAfterFinished,omitempty"`
 }
 
 // QliksenseStatus defines the observed state of Qliksense
@@ -23,6 +144,108 @@ type QliksenseStatus struct {
 	// Important: Run "operator-sdk generate k8s" to regenerate code after modifying this file
 	// Add custom validation using kubebuilder tags: https://book-v1.book.kubebuilder.io/beyond_basics/generating_crd.html
 	Conditions status.Conditions `json:"conditions"`
+	// OpsRunner is the observed state of the ops runner jobs
+	OpsRunner *OpsRunnerStatus `json:"opsRunner,omitempty"`
+	// SyncWindows is the observed state of the sync windows
+	SyncWindows *SyncWindowsStatus `json:"syncWindows,omitempty"`
+	// Operations is the observed state of the scheduled operations
+	Operations []ScheduledOperationStatus `json:"operations,omitempty"`
+}
+
+// SyncWindowsStatus defines whether changes can be applied now, and the changes waiting for the next window
+type SyncWindowsStatus struct {
+	// Open tells whether changes are applied now
+	Open bool `json:"open"`
+	// Overridden tells whether the windows are ignored because of the qlik.com/sync-window-override annotation
+	Overridden bool `json:"overridden,omitempty"`
+	// NextOpenTime is the time changes are applied again, when they are not applied now
+	NextOpenTime *metav1.Time `json:"nextOpenTime,omitempty"`
+	// NextCloseTime is the time changes are not applied anymore, when they are applied now
+	NextCloseTime *metav1.Time `json:"nextCloseTime,omitempty"`
+	// PendingChanges lists the changes waiting for the next window
+	PendingChanges []string `json:"pendingChanges,omitempty"`
+}
+
+// OpsRunnerStatus defines the observed results of the ops runner jobs
+type OpsRunnerStatus struct {
+	// LastScheduleTime is the last time an ops runner job was scheduled
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+	// LastJobName is the name of the last finished ops runner job
+	LastJobName string `json:"lastJobName,omitempty"`
+	// LastFinishedTime is the time the last ops runner job finished
+	LastFinishedTime *metav1.Time `json:"lastFinishedTime,omitempty"`
+	// LastSuccessTime is the time the last successful ops runner job finished
+	LastSuccessTime *metav1.Time `json:"lastSuccessTime,omitempty"`
+	// LastFailureTime is the time the last failed ops runner job finished
+	LastFailureTime *metav1.Time `json:"lastFailureTime,omitempty"`
+	// LastDuration is how long the last finished ops runner job ran
+	LastDuration *metav1.Duration `json:"lastDuration,omitempty"`
+	// LastExitReason is why the last failed ops runner job failed
+	LastExitReason string `json:"lastExitReason,omitempty"`
+	// LastFailedPodName is the name of the pod of the last failed ops runner job, its log is read with kubectl logs
+	LastFailedPodName string `json:"lastFailedPodName,omitempty"`
+	// ConsecutiveFailures is the number of ops runner jobs that failed since the last successful one
+	ConsecutiveFailures int32 `json:"consecutiveFailures,omitempty"`
+	// LastSyncRequest is the last sync requested with the qlik.com/sync-requested annotation
+	LastSyncRequest *SyncRequestStatus `json:"lastSyncRequest,omitempty"`
+	// GitPoller is the observed state of the git poller
+	GitPoller *GitPollerStatus `json:"gitPoller,omitempty"`
+}
+
+// ScheduledOperationStatus defines the observed results of the jobs of a scheduled operation
+type ScheduledOperationStatus struct {
+	// Name is the name of the operation
+	Name string `json:"name"`
+	// CronJobName is the name of the CronJob of the operation
+	CronJobName string `json:"cronJobName,omitempty"`
+	// LastScheduleTime is the last time a job of the operation was scheduled
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+	// LastJobName is the name of the last finished job of the operation
+	LastJobName string `json:"lastJobName,omitempty"`
+	// LastFinishedTime is the time the last job of the operation finished
+	LastFinishedTime *metav1.Time `json:"lastFinishedTime,omitempty"`
+	// LastSuccessTime is the time the last successful job of the operation finished
+	LastSuccessTime *metav1.Time `json:"lastSuccessTime,omitempty"`
+	// LastFailureTime is the time the last failed job of the operation finished
+	LastFailureTime *metav1.Time `json:"lastFailureTime,omitempty"`
+	// LastExitReason is why the last failed job of the operation failed
+	LastExitReason string `json:"lastExitReason,omitempty"`
+	// ConsecutiveFailures is the number of jobs of the operation that failed since the last successful one
+	ConsecutiveFailures int32 `json:"consecutiveFailures,omitempty"`
+	// Error is why the CronJob of the operation could not be applied, it is cleared when it is applied
+	Error string `json:"error,omitempty"`
+}
+
+// GitPollerStatus defines the observed state of the git repository polled by the operator
+type GitPollerStatus struct {
+	// ObservedCommit is the last commit of watchBranch fetched by the poller
+	ObservedCommit string `json:"observedCommit,omitempty"`
+	// ObservedTime is the time the poller fetched a new commit
+	ObservedTime *metav1.Time `json:"observedTime,omitempty"`
+	// AppliedCommit is the last commit the manifests were rendered and applied from
+	AppliedCommit string `json:"appliedCommit,omitempty"`
+	// AppliedGeneration is the generation of the CR the manifests were rendered with
+	AppliedGeneration int64 `json:"appliedGeneration,omitempty"`
+	// AppliedTime is the time the manifests were applied
+	AppliedTime *metav1.Time `json:"appliedTime,omitempty"`
+	// LastError is why the last poll failed, it is cleared by the next successful poll
+	LastError string `json:"lastError,omitempty"`
+}
+
+// SyncRequestStatus defines the observed state of a sync requested with the qlik.com/sync-requested annotation
+type SyncRequestStatus struct {
+	// Requested is the value of the annotation that was handled
+	Requested string `json:"requested"`
+	// HandledTime is the time the operator handled the request
+	HandledTime *metav1.Time `json:"handledTime,omitempty"`
+	// JobName is the name of the job spawned for the request
+	JobName string `json:"jobName,omitempty"`
+	// Result is Running, Succeeded, Failed or Skipped
+	Result string `json:"result,omitempty"`
+	// Message tells why the job failed or the request was skipped
+	Message string `json:"message,omitempty"`
+	// FinishedTime is the time the job spawned for the request finished
+	FinishedTime *metav1.Time `json:"finishedTime,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -34,7 +257,7 @@ type Qliksense struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Spec   *kapis.CRSpec   `json:"spec,omitempty"`
+	Spec   *QliksenseSpec  `json:"spec,omitempty"`
 	Status QliksenseStatus `json:"status,omitempty"`
 }
 
@@ -54,3 +277,20 @@ func init() {
 func (q *Qliksense) GetVersion() string {
 	return q.ObjectMeta.Labels["version"]
 }
+
+// GetCRSpec returns the k-apis spec of the CR, including the k-apis part of git and the ops runner
+func (q *Qliksense) GetCRSpec() *kapis.CRSpec {
+	if q.Spec == nil {
+		return nil
+	}
+	crSpec := q.Spec.CRSpec
+	if q.Spec.Git != nil {
+		git := q.Spec.Git.Repo
+		crSpec.Git = &git
+	}
+	if q.Spec.OpsRunner != nil {
+		opsRunner := q.Spec.OpsRunner.OpsRunner
+		crSpec.OpsRunner = &opsRunner
+	}
+	return &crSpec
+}
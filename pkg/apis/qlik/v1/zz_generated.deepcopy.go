@@ -6,6 +6,8 @@ package v1
 
 import (
 	status "github.com/operator-framework/operator-sdk/pkg/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -73,10 +75,204 @@ func (in *QliksenseList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitSpec) DeepCopyInto(out *GitSpec) {
+	*out = *in
+	out.Repo = in.Repo
+	if in.AccessTokenSecretKeyRef != nil {
+		in, out := &in.AccessTokenSecretKeyRef, &out.AccessTokenSecretKeyRef
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.WebhookSecretKeyRef != nil {
+		in, out := &in.WebhookSecretKeyRef, &out.WebhookSecretKeyRef
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitSpec.
+func (in *GitSpec) DeepCopy() *GitSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(GitSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitPollerStatus) DeepCopyInto(out *GitPollerStatus) {
+	*out = *in
+	if in.ObservedTime != nil {
+		in, out := &in.ObservedTime, &out.ObservedTime
+		*out = (*in).DeepCopy()
+	}
+	if in.AppliedTime != nil {
+		in, out := &in.AppliedTime, &out.AppliedTime
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitPollerStatus.
+func (in *GitPollerStatus) DeepCopy() *GitPollerStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(GitPollerStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *JobPolicySpec) DeepCopyInto(out *JobPolicySpec) {
+	*out = *in
+	if in.SuccessfulJobsHistoryLimit != nil {
+		in, out := &in.SuccessfulJobsHistoryLimit, &out.SuccessfulJobsHistoryLimit
+		*out = new(int32)
+		**out = **in
+	}
+	if in.FailedJobsHistoryLimit != nil {
+		in, out := &in.FailedJobsHistoryLimit, &out.FailedJobsHistoryLimit
+		*out = new(int32)
+		**out = **in
+	}
+	if in.StartingDeadlineSeconds != nil {
+		in, out := &in.StartingDeadlineSeconds, &out.StartingDeadlineSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.BackoffLimit != nil {
+		in, out := &in.BackoffLimit, &out.BackoffLimit
+		*out = new(int32)
+		**out = **in
+	}
+	if in.ActiveDeadlineSeconds != nil {
+		in, out := &in.ActiveDeadlineSeconds, &out.ActiveDeadlineSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.TTLSecondsAfterFinished != nil {
+		in, out := &in.TTLSecondsAfterFinished, &out.TTLSecondsAfterFinished
+		*out = new(int32)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new JobPolicySpec.
+func (in *JobPolicySpec) DeepCopy() *JobPolicySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(JobPolicySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OpsRunnerSpec) DeepCopyInto(out *OpsRunnerSpec) {
+	*out = *in
+	out.OpsRunner = in.OpsRunner
+	if in.PollInterval != nil {
+		in, out := &in.PollInterval, &out.PollInterval
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.PodTemplate != nil {
+		in, out := &in.PodTemplate, &out.PodTemplate
+		*out = new(corev1.PodTemplateSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	in.JobPolicySpec.DeepCopyInto(&out.JobPolicySpec)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OpsRunnerSpec.
+func (in *OpsRunnerSpec) DeepCopy() *OpsRunnerSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(OpsRunnerSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OpsRunnerStatus) DeepCopyInto(out *OpsRunnerStatus) {
+	*out = *in
+	if in.LastScheduleTime != nil {
+		in, out := &in.LastScheduleTime, &out.LastScheduleTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastFinishedTime != nil {
+		in, out := &in.LastFinishedTime, &out.LastFinishedTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastSuccessTime != nil {
+		in, out := &in.LastSuccessTime, &out.LastSuccessTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastFailureTime != nil {
+		in, out := &in.LastFailureTime, &out.LastFailureTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastDuration != nil {
+		in, out := &in.LastDuration, &out.LastDuration
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.LastSyncRequest != nil {
+		in, out := &in.LastSyncRequest, &out.LastSyncRequest
+		*out = new(SyncRequestStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.GitPoller != nil {
+		in, out := &in.GitPoller, &out.GitPoller
+		*out = new(GitPollerStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OpsRunnerStatus.
+func (in *OpsRunnerStatus) DeepCopy() *OpsRunnerStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(OpsRunnerStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *QliksenseSpec) DeepCopyInto(out *QliksenseSpec) {
 	*out = *in
 	in.CRSpec.DeepCopyInto(&out.CRSpec)
+	if in.Git != nil {
+		in, out := &in.Git, &out.Git
+		*out = new(GitSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.OpsRunner != nil {
+		in, out := &in.OpsRunner, &out.OpsRunner
+		*out = new(OpsRunnerSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SyncWindows != nil {
+		in, out := &in.SyncWindows, &out.SyncWindows
+		*out = make([]SyncWindow, len(*in))
+		copy(*out, *in)
+	}
+	if in.Operations != nil {
+		in, out := &in.Operations, &out.Operations
+		*out = make([]ScheduledOperation, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -100,6 +296,23 @@ func (in *QliksenseStatus) DeepCopyInto(out *QliksenseStatus) {
 			(*out)[key] = *val.DeepCopy()
 		}
 	}
+	if in.OpsRunner != nil {
+		in, out := &in.OpsRunner, &out.OpsRunner
+		*out = new(OpsRunnerStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SyncWindows != nil {
+		in, out := &in.SyncWindows, &out.SyncWindows
+		*out = new(SyncWindowsStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Operations != nil {
+		in, out := &in.Operations, &out.Operations
+		*out = make([]ScheduledOperationStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -112,3 +325,144 @@ func (in *QliksenseStatus) DeepCopy() *QliksenseStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScheduledOperation) DeepCopyInto(out *ScheduledOperation) {
+	*out = *in
+	if in.Command != nil {
+		in, out := &in.Command, &out.Command
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Args != nil {
+		in, out := &in.Args, &out.Args
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Env != nil {
+		in, out := &in.Env, &out.Env
+		*out = make([]corev1.EnvVar, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PodTemplate != nil {
+		in, out := &in.PodTemplate, &out.PodTemplate
+		*out = new(corev1.PodTemplateSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	in.JobPolicySpec.DeepCopyInto(&out.JobPolicySpec)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScheduledOperation.
+func (in *ScheduledOperation) DeepCopy() *ScheduledOperation {
+	if in == nil {
+		return nil
+	}
+	out := new(ScheduledOperation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ScheduledOperationStatus) DeepCopyInto(out *ScheduledOperationStatus) {
+	*out = *in
+	if in.LastScheduleTime != nil {
+		in, out := &in.LastScheduleTime, &out.LastScheduleTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastFinishedTime != nil {
+		in, out := &in.LastFinishedTime, &out.LastFinishedTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastSuccessTime != nil {
+		in, out := &in.LastSuccessTime, &out.LastSuccessTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastFailureTime != nil {
+		in, out := &in.LastFailureTime, &out.LastFailureTime
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ScheduledOperationStatus.
+func (in *ScheduledOperationStatus) DeepCopy() *ScheduledOperationStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ScheduledOperationStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SyncRequestStatus) DeepCopyInto(out *SyncRequestStatus) {
+	*out = *in
+	if in.HandledTime != nil {
+		in, out := &in.HandledTime, &out.HandledTime
+		*out = (*in).DeepCopy()
+	}
+	if in.FinishedTime != nil {
+		in, out := &in.FinishedTime, &out.FinishedTime
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SyncRequestStatus.
+func (in *SyncRequestStatus) DeepCopy() *SyncRequestStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SyncRequestStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SyncWindow) DeepCopyInto(out *SyncWindow) {
+	*out = *in
+	out.Duration = in.Duration
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SyncWindow.
+func (in *SyncWindow) DeepCopy() *SyncWindow {
+	if in == nil {
+		return nil
+	}
+	out := new(SyncWindow)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SyncWindowsStatus) DeepCopyInto(out *SyncWindowsStatus) {
+	*out = *in
+	if in.NextOpenTime != nil {
+		in, out := &in.NextOpenTime, &out.NextOpenTime
+		*out = (*in).DeepCopy()
+	}
+	if in.NextCloseTime != nil {
+		in, out := &in.NextCloseTime, &out.NextCloseTime
+		*out = (*in).DeepCopy()
+	}
+	if in.PendingChanges != nil {
+		in, out := &in.PendingChanges, &out.PendingChanges
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SyncWindowsStatus.
+func (in *SyncWindowsStatus) DeepCopy() *SyncWindowsStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SyncWindowsStatus)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,146 @@
+package qliksense
+
+import (
+	"context"
+
+	batch_v1beta1 "k8s.io/api/batch/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// cronJobResource lists the versions of CronJob supported by the operator, in order of preference
+var cronJobResource = GroupVersionsResource{Group: "batch", Versions: []string{"v1", "v1beta1"}, Resource: "cronjobs"}
+
+// resolveCronJobGroupVersion returns the preferred version of CronJob served by the cluster. It falls back to
+// batch/v1beta1, the only version of older clusters, when CronJobs are not discovered.
+func resolveCronJobGroupVersion(discoveryClient discovery.DiscoveryInterface) (schema.GroupVersion, error) {
+	groupVersionResource, served, err := resolveGroupVersionResource(discoveryClient, cronJobResource)
+	if err != nil {
+		return schema.GroupVersion{}, err
+	} else if !served {
+		return batch_v1beta1.SchemeGroupVersion, nil
+	}
+	return groupVersionResource.GroupVersion(), nil
+}
+
+// newCronJobObject returns an empty CronJob of the version, to watch CronJobs
+func newCronJobObject(groupVersion schema.GroupVersion) runtime.Object {
+	if groupVersion == batch_v1beta1.SchemeGroupVersion {
+		return &batch_v1beta1.CronJob{}
+	}
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(groupVersion.WithKind("CronJob"))
+	return u
+}
+
+// The operator builds batch/v1beta1 CronJobs, the only version of CronJob in the API types of the operator.
+// The functions below read and write them as the version served by the cluster, batch/v1 CronJobs are converted
+// through unstructured objects, as the fields of CronJobs used by the operator are the same in both versions.
+
+func (r *ReconcileQliksense) getCronJobGroupVersion() schema.GroupVersion {
+	if r.cronJobGroupVersion.Empty() {
+		return batch_v1beta1.SchemeGroupVersion
+	}
+	return r.cronJobGroupVersion
+}
+
+func (r *ReconcileQliksense) isTypedCronJob() bool {
+	return r.getCronJobGroupVersion() == batch_v1beta1.SchemeGroupVersion
+}
+
+func (r *ReconcileQliksense) getCronJob(key types.NamespacedName, cronJob *batch_v1beta1.CronJob) error {
+	if r.isTypedCronJob() {
+		return r.client.Get(context.TODO(), key, cronJob)
+	}
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(r.getCronJobGroupVersion().WithKind("CronJob"))
+	if err := r.client.Get(context.TODO(), key, u); err != nil {
+		return err
+	}
+	return fromUnstructuredCronJob(u, cronJob)
+}
+
+func (r *ReconcileQliksense) listCronJobs(cronJobList *batch_v1beta1.CronJobList, opts ...client.ListOption) error {
+	if r.isTypedCronJob() {
+		return r.client.List(context.TODO(), cronJobList, opts...)
+	}
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(r.getCronJobGroupVersion().WithKind("CronJobList"))
+	if err := r.client.List(context.TODO(), list, opts...); err != nil {
+		return err
+	}
+	cronJobList.Items = make([]batch_v1beta1.CronJob, len(list.Items))
+	for i := range list.Items {
+		if err := fromUnstructuredCronJob(&list.Items[i], &cronJobList.Items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ReconcileQliksense) createCronJob(cronJob *batch_v1beta1.CronJob) error {
+	if r.isTypedCronJob() {
+		return r.client.Create(context.TODO(), cronJob)
+	}
+	u, err := r.toUnstructuredCronJob(cronJob)
+	if err != nil {
+		return err
+	} else if err := r.client.Create(context.TODO(), u); err != nil {
+		return err
+	}
+	return fromUnstructuredCronJob(u, cronJob)
+}
+
+func (r *ReconcileQliksense) updateCronJob(cronJob *batch_v1beta1.CronJob) error {
+	if r.isTypedCronJob() {
+		return r.client.Update(context.TODO(), cronJob)
+	}
+	u, err := r.toUnstructuredCronJob(cronJob)
+	if err != nil {
+		return err
+	} else if err := r.client.Update(context.TODO(), u); err != nil {
+		return err
+	}
+	return fromUnstructuredCronJob(u, cronJob)
+}
+
+func (r *ReconcileQliksense) deleteCronJobObject(cronJob *batch_v1beta1.CronJob, opts ...client.DeleteOption) error {
+	if r.isTypedCronJob() {
+		return r.client.Delete(context.TODO(), cronJob, opts...)
+	}
+	u, err := r.toUnstructuredCronJob(cronJob)
+	if err != nil {
+		return err
+	}
+	return r.client.Delete(context.TODO(), u, opts...)
+}
+
+// getCronJobControllerRef returns the controller reference of the objects owned by the CronJob, in the served version
+func (r *ReconcileQliksense) getCronJobControllerRef(cronJob *batch_v1beta1.CronJob) *metav1.OwnerReference {
+	return metav1.NewControllerRef(cronJob, r.getCronJobGroupVersion().WithKind("CronJob"))
+}
+
+func (r *ReconcileQliksense) toUnstructuredCronJob(cronJob *batch_v1beta1.CronJob) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(cronJob)
+	if err != nil {
+		return nil, err
+	}
+	u := &unstructured.Unstructured{Object: content}
+	u.SetGroupVersionKind(r.getCronJobGroupVersion().WithKind("CronJob"))
+	return u, nil
+}
+
+func fromUnstructuredCronJob(u *unstructured.Unstructured, cronJob *batch_v1beta1.CronJob) error {
+	*cronJob = batch_v1beta1.CronJob{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), cronJob); err != nil {
+		return err
+	}
+	// the same as the typed objects read by the client
+	cronJob.TypeMeta = metav1.TypeMeta{}
+	return nil
+}
@@ -0,0 +1,151 @@
+package qliksense
+
+import (
+	"context"
+	"testing"
+
+	"github.com/qlik-oss/qliksense-operator/pkg/apis"
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	batch_v1 "k8s.io/api/batch/v1"
+	batch_v1beta1 "k8s.io/api/batch/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var batchV1GroupVersion = schema.GroupVersion{Group: "batch", Version: "v1"}
+
+func Test_resolveCronJobGroupVersion(t *testing.T) {
+	testCases := []struct {
+		name      string
+		resources []*metav1.APIResourceList
+		expected  schema.GroupVersion
+	}{
+		{
+			name: "batch/v1 CronJob",
+			resources: []*metav1.APIResourceList{
+				{GroupVersion: "batch/v1", APIResources: []metav1.APIResource{{Name: "jobs"}, {Name: "cronjobs"}}},
+				{GroupVersion: "batch/v1beta1", APIResources: []metav1.APIResource{{Name: "cronjobs"}}},
+			},
+			expected: batchV1GroupVersion,
+		},
+		{
+			name: "batch/v1beta1 CronJob",
+			resources: []*metav1.APIResourceList{
+				{GroupVersion: "batch/v1", APIResources: []metav1.APIResource{{Name: "jobs"}}},
+				{GroupVersion: "batch/v1beta1", APIResources: []metav1.APIResource{{Name: "cronjobs"}}},
+			},
+			expected: batch_v1beta1.SchemeGroupVersion,
+		},
+		{
+			name:     "no CronJob discovered",
+			expected: batch_v1beta1.SchemeGroupVersion,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			discoveryClient := &fakediscovery.FakeDiscovery{Fake: &k8stesting.Fake{Resources: testCase.resources}}
+			if groupVersion, err := resolveCronJobGroupVersion(discoveryClient); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if groupVersion != testCase.expected {
+				t.Fatalf("expected: %v, but got: %v", testCase.expected, groupVersion)
+			}
+		})
+	}
+}
+
+func Test_opsRunnerCronJobVersions(t *testing.T) {
+	for _, groupVersion := range []schema.GroupVersion{batch_v1beta1.SchemeGroupVersion, batchV1GroupVersion} {
+		t.Run(groupVersion.String(), func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			if err := clientgoscheme.AddToScheme(scheme); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if err := apis.AddToScheme(scheme); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if groupVersion == batchV1GroupVersion {
+				// the fake client needs a type to list the kind, batch/v1 CronJobs are unstructured
+				scheme.AddKnownTypeWithName(batchV1GroupVersion.WithKind("CronJob"), &unstructured.Unstructured{})
+				scheme.AddKnownTypeWithName(batchV1GroupVersion.WithKind("CronJobList"), &unstructured.UnstructuredList{})
+			}
+			m := &qlikv1.Qliksense{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "qlik-default",
+					Namespace:   "default",
+					UID:         "qlik-default-uid",
+					Annotations: map[string]string{syncRequestedAnnotation: "now"},
+				},
+				Spec: &qlikv1.QliksenseSpec{OpsRunner: &qlikv1.OpsRunnerSpec{}},
+			}
+			m.Spec.OpsRunner.Enabled = "yes"
+			m.Spec.OpsRunner.Schedule = "0 * * * *"
+			r := &ReconcileQliksense{
+				client:              fake.NewFakeClientWithScheme(scheme, m),
+				scheme:              scheme,
+				cronJobGroupVersion: groupVersion,
+			}
+			key := types.NamespacedName{Name: m.Name + opsRunnerJobNameSuffix, Namespace: m.Namespace}
+
+			// the CronJob is created as applied by setupOpsRunnerJob, without the last applied annotation
+			if cronJob, err := r.getOpsRunnerCronJob(log, m); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if err := r.createJobObject(cronJob); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			served := &unstructured.Unstructured{}
+			served.SetGroupVersionKind(groupVersion.WithKind("CronJob"))
+			if err := r.client.Get(context.TODO(), key, served); err != nil {
+				t.Fatalf("expected the CronJob to be created as %v, but got: %v", groupVersion, err)
+			} else if schedule, _, _ := unstructured.NestedString(served.Object, "spec", "schedule"); schedule != "0 * * * *" {
+				t.Fatalf("unexpected schedule: %v", schedule)
+			}
+			if groupVersion == batchV1GroupVersion {
+				if err := r.client.Get(context.TODO(), key, &batch_v1beta1.CronJob{}); !errors.IsNotFound(err) {
+					t.Fatalf("expected no batch/v1beta1 CronJob, but got: %v", err)
+				}
+			}
+
+			currentOpsRunnerJob, err := r.getCurrentOpsRunnerJob(log, m)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if currentOpsRunnerJob.Kind != OpsRunnerJobKindCronJob {
+				t.Fatalf("expected the current ops runner job to be the CronJob, but got: %v", currentOpsRunnerJob.Kind)
+			} else if cronJob := currentOpsRunnerJob.Job.(*batch_v1beta1.CronJob); cronJob.Spec.JobTemplate.Labels[opsRunnerJobLabel] != m.Name {
+				t.Fatalf("expected the job template to be read, but got: %v", cronJob.Spec.JobTemplate)
+			}
+
+			// the sync job is owned by the CronJob of the served version
+			if err := r.handleSyncRequest(log, m); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			syncJob := &batch_v1.Job{}
+			if err := r.client.Get(context.TODO(), types.NamespacedName{Name: m.Status.OpsRunner.LastSyncRequest.JobName, Namespace: m.Namespace}, syncJob); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if len(syncJob.OwnerReferences) != 1 || syncJob.OwnerReferences[0].APIVersion != groupVersion.String() || syncJob.OwnerReferences[0].Kind != "CronJob" {
+				t.Fatalf("expected the sync job to be owned by the %v CronJob, but got: %v", groupVersion, syncJob.OwnerReferences)
+			}
+
+			cronJobList := &batch_v1beta1.CronJobList{}
+			if err := r.listCronJobs(cronJobList, client.InNamespace(m.Namespace), client.MatchingLabels{searchingLabel: m.Name}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if len(cronJobList.Items) != 1 || cronJobList.Items[0].Name != key.Name {
+				t.Fatalf("expected the CronJob to be listed, but got: %v", cronJobList.Items)
+			}
+
+			m.Spec.OpsRunner.Enabled = "no"
+			if err := r.setupOpsRunnerJob(log, m); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if err := r.client.Get(context.TODO(), key, served); !errors.IsNotFound(err) {
+				t.Fatalf("expected the CronJob to be deleted, but got: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package qliksense
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"sigs.k8s.io/yaml"
+)
+
+var customResourcesConfigPath string
+
+// GroupVersionsResource is a resource of an API group that may be served under several versions,
+// the versions are listed in order of preference
+type GroupVersionsResource struct {
+	Group    string   `json:"group"`
+	Versions []string `json:"versions"`
+	Resource string   `json:"resource"`
+}
+
+// CustomResourcesConfig declares the custom resource types the operator manages for a Qliksense release
+type CustomResourcesConfig struct {
+	// Engine is used to detect if a release is installed and is deleted when the release is finalized
+	Engine GroupVersionsResource `json:"engine"`
+	// Owned resources get the Qliksense CR set as their owner
+	Owned []GroupVersionsResource `json:"owned"`
+}
+
+func defaultCustomResourcesConfig() *CustomResourcesConfig {
+	return &CustomResourcesConfig{
+		Engine: GroupVersionsResource{Group: "qixmanager.qlik.com", Versions: []string{"v1"}, Resource: "engines"},
+		Owned: []GroupVersionsResource{
+			{Group: "qixmanager.qlik.com", Versions: []string{"v1"}, Resource: "engines"},
+			{Group: "qixengine.qlik.com", Versions: []string{"v1"}, Resource: "engines"},
+			{Group: "qixengine.qlik.com", Versions: []string{"v1"}, Resource: "enginetemplates"},
+			{Group: "qixengine.qlik.com", Versions: []string{"v1"}, Resource: "enginevariants"},
+		},
+	}
+}
+
+// loadCustomResourcesConfig reads the config from the path given by the flag, or returns the default config
+func loadCustomResourcesConfig(path string) (*CustomResourcesConfig, error) {
+	if path == "" {
+		return defaultCustomResourcesConfig(), nil
+	}
+	configBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	customResources := &CustomResourcesConfig{}
+	if err := yaml.UnmarshalStrict(configBytes, customResources); err != nil {
+		return nil, fmt.Errorf("cannot parse custom resources config %v: %w", path, err)
+	}
+	if err := customResources.validate(); err != nil {
+		return nil, fmt.Errorf("invalid custom resources config %v: %w", path, err)
+	}
+	return customResources, nil
+}
+
+func (c *CustomResourcesConfig) validate() error {
+	if err := c.Engine.validate(); err != nil {
+		return fmt.Errorf("engine: %w", err)
+	}
+	for i, owned := range c.Owned {
+		if err := owned.validate(); err != nil {
+			return fmt.Errorf("owned[%v]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (g GroupVersionsResource) validate() error {
+	if g.Resource == "" {
+		return errors.New("resource must be set")
+	} else if len(g.Versions) == 0 {
+		return errors.New("at least one version must be set")
+	}
+	return nil
+}
+
+// resolveGroupVersionResource returns the GroupVersionResource for the first version served by the API server.
+// If none of the versions are served it returns false.
+func resolveGroupVersionResource(discoveryClient discovery.DiscoveryInterface, g GroupVersionsResource) (schema.GroupVersionResource, bool, error) {
+	groups, err := discoveryClient.ServerGroups()
+	if err != nil {
+		return schema.GroupVersionResource{}, false, err
+	}
+	servedVersions := make(map[string]bool)
+	for _, group := range groups.Groups {
+		if group.Name == g.Group {
+			for _, version := range group.Versions {
+				servedVersions[version.Version] = true
+			}
+		}
+	}
+	for _, version := range g.Versions {
+		if !servedVersions[version] {
+			continue
+		}
+		groupVersion := schema.GroupVersion{Group: g.Group, Version: version}
+		resourceList, err := discoveryClient.ServerResourcesForGroupVersion(groupVersion.String())
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return schema.GroupVersionResource{}, false, err
+		}
+		for _, resource := range resourceList.APIResources {
+			if resource.Name == g.Resource {
+				return groupVersion.WithResource(g.Resource), true, nil
+			}
+		}
+	}
+	return schema.GroupVersionResource{}, false, nil
+}
@@ -0,0 +1,112 @@
+package qliksense
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_loadCustomResourcesConfig(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if customResources, err := loadCustomResourcesConfig(""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(customResources.Owned) != 4 {
+		t.Fatalf("expected 4 default owned resources, but got: %v", len(customResources.Owned))
+	}
+
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	if err := ioutil.WriteFile(configPath, []byte(`
+engine:
+  group: qixengine.qlik.com
+  versions: [v1, v1beta1]
+  resource: engines
+owned:
+- group: qixengine.qlik.com
+  versions: [v1, v1beta1]
+  resource: engines
+`), os.ModePerm); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if customResources, err := loadCustomResourcesConfig(configPath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if customResources.Engine.Group != "qixengine.qlik.com" || len(customResources.Engine.Versions) != 2 {
+		t.Fatalf("unexpected engine resource: %v", customResources.Engine)
+	} else if len(customResources.Owned) != 1 {
+		t.Fatalf("expected 1 owned resource, but got: %v", len(customResources.Owned))
+	}
+
+	if err := ioutil.WriteFile(configPath, []byte(`
+engine:
+  group: qixengine.qlik.com
+  resource: engines
+`), os.ModePerm); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := loadCustomResourcesConfig(configPath); err == nil {
+		t.Fatal("expected an error for an engine resource without versions")
+	}
+}
+
+func Test_resolveGroupVersionResource(t *testing.T) {
+	discoveryClient := &fakediscovery.FakeDiscovery{
+		Fake: &k8stesting.Fake{
+			Resources: []*metav1.APIResourceList{
+				{
+					GroupVersion: "qixengine.qlik.com/v1beta1",
+					APIResources: []metav1.APIResource{{Name: "engines"}, {Name: "enginetemplates"}},
+				},
+				{
+					GroupVersion: "qixengine.qlik.com/v1",
+					APIResources: []metav1.APIResource{{Name: "engines"}},
+				},
+			},
+		},
+	}
+
+	var testCases = []struct {
+		name     string
+		resource GroupVersionsResource
+		served   bool
+		expected schema.GroupVersionResource
+	}{
+		{
+			name:     "preferred version is served",
+			resource: GroupVersionsResource{Group: "qixengine.qlik.com", Versions: []string{"v1", "v1beta1"}, Resource: "engines"},
+			served:   true,
+			expected: schema.GroupVersionResource{Group: "qixengine.qlik.com", Version: "v1", Resource: "engines"},
+		},
+		{
+			name:     "fallback version is served",
+			resource: GroupVersionsResource{Group: "qixengine.qlik.com", Versions: []string{"v1", "v1beta1"}, Resource: "enginetemplates"},
+			served:   true,
+			expected: schema.GroupVersionResource{Group: "qixengine.qlik.com", Version: "v1beta1", Resource: "enginetemplates"},
+		},
+		{
+			name:     "group is not served",
+			resource: GroupVersionsResource{Group: "qixmanager.qlik.com", Versions: []string{"v1"}, Resource: "engines"},
+			served:   false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			groupVersionResource, served, err := resolveGroupVersionResource(discoveryClient, testCase.resource)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if served != testCase.served {
+				t.Fatalf("expected served to be: %v, but got: %v", testCase.served, served)
+			} else if served && groupVersionResource != testCase.expected {
+				t.Fatalf("expected: %v, but got: %v", testCase.expected, groupVersionResource)
+			}
+		})
+	}
+}
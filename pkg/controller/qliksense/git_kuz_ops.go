@@ -1,12 +1,14 @@
 package qliksense
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 
 	"github.com/go-logr/logr"
 	"github.com/google/uuid"
@@ -15,11 +17,6 @@ import (
 	_ "github.com/qlik-oss/k-apis/pkg/git"
 	kapis_git "github.com/qlik-oss/k-apis/pkg/git"
 	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/client-go/dynamic"
-	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/kustomize/api/filesys"
 	"sigs.k8s.io/kustomize/api/konfig"
 	"sigs.k8s.io/kustomize/api/krusty"
@@ -34,17 +31,21 @@ const (
 type QliksenseInstances struct {
 	InstanceMap     map[string]*qlikv1.Qliksense
 	ManifestRootMap map[string]string
+	customResources *CustomResourcesConfig
+	clients         *sharedClients
 }
 
-func NewQIs() *QliksenseInstances {
+func NewQIs(customResources *CustomResourcesConfig, clients *sharedClients) *QliksenseInstances {
 	return &QliksenseInstances{
 		InstanceMap:     make(map[string]*qlikv1.Qliksense),
 		ManifestRootMap: make(map[string]string),
+		customResources: customResources,
+		clients:         clients,
 	}
 }
 func (qi *QliksenseInstances) AddToQliksenseInstances(qs *qlikv1.Qliksense) error {
 	qi.InstanceMap[qs.GetName()] = qs
-	if manifestRoot, err := cloneGitRepo(qs.GetName(), qs.GetVersion(), qs.Spec.Git); err != nil {
+	if manifestRoot, err := cloneGitRepo(qs.GetName(), qs.GetVersion(), qs.GetCRSpec().Git); err != nil {
 		return err
 	} else {
 		qs.Spec.ManifestsRoot = manifestRoot
@@ -69,7 +70,7 @@ func (qi *QliksenseInstances) RemoveFromQliksenseInstances(crName string) error
 
 func (qi *QliksenseInstances) GetCRSpec(crName string) *kapis_config.CRSpec {
 	q := qi.InstanceMap[crName]
-	return q.Spec
+	return q.GetCRSpec()
 }
 
 // clone the git repo and checking out a branch out of it
@@ -117,34 +118,17 @@ func (qi *QliksenseInstances) IsInstalled(crName string) bool {
 	if q == nil {
 		return false
 	}
-	// Get a config to talk to the apiserver
-	cfg, err := config.GetConfig()
-	if err != nil {
-		return false
-	}
 
-	dynamicClient, err := dynamic.NewForConfig(cfg)
-	if err != nil {
+	engineRes, served, err := qi.clients.resolve(qi.customResources.Engine)
+	if err != nil || !served {
 		return false
 	}
 
-	engineRes := schema.GroupVersionResource{Group: "qixmanager.qlik.com", Version: "v1", Resource: "engines"}
-
-	list, err := dynamicClient.Resource(engineRes).Namespace(q.Namespace).List(metav1.ListOptions{})
+	list, err := qi.clients.listReleaseMetadata(engineRes, q.Namespace, releaseSelector(q))
 	if err != nil {
 		return false
 	}
-
-	for _, d := range list.Items {
-		rls, _, err := unstructured.NestedString(d.Object, "metadata", "labels", searchingLabel)
-		if err != nil {
-			return false
-		}
-		if rls == q.Name {
-			return true
-		}
-	}
-	return false
+	return len(list) > 0
 }
 
 func IsDirEmpty(name string) (bool, error) {
@@ -177,9 +161,20 @@ func executeKustomizeBuild(directory string) ([]byte, error) {
 	return resMap.AsYaml()
 }
 
+// ejsonKeyDirMutex serializes PatchAndKustomize, k-api reads the ejson keys from the directory of the EJSON_KEYDIR
+// environment variable, which is global to the process
+var ejsonKeyDirMutex sync.Mutex
+
+// generateKApiPatches generates the kustomize patches of a CR, it is replaced in tests
+var generateKApiPatches = kapis_cr.GeneratePatches
+
 func PatchAndKustomize(kcr *kapis_config.KApiCr) ([]byte, error) {
+	ejsonKeyDirMutex.Lock()
+	defer ejsonKeyDirMutex.Unlock()
+
 	kuzLogger := getKuzLogger()
 	dirName, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(dirName)
 	if err := os.Setenv("EJSON_KEYDIR", dirName); err != nil {
 		kuzLogger.Error(err, "cannot set env for EJSON_KEYDIR")
 	}
@@ -191,7 +186,7 @@ func PatchAndKustomize(kcr *kapis_config.KApiCr) ([]byte, error) {
 		userHomeDir, _ := os.UserHomeDir()
 		kubeConfigPath = filepath.Join(userHomeDir, ".kube", "config")
 	}
-	kapis_cr.GeneratePatches(kcr, kapis_config.KeysActionRestoreOrRotate, kubeConfigPath)
+	generateKApiPatches(kcr, kapis_config.KeysActionRestoreOrRotate, kubeConfigPath)
 
 	kuzLogger.Info("executing kustomize build in folder " + filepath.Join(kcr.Spec.GetManifestsRoot(), kcr.Spec.GetProfileDir()))
 	return executeKustomizeBuild(filepath.Join(kcr.Spec.GetManifestsRoot(), kcr.Spec.GetProfileDir()))
@@ -210,11 +205,11 @@ func (qi *QliksenseInstances) installQliksene(qse *qlikv1.Qliksense) error {
 }
 
 func KubectlApply(manifests string) error {
-	return kubectlOperation(manifests, "apply")
+	return kubectlOperation(context.TODO(), manifests, "apply")
 }
 
 func KubectlDelete(manifests string) error {
-	return kubectlOperation(manifests, "delete")
+	return kubectlOperation(context.TODO(), manifests, "delete")
 }
 
 func KubectlDeleteResourceOfRelease(resourceType, releaseName string) error {
@@ -229,7 +224,8 @@ func KubectlDeleteResourceOfRelease(resourceType, releaseName string) error {
 	return nil
 }
 
-func kubectlOperation(manifests string, oprName string) error {
+// kubectlOperation runs kubectl on the manifests, kubectl is killed when ctx is done
+func kubectlOperation(ctx context.Context, manifests string, oprName string) error {
 	tempYaml, err := ioutil.TempFile("", "")
 	if err != nil {
 		getKuzLogger().Error(err, "cannot create file ")
@@ -239,9 +235,9 @@ func kubectlOperation(manifests string, oprName string) error {
 
 	var cmd *exec.Cmd
 	if oprName == "apply" {
-		cmd = exec.Command("kubectl", oprName, "-f", tempYaml.Name(), "--validate=false")
+		cmd = exec.CommandContext(ctx, "kubectl", oprName, "-f", tempYaml.Name(), "--validate=false")
 	} else {
-		cmd = exec.Command("kubectl", oprName, "-f", tempYaml.Name())
+		cmd = exec.CommandContext(ctx, "kubectl", oprName, "-f", tempYaml.Name())
 	}
 
 	cmd.Stdout = os.Stdout
@@ -259,7 +255,7 @@ func convertToKApiCr(qse *qlikv1.Qliksense) *kapis_config.KApiCr {
 	return &kapis_config.KApiCr{
 		TypeMeta:   qse.TypeMeta,
 		ObjectMeta: qse.ObjectMeta,
-		Spec:       qse.Spec,
+		Spec:       qse.GetCRSpec(),
 	}
 }
 
@@ -0,0 +1,77 @@
+package qliksense
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kapis_config "github.com/qlik-oss/k-apis/pkg/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_PatchAndKustomize_concurrent(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// the patches are generated with the ejson keys of EJSON_KEYDIR, which must not change while a CR is rendered
+	defer func(generate func(*kapis_config.KApiCr, kapis_config.KeysAction, string)) {
+		generateKApiPatches = generate
+	}(generateKApiPatches)
+	generateKApiPatches = func(kcr *kapis_config.KApiCr, keysAction kapis_config.KeysAction, kubeConfigPath string) {
+		keyDir := os.Getenv("EJSON_KEYDIR")
+		time.Sleep(10 * time.Millisecond)
+		if os.Getenv("EJSON_KEYDIR") != keyDir {
+			keyDir = "changed"
+		}
+		profileDir := filepath.Join(kcr.Spec.GetManifestsRoot(), kcr.Spec.GetProfileDir())
+		if err := os.MkdirAll(profileDir, 0755); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		configMap := fmt.Sprintf("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: %v\ndata:\n  keyDir: %v\n", kcr.Name, keyDir)
+		if err := ioutil.WriteFile(filepath.Join(profileDir, "configmap.yaml"), []byte(configMap), 0644); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		} else if err := ioutil.WriteFile(filepath.Join(profileDir, "kustomization.yaml"), []byte("resources:\n- configmap.yaml\n"), 0644); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	manifests := make([]string, 8)
+	for i := range manifests {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			kcr := &kapis_config.KApiCr{
+				ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("qlik-%v", i)},
+				Spec:       &kapis_config.CRSpec{ManifestsRoot: filepath.Join(tmpDir, fmt.Sprint(i)), Profile: "docker-desktop"},
+			}
+			manifestBytes, err := PatchAndKustomize(kcr)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			manifests[i] = string(manifestBytes)
+		}(i)
+	}
+	wg.Wait()
+
+	keyDirs := make(map[string]bool, len(manifests))
+	for i, manifest := range manifests {
+		if !strings.Contains(manifest, fmt.Sprintf("name: qlik-%v\n", i)) {
+			t.Fatalf("expected the manifest of qlik-%v, but got: %v", i, manifest)
+		} else if strings.Contains(manifest, "keyDir: changed") {
+			t.Fatalf("expected EJSON_KEYDIR not to change while qlik-%v is rendered", i)
+		}
+		keyDirs[manifest[strings.Index(manifest, "keyDir: "):]] = true
+	}
+	if len(keyDirs) != len(manifests) {
+		t.Fatalf("expected a key directory per render, but got: %v", keyDirs)
+	}
+}
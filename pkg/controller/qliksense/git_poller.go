@@ -0,0 +1,395 @@
+package qliksense
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-logr/logr"
+	kapis_config "github.com/qlik-oss/k-apis/pkg/config"
+	kapis_git "github.com/qlik-oss/k-apis/pkg/git"
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	gitPollerDefaultInterval = time.Minute
+	// gitPollerDefaultTimeout bounds the fetch and the apply of a poll
+	gitPollerDefaultTimeout = 5 * time.Minute
+	// gitPollerRunningRequeue is how often the CRs are requeued while their poll runs
+	gitPollerRunningRequeue = 5 * time.Second
+	gitPollerRemoteName     = "origin"
+)
+
+// gitPoller fetches the git repositories of the CRs in Poller mode and applies the new commits of their watchBranch,
+// instead of the ops runner job. The polls run in the background, one at a time for each CR, so that a slow remote
+// or a large render does not hold the reconciles of the other CRs.
+type gitPoller struct {
+	// rootDir holds a clone of the repository of each CR
+	rootDir string
+	// apply renders the manifests of the release from the checked out repository and applies them
+	apply func(ctx context.Context, kcr *kapis_config.KApiCr) error
+	// timeout is the deadline of the fetch and of the apply of a poll
+	timeout time.Duration
+
+	mu        sync.Mutex
+	lastPolls map[types.NamespacedName]time.Time
+	polls     map[types.NamespacedName]*gitPoll
+}
+
+// gitPoll is a poll running in the background, its result is set when done is closed
+type gitPoll struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	result *gitPollResult
+}
+
+// gitPollResult is the outcome of a poll, recorded in the status of the CR by the next reconcile
+type gitPollResult struct {
+	commit   string
+	fetchErr error
+	// applied tells whether the commit was applied, with the generation of the CR, when applyErr is nil
+	applied    bool
+	applyErr   error
+	generation int64
+	// syncRequest is the sync request handled by the poll, if any
+	syncRequest string
+	started     metav1.Time
+	finished    metav1.Time
+}
+
+func newGitPoller() *gitPoller {
+	return &gitPoller{
+		rootDir:   filepath.Join(os.TempDir(), "qlik-k8s-poller"),
+		apply:     renderAndApplyRelease,
+		timeout:   gitPollerDefaultTimeout,
+		lastPolls: make(map[types.NamespacedName]time.Time),
+		polls:     make(map[types.NamespacedName]*gitPoll),
+	}
+}
+
+func renderAndApplyRelease(ctx context.Context, kcr *kapis_config.KApiCr) error {
+	manifests, err := PatchAndKustomize(kcr)
+	if err != nil {
+		return err
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+	return kubectlOperation(ctx, string(manifests), "apply")
+}
+
+func isGitPollerMode(m *qlikv1.Qliksense) bool {
+	return m.Spec.OpsRunner != nil && m.Spec.OpsRunner.Enabled == "yes" && m.Spec.OpsRunner.Mode == qlikv1.OpsRunnerModePoller
+}
+
+func getGitPollInterval(m *qlikv1.Qliksense) time.Duration {
+	if m.Spec.OpsRunner.PollInterval != nil && m.Spec.OpsRunner.PollInterval.Duration > 0 {
+		return m.Spec.OpsRunner.PollInterval.Duration
+	}
+	return gitPollerDefaultInterval
+}
+
+func getWatchBranch(m *qlikv1.Qliksense) string {
+	if m.Spec.OpsRunner != nil && m.Spec.OpsRunner.WatchBranch != "" {
+		return m.Spec.OpsRunner.WatchBranch
+	}
+	return gitDefaultWatchBranch
+}
+
+// pollGitRepository starts a poll of the repository of the CR when the poll interval elapsed, or a sync is requested,
+// and records the result of the last poll in the status. A poll fetches the repository and applies the manifests when
+// the commit of watchBranch or the CR changed since they were last applied, the fetch and the apply fail when they do
+// not complete within the timeout of the poller. It returns how long to wait for the next poll, or for the running
+// poll to complete. Failures are recorded in the status and retried with the next poll.
+func (r *ReconcileQliksense) pollGitRepository(reqLogger logr.Logger, m *qlikv1.Qliksense) (time.Duration, error) {
+	interval := getGitPollInterval(m)
+	opsRunnerStatus := m.Status.OpsRunner.DeepCopy()
+	if opsRunnerStatus == nil {
+		opsRunnerStatus = &qlikv1.OpsRunnerStatus{}
+	}
+	pollerStatus := opsRunnerStatus.GitPoller
+	if pollerStatus == nil {
+		pollerStatus = &qlikv1.GitPollerStatus{}
+	}
+
+	requested := m.GetAnnotations()[syncRequestedAnnotation]
+	syncRequested := getOperatorConfig().Features.SyncRequests && requested != "" &&
+		(opsRunnerStatus.LastSyncRequest == nil || opsRunnerStatus.LastSyncRequest.Requested != requested)
+	// changes held back by the sync windows are applied by the first poll after they open
+	closed := isSyncWindowClosed(m)
+	key := types.NamespacedName{Name: m.Name, Namespace: m.Namespace}
+	if result, running := r.gitPoller.takeResult(key); running {
+		addGitPollerPendingChanges(m, pollerStatus, syncRequested)
+		return gitPollerRunningRequeue, nil
+	} else if result != nil {
+		recordGitPollResult(reqLogger, m, pollerStatus, result)
+		if syncRequested = syncRequested && requested != result.syncRequest; syncRequested && !closed {
+			// the sync was requested while the poll was running
+			interval = gitPollerRunningRequeue
+		}
+		addGitPollerPendingChanges(m, pollerStatus, syncRequested)
+		if result.syncRequest != "" {
+			syncRequest := &qlikv1.SyncRequestStatus{Requested: result.syncRequest, HandledTime: &result.started, FinishedTime: &result.finished, Result: syncResultSucceeded}
+			if pollerStatus.LastError != "" {
+				syncRequest.Result = syncResultFailed
+				syncRequest.Message = pollerStatus.LastError
+			}
+			opsRunnerStatus.LastSyncRequest = syncRequest
+		} else if equalGitPollerStatus(m.Status.OpsRunner, pollerStatus) {
+			return interval, nil
+		}
+		opsRunnerStatus.GitPoller = pollerStatus
+		m.Status.OpsRunner = opsRunnerStatus
+		return interval, r.client.Status().Update(context.TODO(), m)
+	}
+
+	upToDate := pollerStatus.AppliedGeneration == m.Generation && pollerStatus.AppliedCommit == pollerStatus.ObservedCommit
+	if wait := r.gitPoller.nextPoll(key, interval); wait > 0 && (closed || (upToDate && !syncRequested)) {
+		addGitPollerPendingChanges(m, pollerStatus, syncRequested)
+		return wait, nil
+	}
+
+	polled := m.DeepCopy()
+	appliedCommit, appliedGeneration := pollerStatus.AppliedCommit, pollerStatus.AppliedGeneration
+	// a sync request is handled by the first poll after the windows open
+	handledSyncRequest := ""
+	if syncRequested && !closed {
+		handledSyncRequest = requested
+	}
+	r.gitPoller.start(key, handledSyncRequest, func(ctx context.Context, result *gitPollResult) {
+		result.generation = polled.Generation
+		if result.commit, result.fetchErr = r.fetchWatchBranch(ctx, polled); result.fetchErr != nil {
+			return
+		}
+		if !closed && (result.commit != appliedCommit || polled.Generation != appliedGeneration || handledSyncRequest != "") {
+			result.applied = true
+			result.applyErr = r.applyGitCommit(ctx, polled, result.commit)
+		}
+	})
+	addGitPollerPendingChanges(m, pollerStatus, syncRequested)
+	return gitPollerRunningRequeue, nil
+}
+
+// recordGitPollResult records the commit observed and applied by the poll in the status of the git poller
+func recordGitPollResult(reqLogger logr.Logger, m *qlikv1.Qliksense, pollerStatus *qlikv1.GitPollerStatus, result *gitPollResult) {
+	if result.fetchErr != nil {
+		reqLogger.Error(result.fetchErr, "Failed to fetch the git repository")
+		pollerStatus.LastError = result.fetchErr.Error()
+		return
+	}
+	pollerStatus.LastError = ""
+	if result.commit != pollerStatus.ObservedCommit {
+		reqLogger.Info("Observed a new commit", "branch", getWatchBranch(m), "commit", result.commit)
+		pollerStatus.ObservedCommit = result.commit
+		pollerStatus.ObservedTime = &result.started
+	}
+	if !result.applied {
+		return
+	} else if result.applyErr != nil {
+		reqLogger.Error(result.applyErr, "Failed to apply the git commit", "commit", result.commit)
+		pollerStatus.LastError = result.applyErr.Error()
+		return
+	}
+	reqLogger.Info("Applied the git commit", "commit", result.commit)
+	pollerStatus.AppliedCommit = result.commit
+	pollerStatus.AppliedGeneration = result.generation
+	pollerStatus.AppliedTime = &result.finished
+}
+
+// addGitPollerPendingChanges records the commit, the CR changes and the sync request held back by the sync windows
+func addGitPollerPendingChanges(m *qlikv1.Qliksense, pollerStatus *qlikv1.GitPollerStatus, syncRequested bool) {
+	if !isSyncWindowClosed(m) {
+		return
+	}
+	if pollerStatus.ObservedCommit != "" && pollerStatus.ObservedCommit != pollerStatus.AppliedCommit {
+		addPendingChange(m, "commit "+pollerStatus.ObservedCommit)
+	}
+	if pollerStatus.AppliedCommit != "" && pollerStatus.AppliedGeneration != m.Generation {
+		addPendingChange(m, fmt.Sprintf("generation %v", m.Generation))
+	}
+	if syncRequested {
+		addPendingChange(m, "sync request "+m.GetAnnotations()[syncRequestedAnnotation])
+	}
+}
+
+// fetchWatchBranch clones or fetches the repository of the CR and returns the commit of watchBranch. The repository is
+// fetched with go-git, the k-apis git package has no fetch.
+func (r *ReconcileQliksense) fetchWatchBranch(ctx context.Context, m *qlikv1.Qliksense) (string, error) {
+	if m.Spec.Git == nil || m.Spec.Git.Repository == "" {
+		return "", fmt.Errorf("git.repository must be set in Poller mode")
+	}
+	auth, err := r.getGitAuth(m)
+	if err != nil {
+		return "", err
+	}
+	repo, err := r.gitPoller.openRepository(ctx, m, auth)
+	if err != nil {
+		return "", err
+	}
+	if err := repo.FetchContext(ctx, &git.FetchOptions{RemoteName: gitPollerRemoteName, Auth: auth, Force: true}); err != nil && err != git.NoErrAlreadyUpToDate {
+		return "", fmt.Errorf("cannot fetch %v: %w", m.Spec.Git.Repository, err)
+	}
+	ref, err := repo.Reference(plumbing.NewRemoteReferenceName(gitPollerRemoteName, getWatchBranch(m)), true)
+	if err != nil {
+		return "", fmt.Errorf("cannot find the branch %v in %v: %w", getWatchBranch(m), m.Spec.Git.Repository, err)
+	}
+	return ref.Hash().String(), nil
+}
+
+// applyGitCommit checks out the commit and applies the manifests rendered with the CR
+func (r *ReconcileQliksense) applyGitCommit(ctx context.Context, m *qlikv1.Qliksense, commit string) error {
+	repo, err := kapis_git.OpenRepository(r.gitPoller.getRepositoryDir(m))
+	if err != nil {
+		return err
+	}
+	// the patches generated by the last render are discarded
+	if err := kapis_git.DiscardAllUnstagedChanges(repo); err != nil {
+		return err
+	} else if err := kapis_git.Checkout(repo, commit, "", nil); err != nil {
+		return fmt.Errorf("cannot checkout %v: %w", commit, err)
+	}
+	rendered, err := r.resolveSecretRefs(m)
+	if err != nil {
+		return err
+	}
+	rendered.Spec.ManifestsRoot = r.gitPoller.getRepositoryDir(m)
+	return r.gitPoller.apply(ctx, convertToKApiCr(rendered))
+}
+
+// getGitAuth returns the basic auth of the access token, or of the user name and password of the CR
+func (r *ReconcileQliksense) getGitAuth(m *qlikv1.Qliksense) (transport.AuthMethod, error) {
+	gitSpec := m.Spec.Git
+	accessToken := gitSpec.AccessToken
+	if gitSpec.AccessTokenSecretKeyRef != nil {
+		var err error
+		if accessToken, err = getSecretKeyValue(r.client, m.Namespace, gitSpec.AccessTokenSecretKeyRef.Name, gitSpec.AccessTokenSecretKeyRef.Key); err != nil {
+			return nil, fmt.Errorf("cannot get the git access token: %w", err)
+		}
+	}
+	if accessToken != "" {
+		userName := gitSpec.UserName
+		if userName == "" {
+			// any user name is accepted with a token
+			userName = "git"
+		}
+		return &githttp.BasicAuth{Username: userName, Password: accessToken}, nil
+	} else if gitSpec.UserName != "" && gitSpec.Password != "" {
+		return &githttp.BasicAuth{Username: gitSpec.UserName, Password: gitSpec.Password}, nil
+	}
+	return nil, nil
+}
+
+func (p *gitPoller) getRepositoryDir(m *qlikv1.Qliksense) string {
+	return filepath.Join(p.rootDir, m.Namespace, m.Name)
+}
+
+// openRepository opens the clone of the repository of the CR, the repository is cloned again when its URL changed.
+// It is cloned with go-git rather than with kapis_git.CloneRepository, which cannot be cancelled when the poll times out.
+func (p *gitPoller) openRepository(ctx context.Context, m *qlikv1.Qliksense, auth transport.AuthMethod) (*git.Repository, error) {
+	dir := p.getRepositoryDir(m)
+	if repo, err := kapis_git.OpenRepository(dir); err == nil {
+		if remote, err := repo.Remote(gitPollerRemoteName); err == nil && len(remote.Config().URLs) > 0 && remote.Config().URLs[0] == m.Spec.Git.Repository {
+			return repo, nil
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	} else if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	repo, err := git.PlainCloneContext(ctx, dir, false, &git.CloneOptions{URL: m.Spec.Git.Repository, Auth: auth})
+	if err != nil {
+		return nil, fmt.Errorf("cannot clone %v: %w", m.Spec.Git.Repository, err)
+	}
+	return repo, nil
+}
+
+// start runs the poll of the CR in the background, within the timeout of the poller
+func (p *gitPoller) start(key types.NamespacedName, syncRequest string, poll func(ctx context.Context, result *gitPollResult)) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	running := &gitPoll{cancel: cancel, done: make(chan struct{})}
+	p.mu.Lock()
+	p.polls[key] = running
+	p.mu.Unlock()
+
+	go func() {
+		defer close(running.done)
+		defer cancel()
+		result := &gitPollResult{syncRequest: syncRequest, started: metav1.Now()}
+		poll(ctx, result)
+		result.finished = metav1.Now()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		running.result = result
+		p.lastPolls[key] = time.Now()
+	}()
+}
+
+// takeResult returns the result of the completed poll of the CR, and forgets it, or whether a poll is still running
+func (p *gitPoller) takeResult(key types.NamespacedName) (*gitPollResult, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	running, ok := p.polls[key]
+	if !ok {
+		return nil, false
+	} else if running.result == nil {
+		return nil, true
+	}
+	delete(p.polls, key)
+	return running.result, false
+}
+
+// wait waits for the running poll of the CR to complete
+func (p *gitPoller) wait(key types.NamespacedName) {
+	p.mu.Lock()
+	running, ok := p.polls[key]
+	p.mu.Unlock()
+	if ok {
+		<-running.done
+	}
+}
+
+// remove cancels the running poll of the CR and deletes the clone of its repository
+func (p *gitPoller) remove(m *qlikv1.Qliksense) error {
+	key := types.NamespacedName{Name: m.Name, Namespace: m.Namespace}
+	p.mu.Lock()
+	if running, ok := p.polls[key]; ok {
+		running.cancel()
+	}
+	p.mu.Unlock()
+	p.wait(key)
+
+	p.mu.Lock()
+	delete(p.polls, key)
+	delete(p.lastPolls, key)
+	p.mu.Unlock()
+	return os.RemoveAll(p.getRepositoryDir(m))
+}
+
+// nextPoll returns how long to wait until the repository of the CR is polled again
+func (p *gitPoller) nextPoll(key types.NamespacedName, interval time.Duration) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lastPoll, ok := p.lastPolls[key]
+	if !ok {
+		return 0
+	}
+	return interval - time.Since(lastPoll)
+}
+
+func equalGitPollerStatus(opsRunnerStatus *qlikv1.OpsRunnerStatus, b *qlikv1.GitPollerStatus) bool {
+	if opsRunnerStatus == nil || opsRunnerStatus.GitPoller == nil {
+		return false
+	}
+	a := opsRunnerStatus.GitPoller
+	return a.ObservedCommit == b.ObservedCommit && a.AppliedCommit == b.AppliedCommit &&
+		a.AppliedGeneration == b.AppliedGeneration && a.LastError == b.LastError
+}
@@ -0,0 +1,236 @@
+package qliksense
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	kapis_config "github.com/qlik-oss/k-apis/pkg/config"
+	"github.com/qlik-oss/qliksense-operator/pkg/apis"
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func Test_pollGitRepository(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// the bare repository stands for the remote repository of the CR
+	remoteDir := filepath.Join(tmpDir, "remote.git")
+	if _, err := git.PlainInit(remoteDir, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	workRepo, err := git.PlainInit(filepath.Join(tmpDir, "work"), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := workRepo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{remoteDir}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pushCommit := func(content string) string {
+		workTree, err := workRepo.Worktree()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := ioutil.WriteFile(filepath.Join(tmpDir, "work", "kustomization.yaml"), []byte(content), os.ModePerm); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		} else if _, err := workTree.Add("kustomization.yaml"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		hash, err := workTree.Commit(content, &git.CommitOptions{Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := workRepo.Push(&git.PushOptions{RemoteName: "origin"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return hash.String()
+	}
+	firstCommit := pushCommit("resources: []\n")
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := apis.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m := &qlikv1.Qliksense{
+		ObjectMeta: metav1.ObjectMeta{Name: "qlik-default", Namespace: "default", Generation: 1},
+		Spec: &qlikv1.QliksenseSpec{
+			Git: &qlikv1.GitSpec{},
+			OpsRunner: &qlikv1.OpsRunnerSpec{
+				Mode: qlikv1.OpsRunnerModePoller,
+			},
+		},
+	}
+	m.Spec.Git.Repository = remoteDir
+	m.Spec.OpsRunner.Enabled = "yes"
+	var applied []string
+	r := &ReconcileQliksense{
+		client: fake.NewFakeClientWithScheme(scheme, m),
+		scheme: scheme,
+		gitPoller: &gitPoller{
+			rootDir: filepath.Join(tmpDir, "poller"),
+			apply: func(ctx context.Context, kcr *kapis_config.KApiCr) error {
+				content, err := ioutil.ReadFile(filepath.Join(kcr.Spec.GetManifestsRoot(), "kustomization.yaml"))
+				if err != nil {
+					return err
+				}
+				applied = append(applied, string(content))
+				return nil
+			},
+			timeout:   gitPollerDefaultTimeout,
+			lastPolls: make(map[types.NamespacedName]time.Time),
+			polls:     make(map[types.NamespacedName]*gitPoll),
+		},
+	}
+	if getRequiredOpsRunnerJobKind(m) != OpsRunnerJobKindNone {
+		t.Fatalf("expected no ops runner job in Poller mode, but got: %v", getRequiredOpsRunnerJobKind(m))
+	}
+
+	// reconcilePoll polls the repository and, when the poll starts, reconciles again once it completed to record its result
+	key := types.NamespacedName{Name: m.Name, Namespace: m.Namespace}
+	reconcilePoll := func(current *qlikv1.Qliksense) time.Duration {
+		requeueAfter, err := r.pollGitRepository(log, current)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		} else if requeueAfter != gitPollerRunningRequeue {
+			return requeueAfter
+		}
+		r.gitPoller.wait(key)
+		if requeueAfter, err = r.pollGitRepository(log, current); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return requeueAfter
+	}
+	poll := func() (*qlikv1.GitPollerStatus, time.Duration) {
+		current := &qlikv1.Qliksense{}
+		if err := r.client.Get(context.TODO(), types.NamespacedName{Name: m.Name, Namespace: m.Namespace}, current); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// the CR has no sync windows, the same as in Reconcile
+		current.Status.SyncWindows = nil
+		requeueAfter := reconcilePoll(current)
+		if err := r.client.Get(context.TODO(), types.NamespacedName{Name: m.Name, Namespace: m.Namespace}, current); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		} else if current.Status.OpsRunner == nil || current.Status.OpsRunner.GitPoller == nil {
+			t.Fatal("expected the git poller status to be recorded")
+		}
+		return current.Status.OpsRunner.GitPoller, requeueAfter
+	}
+
+	status, requeueAfter := poll()
+	if status.ObservedCommit != firstCommit || status.AppliedCommit != firstCommit || status.AppliedGeneration != 1 {
+		t.Fatalf("expected the first commit to be observed and applied, but got: %+v", status)
+	} else if len(applied) != 1 || applied[0] != "resources: []\n" {
+		t.Fatalf("expected the first commit to be checked out and applied once, but got: %v", applied)
+	} else if requeueAfter != gitPollerDefaultInterval {
+		t.Fatalf("expected to poll again after: %v, but got: %v", gitPollerDefaultInterval, requeueAfter)
+	}
+
+	// the repository is not fetched again before the poll interval elapsed
+	secondCommit := pushCommit("resources:\n- qliksense\n")
+	if status, requeueAfter = poll(); status.ObservedCommit != firstCommit || len(applied) != 1 {
+		t.Fatalf("expected no poll before the interval elapsed, but got: %+v", status)
+	} else if requeueAfter <= 0 || requeueAfter > gitPollerDefaultInterval {
+		t.Fatalf("unexpected requeue: %v", requeueAfter)
+	}
+
+	r.gitPoller.lastPolls = make(map[types.NamespacedName]time.Time)
+	if status, _ = poll(); status.ObservedCommit != secondCommit || status.AppliedCommit != secondCommit {
+		t.Fatalf("expected the second commit to be observed and applied, but got: %+v", status)
+	} else if len(applied) != 2 || applied[1] != "resources:\n- qliksense\n" {
+		t.Fatalf("expected the second commit to be checked out and applied, but got: %v", applied)
+	}
+
+	// an unchanged commit is not applied again
+	r.gitPoller.lastPolls = make(map[types.NamespacedName]time.Time)
+	if status, _ = poll(); status.AppliedCommit != secondCommit || len(applied) != 2 {
+		t.Fatalf("expected the commit to be applied once, but got: %v", applied)
+	}
+
+	// a new commit waits for the sync windows to open
+	thirdCommit := pushCommit("resources:\n- qliksense\n- monitoring\n")
+	r.gitPoller.lastPolls = make(map[types.NamespacedName]time.Time)
+	closed := &qlikv1.Qliksense{}
+	if err := r.client.Get(context.TODO(), types.NamespacedName{Name: m.Name, Namespace: m.Namespace}, closed); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	closed.Status.SyncWindows = &qlikv1.SyncWindowsStatus{}
+	if reconcilePoll(closed); closed.Status.OpsRunner == nil || closed.Status.OpsRunner.GitPoller == nil {
+		t.Fatal("expected the git poller status to be recorded")
+	} else if status := closed.Status.OpsRunner.GitPoller; status.ObservedCommit != thirdCommit || status.AppliedCommit != secondCommit || len(applied) != 2 {
+		t.Fatalf("expected the third commit to be observed but not applied, but got: %+v", status)
+	} else if pendingChanges := closed.Status.SyncWindows.PendingChanges; len(pendingChanges) != 1 || pendingChanges[0] != "commit "+thirdCommit {
+		t.Fatalf("expected the third commit to be pending, but got: %v", pendingChanges)
+	}
+	if status, _ = poll(); status.AppliedCommit != thirdCommit || len(applied) != 3 {
+		t.Fatalf("expected the third commit to be applied when the sync windows open, but got: %+v", status)
+	}
+
+	// a missing branch is recorded in the status
+	current := &qlikv1.Qliksense{}
+	if err := r.client.Get(context.TODO(), types.NamespacedName{Name: m.Name, Namespace: m.Namespace}, current); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	current.Spec.OpsRunner.WatchBranch = "release"
+	current.Generation = 2
+	if err := r.client.Update(context.TODO(), current); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if status, _ = poll(); status.LastError == "" || status.AppliedCommit != thirdCommit {
+		t.Fatalf("expected the missing branch to be recorded, but got: %+v", status)
+	}
+
+	// an apply that does not complete within the timeout fails the poll
+	current.Spec.OpsRunner.WatchBranch = ""
+	current.Generation = 3
+	if err := r.client.Update(context.TODO(), current); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r.gitPoller.lastPolls = make(map[types.NamespacedName]time.Time)
+	r.gitPoller.timeout = 100 * time.Millisecond
+	r.gitPoller.apply = func(ctx context.Context, kcr *kapis_config.KApiCr) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if status, _ = poll(); status.LastError != context.DeadlineExceeded.Error() || status.AppliedGeneration != 1 {
+		t.Fatalf("expected the apply to time out, but got: %+v", status)
+	}
+
+	// a running poll does not hold the reconcile, and is cancelled when the CR is deleted
+	r.gitPoller.lastPolls = make(map[types.NamespacedName]time.Time)
+	r.gitPoller.timeout = gitPollerDefaultTimeout
+	started := make(chan struct{})
+	r.gitPoller.apply = func(ctx context.Context, kcr *kapis_config.KApiCr) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if requeueAfter, err := r.pollGitRepository(log, current); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if requeueAfter != gitPollerRunningRequeue {
+		t.Fatalf("expected to requeue while the poll runs, but got: %v", requeueAfter)
+	}
+	<-started
+	if requeueAfter, err := r.pollGitRepository(log, current); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if requeueAfter != gitPollerRunningRequeue {
+		t.Fatalf("expected to requeue while the poll runs, but got: %v", requeueAfter)
+	} else if err := r.gitPoller.remove(current); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(r.gitPoller.polls) != 0 {
+		t.Fatalf("expected the poll to be cancelled, but got: %v", r.gitPoller.polls)
+	} else if _, err := os.Stat(r.gitPoller.getRepositoryDir(current)); !os.IsNotExist(err) {
+		t.Fatalf("expected the clone to be deleted, but got: %v", err)
+	}
+}
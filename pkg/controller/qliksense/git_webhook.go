@@ -0,0 +1,375 @@
+package qliksense
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	crclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	gitWebhookPath            = "/webhooks/git"
+	gitWebhookMaxPayloadBytes = 5 << 20
+	gitDefaultWatchBranch     = "master"
+	gitBranchRefPrefix        = "refs/heads/"
+	gitZeroCommit             = "0000000000000000000000000000000000000000"
+
+	gitProviderGitHub    = "github"
+	gitProviderGitLab    = "gitlab"
+	gitProviderBitbucket = "bitbucket"
+	gitProviderGitea     = "gitea"
+)
+
+var (
+	errGitWebhookUnsupported = errors.New("unsupported git webhook, expected a GitHub, GitLab, Bitbucket or Gitea push event")
+
+	gitURLSchemeRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://`)
+	gitURLPortRegexp   = regexp.MustCompile(`^([^/]+):[0-9]+(/|$)`)
+)
+
+// gitPushEvent is a push webhook of any provider, with the branches that were updated
+type gitPushEvent struct {
+	provider       string
+	repositoryURLs []string
+	branches       map[string]string // branch name to the new commit
+}
+
+// gitWebhookHandler triggers a sync of the Qliksense CRs watching the branches of the repository a push webhook is sent for
+type gitWebhookHandler struct {
+	client    crclient.Client
+	namespace string
+}
+
+type gitWebhookResponse struct {
+	Triggered []string `json:"triggered"`
+}
+
+func (h *gitWebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !getOperatorConfig().Features.GitWebhooks {
+		http.NotFound(w, r)
+		return
+	}
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, gitWebhookMaxPayloadBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	event, err := parseGitPushEvent(r.Header, payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if event == nil {
+		// ping and other events are acknowledged, so that the webhook is shown as working by the provider
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	qliksenseList := &qlikv1.QliksenseList{}
+	if err := h.client.List(context.TODO(), qliksenseList, crclient.InNamespace(h.namespace)); err != nil {
+		serverLog.Error(err, "cannot list the Qliksense CRs for the git webhook")
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	matched := 0
+	response := gitWebhookResponse{Triggered: []string{}}
+	for i := range qliksenseList.Items {
+		m := &qliksenseList.Items[i]
+		commit, ok := event.matches(m)
+		if !ok {
+			continue
+		}
+		matched++
+		if verified, err := h.verify(event.provider, r.Header, payload, m); err != nil {
+			serverLog.Error(err, "cannot verify the git webhook", "namespace", m.Namespace, "name", m.Name)
+			continue
+		} else if !verified {
+			serverLog.Info("Invalid git webhook signature", "provider", event.provider, "namespace", m.Namespace, "name", m.Name)
+			continue
+		}
+		if err := h.requestSync(m, fmt.Sprintf("%v:%v", event.provider, commit)); err != nil {
+			serverLog.Error(err, "cannot request a sync for the git webhook", "namespace", m.Namespace, "name", m.Name)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		serverLog.Info("Requested a sync for the git webhook", "provider", event.provider, "commit", commit, "namespace", m.Namespace, "name", m.Name)
+		response.Triggered = append(response.Triggered, fmt.Sprintf("%v/%v", m.Namespace, m.Name))
+	}
+	if matched > 0 && len(response.Triggered) == 0 {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// verify checks the signature of the payload with the webhook secret of the CR
+func (h *gitWebhookHandler) verify(provider string, header http.Header, payload []byte, m *qlikv1.Qliksense) (bool, error) {
+	secretKeyRef := m.Spec.Git.WebhookSecretKeyRef
+	webhookSecret, err := getSecretKeyValue(h.client, m.Namespace, secretKeyRef.Name, secretKeyRef.Key)
+	if err != nil {
+		return false, err
+	} else if webhookSecret == "" {
+		return false, fmt.Errorf("the webhook secret %v is empty", secretKeyRef.Name)
+	}
+	return verifyGitWebhookSignature(provider, header, payload, []byte(webhookSecret)), nil
+}
+
+// requestSync sets the sync-requested annotation, the ops runner job is spawned when the CR is reconciled.
+// A push of the same commit is only synced once.
+func (h *gitWebhookHandler) requestSync(m *qlikv1.Qliksense, requested string) error {
+	patch := crclient.MergeFrom(m.DeepCopy())
+	annotations := m.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[syncRequestedAnnotation] = requested
+	m.SetAnnotations(annotations)
+	return h.client.Patch(context.TODO(), m, patch)
+}
+
+// matches returns the new commit of the branch watched by the CR, if the CR watches the repository of the event
+// and accepts webhooks
+func (e *gitPushEvent) matches(m *qlikv1.Qliksense) (string, bool) {
+	if m.Spec == nil || m.Spec.Git == nil || m.Spec.Git.WebhookSecretKeyRef == nil || m.Spec.Git.Repository == "" {
+		return "", false
+	}
+	watchBranch := gitDefaultWatchBranch
+	if m.Spec.OpsRunner != nil && m.Spec.OpsRunner.WatchBranch != "" {
+		watchBranch = strings.TrimPrefix(m.Spec.OpsRunner.WatchBranch, gitBranchRefPrefix)
+	}
+	commit, ok := e.branches[watchBranch]
+	if !ok {
+		return "", false
+	}
+	repository := normalizeGitRepositoryURL(m.Spec.Git.Repository)
+	for _, repositoryURL := range e.repositoryURLs {
+		if repositoryURL != "" && normalizeGitRepositoryURL(repositoryURL) == repository {
+			return commit, true
+		}
+	}
+	return "", false
+}
+
+// normalizeGitRepositoryURL returns the host and path of a repository URL, so that the https and ssh URLs
+// of a repository are equal, e.g. https://user@github.com/org/repo.git and git@github.com:org/repo are github.com/org/repo
+func normalizeGitRepositoryURL(repositoryURL string) string {
+	normalized := strings.TrimSpace(repositoryURL)
+	if scheme := gitURLSchemeRegexp.FindString(normalized); scheme != "" {
+		normalized = strings.TrimPrefix(normalized, scheme)
+	} else if colon := strings.Index(normalized, ":"); colon >= 0 && !strings.Contains(normalized[:colon], "/") {
+		// scp-like syntax of ssh URLs
+		normalized = normalized[:colon] + "/" + normalized[colon+1:]
+	}
+	if slash := strings.Index(normalized, "/"); slash >= 0 {
+		if at := strings.LastIndex(normalized[:slash], "@"); at >= 0 {
+			normalized = normalized[at+1:]
+		}
+	}
+	normalized = gitURLPortRegexp.ReplaceAllString(normalized, "$1$2")
+	normalized = strings.TrimSuffix(strings.TrimSuffix(normalized, "/"), ".git")
+	return strings.ToLower(normalized)
+}
+
+// parseGitPushEvent detects the provider from the headers and parses the push payload. It returns nil for other events.
+func parseGitPushEvent(header http.Header, payload []byte) (*gitPushEvent, error) {
+	// Gitea also sends the GitHub headers, so it is detected first
+	switch {
+	case header.Get("X-Gitea-Event") != "":
+		if header.Get("X-Gitea-Event") != "push" {
+			return nil, nil
+		}
+		return parseGitHubPushEvent(gitProviderGitea, payload)
+	case header.Get("X-GitHub-Event") != "":
+		if header.Get("X-GitHub-Event") != "push" {
+			return nil, nil
+		}
+		return parseGitHubPushEvent(gitProviderGitHub, payload)
+	case header.Get("X-Gitlab-Event") != "":
+		if header.Get("X-Gitlab-Event") != "Push Hook" {
+			return nil, nil
+		}
+		return parseGitLabPushEvent(payload)
+	case header.Get("X-Event-Key") != "":
+		switch header.Get("X-Event-Key") {
+		case "repo:push":
+			return parseBitbucketCloudPushEvent(payload)
+		case "repo:refs_changed":
+			return parseBitbucketServerPushEvent(payload)
+		}
+		return nil, nil
+	}
+	return nil, errGitWebhookUnsupported
+}
+
+// verifyGitWebhookSignature checks the HMAC signature of the payload, GitLab sends the secret token itself
+func verifyGitWebhookSignature(provider string, header http.Header, payload, secret []byte) bool {
+	switch provider {
+	case gitProviderGitLab:
+		token := header.Get("X-Gitlab-Token")
+		return token != "" && subtle.ConstantTimeCompare([]byte(token), secret) == 1
+	case gitProviderGitea:
+		if signature := header.Get("X-Gitea-Signature"); signature != "" {
+			return verifyHMAC(sha256.New, secret, payload, signature)
+		}
+	}
+	if signature := header.Get("X-Hub-Signature-256"); signature != "" {
+		return strings.HasPrefix(signature, "sha256=") && verifyHMAC(sha256.New, secret, payload, strings.TrimPrefix(signature, "sha256="))
+	}
+	// Bitbucket sends the sha256 signature in X-Hub-Signature, older GitHub webhooks a sha1 signature
+	signature := header.Get("X-Hub-Signature")
+	if strings.HasPrefix(signature, "sha256=") {
+		return verifyHMAC(sha256.New, secret, payload, strings.TrimPrefix(signature, "sha256="))
+	} else if strings.HasPrefix(signature, "sha1=") && provider == gitProviderGitHub {
+		return verifyHMAC(sha1.New, secret, payload, strings.TrimPrefix(signature, "sha1="))
+	}
+	return false
+}
+
+func verifyHMAC(newHash func() hash.Hash, secret, payload []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(newHash, secret)
+	mac.Write(payload)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+func newGitPushEvent(provider string, repositoryURLs ...string) *gitPushEvent {
+	return &gitPushEvent{provider: provider, repositoryURLs: repositoryURLs, branches: make(map[string]string)}
+}
+
+// addBranch records a pushed branch, deleted branches are not synced
+func (e *gitPushEvent) addBranch(ref, commit string) {
+	if commit == "" || commit == gitZeroCommit {
+		return
+	}
+	e.branches[strings.TrimPrefix(ref, gitBranchRefPrefix)] = commit
+}
+
+// parseGitHubPushEvent parses the push payload of GitHub, the payload of Gitea has the same format
+func parseGitHubPushEvent(provider string, payload []byte) (*gitPushEvent, error) {
+	push := struct {
+		Ref        string `json:"ref"`
+		After      string `json:"after"`
+		Deleted    bool   `json:"deleted"`
+		Repository struct {
+			CloneURL string `json:"clone_url"`
+			SSHURL   string `json:"ssh_url"`
+			HTMLURL  string `json:"html_url"`
+		} `json:"repository"`
+	}{}
+	if err := json.Unmarshal(payload, &push); err != nil {
+		return nil, fmt.Errorf("cannot parse the %v push event: %w", provider, err)
+	}
+	event := newGitPushEvent(provider, push.Repository.CloneURL, push.Repository.SSHURL, push.Repository.HTMLURL)
+	if !push.Deleted && strings.HasPrefix(push.Ref, gitBranchRefPrefix) {
+		event.addBranch(push.Ref, push.After)
+	}
+	return event, nil
+}
+
+func parseGitLabPushEvent(payload []byte) (*gitPushEvent, error) {
+	push := struct {
+		Ref     string `json:"ref"`
+		After   string `json:"after"`
+		Project struct {
+			GitHTTPURL string `json:"git_http_url"`
+			GitSSHURL  string `json:"git_ssh_url"`
+			WebURL     string `json:"web_url"`
+		} `json:"project"`
+	}{}
+	if err := json.Unmarshal(payload, &push); err != nil {
+		return nil, fmt.Errorf("cannot parse the %v push event: %w", gitProviderGitLab, err)
+	}
+	event := newGitPushEvent(gitProviderGitLab, push.Project.GitHTTPURL, push.Project.GitSSHURL, push.Project.WebURL)
+	if strings.HasPrefix(push.Ref, gitBranchRefPrefix) {
+		event.addBranch(push.Ref, push.After)
+	}
+	return event, nil
+}
+
+func parseBitbucketCloudPushEvent(payload []byte) (*gitPushEvent, error) {
+	push := struct {
+		Push struct {
+			Changes []struct {
+				New *struct {
+					Type   string `json:"type"`
+					Name   string `json:"name"`
+					Target struct {
+						Hash string `json:"hash"`
+					} `json:"target"`
+				} `json:"new"`
+			} `json:"changes"`
+		} `json:"push"`
+		Repository struct {
+			FullName string `json:"full_name"`
+			Links    struct {
+				HTML struct {
+					Href string `json:"href"`
+				} `json:"html"`
+			} `json:"links"`
+		} `json:"repository"`
+	}{}
+	if err := json.Unmarshal(payload, &push); err != nil {
+		return nil, fmt.Errorf("cannot parse the %v push event: %w", gitProviderBitbucket, err)
+	}
+	event := newGitPushEvent(gitProviderBitbucket, push.Repository.Links.HTML.Href)
+	for _, change := range push.Push.Changes {
+		// new is null when the branch was deleted
+		if change.New != nil && change.New.Type == "branch" {
+			event.addBranch(change.New.Name, change.New.Target.Hash)
+		}
+	}
+	return event, nil
+}
+
+func parseBitbucketServerPushEvent(payload []byte) (*gitPushEvent, error) {
+	push := struct {
+		Changes []struct {
+			Ref struct {
+				ID        string `json:"id"`
+				DisplayID string `json:"displayId"`
+				Type      string `json:"type"`
+			} `json:"ref"`
+			ToHash string `json:"toHash"`
+			Type   string `json:"type"`
+		} `json:"changes"`
+		Repository struct {
+			Links struct {
+				Clone []struct {
+					Href string `json:"href"`
+				} `json:"clone"`
+			} `json:"links"`
+		} `json:"repository"`
+	}{}
+	if err := json.Unmarshal(payload, &push); err != nil {
+		return nil, fmt.Errorf("cannot parse the %v push event: %w", gitProviderBitbucket, err)
+	}
+	var repositoryURLs []string
+	for _, clone := range push.Repository.Links.Clone {
+		repositoryURLs = append(repositoryURLs, clone.Href)
+	}
+	event := newGitPushEvent(gitProviderBitbucket, repositoryURLs...)
+	for _, change := range push.Changes {
+		if change.Ref.Type == "BRANCH" && change.Type != "DELETE" {
+			event.addBranch(change.Ref.ID, change.ToHash)
+		}
+	}
+	return event, nil
+}
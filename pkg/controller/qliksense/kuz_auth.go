@@ -0,0 +1,171 @@
+package qliksense
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	machine_yaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// kuzSubresource is the subresource of the Qliksense CRs a caller must be allowed to create to render their manifests
+	kuzSubresource = "kuz"
+	kuzVerb        = "create"
+)
+
+// kuzAuthenticator authenticates the bearer tokens of the kuz requests with the TokenReview API, and authorizes
+// the callers with the SubjectAccessReview API to create the kuz subresource of the Qliksense CR they render
+type kuzAuthenticator struct {
+	client kubernetes.Interface
+	// namespace of the CRs that do not set one, the namespace watched by the operator
+	namespace string
+}
+
+type kuzCallerKey struct{}
+
+// kuzCaller is the authenticated caller of a kuz request
+type kuzCaller struct {
+	auth *kuzAuthenticator
+	user authenticationv1.UserInfo
+}
+
+func newKuzAuthenticator(client kubernetes.Interface, namespace string) *kuzAuthenticator {
+	return &kuzAuthenticator{client: client, namespace: namespace}
+}
+
+// wrap rejects the requests without a valid bearer token, and passes the caller to next in the context of the request.
+// Requests are passed through unchanged when the kuzAuthentication feature is disabled, or there is no authenticator.
+func (a *kuzAuthenticator) wrap(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !getOperatorConfig().Features.KuzAuthentication {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := getBearerToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kuz"`)
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		user, authenticated, err := a.authenticate(token)
+		if err != nil {
+			serverLog.Error(err, "cannot review the token of a kuz request")
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		} else if !authenticated {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kuz", error="invalid_token"`)
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), kuzCallerKey{}, &kuzCaller{auth: a, user: user})))
+	})
+}
+
+func (a *kuzAuthenticator) authenticate(token string) (authenticationv1.UserInfo, bool, error) {
+	tokenReview, err := a.client.AuthenticationV1().TokenReviews().Create(&authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		return authenticationv1.UserInfo{}, false, err
+	} else if tokenReview.Status.Error != "" {
+		serverLog.Info("kuz request token was not authenticated", "error", tokenReview.Status.Error)
+	}
+	return tokenReview.Status.User, tokenReview.Status.Authenticated, nil
+}
+
+// authorize tells whether the user may create the kuz subresource of the Qliksense CR
+func (a *kuzAuthenticator) authorize(user authenticationv1.UserInfo, target types.NamespacedName) (bool, string, error) {
+	return a.review(user, &authorizationv1.ResourceAttributes{
+		Namespace:   target.Namespace,
+		Verb:        kuzVerb,
+		Group:       qlikv1.SchemeGroupVersion.Group,
+		Resource:    "qliksenses",
+		Subresource: kuzSubresource,
+		Name:        target.Name,
+	})
+}
+
+// review tells whether the user may access the resource, and why
+func (a *kuzAuthenticator) review(user authenticationv1.UserInfo, attributes *authorizationv1.ResourceAttributes) (bool, string, error) {
+	extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+	for key, value := range user.Extra {
+		extra[key] = authorizationv1.ExtraValue(value)
+	}
+	review, err := a.client.AuthorizationV1().SubjectAccessReviews().Create(&authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               user.Username,
+			UID:                user.UID,
+			Groups:             user.Groups,
+			Extra:              extra,
+			ResourceAttributes: attributes,
+		},
+	})
+	if err != nil {
+		return false, "", err
+	}
+	return review.Status.Allowed, review.Status.Reason, nil
+}
+
+// getKuzCaller returns the caller authenticated by kuzAuthenticator.wrap, or nil when authentication is disabled
+func getKuzCaller(r *http.Request) *kuzCaller {
+	caller, _ := r.Context().Value(kuzCallerKey{}).(*kuzCaller)
+	return caller
+}
+
+// authorizeKuzRequest checks the caller authenticated by kuzAuthenticator.wrap may render the manifests of the CR.
+// It returns the HTTP status of the rejection, or 0 when the request is authorized or authentication is disabled.
+func authorizeKuzRequest(r *http.Request, crBytes []byte) (int, error) {
+	caller := getKuzCaller(r)
+	if caller == nil {
+		return 0, nil
+	}
+	target, err := getKuzRequestTarget(crBytes, caller.auth.namespace)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	allowed, reason, err := caller.auth.authorize(caller.user, target)
+	if err != nil {
+		serverLog.Error(err, "cannot review the access of a kuz request", "user", caller.user.Username)
+		return http.StatusInternalServerError, fmt.Errorf("cannot authorize the request")
+	} else if !allowed {
+		serverLog.Info("kuz request denied", "user", caller.user.Username, "qliksense", target.String(), "reason", reason)
+		return http.StatusForbidden, fmt.Errorf("user %q cannot %v qliksenses/%v %q in namespace %q",
+			caller.user.Username, kuzVerb, kuzSubresource, target.Name, target.Namespace)
+	}
+	return 0, nil
+}
+
+// getKuzRequestTarget returns the name and namespace of the CR of a kuz request, in the default namespace when it has none
+func getKuzRequestTarget(crBytes []byte, defaultNamespace string) (types.NamespacedName, error) {
+	var cr struct {
+		metav1.ObjectMeta `json:"metadata,omitempty"`
+	}
+	if err := machine_yaml.NewYAMLOrJSONDecoder(bytes.NewReader(crBytes), 10000).Decode(&cr); err != nil {
+		return types.NamespacedName{}, fmt.Errorf("cannot decode the cr: %w", err)
+	}
+	target := types.NamespacedName{Name: cr.Name, Namespace: cr.Namespace}
+	if target.Namespace == "" {
+		target.Namespace = defaultNamespace
+	}
+	return target, nil
+}
+
+func getBearerToken(r *http.Request) string {
+	authorization := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(authorization) < len("Bearer ") || !strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(authorization[len("Bearer "):])
+}
@@ -0,0 +1,237 @@
+package qliksense
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+)
+
+func Test_kuzAuthenticator(t *testing.T) {
+	const crYaml = `
+apiVersion: qlik.com/v1
+kind: Qliksense
+metadata:
+  name: qlik-default
+spec:
+  profile: docker-desktop
+`
+	// the authentication is disabled by default
+	config := defaultOperatorConfig()
+	config.Features.KuzAuthentication = true
+	setOperatorConfig(config)
+	defer setOperatorConfig(nil)
+
+	var reviewed *authorizationv1.SubjectAccessReview
+	kubeClient := kubefake.NewSimpleClientset()
+	kubeClient.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		tokenReview := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview).DeepCopy()
+		switch tokenReview.Spec.Token {
+		case "alice-token":
+			tokenReview.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "alice", Groups: []string{"qlik"}}}
+		case "bob-token":
+			tokenReview.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "bob"}}
+		default:
+			tokenReview.Status = authenticationv1.TokenReviewStatus{Error: "invalid token"}
+		}
+		return true, tokenReview, nil
+	})
+	kubeClient.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviewed = action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview).DeepCopy()
+		reviewed.Status.Allowed = reviewed.Spec.User == "alice"
+		return true, reviewed, nil
+	})
+	server := httptest.NewServer(newKuzAuthenticator(kubeClient, "qlik").wrap(http.HandlerFunc(kuzHandler)))
+	defer server.Close()
+
+	// the config is not a tarball, authorized requests fail after the authorization
+	body, err := json.Marshal(map[string]string{
+		"cr":     base64.StdEncoding.EncodeToString([]byte(crYaml)),
+		"config": base64.StdEncoding.EncodeToString([]byte("not a tarball")),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	testCases := []struct {
+		name           string
+		authorization  string
+		expectedStatus int
+	}{
+		{name: "no token", expectedStatus: http.StatusUnauthorized},
+		{name: "not a bearer token", authorization: "Basic YWxpY2U6c2VjcmV0", expectedStatus: http.StatusUnauthorized},
+		{name: "invalid token", authorization: "Bearer mallory-token", expectedStatus: http.StatusUnauthorized},
+		{name: "unauthorized user", authorization: "Bearer bob-token", expectedStatus: http.StatusForbidden},
+		{name: "authorized user", authorization: "Bearer alice-token", expectedStatus: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if testCase.authorization != "" {
+				request.Header.Set("Authorization", testCase.authorization)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer response.Body.Close()
+			if response.StatusCode != testCase.expectedStatus {
+				t.Fatalf("expected status: %v, but got: %v", testCase.expectedStatus, response.StatusCode)
+			} else if response.StatusCode == http.StatusUnauthorized && response.Header.Get("WWW-Authenticate") == "" {
+				t.Fatal("expected a WWW-Authenticate challenge")
+			}
+		})
+	}
+
+	// the access to the kuz subresource of the CR is reviewed, in the namespace of the operator when the CR has none
+	attributes := reviewed.Spec.ResourceAttributes
+	if reviewed.Spec.User != "alice" || len(reviewed.Spec.Groups) != 1 || reviewed.Spec.Groups[0] != "qlik" {
+		t.Fatalf("unexpected user: %v, groups: %v", reviewed.Spec.User, reviewed.Spec.Groups)
+	} else if attributes == nil || attributes.Verb != "create" || attributes.Group != "qlik.com" || attributes.Resource != "qliksenses" ||
+		attributes.Subresource != "kuz" || attributes.Name != "qlik-default" || attributes.Namespace != "qlik" {
+		t.Fatalf("unexpected resource attributes: %+v", attributes)
+	}
+
+	// requests are not authenticated when the feature is disabled
+	config.Features.KuzAuthentication = false
+	setOperatorConfig(config)
+	if response, err := http.Post(server.URL, "application/json", bytes.NewReader(body)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if response.Body.Close(); response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected the request to pass the authentication, but got: %v", response.StatusCode)
+	}
+}
+
+func Test_getKuzRequestTarget(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cr       string
+		expected types.NamespacedName
+	}{
+		{
+			name:     "yaml with namespace",
+			cr:       "metadata:\n  name: qlik-default\n  namespace: qlik\n",
+			expected: types.NamespacedName{Name: "qlik-default", Namespace: "qlik"},
+		},
+		{
+			name:     "json without namespace",
+			cr:       `{"metadata": {"name": "qlik-default"}}`,
+			expected: types.NamespacedName{Name: "qlik-default", Namespace: "default"},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if target, err := getKuzRequestTarget([]byte(testCase.cr), "default"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if target != testCase.expected {
+				t.Fatalf("expected: %v, but got: %v", testCase.expected, target)
+			}
+		})
+	}
+}
+
+// Test_kuzAuthenticator_envtest reviews static tokens and RBAC rules with a real API server, it is skipped when
+// the envtest binaries are not installed, see KUBEBUILDER_ASSETS
+func Test_kuzAuthenticator_envtest(t *testing.T) {
+	assets := os.Getenv("KUBEBUILDER_ASSETS")
+	if assets == "" {
+		assets = "/usr/local/kubebuilder/bin"
+	}
+	if _, err := os.Stat(filepath.Join(assets, "kube-apiserver")); err != nil {
+		t.Skipf("envtest binaries not found in %v", assets)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tokenFile := filepath.Join(tmpDir, "tokens.csv")
+	if err := ioutil.WriteFile(tokenFile, []byte("alice-token,alice,alice-uid,qlik\nbob-token,bob,bob-uid\n"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	testEnv := &envtest.Environment{
+		KubeAPIServerFlags: append(append([]string{}, envtest.DefaultKubeAPIServerFlags...),
+			"--token-auth-file="+tokenFile,
+			"--authorization-mode=RBAC",
+		),
+	}
+	cfg, err := testEnv.Start()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer testEnv.Stop()
+	kubeClient, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the ops runner Role of a CR allows to render it
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{Name: "qlik-default-ops-runner", Namespace: "default"},
+		Rules:      opsRunnerPolicyRules,
+	}
+	roleBinding := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "qlik-default-ops-runner", Namespace: "default"},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: role.Name},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: "qlik"}},
+	}
+	if _, err := kubeClient.RbacV1().Roles("default").Create(role); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := kubeClient.RbacV1().RoleBindings("default").Create(roleBinding); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	auth := newKuzAuthenticator(kubeClient, "default")
+	if _, authenticated, err := auth.authenticate("mallory-token"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if authenticated {
+		t.Fatal("expected an unknown token not to be authenticated")
+	}
+	target := types.NamespacedName{Name: "qlik-default", Namespace: "default"}
+	for _, user := range []struct {
+		token   string
+		allowed bool
+	}{
+		{token: "alice-token", allowed: true},
+		{token: "bob-token", allowed: false},
+	} {
+		t.Run(user.token, func(t *testing.T) {
+			userInfo, authenticated, err := auth.authenticate(user.token)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if !authenticated {
+				t.Fatal("expected the token to be authenticated")
+			}
+			if allowed, reason, err := auth.authorize(userInfo, target); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if allowed != user.allowed {
+				t.Fatalf("expected allowed: %v, but got: %v (%v)", user.allowed, allowed, reason)
+			}
+		})
+	}
+	if allowed, _, err := auth.authorize(authenticationv1.UserInfo{Username: "alice", Groups: []string{"qlik"}},
+		types.NamespacedName{Name: "qlik-default", Namespace: "other"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if allowed {
+		t.Fatal("expected alice not to be allowed in another namespace")
+	}
+}
@@ -0,0 +1,343 @@
+package qliksense
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const kuzBuildsPath = "/kuz/builds"
+
+type kuzBuildStatus string
+
+const (
+	kuzBuildPending   kuzBuildStatus = "Pending"
+	kuzBuildRunning   kuzBuildStatus = "Running"
+	kuzBuildSucceeded kuzBuildStatus = "Succeeded"
+	kuzBuildFailed    kuzBuildStatus = "Failed"
+	kuzBuildCancelled kuzBuildStatus = "Cancelled"
+)
+
+// kuzBuild is an asynchronous kustomize build, its fields are guarded by the mutex of kuzBuilds
+type kuzBuild struct {
+	id string
+	// owner is the user who submitted the build, only they can access it
+	owner  string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	crBytes           []byte
+	configTarZipBytes []byte
+	layout            kuzLayout
+
+	status     kuzBuildStatus
+	createdAt  time.Time
+	startedAt  *time.Time
+	finishedAt *time.Time
+	err        string
+	logs       []string
+	manifests  []byte
+}
+
+// kuzBuildResponse is the status of a build returned by the API
+type kuzBuildResponse struct {
+	ID         string         `json:"id"`
+	Status     kuzBuildStatus `json:"status"`
+	CreatedAt  time.Time      `json:"createdAt"`
+	StartedAt  *time.Time     `json:"startedAt,omitempty"`
+	FinishedAt *time.Time     `json:"finishedAt,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Logs       []string       `json:"logs"`
+}
+
+// kuzBuilds runs the kustomize builds submitted to POST /kuz/builds with a bounded pool of workers, so that the work
+// is not lost when the connection of the caller drops. The builds are kept for the result TTL after they finished.
+type kuzBuilds struct {
+	workers   int
+	queueSize int
+	resultTTL time.Duration
+	render    func(ctx context.Context, crBytes []byte, configTarZipBytes []byte, layout kuzLayout, progress func(string)) ([]byte, error)
+	now       func() time.Time
+
+	mu sync.Mutex
+	// pendingCond is signalled when a build is queued, or the workers stop
+	pendingCond *sync.Cond
+	pending     []*kuzBuild
+	running     int
+	stopped     bool
+	builds      map[string]*kuzBuild
+}
+
+func newKuzBuilds(config KuzBuildsConfig) *kuzBuilds {
+	b := &kuzBuilds{
+		workers:   int(config.Workers),
+		queueSize: int(config.QueueSize),
+		resultTTL: config.ResultTTL.Duration,
+		render:    renderKuzRequest,
+		now:       time.Now,
+		builds:    make(map[string]*kuzBuild),
+	}
+	b.pendingCond = sync.NewCond(&b.mu)
+	return b
+}
+
+// start runs the workers until ctx is done
+func (b *kuzBuilds) start(ctx context.Context) {
+	for i := 0; i < b.workers; i++ {
+		go func() {
+			for build := b.next(); build != nil; build = b.next() {
+				b.run(build)
+			}
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.stopped = true
+		b.pendingCond.Broadcast()
+	}()
+}
+
+// next waits for a pending build and marks it as running, it returns nil when the workers stop
+func (b *kuzBuilds) next() *kuzBuild {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.pending) == 0 && !b.stopped {
+		b.pendingCond.Wait()
+	}
+	if b.stopped {
+		return nil
+	}
+	build := b.pending[0]
+	b.pending = b.pending[1:]
+	startedAt := b.now()
+	build.status = kuzBuildRunning
+	build.startedAt = &startedAt
+	build.log(startedAt, "started")
+	b.running++
+	return build
+}
+
+func (b *kuzBuilds) register(r *mux.Router, auth *kuzAuthenticator, limiter *kuzLimiter) {
+	r.Handle(kuzBuildsPath, limiter.wrap(auth.wrap(http.HandlerFunc(b.submitHandler)))).Methods("POST")
+	r.Handle(kuzBuildsPath+"/{id}", auth.wrap(http.HandlerFunc(b.statusHandler))).Methods("GET")
+	r.Handle(kuzBuildsPath+"/{id}", auth.wrap(http.HandlerFunc(b.cancelHandler))).Methods("DELETE")
+	r.Handle(kuzBuildsPath+"/{id}/result", auth.wrap(http.HandlerFunc(b.resultHandler))).Methods("GET")
+}
+
+// submit queues a build of the CR and config in layout, it returns nil when all the workers are busy and the queue is full.
+// The build outlives the request of ctx, and renders with its cache.
+func (b *kuzBuilds) submit(ctx context.Context, owner string, crBytes []byte, configTarZipBytes []byte, layout kuzLayout) (*kuzBuild, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(withKuzCacheRequest(context.Background(), ctx))
+	build := &kuzBuild{
+		id:                hex.EncodeToString(idBytes),
+		owner:             owner,
+		ctx:               ctx,
+		cancel:            cancel,
+		crBytes:           crBytes,
+		configTarZipBytes: configTarZipBytes,
+		layout:            layout,
+		status:            kuzBuildPending,
+		createdAt:         b.now(),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire()
+	if len(b.pending)+b.running >= b.workers+b.queueSize {
+		cancel()
+		return nil, nil
+	}
+	build.log(build.createdAt, "queued")
+	b.builds[build.id] = build
+	b.pending = append(b.pending, build)
+	b.pendingCond.Signal()
+	return build, nil
+}
+
+func (b *kuzBuilds) run(build *kuzBuild) {
+	manifests, err := b.render(build.ctx, build.crBytes, build.configTarZipBytes, build.layout, func(message string) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		build.log(b.now(), message)
+	})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.running--
+	finishedAt := b.now()
+	build.finishedAt = &finishedAt
+	build.crBytes, build.configTarZipBytes = nil, nil
+	switch {
+	case build.ctx.Err() != nil:
+		build.status = kuzBuildCancelled
+		build.log(finishedAt, "cancelled")
+	case err != nil:
+		build.status = kuzBuildFailed
+		build.err = err.Error()
+		build.log(finishedAt, "failed: "+build.err)
+	default:
+		build.status = kuzBuildSucceeded
+		build.manifests = manifests
+		build.log(finishedAt, "succeeded")
+	}
+	build.cancel()
+}
+
+// get returns the build of the owner, or nil when there is none
+func (b *kuzBuilds) get(id, owner string) *kuzBuild {
+	b.expire()
+	if build, ok := b.builds[id]; ok && build.owner == owner {
+		return build
+	}
+	return nil
+}
+
+// expire deletes the builds that finished more than the result TTL ago, it must be called with the mutex locked
+func (b *kuzBuilds) expire() {
+	now := b.now()
+	for id, build := range b.builds {
+		if build.finishedAt != nil && now.Sub(*build.finishedAt) > b.resultTTL {
+			delete(b.builds, id)
+		}
+	}
+}
+
+func (build *kuzBuild) log(t time.Time, message string) {
+	build.logs = append(build.logs, fmt.Sprintf("%v %v", t.UTC().Format(time.RFC3339), message))
+}
+
+func (build *kuzBuild) response() *kuzBuildResponse {
+	return &kuzBuildResponse{
+		ID:         build.id,
+		Status:     build.status,
+		CreatedAt:  build.createdAt,
+		StartedAt:  build.startedAt,
+		FinishedAt: build.finishedAt,
+		Error:      build.err,
+		Logs:       append([]string{}, build.logs...),
+	}
+}
+
+func getKuzBuildOwner(r *http.Request) string {
+	if caller := getKuzCaller(r); caller != nil {
+		return caller.user.Username
+	}
+	return ""
+}
+
+func (b *kuzBuilds) submitHandler(w http.ResponseWriter, r *http.Request) {
+	crBytes, configTarZipBytes, layout, err := parseKuzRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), getKuzErrorStatus(err, http.StatusBadRequest))
+		return
+	} else if status, err := authorizeKuzRequest(r, crBytes); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	build, err := b.submit(r.Context(), getKuzBuildOwner(r), crBytes, configTarZipBytes, layout)
+	if err != nil {
+		serverLog.Error(err, "cannot submit a kustomize build")
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	} else if build == nil {
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "too many kustomize builds", http.StatusServiceUnavailable)
+		return
+	}
+	serverLog.Info("kustomize build queued", "id", build.id)
+
+	b.mu.Lock()
+	response := build.response()
+	b.mu.Unlock()
+	w.Header().Set("Location", fmt.Sprintf("%v/%v", kuzBuildsPath, build.id))
+	writeKuzBuildResponse(w, http.StatusAccepted, response)
+}
+
+func (b *kuzBuilds) statusHandler(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	build := b.get(mux.Vars(r)["id"], getKuzBuildOwner(r))
+	if build == nil {
+		b.mu.Unlock()
+		http.Error(w, "build not found", http.StatusNotFound)
+		return
+	}
+	response := build.response()
+	b.mu.Unlock()
+	writeKuzBuildResponse(w, http.StatusOK, response)
+}
+
+func (b *kuzBuilds) resultHandler(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	build := b.get(mux.Vars(r)["id"], getKuzBuildOwner(r))
+	if build == nil {
+		b.mu.Unlock()
+		http.Error(w, "build not found", http.StatusNotFound)
+		return
+	}
+	status, manifests := build.status, build.manifests
+	b.mu.Unlock()
+	if status != kuzBuildSucceeded {
+		http.Error(w, fmt.Sprintf("build is %v", status), http.StatusConflict)
+		return
+	}
+	writeKuzManifests(w, manifests)
+}
+
+// cancelHandler cancels a pending build right away, and a running build when its current step returns
+func (b *kuzBuilds) cancelHandler(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	build := b.get(mux.Vars(r)["id"], getKuzBuildOwner(r))
+	if build == nil {
+		b.mu.Unlock()
+		http.Error(w, "build not found", http.StatusNotFound)
+		return
+	}
+	switch build.status {
+	case kuzBuildPending:
+		for i := range b.pending {
+			if b.pending[i] == build {
+				b.pending = append(b.pending[:i], b.pending[i+1:]...)
+				break
+			}
+		}
+		finishedAt := b.now()
+		build.status = kuzBuildCancelled
+		build.finishedAt = &finishedAt
+		build.crBytes, build.configTarZipBytes = nil, nil
+		build.log(finishedAt, "cancelled")
+		build.cancel()
+	case kuzBuildRunning:
+		build.log(b.now(), "cancelling")
+		build.cancel()
+	default:
+		status := build.status
+		b.mu.Unlock()
+		http.Error(w, fmt.Sprintf("build is %v", status), http.StatusConflict)
+		return
+	}
+	response := build.response()
+	b.mu.Unlock()
+	serverLog.Info("kustomize build cancelled", "id", build.id)
+	writeKuzBuildResponse(w, http.StatusAccepted, response)
+}
+
+func writeKuzBuildResponse(w http.ResponseWriter, status int, response *kuzBuildResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		serverLog.Error(err, "error marshalling result to json")
+	}
+}
@@ -0,0 +1,153 @@
+package qliksense
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func Test_kuzBuilds(t *testing.T) {
+	b := newKuzBuilds(KuzBuildsConfig{Workers: 1, QueueSize: 1, ResultTTL: metav1.Duration{Duration: time.Hour}})
+	release := make(chan struct{})
+	b.render = func(ctx context.Context, crBytes []byte, configTarZipBytes []byte, layout kuzLayout, progress func(string)) ([]byte, error) {
+		progress("rendering " + string(crBytes))
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if string(crBytes) == "invalid" {
+			return nil, errors.New("cannot patch and kustomize the config")
+		}
+		return []byte("manifests of " + string(crBytes)), nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b.start(ctx)
+	r := mux.NewRouter()
+	b.register(r, nil, nil)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	do := func(method, path string, body []byte) (int, []byte) {
+		t.Helper()
+		request, err := http.NewRequest(method, server.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer response.Body.Close()
+		buffer := &bytes.Buffer{}
+		if _, err := buffer.ReadFrom(response.Body); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return response.StatusCode, buffer.Bytes()
+	}
+	submit := func(cr string) (int, *kuzBuildResponse) {
+		t.Helper()
+		body, _ := json.Marshal(map[string]string{"cr": base64.StdEncoding.EncodeToString([]byte(cr))})
+		status, responseBytes := do(http.MethodPost, kuzBuildsPath, body)
+		build := &kuzBuildResponse{}
+		if status == http.StatusAccepted {
+			if err := json.Unmarshal(responseBytes, build); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		return status, build
+	}
+	waitFor := func(id string, expected kuzBuildStatus) *kuzBuildResponse {
+		t.Helper()
+		build := &kuzBuildResponse{}
+		if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+			status, responseBytes := do(http.MethodGet, kuzBuildsPath+"/"+id, nil)
+			if status != http.StatusOK {
+				return false, errors.New(string(responseBytes))
+			}
+			if err := json.Unmarshal(responseBytes, build); err != nil {
+				return false, err
+			}
+			return build.Status == expected, nil
+		}); err != nil {
+			t.Fatalf("expected the build to be %v, but got: %v (%v)", expected, build.Status, err)
+		}
+		return build
+	}
+
+	// the worker runs the first build, the second one is queued and the third one is rejected
+	status, running := submit("qlik-default")
+	if status != http.StatusAccepted || running.ID == "" {
+		t.Fatalf("expected the build to be accepted, but got: %v", status)
+	}
+	waitFor(running.ID, kuzBuildRunning)
+	_, pending := submit("qlik-other")
+	if pending.Status != kuzBuildPending {
+		t.Fatalf("expected the build to be queued, but got: %v", pending.Status)
+	} else if status, _ := submit("qlik-rejected"); status != http.StatusServiceUnavailable {
+		t.Fatalf("expected the build to be rejected when the queue is full, but got: %v", status)
+	}
+	if status, _ := do(http.MethodGet, kuzBuildsPath+"/"+running.ID+"/result", nil); status != http.StatusConflict {
+		t.Fatalf("expected no result of a running build, but got: %v", status)
+	}
+
+	// cancelling the queued build frees its slot, cancelling the running build stops it
+	if status, _ := do(http.MethodDelete, kuzBuildsPath+"/"+pending.ID, nil); status != http.StatusAccepted {
+		t.Fatalf("unexpected status: %v", status)
+	}
+	waitFor(pending.ID, kuzBuildCancelled)
+	if status, _ := do(http.MethodDelete, kuzBuildsPath+"/"+running.ID, nil); status != http.StatusAccepted {
+		t.Fatalf("unexpected status: %v", status)
+	}
+	waitFor(running.ID, kuzBuildCancelled)
+	if status, _ := do(http.MethodDelete, kuzBuildsPath+"/"+running.ID, nil); status != http.StatusConflict {
+		t.Fatalf("expected a finished build not to be cancelled, but got: %v", status)
+	}
+
+	// the result of a successful build is returned, with the logs of its steps
+	_, succeeded := submit("qlik-default")
+	waitFor(succeeded.ID, kuzBuildRunning)
+	release <- struct{}{}
+	succeeded = waitFor(succeeded.ID, kuzBuildSucceeded)
+	if len(succeeded.Logs) != 4 || succeeded.StartedAt == nil || succeeded.FinishedAt == nil {
+		t.Fatalf("unexpected build: %+v", succeeded)
+	}
+	status, responseBytes := do(http.MethodGet, kuzBuildsPath+"/"+succeeded.ID+"/result", nil)
+	result := map[string]string{}
+	if status != http.StatusOK {
+		t.Fatalf("unexpected status: %v", status)
+	} else if err := json.Unmarshal(responseBytes, &result); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if manifests, err := base64.StdEncoding.DecodeString(result["manifests"]); err != nil || string(manifests) != "manifests of qlik-default" {
+		t.Fatalf("unexpected manifests: %v (%v)", string(manifests), err)
+	}
+
+	_, failed := submit("invalid")
+	waitFor(failed.ID, kuzBuildRunning)
+	release <- struct{}{}
+	if failed = waitFor(failed.ID, kuzBuildFailed); failed.Error != "cannot patch and kustomize the config" {
+		t.Fatalf("unexpected error: %v", failed.Error)
+	}
+
+	// the builds are only visible to their owner, and expire after the result TTL
+	b.mu.Lock()
+	if build := b.get(succeeded.ID, "alice"); build != nil {
+		t.Fatal("expected the build not to be visible to another user")
+	}
+	b.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	b.mu.Unlock()
+	if status, _ := do(http.MethodGet, kuzBuildsPath+"/"+succeeded.ID, nil); status != http.StatusNotFound {
+		t.Fatalf("expected the build to expire, but got: %v", status)
+	}
+}
@@ -0,0 +1,439 @@
+package qliksense
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	kapis_config "github.com/qlik-oss/k-apis/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/yaml"
+)
+
+// kuzKeysSecretNameSuffix is the suffix of the Secret k-apis backs up the application keys of a CR to, the manifests
+// are rendered with the keys restored from it
+const kuzKeysSecretNameSuffix = "-operator-state-backup"
+
+// kuzCacheEntryName matches the files of the cache entries, and of the entries being written
+var kuzCacheEntryName = regexp.MustCompile(`^[0-9a-f]{64}\.yaml(\.tmp[0-9]*)?$`)
+
+var (
+	kuzCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "qliksense_operator_kuz_cache_hits_total",
+		Help: "Number of kustomize builds served from the cache of the rendered manifests",
+	})
+	kuzCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "qliksense_operator_kuz_cache_misses_total",
+		Help: "Number of kustomize builds not found in the cache of the rendered manifests",
+	})
+	kuzCacheBypasses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "qliksense_operator_kuz_cache_bypasses_total",
+		Help: "Number of kustomize builds that bypassed the cache of the rendered manifests",
+	})
+	kuzCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "qliksense_operator_kuz_cache_evictions_total",
+		Help: "Number of rendered manifests evicted from the cache, or invalidated by a rotation of the keys",
+	})
+	kuzCacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "qliksense_operator_kuz_cache_size_bytes",
+		Help: "Size of the rendered manifests in the cache",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(kuzCacheHits, kuzCacheMisses, kuzCacheBypasses, kuzCacheEvictions, kuzCacheSize)
+}
+
+// kuzRenderCache keeps the rendered manifests in files of a directory, keyed by a hash of the normalized CR, of the
+// staged config and of the keys of the CR, and evicts the least recently used ones. The index is in memory, the
+// entries left by a previous run are deleted when it starts.
+type kuzRenderCache struct {
+	client kubernetes.Interface
+	// namespace of the CRs that do not set one, the namespace watched by the operator
+	namespace  string
+	dir        string
+	maxEntries int
+	maxSize    int64
+
+	mu sync.Mutex
+	// lru holds the entries, the most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+	// keys are the fingerprints of the keys of the CRs, the entries rendered with other keys are invalidated
+	keys map[types.NamespacedName]string
+}
+
+type kuzCacheEntry struct {
+	key    string
+	target types.NamespacedName
+	keys   string
+	size   int64
+}
+
+type kuzCacheRequestKey struct{}
+
+// kuzCacheRequest is how a request renders with the cache, bypass renders the manifests again and replaces the entry
+type kuzCacheRequest struct {
+	cache  *kuzRenderCache
+	bypass bool
+}
+
+func newKuzRenderCache(client kubernetes.Interface, namespace string, config KuzCacheConfig) (*kuzRenderCache, error) {
+	dir := config.Dir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "qliksense-operator-kuz-cache")
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fileInfo := range fileInfos {
+		if kuzCacheEntryName.MatchString(fileInfo.Name()) {
+			if err := os.Remove(filepath.Join(dir, fileInfo.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	kuzCacheSize.Set(0)
+	return &kuzRenderCache{
+		client:     client,
+		namespace:  namespace,
+		dir:        dir,
+		maxEntries: int(config.MaxEntries),
+		maxSize:    config.MaxSize.Value(),
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+		keys:       make(map[types.NamespacedName]string),
+	}, nil
+}
+
+// wrap passes the cache to next in the context of the request, requests with a Cache-Control: no-cache header bypass it
+func (c *kuzRenderCache) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cacheRequest := &kuzCacheRequest{cache: c, bypass: isKuzCacheBypassed(r)}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), kuzCacheRequestKey{}, cacheRequest)))
+	})
+}
+
+func isKuzCacheBypassed(r *http.Request) bool {
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		if directive = strings.ToLower(strings.TrimSpace(directive)); directive == "no-cache" || directive == "no-store" {
+			return true
+		}
+	}
+	return r.Header.Get("Pragma") == "no-cache"
+}
+
+// getKuzCacheRequest returns how the request of ctx renders with the cache, or nil when it renders without it
+func getKuzCacheRequest(ctx context.Context) *kuzCacheRequest {
+	cacheRequest, _ := ctx.Value(kuzCacheRequestKey{}).(*kuzCacheRequest)
+	return cacheRequest
+}
+
+// withKuzCacheRequest returns ctx rendering with the cache the same way as the request of from
+func withKuzCacheRequest(ctx context.Context, from context.Context) context.Context {
+	if cacheRequest := getKuzCacheRequest(from); cacheRequest != nil {
+		return context.WithValue(ctx, kuzCacheRequestKey{}, cacheRequest)
+	}
+	return ctx
+}
+
+// render returns the cached manifests of the CR and staged config, or the manifests rendered by render
+func (r *kuzCacheRequest) render(crBytes []byte, configDir string, render func() ([]byte, error)) ([]byte, error) {
+	c := r.cache
+	target, contentKey, err := c.getContentKey(crBytes, configDir)
+	if err != nil {
+		serverLog.Error(err, "cannot compute the cache key of the manifests, rendering them without the cache")
+		return render()
+	}
+	keys, err := c.getKeysFingerprint(target)
+	if err != nil {
+		serverLog.Error(err, "cannot read the keys of the CR, rendering the manifests without the cache", "qliksense", target.String())
+		return render()
+	}
+
+	if r.bypass {
+		kuzCacheBypasses.Inc()
+	} else if manifestBytes, ok := c.get(target, getKuzCacheKey(contentKey, keys), keys); ok {
+		kuzCacheHits.Inc()
+		return manifestBytes, nil
+	} else {
+		kuzCacheMisses.Inc()
+	}
+	manifestBytes, err := render()
+	if err != nil {
+		return nil, err
+	}
+	// the keys are generated and backed up by the first render of a CR
+	if keys, err = c.getKeysFingerprint(target); err != nil {
+		serverLog.Error(err, "cannot read the keys of the CR, the manifests are not cached", "qliksense", target.String())
+	} else if err := c.put(target, getKuzCacheKey(contentKey, keys), keys, manifestBytes); err != nil {
+		serverLog.Error(err, "cannot cache the manifests", "qliksense", target.String())
+	}
+	return manifestBytes, nil
+}
+
+// getContentKey returns the target of the CR, and a hash of the normalized CR, of the values of the Secrets it
+// references and of the files of the staged config. The fields set by the API server and the status of the CR do not
+// change the hash.
+func (c *kuzRenderCache) getContentKey(crBytes []byte, configDir string) (types.NamespacedName, string, error) {
+	target, err := getKuzRequestTarget(crBytes, c.namespace)
+	if err != nil {
+		return types.NamespacedName{}, "", err
+	}
+	cr := map[string]interface{}{}
+	if err := yaml.Unmarshal(crBytes, &cr); err != nil {
+		return types.NamespacedName{}, "", fmt.Errorf("cannot decode the cr: %w", err)
+	}
+	delete(cr, "status")
+	if metadata, ok := cr["metadata"].(map[string]interface{}); ok {
+		for _, field := range []string{"resourceVersion", "uid", "generation", "creationTimestamp", "managedFields", "selfLink"} {
+			delete(metadata, field)
+		}
+		if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+			delete(annotations, "kubectl.kubernetes.io/last-applied-configuration")
+		}
+		metadata["namespace"] = target.Namespace
+	}
+	// maps are marshalled with sorted keys
+	normalizedCRBytes, err := json.Marshal(cr)
+	if err != nil {
+		return types.NamespacedName{}, "", err
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "cr %d\n", len(normalizedCRBytes))
+	hash.Write(normalizedCRBytes)
+	if err := c.hashSecretRefs(hash, target, crBytes); err != nil {
+		return types.NamespacedName{}, "", err
+	}
+	if err := filepath.Walk(configDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(configDir, path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			linkTarget, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hash, "symlink %q %q\n", filepath.ToSlash(relPath), linkTarget)
+		case info.IsDir():
+			fmt.Fprintf(hash, "dir %q\n", filepath.ToSlash(relPath))
+		case info.Mode().IsRegular():
+			fmt.Fprintf(hash, "file %q %v %d\n", filepath.ToSlash(relPath), info.Mode().Perm(), info.Size())
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			if _, err := io.Copy(hash, file); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return types.NamespacedName{}, "", fmt.Errorf("cannot hash the config: %w", err)
+	}
+	return target, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashSecretRefs writes the values of the Secret keys referenced by the configs and secrets of the CR to hash, they
+// are read by the render, so a rotated value must not be served from the cache
+func (c *kuzRenderCache) hashSecretRefs(hash io.Writer, target types.NamespacedName, crBytes []byte) error {
+	cr := struct {
+		Spec struct {
+			Configs map[string]kapis_config.NameValues `json:"configs"`
+			Secrets map[string]kapis_config.NameValues `json:"secrets"`
+		} `json:"spec"`
+	}{}
+	if err := yaml.Unmarshal(crBytes, &cr); err != nil {
+		return fmt.Errorf("cannot decode the cr: %w", err)
+	}
+	var refs []kapis_config.SecretKeyRef
+	seen := make(map[kapis_config.SecretKeyRef]bool)
+	for _, nameValuesMap := range []map[string]kapis_config.NameValues{cr.Spec.Configs, cr.Spec.Secrets} {
+		for _, nameValues := range nameValuesMap {
+			for _, nameValue := range nameValues {
+				if nameValue.ValueFrom == nil || nameValue.ValueFrom.SecretKeyRef == nil || seen[*nameValue.ValueFrom.SecretKeyRef] {
+					continue
+				}
+				seen[*nameValue.ValueFrom.SecretKeyRef] = true
+				refs = append(refs, *nameValue.ValueFrom.SecretKeyRef)
+			}
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].Name < refs[j].Name || (refs[i].Name == refs[j].Name && refs[i].Key < refs[j].Key)
+	})
+
+	secrets := make(map[string]*corev1.Secret)
+	for _, ref := range refs {
+		secret, ok := secrets[ref.Name]
+		if !ok {
+			var err error
+			if secret, err = c.client.CoreV1().Secrets(target.Namespace).Get(ref.Name, metav1.GetOptions{}); errors.IsNotFound(err) {
+				secret = nil
+			} else if err != nil {
+				return fmt.Errorf("cannot get the secret %v: %w", ref.Name, err)
+			}
+			secrets[ref.Name] = secret
+		}
+		// a missing Secret or key renders an empty value
+		var value []byte
+		found := false
+		if secret != nil {
+			value, found = secret.Data[ref.Key]
+		}
+		fmt.Fprintf(hash, "secretKeyRef %q %q %v %d\n", ref.Name, ref.Key, found, len(value))
+		hash.Write(value)
+	}
+	return nil
+}
+
+// getKeysFingerprint returns a hash of the keys of the CR backed up by k-apis, or an empty string when there are none
+func (c *kuzRenderCache) getKeysFingerprint(target types.NamespacedName) (string, error) {
+	secret, err := c.client.CoreV1().Secrets(target.Namespace).Get(target.Name+kuzKeysSecretNameSuffix, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(secret.Data))
+	for name := range secret.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hash := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%q %d\n", name, len(secret.Data[name]))
+		hash.Write(secret.Data[name])
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func getKuzCacheKey(contentKey, keys string) string {
+	hash := sha256.Sum256([]byte(contentKey + "\n" + keys))
+	return hex.EncodeToString(hash[:])
+}
+
+func (c *kuzRenderCache) entryPath(key string) string {
+	return filepath.Join(c.dir, key+".yaml")
+}
+
+// get returns the manifests of the entry, the entries of the target rendered with other keys are invalidated first
+func (c *kuzRenderCache) get(target types.NamespacedName, key, keys string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidate(target, keys)
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	manifestBytes, err := ioutil.ReadFile(c.entryPath(key))
+	if err != nil {
+		serverLog.Error(err, "cannot read cached manifests", "qliksense", target.String())
+		c.remove(element)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return manifestBytes, true
+}
+
+// put caches the manifests, and evicts the least recently used entries beyond the bounds of the cache
+func (c *kuzRenderCache) put(target types.NamespacedName, key, keys string, manifestBytes []byte) error {
+	size := int64(len(manifestBytes))
+	if size > c.maxSize {
+		return nil
+	}
+	// the entry is written to a temporary file first, so that it is never read partially written
+	tmpFile, err := ioutil.TempFile(c.dir, key+".yaml.tmp")
+	if err != nil {
+		return err
+	} else if _, err := tmpFile.Write(manifestBytes); err != nil {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+		return err
+	} else if err := tmpFile.Close(); err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidate(target, keys)
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	if err := os.Rename(tmpFile.Name(), c.entryPath(key)); err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return err
+	}
+	c.entries[key] = c.lru.PushFront(&kuzCacheEntry{key: key, target: target, keys: keys, size: size})
+	c.size += size
+	for c.lru.Len() > c.maxEntries || c.size > c.maxSize {
+		c.remove(c.lru.Back())
+		kuzCacheEvictions.Inc()
+	}
+	kuzCacheSize.Set(float64(c.size))
+	return nil
+}
+
+// invalidate removes the entries of the target rendered with keys other than the current ones, it must be called with
+// the mutex locked
+func (c *kuzRenderCache) invalidate(target types.NamespacedName, keys string) {
+	if previousKeys, ok := c.keys[target]; ok && previousKeys != keys {
+		invalidated := 0
+		for element := c.lru.Front(); element != nil; {
+			next := element.Next()
+			if entry := element.Value.(*kuzCacheEntry); entry.target == target && entry.keys != keys {
+				c.remove(element)
+				invalidated++
+			}
+			element = next
+		}
+		if invalidated > 0 {
+			serverLog.Info("the keys of the CR were rotated, invalidated its cached manifests", "qliksense", target.String(), "entries", invalidated)
+			kuzCacheEvictions.Add(float64(invalidated))
+			kuzCacheSize.Set(float64(c.size))
+		}
+	}
+	c.keys[target] = keys
+}
+
+// remove deletes the entry and its file, it must be called with the mutex locked
+func (c *kuzRenderCache) remove(element *list.Element) {
+	entry := element.Value.(*kuzCacheEntry)
+	c.lru.Remove(element)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	if err := os.Remove(c.entryPath(entry.key)); err != nil && !os.IsNotExist(err) {
+		serverLog.Error(err, "cannot delete cached manifests", "qliksense", entry.target.String())
+	}
+}
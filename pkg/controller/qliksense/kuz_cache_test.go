@@ -0,0 +1,182 @@
+package qliksense
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_kuzRenderCache(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	cacheDir, configDir := filepath.Join(tmpDir, "cache"), filepath.Join(tmpDir, "config")
+	if err := os.MkdirAll(cacheDir, os.ModePerm); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// entries of a previous run are deleted, other files are kept
+	staleEntry := filepath.Join(cacheDir, getKuzCacheKey("stale", "")+".yaml")
+	otherFile := filepath.Join(cacheDir, "README")
+	for _, path := range []string{staleEntry, otherFile, filepath.Join(configDir, "kustomization.yaml")} {
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := ioutil.WriteFile(path, []byte("kind: Kustomization\n"), os.ModePerm); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	kubeClient := kubefake.NewSimpleClientset()
+	cache, err := newKuzRenderCache(kubeClient, "qlik", KuzCacheConfig{Enabled: true, Dir: cacheDir, MaxEntries: 2, MaxSize: resource.MustParse("1Mi")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := os.Stat(staleEntry); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale entry to be deleted, but got: %v", err)
+	} else if _, err := os.Stat(otherFile); err != nil {
+		t.Fatalf("expected the other file to be kept, but got: %v", err)
+	}
+
+	renders := 0
+	defer func(kustomize func([]byte, string) ([]byte, error)) { kustomizeKuzConfig = kustomize }(kustomizeKuzConfig)
+	kustomizeKuzConfig = func(crBytes []byte, configDir string) ([]byte, error) {
+		renders++
+		// the first render generates and backs up the keys of the CR
+		if _, err := kubeClient.CoreV1().Secrets("qlik").Get("qlik-default"+kuzKeysSecretNameSuffix, metav1.GetOptions{}); err != nil {
+			if _, err := kubeClient.CoreV1().Secrets("qlik").Create(&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "qlik-default" + kuzKeysSecretNameSuffix, Namespace: "qlik"},
+				Data:       map[string][]byte{"operator-keys": []byte("generated")},
+			}); err != nil {
+				return nil, err
+			}
+		}
+		return append([]byte("kind: ConfigMap\n---\n"), crBytes...), nil
+	}
+	render := func(cr string, bypass bool) []byte {
+		t.Helper()
+		ctx := context.WithValue(context.Background(), kuzCacheRequestKey{}, &kuzCacheRequest{cache: cache, bypass: bypass})
+		manifestBytes, err := renderKuzConfig(ctx, []byte(cr), configDir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return manifestBytes
+	}
+	expectRenders := func(expected int) {
+		t.Helper()
+		if renders != expected {
+			t.Fatalf("expected %v renders, but got: %v", expected, renders)
+		}
+	}
+	hits, misses := testutil.ToFloat64(kuzCacheHits), testutil.ToFloat64(kuzCacheMisses)
+
+	const cr = `
+apiVersion: qlik.com/v1
+kind: Qliksense
+metadata:
+  name: qlik-default
+spec:
+  profile: docker-desktop
+`
+	manifestBytes := render(cr, false)
+	expectRenders(1)
+	// the fields set by the API server and the formatting do not change the key
+	if cached := render(`{"apiVersion": "qlik.com/v1", "kind": "Qliksense", "metadata": {"name": "qlik-default",
+"namespace": "qlik", "resourceVersion": "42", "uid": "1234"}, "spec": {"profile": "docker-desktop"}, "status": {}}`, false); string(cached) != string(manifestBytes) {
+		t.Fatalf("unexpected cached manifests: %v", string(cached))
+	}
+	expectRenders(1)
+	if hitCount, missCount := testutil.ToFloat64(kuzCacheHits)-hits, testutil.ToFloat64(kuzCacheMisses)-misses; hitCount != 1 || missCount != 1 {
+		t.Fatalf("unexpected hits: %v, misses: %v", hitCount, missCount)
+	}
+
+	// bypassing the cache renders again
+	bypasses := testutil.ToFloat64(kuzCacheBypasses)
+	render(cr, true)
+	expectRenders(2)
+	if bypassCount := testutil.ToFloat64(kuzCacheBypasses) - bypasses; bypassCount != 1 {
+		t.Fatalf("unexpected bypasses: %v", bypassCount)
+	}
+
+	// a change of the config or of the spec renders again
+	if err := ioutil.WriteFile(filepath.Join(configDir, "patch.yaml"), []byte("kind: ConfigMap\n"), os.ModePerm); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	render(cr, false)
+	expectRenders(3)
+	render(cr, false)
+	expectRenders(3)
+
+	// rotating the keys invalidates the entries of the CR
+	secret, err := kubeClient.CoreV1().Secrets("qlik").Get("qlik-default"+kuzKeysSecretNameSuffix, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secret.Data["operator-keys"] = []byte("rotated")
+	if _, err := kubeClient.CoreV1().Secrets("qlik").Update(secret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	render(cr, false)
+	expectRenders(4)
+	if len(cache.entries) != 1 {
+		t.Fatalf("expected the entries rendered with the previous keys to be invalidated, but got: %v", len(cache.entries))
+	}
+
+	// the least recently used entries are evicted
+	evictions := testutil.ToFloat64(kuzCacheEvictions)
+	render(cr+"  version: v1\n", false)
+	render(cr+"  version: v2\n", false)
+	expectRenders(6)
+	if evictionCount := testutil.ToFloat64(kuzCacheEvictions) - evictions; evictionCount != 1 {
+		t.Fatalf("unexpected evictions: %v", evictionCount)
+	}
+	render(cr, false)
+	expectRenders(7)
+	if fileInfos, err := ioutil.ReadDir(cacheDir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(fileInfos) != 3 {
+		t.Fatalf("expected the files of the 2 entries and the other file, but got: %v", len(fileInfos))
+	} else if size := testutil.ToFloat64(kuzCacheSize); size != float64(cache.size) || size == 0 {
+		t.Fatalf("unexpected size: %v", size)
+	}
+
+	// rotating a Secret referenced by the CR renders again
+	const crWithSecretRef = cr + `  secrets:
+    qliksense:
+    - name: mongodbUri
+      valueFrom:
+        secretKeyRef:
+          name: mongodb
+          key: uri
+`
+	if _, err := kubeClient.CoreV1().Secrets("qlik").Create(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "mongodb", Namespace: "qlik"},
+		Data:       map[string][]byte{"uri": []byte("mongodb://first")},
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	render(crWithSecretRef, false)
+	render(crWithSecretRef, false)
+	expectRenders(8)
+	mongodbSecret, err := kubeClient.CoreV1().Secrets("qlik").Get("mongodb", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mongodbSecret.Data["uri"] = []byte("mongodb://second")
+	if _, err := kubeClient.CoreV1().Secrets("qlik").Update(mongodbSecret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	misses = testutil.ToFloat64(kuzCacheMisses)
+	render(crWithSecretRef, false)
+	expectRenders(9)
+	if missCount := testutil.ToFloat64(kuzCacheMisses) - misses; missCount != 1 {
+		t.Fatalf("expected the rotated secret to miss the cache, but got misses: %v", missCount)
+	}
+}
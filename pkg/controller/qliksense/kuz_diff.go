@@ -0,0 +1,464 @@
+package qliksense
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	machine_yaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	kuzDiffPath = "/kuz/diff"
+
+	// kuzLastAppliedAnnotation holds the configuration last applied by kubectl apply, the fields removed from it since
+	// are removed from the live objects
+	kuzLastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+)
+
+type kuzObjectDiffStatus string
+
+const (
+	kuzObjectAdded     kuzObjectDiffStatus = "Added"
+	kuzObjectChanged   kuzObjectDiffStatus = "Changed"
+	kuzObjectUnchanged kuzObjectDiffStatus = "Unchanged"
+	kuzObjectError     kuzObjectDiffStatus = "Error"
+)
+
+type kuzFieldChangeOp string
+
+const (
+	kuzFieldAdded   kuzFieldChangeOp = "added"
+	kuzFieldRemoved kuzFieldChangeOp = "removed"
+	kuzFieldChanged kuzFieldChangeOp = "changed"
+)
+
+// kuzDiffResponse is the diff of the rendered objects with the live objects, in the order of the manifests
+type kuzDiffResponse struct {
+	Objects []kuzObjectDiff `json:"objects"`
+}
+
+type kuzObjectDiff struct {
+	APIVersion string              `json:"apiVersion"`
+	Kind       string              `json:"kind"`
+	Namespace  string              `json:"namespace,omitempty"`
+	Name       string              `json:"name"`
+	Status     kuzObjectDiffStatus `json:"status"`
+	Changes    []kuzFieldChange    `json:"changes,omitempty"`
+	Error      string              `json:"error,omitempty"`
+}
+
+// kuzFieldChange is a change of the field at Path, the values of the data of the Secrets are redacted
+type kuzFieldChange struct {
+	Op       kuzFieldChangeOp `json:"op"`
+	Path     string           `json:"path"`
+	From     interface{}      `json:"from,omitempty"`
+	To       interface{}      `json:"to,omitempty"`
+	Redacted bool             `json:"redacted,omitempty"`
+}
+
+// kuzDiffer diffs the manifests rendered for the CR and config of POST /kuz/diff with the live objects
+type kuzDiffer struct {
+	client dynamic.Interface
+	mapper meta.RESTMapper
+	// namespace of the CRs that do not set one, the namespace watched by the operator
+	namespace string
+}
+
+func newKuzDiffer(client dynamic.Interface, mapper meta.RESTMapper, namespace string) *kuzDiffer {
+	return &kuzDiffer{client: client, mapper: mapper, namespace: namespace}
+}
+
+// handler responds with the diff of the objects, the live objects the caller cannot get are not diffed
+func (d *kuzDiffer) handler(w http.ResponseWriter, r *http.Request) {
+	objects, namespace, ok := renderKuzObjects(w, r, d.namespace)
+	if !ok {
+		return
+	}
+
+	caller := getKuzCaller(r)
+	response := &kuzDiffResponse{Objects: make([]kuzObjectDiff, 0, len(objects))}
+	for _, object := range objects {
+		response.Objects = append(response.Objects, d.diff(caller, namespace, object))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		serverLog.Error(err, "error marshalling result to json")
+	}
+}
+
+// renderKuzObjects renders the objects of the CR and config of a kuz request, and returns them with the namespace of
+// the CR, or the default namespace when it has none. It responds with the error and returns false when it fails.
+func renderKuzObjects(w http.ResponseWriter, r *http.Request, defaultNamespace string) ([]*unstructured.Unstructured, string, bool) {
+	crBytes, configTarZipBytes, _, err := parseKuzRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), getKuzErrorStatus(err, http.StatusBadRequest))
+		return nil, "", false
+	} else if status, err := authorizeKuzRequest(r, crBytes); err != nil {
+		http.Error(w, err.Error(), status)
+		return nil, "", false
+	}
+	target, err := getKuzRequestTarget(crBytes, defaultNamespace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, "", false
+	}
+	manifestBytes, err := renderKuzManifests(r.Context(), crBytes, configTarZipBytes, func(string) {})
+	if err != nil {
+		writeKuzRenderError(w, err)
+		return nil, "", false
+	}
+	objects, err := decodeKuzManifests(manifestBytes)
+	if err != nil {
+		serverLog.Error(err, "cannot decode the rendered manifests")
+		http.Error(w, "", http.StatusInternalServerError)
+		return nil, "", false
+	}
+	return objects, target.Namespace, true
+}
+
+// diff fetches the live object of the rendered object, in namespace when it is namespaced and has none, and diffs them
+func (d *kuzDiffer) diff(caller *kuzCaller, namespace string, object *unstructured.Unstructured) kuzObjectDiff {
+	gvk := object.GroupVersionKind()
+	mapping, err := mapKuzObject(d.mapper, namespace, object)
+	if meta.IsNoMatchError(err) {
+		// the type is not served yet, neither is the object
+		return newKuzObjectDiff(object, kuzObjectAdded)
+	} else if err != nil {
+		return newKuzObjectDiffError(object, err)
+	} else if err := authorizeKuzObject(caller, "get", mapping, object); err != nil {
+		return newKuzObjectDiffError(object, err)
+	}
+
+	live, err := d.client.Resource(mapping.Resource).Namespace(object.GetNamespace()).Get(object.GetName(), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return newKuzObjectDiff(object, kuzObjectAdded)
+	} else if err != nil {
+		return newKuzObjectDiffError(object, err)
+	}
+
+	var lastApplied map[string]interface{}
+	if annotations := live.GetAnnotations(); annotations != nil {
+		if lastAppliedJSON, ok := annotations[kuzLastAppliedAnnotation]; ok {
+			if err := json.Unmarshal([]byte(lastAppliedJSON), &lastApplied); err != nil {
+				serverLog.Info("cannot decode the last applied configuration of a live object", "kind", live.GetKind(), "name", live.GetName(), "error", err.Error())
+				lastApplied = nil
+			}
+			// the last applied configuration is not diffed, it holds the data of the Secrets
+			delete(annotations, kuzLastAppliedAnnotation)
+			if len(annotations) == 0 {
+				unstructured.RemoveNestedField(live.Object, "metadata", "annotations")
+			} else {
+				live.SetAnnotations(annotations)
+			}
+		}
+	}
+	desired, liveContent := object.UnstructuredContent(), live.UnstructuredContent()
+	secret := gvk.Group == "" && gvk.Kind == "Secret"
+	if secret {
+		desired, lastApplied = normalizeKuzSecret(desired), normalizeKuzSecret(lastApplied)
+	}
+	changes := diffKuzObject(desired, liveContent, lastApplied)
+	if secret {
+		redactKuzSecretChanges(changes)
+	}
+	objectDiff := newKuzObjectDiff(object, kuzObjectUnchanged)
+	if len(changes) > 0 {
+		objectDiff.Status, objectDiff.Changes = kuzObjectChanged, changes
+	}
+	return objectDiff
+}
+
+// mapKuzObject returns the mapping of the type of a rendered object, and sets the namespace of the object: namespace
+// when the type is namespaced and the object has none, none when the type is cluster scoped
+func mapKuzObject(mapper meta.RESTMapper, namespace string, object *unstructured.Unstructured) (*meta.RESTMapping, error) {
+	gvk := object.GroupVersionKind()
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, err
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		if object.GetNamespace() == "" {
+			object.SetNamespace(namespace)
+		}
+	} else {
+		object.SetNamespace("")
+	}
+	return mapping, nil
+}
+
+// authorizeKuzObject checks the caller authenticated by kuzAuthenticator.wrap may access the live object of a rendered
+// object with verb, any caller may when authentication is disabled
+func authorizeKuzObject(caller *kuzCaller, verb string, mapping *meta.RESTMapping, object *unstructured.Unstructured) error {
+	return authorizeKuzObjectVerbs(caller, verb, []string{verb}, mapping, object)
+}
+
+// authorizeKuzObjectVerbs checks the caller may access the live object with all the verbs, the denial tells the action
+// they are required for
+func authorizeKuzObjectVerbs(caller *kuzCaller, action string, verbs []string, mapping *meta.RESTMapping, object *unstructured.Unstructured) error {
+	if caller == nil {
+		return nil
+	}
+	for _, verb := range verbs {
+		allowed, reason, err := caller.auth.review(caller.user, &authorizationv1.ResourceAttributes{
+			Namespace: object.GetNamespace(),
+			Verb:      verb,
+			Group:     mapping.Resource.Group,
+			Version:   mapping.Resource.Version,
+			Resource:  mapping.Resource.Resource,
+			Name:      object.GetName(),
+		})
+		if err != nil {
+			serverLog.Error(err, "cannot review the access to a live object", "user", caller.user.Username)
+			return fmt.Errorf("cannot authorize the request")
+		} else if allowed {
+			continue
+		}
+		serverLog.Info("kuz request for a live object denied", "user", caller.user.Username, "verb", verb,
+			"resource", mapping.Resource.Resource, "namespace", object.GetNamespace(), "name", object.GetName(), "reason", reason)
+		if object.GetNamespace() == "" {
+			return fmt.Errorf("user %q cannot %v %v %q", caller.user.Username, action, mapping.Resource.Resource, object.GetName())
+		}
+		return fmt.Errorf("user %q cannot %v %v %q in namespace %q",
+			caller.user.Username, action, mapping.Resource.Resource, object.GetName(), object.GetNamespace())
+	}
+	return nil
+}
+
+func newKuzObjectDiff(object *unstructured.Unstructured, status kuzObjectDiffStatus) kuzObjectDiff {
+	return kuzObjectDiff{
+		APIVersion: object.GetAPIVersion(),
+		Kind:       object.GetKind(),
+		Namespace:  object.GetNamespace(),
+		Name:       object.GetName(),
+		Status:     status,
+	}
+}
+
+func newKuzObjectDiffError(object *unstructured.Unstructured, err error) kuzObjectDiff {
+	objectDiff := newKuzObjectDiff(object, kuzObjectError)
+	objectDiff.Error = err.Error()
+	return objectDiff
+}
+
+// decodeKuzManifests decodes the objects of multi-document yaml manifests, the List objects are flattened. The integers
+// are decoded as int64, as the objects of the API server.
+func decodeKuzManifests(manifestBytes []byte) ([]*unstructured.Unstructured, error) {
+	var objects []*unstructured.Unstructured
+	decoder := machine_yaml.NewYAMLOrJSONDecoder(bytes.NewReader(manifestBytes), 4096)
+	for {
+		var objectBytes json.RawMessage
+		if err := decoder.Decode(&objectBytes); err == io.EOF {
+			return objects, nil
+		} else if err != nil {
+			return nil, err
+		} else if trimmed := bytes.TrimSpace(objectBytes); len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+			continue
+		}
+		object := &unstructured.Unstructured{}
+		if err := object.UnmarshalJSON(objectBytes); err != nil {
+			return nil, err
+		}
+		if object.IsList() {
+			list, err := object.ToList()
+			if err != nil {
+				return nil, err
+			}
+			for i := range list.Items {
+				objects = append(objects, &list.Items[i])
+			}
+		} else {
+			objects = append(objects, object)
+		}
+	}
+}
+
+// diffKuzObject returns the changes of the fields set in desired compared to live, the fields of the live object
+// that are not set in desired are only removed when they were set in the last applied configuration
+func diffKuzObject(desired, live, lastApplied map[string]interface{}) []kuzFieldChange {
+	var changes []kuzFieldChange
+	for _, key := range sortedKuzFieldKeys(desired) {
+		if key == "status" {
+			continue
+		}
+		liveValue, liveOk := live[key]
+		changes = diffKuzField(changes, getKuzFieldPath("", key), desired[key], liveValue, liveOk)
+	}
+	for _, key := range sortedKuzFieldKeys(lastApplied) {
+		if key == "status" {
+			continue
+		}
+		desiredValue, desiredOk := desired[key]
+		liveValue, liveOk := live[key]
+		changes = diffKuzRemovedField(changes, getKuzFieldPath("", key), lastApplied[key], desiredValue, desiredOk, liveValue, liveOk)
+	}
+	return changes
+}
+
+func diffKuzField(changes []kuzFieldChange, path string, desired, live interface{}, liveOk bool) []kuzFieldChange {
+	if !liveOk {
+		return append(changes, kuzFieldChange{Op: kuzFieldAdded, Path: path, To: desired})
+	}
+	switch desiredValue := desired.(type) {
+	case map[string]interface{}:
+		if liveValue, ok := live.(map[string]interface{}); ok {
+			for _, key := range sortedKuzFieldKeys(desiredValue) {
+				liveFieldValue, liveFieldOk := liveValue[key]
+				changes = diffKuzField(changes, getKuzFieldPath(path, key), desiredValue[key], liveFieldValue, liveFieldOk)
+			}
+			return changes
+		}
+	case []interface{}:
+		if liveValue, ok := live.([]interface{}); ok {
+			for i := range desiredValue {
+				itemPath := fmt.Sprintf("%v[%d]", path, i)
+				if i < len(liveValue) {
+					changes = diffKuzField(changes, itemPath, desiredValue[i], liveValue[i], true)
+				} else {
+					changes = append(changes, kuzFieldChange{Op: kuzFieldAdded, Path: itemPath, To: desiredValue[i]})
+				}
+			}
+			for i := len(desiredValue); i < len(liveValue); i++ {
+				changes = append(changes, kuzFieldChange{Op: kuzFieldRemoved, Path: fmt.Sprintf("%v[%d]", path, i), From: liveValue[i]})
+			}
+			return changes
+		}
+	default:
+		if equalKuzFieldValues(desired, live) {
+			return changes
+		}
+	}
+	return append(changes, kuzFieldChange{Op: kuzFieldChanged, Path: path, From: live, To: desired})
+}
+
+func diffKuzRemovedField(changes []kuzFieldChange, path string, lastApplied, desired interface{}, desiredOk bool, live interface{}, liveOk bool) []kuzFieldChange {
+	if !liveOk {
+		return changes
+	} else if !desiredOk {
+		return append(changes, kuzFieldChange{Op: kuzFieldRemoved, Path: path, From: live})
+	}
+	lastAppliedValue, lastAppliedOk := lastApplied.(map[string]interface{})
+	desiredValue, desiredValueOk := desired.(map[string]interface{})
+	liveValue, liveValueOk := live.(map[string]interface{})
+	if !lastAppliedOk || !desiredValueOk || !liveValueOk {
+		return changes
+	}
+	for _, key := range sortedKuzFieldKeys(lastAppliedValue) {
+		desiredFieldValue, desiredFieldOk := desiredValue[key]
+		liveFieldValue, liveFieldOk := liveValue[key]
+		changes = diffKuzRemovedField(changes, getKuzFieldPath(path, key), lastAppliedValue[key], desiredFieldValue, desiredFieldOk, liveFieldValue, liveFieldOk)
+	}
+	return changes
+}
+
+// equalKuzFieldValues compares the scalar values, the numbers and the quantities are compared by value
+func equalKuzFieldValues(desired, live interface{}) bool {
+	if desiredNumber, ok := getKuzFieldNumber(desired); ok {
+		liveNumber, ok := getKuzFieldNumber(live)
+		return ok && desiredNumber == liveNumber
+	}
+	if desiredString, ok := desired.(string); ok {
+		if liveString, ok := live.(string); !ok {
+			return false
+		} else if desiredString == liveString {
+			return true
+		} else if desiredQuantity, err := resource.ParseQuantity(desiredString); err != nil {
+			return false
+		} else if liveQuantity, err := resource.ParseQuantity(liveString); err != nil {
+			return false
+		} else {
+			return desiredQuantity.Cmp(liveQuantity) == 0
+		}
+	}
+	return reflect.DeepEqual(desired, live)
+}
+
+func getKuzFieldNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case int64:
+		return float64(number), true
+	case int:
+		return float64(number), true
+	case float64:
+		return number, true
+	case json.Number:
+		f, err := number.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+var kuzFieldName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// getKuzFieldPath returns the path of the field key of the field at path, the keys that are not plain names are quoted
+func getKuzFieldPath(path, key string) string {
+	if !kuzFieldName.MatchString(key) {
+		return path + "[" + strconv.Quote(key) + "]"
+	} else if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedKuzFieldKeys(fields map[string]interface{}) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// normalizeKuzSecret returns the Secret with its stringData merged in its data, as the API server does
+func normalizeKuzSecret(secret map[string]interface{}) map[string]interface{} {
+	stringData, ok := secret["stringData"].(map[string]interface{})
+	if !ok {
+		return secret
+	}
+	normalized := make(map[string]interface{}, len(secret))
+	for key, value := range secret {
+		normalized[key] = value
+	}
+	data := map[string]interface{}{}
+	if secretData, ok := secret["data"].(map[string]interface{}); ok {
+		for key, value := range secretData {
+			data[key] = value
+		}
+	}
+	for key, value := range stringData {
+		if stringValue, ok := value.(string); ok {
+			data[key] = base64.StdEncoding.EncodeToString([]byte(stringValue))
+		}
+	}
+	delete(normalized, "stringData")
+	normalized["data"] = data
+	return normalized
+}
+
+// redactKuzSecretChanges removes the values of the changes of the data and of the annotations of a Secret, which
+// may hold its data too
+func redactKuzSecretChanges(changes []kuzFieldChange) {
+	for i := range changes {
+		for _, field := range []string{"data", "stringData", "metadata.annotations"} {
+			if path := changes[i].Path; path == field || strings.HasPrefix(path, field+".") || strings.HasPrefix(path, field+"[") {
+				changes[i].From, changes[i].To, changes[i].Redacted = nil, nil, true
+			}
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package qliksense
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_diffKuzObject(t *testing.T) {
+	testCases := []struct {
+		name        string
+		desired     string
+		live        string
+		lastApplied string
+		expected    []kuzFieldChange
+	}{
+		{
+			name:    "unchanged",
+			desired: `{"metadata": {"name": "qlik"}, "spec": {"replicas": 1, "cpu": "0.5"}}`,
+			live:    `{"metadata": {"name": "qlik", "uid": "1234"}, "spec": {"replicas": 1, "cpu": "500m"}, "status": {"ready": true}}`,
+		},
+		{
+			name:    "added and changed",
+			desired: `{"metadata": {"labels": {"app.kubernetes.io/name": "qlik"}}, "spec": {"replicas": 2, "image": "qlik:2"}}`,
+			live:    `{"metadata": {}, "spec": {"replicas": 1}}`,
+			expected: []kuzFieldChange{
+				{Op: kuzFieldAdded, Path: `metadata.labels`, To: map[string]interface{}{"app.kubernetes.io/name": "qlik"}},
+				{Op: kuzFieldAdded, Path: `spec.image`, To: "qlik:2"},
+				{Op: kuzFieldChanged, Path: `spec.replicas`, From: float64(1), To: float64(2)},
+			},
+		},
+		{
+			name:    "lists",
+			desired: `{"spec": {"ports": [{"port": 80}, {"port": 443}]}}`,
+			live:    `{"spec": {"ports": [{"port": 8080}, {"port": 443}, {"port": 9090}]}}`,
+			expected: []kuzFieldChange{
+				{Op: kuzFieldChanged, Path: `spec.ports[0].port`, From: float64(8080), To: float64(80)},
+				{Op: kuzFieldRemoved, Path: `spec.ports[2]`, From: map[string]interface{}{"port": float64(9090)}},
+			},
+		},
+		{
+			name:        "removed",
+			desired:     `{"metadata": {"annotations": {"a": "1"}}, "data": {"b": "2"}}`,
+			live:        `{"metadata": {"annotations": {"a": "1"}}, "data": {"b": "2", "c": "3", "d": "4"}}`,
+			lastApplied: `{"data": {"b": "2", "c": "3"}, "kind": "ConfigMap"}`,
+			expected: []kuzFieldChange{
+				{Op: kuzFieldRemoved, Path: `data.c`, From: "3"},
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var desired, live, lastApplied map[string]interface{}
+			for _, field := range []struct {
+				value  string
+				fields *map[string]interface{}
+			}{{testCase.desired, &desired}, {testCase.live, &live}, {testCase.lastApplied, &lastApplied}} {
+				if field.value == "" {
+					continue
+				} else if err := json.Unmarshal([]byte(field.value), field.fields); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			if changes := diffKuzObject(desired, live, lastApplied); !reflect.DeepEqual(changes, testCase.expected) {
+				t.Fatalf("expected: %#v, but got: %#v", testCase.expected, changes)
+			}
+		})
+	}
+}
+
+func Test_kuzDiffer(t *testing.T) {
+	defer func(kustomize func([]byte, string) ([]byte, error)) { kustomizeKuzConfig = kustomize }(kustomizeKuzConfig)
+	kustomizeKuzConfig = func(crBytes []byte, configDir string) ([]byte, error) {
+		return []byte(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: qlik-config
+data:
+  level: debug
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: qlik-secret
+stringData:
+  password: new-password
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: qlik-engine
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: qlik
+---
+apiVersion: qlik.com/v1
+kind: Engine
+metadata:
+  name: qlik-engine
+`), nil
+	}
+
+	mapper := meta.NewDefaultRESTMapper(nil)
+	for _, gvk := range []schema.GroupVersionKind{
+		{Version: "v1", Kind: "ConfigMap"},
+		{Version: "v1", Kind: "Secret"},
+		{Group: "apps", Version: "v1", Kind: "Deployment"},
+	} {
+		mapper.Add(gvk, meta.RESTScopeNamespace)
+	}
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+	newLive := func(kind, namespace, name string, fields map[string]interface{}) *unstructured.Unstructured {
+		live := &unstructured.Unstructured{Object: fields}
+		live.SetAPIVersion("v1")
+		live.SetKind(kind)
+		live.SetNamespace(namespace)
+		live.SetName(name)
+		return live
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		newLive("ConfigMap", "qlik", "qlik-config", map[string]interface{}{"data": map[string]interface{}{"level": "info"}}),
+		// the annotations of the live Secret are removed from the rendered Secret, and its last applied configuration
+		// holds its data
+		newLive("Secret", "qlik", "qlik-secret", map[string]interface{}{
+			"metadata": map[string]interface{}{"annotations": map[string]interface{}{
+				"qlik.com/owner": "qlik-default",
+				kuzLastAppliedAnnotation: fmt.Sprintf(`{"data": {"password": %q}, "metadata": {"annotations": {"qlik.com/owner": "qlik-default"}}}`,
+					base64.StdEncoding.EncodeToString([]byte("old-password"))),
+			}},
+			"data": map[string]interface{}{"password": base64.StdEncoding.EncodeToString([]byte("old-password"))},
+		}),
+		newLive("Namespace", "", "qlik", map[string]interface{}{}),
+	)
+
+	kubeClient := kubefake.NewSimpleClientset()
+	kubeClient.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview).DeepCopy()
+		review.Status.Allowed = review.Spec.ResourceAttributes.Resource != "namespaces"
+		return true, review, nil
+	})
+	caller := &kuzCaller{auth: newKuzAuthenticator(kubeClient, "qlik"), user: authenticationv1.UserInfo{Username: "alice"}}
+	differ := newKuzDiffer(dynamicClient, mapper, "qlik")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		differ.handler(w, r.WithContext(context.WithValue(r.Context(), kuzCallerKey{}, caller)))
+	}))
+	defer server.Close()
+
+	configTarZipBytes, err := createTarGz("kustomization.yaml", []byte("kind: Kustomization\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, err := json.Marshal(map[string]string{
+		"cr":     base64.StdEncoding.EncodeToString([]byte("metadata:\n  name: qlik-default\n")),
+		"config": base64.StdEncoding.EncodeToString(configTarZipBytes),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	response, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer response.Body.Close()
+	responseBytes, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %v, %v", response.StatusCode, string(responseBytes))
+	} else if strings.Contains(string(responseBytes), base64.StdEncoding.EncodeToString([]byte("new-password"))) ||
+		strings.Contains(string(responseBytes), base64.StdEncoding.EncodeToString([]byte("old-password"))) {
+		t.Fatalf("the secret data is not redacted: %v", string(responseBytes))
+	}
+	var diffResponse kuzDiffResponse
+	if err := json.Unmarshal(responseBytes, &diffResponse); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []kuzObjectDiff{
+		{APIVersion: "v1", Kind: "ConfigMap", Namespace: "qlik", Name: "qlik-config", Status: kuzObjectChanged, Changes: []kuzFieldChange{
+			{Op: kuzFieldChanged, Path: "data.level", From: "info", To: "debug"},
+		}},
+		{APIVersion: "v1", Kind: "Secret", Namespace: "qlik", Name: "qlik-secret", Status: kuzObjectChanged, Changes: []kuzFieldChange{
+			{Op: kuzFieldChanged, Path: "data.password", Redacted: true},
+			{Op: kuzFieldRemoved, Path: "metadata.annotations", Redacted: true},
+		}},
+		{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "qlik", Name: "qlik-engine", Status: kuzObjectAdded},
+		{APIVersion: "v1", Kind: "Namespace", Name: "qlik", Status: kuzObjectError,
+			Error: `user "alice" cannot get namespaces "qlik"`},
+		{APIVersion: "qlik.com/v1", Kind: "Engine", Name: "qlik-engine", Status: kuzObjectAdded},
+	}
+	if !reflect.DeepEqual(diffResponse.Objects, expected) {
+		t.Fatalf("expected: %#v, but got: %#v", expected, diffResponse.Objects)
+	}
+}
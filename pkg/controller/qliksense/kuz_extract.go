@@ -0,0 +1,213 @@
+package qliksense
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// errKuzRequestTooLarge is wrapped by the errors of the requests exceeding the limits of the kustomize server
+	errKuzRequestTooLarge = errors.New("request too large")
+	// errKuzInvalidConfig is wrapped by the errors of the malformed or unsafe config tarballs
+	errKuzInvalidConfig = errors.New("invalid config tarball")
+)
+
+// kuzConfigLimits bound the config tarballs of the kustomize build requests
+type kuzConfigLimits struct {
+	maxCompressedSize   int64
+	maxUncompressedSize int64
+	maxFiles            int
+}
+
+func newKuzConfigLimits(config KuzLimitsConfig) kuzConfigLimits {
+	return kuzConfigLimits{
+		maxCompressedSize:   config.MaxCompressedSize.Value(),
+		maxUncompressedSize: config.MaxUncompressedSize.Value(),
+		maxFiles:            int(config.MaxFiles),
+	}
+}
+
+// getKuzErrorStatus returns the HTTP status of the errors of the requests exceeding the limits of the kustomize server,
+// with an invalid config tarball or rendering manifests that cannot be laid out, and status for other errors
+func getKuzErrorStatus(err error, status int) int {
+	if errors.Is(err, errKuzRequestTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	} else if errors.Is(err, errKuzInvalidConfig) {
+		return http.StatusBadRequest
+	} else if errors.Is(err, errKuzInvalidManifests) {
+		return http.StatusUnprocessableEntity
+	}
+	return status
+}
+
+// kuzLimitedReader reads at most n bytes of r, and fails with err when there are more
+type kuzLimitedReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (l *kuzLimitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, l.err
+	} else if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if l.n -= int64(n); l.n < 0 {
+		return 0, l.err
+	}
+	return n, err
+}
+
+// extractKuzConfig unpacks the config tarball read from r in dir. Only directories, regular files, hard links and
+// symbolic links are unpacked, and the entries cannot be written outside of dir: absolute paths, paths with ..
+// elements, paths through symbolic links and symbolic links resolving outside of dir are rejected.
+func extractKuzConfig(r io.Reader, dir string, limits kuzConfigLimits) error {
+	gzipReader, err := gzip.NewReader(&kuzLimitedReader{
+		r:   r,
+		n:   limits.maxCompressedSize,
+		err: fmt.Errorf("%w: the config tarball is larger than %v bytes", errKuzRequestTooLarge, limits.maxCompressedSize),
+	})
+	if err != nil {
+		return wrapKuzConfigReadError(err)
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+	remainingSize := limits.maxUncompressedSize
+	files := 0
+	var symlinks []string
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return wrapKuzConfigReadError(err)
+		} else if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		if files++; files > limits.maxFiles {
+			return fmt.Errorf("%w: the config tarball has more than %v entries", errKuzRequestTooLarge, limits.maxFiles)
+		}
+		name, err := getKuzConfigEntryName(dir, header.Name)
+		if err != nil {
+			return err
+		} else if name == "." {
+			continue
+		}
+		entryPath := filepath.Join(dir, filepath.FromSlash(name))
+		if header.Typeflag != tar.TypeDir {
+			if _, err := os.Lstat(entryPath); err == nil {
+				return fmt.Errorf("%w: duplicate entry %q", errKuzInvalidConfig, header.Name)
+			} else if err := os.MkdirAll(filepath.Dir(entryPath), os.ModePerm); err != nil {
+				return fmt.Errorf("%w: cannot create the directory of %q: %v", errKuzInvalidConfig, header.Name, err)
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(entryPath, os.ModePerm); err != nil {
+				return fmt.Errorf("%w: cannot create directory %q: %v", errKuzInvalidConfig, header.Name, err)
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if header.Size > remainingSize {
+				return fmt.Errorf("%w: the files of the config tarball are larger than %v bytes", errKuzRequestTooLarge, limits.maxUncompressedSize)
+			}
+			remainingSize -= header.Size
+			file, err := os.OpenFile(entryPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, header.FileInfo().Mode().Perm()|0600)
+			if err != nil {
+				return err
+			} else if _, err := io.Copy(file, tarReader); err != nil {
+				_ = file.Close()
+				return wrapKuzConfigReadError(err)
+			} else if err := file.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if header.Linkname == "" || path.IsAbs(header.Linkname) || filepath.IsAbs(header.Linkname) {
+				return fmt.Errorf("%w: symbolic link %q to absolute path %q", errKuzInvalidConfig, header.Name, header.Linkname)
+			} else if target := path.Join(path.Dir(name), header.Linkname); target == ".." || strings.HasPrefix(target, "../") {
+				return fmt.Errorf("%w: symbolic link %q to %q outside of the config", errKuzInvalidConfig, header.Name, header.Linkname)
+			} else if err := os.Symlink(header.Linkname, entryPath); err != nil {
+				return err
+			}
+			symlinks = append(symlinks, entryPath)
+		case tar.TypeLink:
+			// the targets of hard links are relative to the root of the tarball
+			linkName, err := getKuzConfigEntryName(dir, header.Linkname)
+			if err != nil {
+				return err
+			}
+			source := filepath.Join(dir, filepath.FromSlash(linkName))
+			if info, err := os.Lstat(source); err != nil || !info.Mode().IsRegular() {
+				return fmt.Errorf("%w: hard link %q to %q which is not a regular file", errKuzInvalidConfig, header.Name, header.Linkname)
+			} else if err := os.Link(source, entryPath); err != nil {
+				return err
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			return fmt.Errorf("%w: device file %q", errKuzInvalidConfig, header.Name)
+		default:
+			return fmt.Errorf("%w: unsupported entry %q of type %q", errKuzInvalidConfig, header.Name, header.Typeflag)
+		}
+	}
+
+	// the symbolic links are resolved once they are all unpacked, so that chains of links are followed
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	for _, symlink := range symlinks {
+		if target, err := filepath.EvalSymlinks(symlink); err != nil {
+			return fmt.Errorf("%w: cannot resolve symbolic link %q: %v", errKuzInvalidConfig, symlink[len(dir)+1:], err)
+		} else if target != root && !strings.HasPrefix(target, root+string(filepath.Separator)) {
+			return fmt.Errorf("%w: symbolic link %q resolves outside of the config", errKuzInvalidConfig, symlink[len(dir)+1:])
+		}
+	}
+	return nil
+}
+
+// getKuzConfigEntryName returns the clean relative path of an entry of a config tarball unpacked in dir, it fails when
+// the path is absolute, has .. elements, or goes through a symbolic link
+func getKuzConfigEntryName(dir, entryName string) (string, error) {
+	if entryName == "" || path.IsAbs(entryName) || filepath.IsAbs(entryName) || filepath.VolumeName(entryName) != "" {
+		return "", fmt.Errorf("%w: entry %q is not a relative path", errKuzInvalidConfig, entryName)
+	}
+	for _, element := range strings.Split(strings.ReplaceAll(entryName, "\\", "/"), "/") {
+		if element == ".." {
+			return "", fmt.Errorf("%w: entry %q is outside of the config", errKuzInvalidConfig, entryName)
+		}
+	}
+	name := path.Clean(entryName)
+	parent := dir
+	for _, element := range strings.Split(path.Dir(name), "/") {
+		if element == "." {
+			continue
+		}
+		parent = filepath.Join(parent, element)
+		if info, err := os.Lstat(parent); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("%w: entry %q: %v", errKuzInvalidConfig, entryName, err)
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%w: entry %q is in a symbolic link", errKuzInvalidConfig, entryName)
+		}
+	}
+	return name, nil
+}
+
+// wrapKuzConfigReadError returns err when the config tarball is too large, and an invalid config error otherwise
+func wrapKuzConfigReadError(err error) error {
+	if errors.Is(err, errKuzRequestTooLarge) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", errKuzInvalidConfig, err)
+}
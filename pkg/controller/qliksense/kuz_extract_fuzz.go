@@ -0,0 +1,52 @@
+//go:build gofuzz
+// +build gofuzz
+
+package qliksense
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Fuzz is the go-fuzz entry point of the extraction of the config tarballs, data is the raw gzip stream of a request.
+// It panics when the extraction writes outside of the config directory, or leaves a link resolving outside of it.
+func Fuzz(data []byte) int {
+	tmpDir, err := ioutil.TempDir("", "kuz-fuzz")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dir := filepath.Join(tmpDir, "config")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		panic(err)
+	}
+
+	limits := kuzConfigLimits{maxCompressedSize: 1 << 20, maxUncompressedSize: 4 << 20, maxFiles: 64}
+	extractErr := extractKuzConfig(bytes.NewReader(data), dir, limits)
+	if fileInfos, err := ioutil.ReadDir(tmpDir); err != nil {
+		panic(err)
+	} else if len(fileInfos) != 1 {
+		panic(fmt.Sprintf("extracted %v entries outside of the config directory (%v)", len(fileInfos)-1, extractErr))
+	}
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.Mode()&os.ModeSymlink == 0 || extractErr != nil {
+			return nil
+		}
+		if target, err := filepath.EvalSymlinks(path); err != nil || !strings.HasPrefix(target+"/", dir+"/") {
+			return fmt.Errorf("symbolic link %v resolves outside of the config directory: %v (%v)", path, target, err)
+		}
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	if extractErr != nil {
+		return 0
+	}
+	return 1
+}
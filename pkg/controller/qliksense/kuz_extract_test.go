@@ -0,0 +1,322 @@
+package qliksense
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// kuzConfigEntry is an entry of a test config tarball, its content is the content of a regular file
+type kuzConfigEntry struct {
+	header  tar.Header
+	content string
+}
+
+func kuzConfigFile(name, content string) kuzConfigEntry {
+	return kuzConfigEntry{header: tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(content))}, content: content}
+}
+
+func kuzConfigLink(typeflag byte, name, linkname string) kuzConfigEntry {
+	return kuzConfigEntry{header: tar.Header{Typeflag: typeflag, Name: name, Linkname: linkname, Mode: 0777}}
+}
+
+func createKuzConfigTar(t testing.TB, entries ...kuzConfigEntry) []byte {
+	t.Helper()
+	buffer := &bytes.Buffer{}
+	tarWriter := tar.NewWriter(buffer)
+	for _, entry := range entries {
+		header := entry.header
+		if err := tarWriter.WriteHeader(&header); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		} else if _, err := tarWriter.Write([]byte(entry.content)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+func gzipKuzConfigTar(t testing.TB, tarBytes []byte) []byte {
+	t.Helper()
+	buffer := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(buffer)
+	if _, err := gzipWriter.Write(tarBytes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := gzipWriter.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+var testKuzConfigLimits = kuzConfigLimits{maxCompressedSize: 1 << 20, maxUncompressedSize: 1 << 20, maxFiles: 10}
+
+func Test_extractKuzConfig(t *testing.T) {
+	testCases := []struct {
+		name    string
+		entries []kuzConfigEntry
+		limits  *kuzConfigLimits
+		// expectError is the error wrapped by the expected error
+		expectError error
+		verify      func(t *testing.T, dir string)
+	}{
+		{
+			name: "config",
+			entries: []kuzConfigEntry{
+				{header: tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0755}},
+				{header: tar.Header{Typeflag: tar.TypeDir, Name: "manifests/base/", Mode: 0755}},
+				kuzConfigFile("manifests/base/kustomization.yaml", "kind: Kustomization\n"),
+				kuzConfigFile("./manifests/docker-desktop/kustomization.yaml", "resources: [../base]\n"),
+				kuzConfigLink(tar.TypeSymlink, "manifests/base-link", "base"),
+				kuzConfigLink(tar.TypeSymlink, "manifests/docker-desktop/base", "../base-link/kustomization.yaml"),
+				// hard links are relative to the root of the tarball
+				kuzConfigLink(tar.TypeLink, "manifests/docker-desktop/copy.yaml", "manifests/base/kustomization.yaml"),
+			},
+			verify: func(t *testing.T, dir string) {
+				for _, name := range []string{"manifests/docker-desktop/base", "manifests/docker-desktop/copy.yaml"} {
+					if content, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					} else if string(content) != "kind: Kustomization\n" {
+						t.Fatalf("unexpected content of %v: %v", name, string(content))
+					}
+				}
+			},
+		},
+		{
+			name:        "absolute path",
+			entries:     []kuzConfigEntry{kuzConfigFile("/etc/passwd", "root")},
+			expectError: errKuzInvalidConfig,
+		},
+		{
+			name:        "parent path",
+			entries:     []kuzConfigEntry{kuzConfigFile("manifests/../../passwd", "root")},
+			expectError: errKuzInvalidConfig,
+		},
+		{
+			name:        "symbolic link to an absolute path",
+			entries:     []kuzConfigEntry{kuzConfigLink(tar.TypeSymlink, "passwd", "/etc/passwd")},
+			expectError: errKuzInvalidConfig,
+		},
+		{
+			name:        "symbolic link outside",
+			entries:     []kuzConfigEntry{kuzConfigLink(tar.TypeSymlink, "manifests/passwd", "../../etc/passwd")},
+			expectError: errKuzInvalidConfig,
+		},
+		{
+			name: "symbolic links resolving outside",
+			entries: []kuzConfigEntry{
+				kuzConfigLink(tar.TypeSymlink, "root", "."),
+				kuzConfigLink(tar.TypeSymlink, "parent", "root/.."),
+			},
+			expectError: errKuzInvalidConfig,
+		},
+		{
+			name: "file in a symbolic link",
+			entries: []kuzConfigEntry{
+				kuzConfigLink(tar.TypeSymlink, "manifests", "."),
+				kuzConfigFile("manifests/kustomization.yaml", "kind: Kustomization\n"),
+			},
+			expectError: errKuzInvalidConfig,
+		},
+		{
+			name: "file replacing a symbolic link",
+			entries: []kuzConfigEntry{
+				kuzConfigLink(tar.TypeSymlink, "kustomization.yaml", "other.yaml"),
+				kuzConfigFile("kustomization.yaml", "kind: Kustomization\n"),
+			},
+			expectError: errKuzInvalidConfig,
+		},
+		{
+			name:        "hard link outside",
+			entries:     []kuzConfigEntry{kuzConfigLink(tar.TypeLink, "passwd", "../etc/passwd")},
+			expectError: errKuzInvalidConfig,
+		},
+		{
+			name: "hard link to a symbolic link",
+			entries: []kuzConfigEntry{
+				kuzConfigLink(tar.TypeSymlink, "root", "."),
+				kuzConfigLink(tar.TypeLink, "copy", "root"),
+			},
+			expectError: errKuzInvalidConfig,
+		},
+		{
+			name:        "device file",
+			entries:     []kuzConfigEntry{{header: tar.Header{Typeflag: tar.TypeChar, Name: "null", Mode: 0666, Devmajor: 1, Devminor: 3}}},
+			expectError: errKuzInvalidConfig,
+		},
+		{
+			name:        "fifo",
+			entries:     []kuzConfigEntry{{header: tar.Header{Typeflag: tar.TypeFifo, Name: "fifo", Mode: 0666}}},
+			expectError: errKuzInvalidConfig,
+		},
+		{
+			name:        "too many files",
+			entries:     []kuzConfigEntry{kuzConfigFile("a", ""), kuzConfigFile("b", ""), kuzConfigFile("c", "")},
+			limits:      &kuzConfigLimits{maxCompressedSize: 1 << 20, maxUncompressedSize: 1 << 20, maxFiles: 2},
+			expectError: errKuzRequestTooLarge,
+		},
+		{
+			name:        "too large files",
+			entries:     []kuzConfigEntry{kuzConfigFile("a", "0123456789"), kuzConfigFile("b", "0123456789")},
+			limits:      &kuzConfigLimits{maxCompressedSize: 1 << 20, maxUncompressedSize: 15, maxFiles: 10},
+			expectError: errKuzRequestTooLarge,
+		},
+		{
+			name:        "too large tarball",
+			entries:     []kuzConfigEntry{kuzConfigFile("a", strings.Repeat("0123456789", 100))},
+			limits:      &kuzConfigLimits{maxCompressedSize: 16, maxUncompressedSize: 1 << 20, maxFiles: 10},
+			expectError: errKuzRequestTooLarge,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer os.RemoveAll(tmpDir)
+			dir := filepath.Join(tmpDir, "config")
+			if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			limits := testKuzConfigLimits
+			if testCase.limits != nil {
+				limits = *testCase.limits
+			}
+
+			err = extractKuzConfig(bytes.NewReader(gzipKuzConfigTar(t, createKuzConfigTar(t, testCase.entries...))), dir, limits)
+			if testCase.expectError != nil {
+				if !errors.Is(err, testCase.expectError) {
+					t.Fatalf("expected an error wrapping %v, but got: %v", testCase.expectError, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			testCase.verify(t, dir)
+		})
+	}
+}
+
+// randomKuzConfig is a random config tarball of files, directories and links, with names and link targets escaping the
+// config directory in many ways
+type randomKuzConfig []kuzConfigEntry
+
+func (randomKuzConfig) Generate(rand *rand.Rand, size int) reflect.Value {
+	names := []string{"kustomization.yaml", "manifests", "manifests/base", "manifests/base/kustomization.yaml", "root",
+		"root/passwd", "parent", "parent/passwd", "../passwd", "/etc/passwd", "manifests/../../passwd", "./copy"}
+	targets := []string{".", "..", "root", "root/..", "parent/..", "manifests", "../base", "kustomization.yaml",
+		"/etc/passwd", "../etc/passwd", "manifests/base/kustomization.yaml"}
+	entries := make(randomKuzConfig, rand.Intn(size%8+1)+1)
+	for i := range entries {
+		name := names[rand.Intn(len(names))]
+		switch rand.Intn(4) {
+		case 0:
+			entries[i] = kuzConfigFile(name, "kind: Kustomization\n")
+		case 1:
+			entries[i] = kuzConfigEntry{header: tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0755}}
+		case 2:
+			entries[i] = kuzConfigLink(tar.TypeSymlink, name, targets[rand.Intn(len(targets))])
+		default:
+			entries[i] = kuzConfigLink(tar.TypeLink, name, targets[rand.Intn(len(targets))])
+		}
+	}
+	return reflect.ValueOf(entries)
+}
+
+func Test_extractKuzConfig_random(t *testing.T) {
+	checkTarGz := func(tarGzBytes []byte) bool {
+		tmpDir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+		dir := filepath.Join(tmpDir, "config")
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		extractErr := extractKuzConfig(bytes.NewReader(tarGzBytes), dir, testKuzConfigLimits)
+
+		// whether the tarball is rejected or not, nothing is written outside of the config directory
+		if fileInfos, readErr := ioutil.ReadDir(tmpDir); readErr != nil {
+			t.Fatalf("unexpected error: %v", readErr)
+		} else if len(fileInfos) != 1 {
+			t.Errorf("expected only the config directory, but got %v entries (%v)", len(fileInfos), extractErr)
+			return false
+		}
+		files := 0
+		if walkErr := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			} else if path == dir || info.IsDir() {
+				return nil
+			}
+			files++
+			switch mode := info.Mode(); {
+			case mode.IsRegular():
+			case mode&os.ModeSymlink != 0:
+				// the links of an accepted tarball resolve inside of the config directory
+				if target, evalErr := filepath.EvalSymlinks(path); extractErr == nil && (evalErr != nil || !strings.HasPrefix(target+"/", dir+"/")) {
+					return fmt.Errorf("symbolic link %v resolves outside of the config directory: %v (%v)", path, target, evalErr)
+				}
+			default:
+				return fmt.Errorf("unexpected file %v of mode %v", path, mode)
+			}
+			return nil
+		}); walkErr != nil {
+			t.Errorf("unexpected error: %v", walkErr)
+			return false
+		} else if files > testKuzConfigLimits.maxFiles {
+			t.Errorf("expected at most %v files and links, but got: %v", testKuzConfigLimits.maxFiles, files)
+			return false
+		}
+		return true
+	}
+	check := func(entries randomKuzConfig) bool {
+		return checkTarGz(gzipKuzConfigTar(t, createKuzConfigTar(t, entries...)))
+	}
+	// the malformed tarballs flip the bits of a byte of the tar stream, or of the gzip stream
+	checkCorrupted := func(entries randomKuzConfig, offset uint16, bits byte, compressed bool) bool {
+		tarBytes := createKuzConfigTar(t, entries...)
+		if !compressed {
+			tarBytes[int(offset)%len(tarBytes)] ^= bits | 1
+		}
+		tarGzBytes := gzipKuzConfigTar(t, tarBytes)
+		if compressed {
+			tarGzBytes[int(offset)%len(tarGzBytes)] ^= bits | 1
+		}
+		return checkTarGz(tarGzBytes)
+	}
+
+	for _, entries := range []randomKuzConfig{
+		{kuzConfigFile("kustomization.yaml", "kind: Kustomization\n"), kuzConfigLink(tar.TypeSymlink, "base", ".")},
+		{kuzConfigLink(tar.TypeSymlink, "root", "."), kuzConfigLink(tar.TypeSymlink, "parent", "root/..")},
+		{kuzConfigLink(tar.TypeSymlink, "manifests", ".."), kuzConfigFile("manifests/passwd", "root")},
+		{kuzConfigFile("../passwd", "root"), kuzConfigLink(tar.TypeLink, "copy", "/etc/passwd")},
+	} {
+		if !check(entries) {
+			t.Fatalf("unexpected extraction of: %v", entries)
+		}
+	}
+	if err := quick.Check(check, &quick.Config{MaxCount: 500}); err != nil {
+		t.Fatalf("unexpected extraction: %v", err)
+	} else if err := quick.Check(checkCorrupted, &quick.Config{MaxCount: 500}); err != nil {
+		t.Fatalf("unexpected extraction of a malformed tarball: %v", err)
+	}
+	for _, tarGzBytes := range [][]byte{nil, []byte("kind: Kustomization\n"), {0x1f, 0x8b}, gzipKuzConfigTar(t, []byte("not a tarball"))} {
+		if !checkTarGz(tarGzBytes) {
+			t.Fatalf("unexpected extraction of: %q", tarGzBytes)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package qliksense
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// kuzLayout is the layout of the manifests in the tarballs of the kustomize builds
+type kuzLayout string
+
+const (
+	// kuzLayoutDefault packs the manifests in manifest.yaml without an index, as the ops runner images expect
+	kuzLayoutDefault kuzLayout = ""
+	// kuzLayoutYaml packs the manifests in manifest.yaml, as multi-document yaml
+	kuzLayoutYaml kuzLayout = "yaml"
+	// kuzLayoutKinds packs each resource in its own file, in a directory per kind
+	kuzLayoutKinds kuzLayout = "kinds"
+	// kuzLayoutList packs the manifests in manifest.json, as a JSON List
+	kuzLayoutList kuzLayout = "list"
+	// kuzLayoutKustomize packs each resource in its own file like kuzLayoutKinds, under a kustomization.yaml listing them
+	kuzLayoutKustomize kuzLayout = "kustomize"
+
+	kuzManifestName          = "manifest.yaml"
+	kuzManifestListName      = "manifest.json"
+	kuzIndexName             = "index.json"
+	kuzKustomizationName     = "kustomization.yaml"
+	kuzKustomizeResourcesDir = "resources"
+)
+
+// errKuzInvalidManifests is wrapped by the errors of the manifests that cannot be laid out, a resource with a name
+// that is not a valid file name or two resources with the same path
+var errKuzInvalidManifests = errors.New("invalid manifests")
+
+// parseKuzLayout returns the layout of a kuz request, the default layout when it has none
+func parseKuzLayout(layout string) (kuzLayout, error) {
+	switch kuzLayout(layout) {
+	case kuzLayoutDefault, kuzLayoutYaml, kuzLayoutKinds, kuzLayoutList, kuzLayoutKustomize:
+		return kuzLayout(layout), nil
+	}
+	return "", fmt.Errorf("unknown layout %q, expected one of %v, %v, %v or %v",
+		layout, kuzLayoutYaml, kuzLayoutKinds, kuzLayoutList, kuzLayoutKustomize)
+}
+
+// kuzTarItem is a file of a tarball
+type kuzTarItem struct {
+	name  string
+	bytes []byte
+}
+
+// kuzIndex lists the resources of a manifests tarball, it is packed in index.json
+type kuzIndex struct {
+	Layout    kuzLayout       `json:"layout"`
+	Resources []kuzIndexEntry `json:"resources"`
+}
+
+// kuzIndexEntry is a resource of a manifests tarball, SHA256 is the hash of its JSON encoding with sorted keys, which
+// does not depend on the layout
+type kuzIndexEntry struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+	Path       string `json:"path"`
+	SHA256     string `json:"sha256"`
+}
+
+// layoutKuzManifests returns the files of the tarball of the manifests in layout, with the index of the resources
+// unless the layout is the default one
+func layoutKuzManifests(layout kuzLayout, manifestBytes []byte) ([]kuzTarItem, error) {
+	if layout == kuzLayoutDefault {
+		return []kuzTarItem{{name: kuzManifestName, bytes: manifestBytes}}, nil
+	}
+	objects, err := decodeKuzManifests(manifestBytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode the manifests: %w", err)
+	}
+
+	var items []kuzTarItem
+	var listItems []interface{}
+	var kustomizeResources []string
+	index := &kuzIndex{Layout: layout, Resources: make([]kuzIndexEntry, 0, len(objects))}
+	paths := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		objectBytes, err := json.Marshal(object.Object)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(objectBytes)
+		entry := kuzIndexEntry{
+			APIVersion: object.GetAPIVersion(),
+			Kind:       object.GetKind(),
+			Namespace:  object.GetNamespace(),
+			Name:       object.GetName(),
+			SHA256:     hex.EncodeToString(sum[:]),
+		}
+		switch layout {
+		case kuzLayoutYaml:
+			entry.Path = kuzManifestName
+		case kuzLayoutList:
+			entry.Path = kuzManifestListName
+			listItems = append(listItems, object.Object)
+		case kuzLayoutKinds, kuzLayoutKustomize:
+			if entry.Path, err = getKuzResourcePath(object); err != nil {
+				return nil, err
+			} else if layout == kuzLayoutKustomize {
+				entry.Path = path.Join(kuzKustomizeResourcesDir, entry.Path)
+				kustomizeResources = append(kustomizeResources, entry.Path)
+			}
+			if paths[entry.Path] {
+				return nil, fmt.Errorf("%w: duplicate resource %v %v %q in namespace %q",
+					errKuzInvalidManifests, entry.APIVersion, entry.Kind, entry.Name, entry.Namespace)
+			}
+			paths[entry.Path] = true
+			objectYamlBytes, err := yaml.JSONToYAML(objectBytes)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, kuzTarItem{name: entry.Path, bytes: objectYamlBytes})
+		}
+		index.Resources = append(index.Resources, entry)
+	}
+
+	switch layout {
+	case kuzLayoutYaml:
+		items = append(items, kuzTarItem{name: kuzManifestName, bytes: manifestBytes})
+	case kuzLayoutList:
+		if listItems == nil {
+			listItems = []interface{}{}
+		}
+		listBytes, err := json.MarshalIndent(map[string]interface{}{"apiVersion": "v1", "kind": "List", "items": listItems}, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, kuzTarItem{name: kuzManifestListName, bytes: listBytes})
+	case kuzLayoutKustomize:
+		// the resources are listed in the order of the manifests
+		kustomizationBytes, err := yaml.Marshal(map[string]interface{}{
+			"apiVersion": "kustomize.config.k8s.io/v1beta1",
+			"kind":       "Kustomization",
+			"resources":  kustomizeResources,
+		})
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, kuzTarItem{name: kuzKustomizationName, bytes: kustomizationBytes})
+	}
+	indexBytes, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(items, kuzTarItem{name: kuzIndexName, bytes: indexBytes}), nil
+}
+
+// getKuzResourcePath returns the path of the file of a resource, in the directory of its kind, version and group, so
+// that the versions of a kind do not collide, prefixed with its namespace which cannot have an underscore. It fails
+// when the name or namespace is not a valid file name.
+func getKuzResourcePath(object *unstructured.Unstructured) (string, error) {
+	gvk := object.GroupVersionKind()
+	dir := strings.ToLower(gvk.Kind) + "." + gvk.Version
+	if gvk.Group != "" {
+		dir += "." + gvk.Group
+	}
+	for _, element := range []string{dir, object.GetNamespace(), object.GetName()} {
+		if element == "." || element == ".." || strings.ContainsAny(element, "/\\") {
+			return "", fmt.Errorf("%w: invalid resource %v %q in namespace %q", errKuzInvalidManifests, gvk.Kind, object.GetName(), object.GetNamespace())
+		}
+	}
+	name := object.GetName()
+	if namespace := object.GetNamespace(); namespace != "" {
+		name = namespace + "_" + name
+	}
+	return path.Join(dir, name+".yaml"), nil
+}
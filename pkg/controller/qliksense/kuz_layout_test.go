@@ -0,0 +1,162 @@
+package qliksense
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_layoutKuzManifests(t *testing.T) {
+	const manifestYaml = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: qlik-config
+  namespace: qlik
+data:
+  level: debug
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: qlik-engine
+spec:
+  replicas: 2
+`
+	configMapJSON := `{"apiVersion":"v1","data":{"level":"debug"},"kind":"ConfigMap","metadata":{"name":"qlik-config","namespace":"qlik"}}`
+	deploymentJSON := `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"qlik-engine"},"spec":{"replicas":2}}`
+	hash := func(objectJSON string) string {
+		sum := sha256.Sum256([]byte(objectJSON))
+		return hex.EncodeToString(sum[:])
+	}
+	index := func(layout kuzLayout, configMapPath, deploymentPath string, moreResources ...kuzIndexEntry) string {
+		indexBytes, err := json.MarshalIndent(&kuzIndex{Layout: layout, Resources: append([]kuzIndexEntry{
+			{APIVersion: "v1", Kind: "ConfigMap", Namespace: "qlik", Name: "qlik-config", Path: configMapPath, SHA256: hash(configMapJSON)},
+			{APIVersion: "apps/v1", Kind: "Deployment", Name: "qlik-engine", Path: deploymentPath, SHA256: hash(deploymentJSON)},
+		}, moreResources...)}, "", "  ")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return string(indexBytes)
+	}
+	deploymentV1beta2JSON := `{"apiVersion":"apps/v1beta2","kind":"Deployment","metadata":{"name":"qlik-engine"}}`
+	configMapYaml := "apiVersion: v1\ndata:\n  level: debug\nkind: ConfigMap\nmetadata:\n  name: qlik-config\n  namespace: qlik\n"
+	deploymentYaml := "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: qlik-engine\nspec:\n  replicas: 2\n"
+
+	testCases := []struct {
+		layout   kuzLayout
+		manifest string
+		expected map[string]string
+	}{
+		{
+			layout:   kuzLayoutDefault,
+			manifest: manifestYaml,
+			expected: map[string]string{"manifest.yaml": manifestYaml},
+		},
+		{
+			layout:   kuzLayoutYaml,
+			manifest: manifestYaml,
+			expected: map[string]string{
+				"manifest.yaml": manifestYaml,
+				"index.json":    index(kuzLayoutYaml, "manifest.yaml", "manifest.yaml"),
+			},
+		},
+		{
+			layout:   kuzLayoutKinds,
+			manifest: manifestYaml,
+			expected: map[string]string{
+				"configmap.v1/qlik_qlik-config.yaml":  configMapYaml,
+				"deployment.v1.apps/qlik-engine.yaml": deploymentYaml,
+				"index.json":                          index(kuzLayoutKinds, "configmap.v1/qlik_qlik-config.yaml", "deployment.v1.apps/qlik-engine.yaml"),
+			},
+		},
+		{
+			layout:   kuzLayoutList,
+			manifest: manifestYaml,
+			expected: map[string]string{
+				"manifest.json": `{"apiVersion":"v1","items":[` + configMapJSON + `,` + deploymentJSON + `],"kind":"List"}`,
+				"index.json":    index(kuzLayoutList, "manifest.json", "manifest.json"),
+			},
+		},
+		{
+			layout:   kuzLayoutKustomize,
+			manifest: manifestYaml,
+			expected: map[string]string{
+				"resources/configmap.v1/qlik_qlik-config.yaml":  configMapYaml,
+				"resources/deployment.v1.apps/qlik-engine.yaml": deploymentYaml,
+				"kustomization.yaml": "apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\nresources:\n" +
+					"- resources/configmap.v1/qlik_qlik-config.yaml\n- resources/deployment.v1.apps/qlik-engine.yaml\n",
+				"index.json": index(kuzLayoutKustomize, "resources/configmap.v1/qlik_qlik-config.yaml", "resources/deployment.v1.apps/qlik-engine.yaml"),
+			},
+		},
+		{
+			layout:   kuzLayoutKinds,
+			manifest: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: ../../passwd\n",
+		},
+		{
+			layout:   kuzLayoutKustomize,
+			manifest: manifestYaml + "---\n" + manifestYaml,
+		},
+		{
+			layout:   kuzLayoutKinds,
+			manifest: manifestYaml + "---\napiVersion: apps/v1beta2\nkind: Deployment\nmetadata:\n  name: qlik-engine\n",
+			expected: map[string]string{
+				"configmap.v1/qlik_qlik-config.yaml":       configMapYaml,
+				"deployment.v1.apps/qlik-engine.yaml":      deploymentYaml,
+				"deployment.v1beta2.apps/qlik-engine.yaml": "apiVersion: apps/v1beta2\nkind: Deployment\nmetadata:\n  name: qlik-engine\n",
+				"index.json": index(kuzLayoutKinds, "configmap.v1/qlik_qlik-config.yaml", "deployment.v1.apps/qlik-engine.yaml", kuzIndexEntry{
+					APIVersion: "apps/v1beta2", Kind: "Deployment", Name: "qlik-engine", Path: "deployment.v1beta2.apps/qlik-engine.yaml", SHA256: hash(deploymentV1beta2JSON),
+				}),
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(string(testCase.layout), func(t *testing.T) {
+			items, err := layoutKuzManifests(testCase.layout, []byte(testCase.manifest))
+			if testCase.expected == nil {
+				if !errors.Is(err, errKuzInvalidManifests) {
+					t.Fatalf("expected an invalid manifests error, but got: %v", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// the JSON files are compared regardless of their indentation
+			compact := func(name, content string) string {
+				if !strings.HasSuffix(name, ".json") {
+					return content
+				}
+				var compacted interface{}
+				if err := json.Unmarshal([]byte(content), &compacted); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				compactedBytes, _ := json.Marshal(compacted)
+				return string(compactedBytes)
+			}
+			files := make(map[string]string, len(items))
+			for _, item := range items {
+				files[item.name] = compact(item.name, string(item.bytes))
+			}
+			expected := make(map[string]string, len(testCase.expected))
+			for name, content := range testCase.expected {
+				expected[name] = compact(name, content)
+			}
+			if !reflect.DeepEqual(files, expected) {
+				t.Fatalf("expected: %v, but got: %v", expected, files)
+			}
+		})
+	}
+}
+
+func Test_parseKuzLayout(t *testing.T) {
+	if layout, err := parseKuzLayout(""); err != nil || layout != kuzLayoutDefault {
+		t.Fatalf("expected the default layout, but got: %v, %v", layout, err)
+	} else if layout, err := parseKuzLayout("kustomize"); err != nil || layout != kuzLayoutKustomize {
+		t.Fatalf("expected the kustomize layout, but got: %v, %v", layout, err)
+	} else if _, err := parseKuzLayout("zip"); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
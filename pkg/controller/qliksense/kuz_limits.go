@@ -0,0 +1,63 @@
+package qliksense
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const (
+	// kuzMaxCRSize bounds the CR of the kustomize build requests, the API server does not store larger objects
+	kuzMaxCRSize = 3 << 20
+	// kuzMaxRequestOverhead bounds the parts of the kustomize build requests other than the CR and the config
+	kuzMaxRequestOverhead = 64 << 10
+)
+
+// kuzLimiter rejects the kustomize build requests beyond the concurrency limit with 429 Too Many Requests, and bounds
+// the size of their bodies
+type kuzLimiter struct {
+	slots       chan struct{}
+	maxBodySize int64
+}
+
+func newKuzLimiter(config KuzLimitsConfig) *kuzLimiter {
+	return &kuzLimiter{
+		slots: make(chan struct{}, config.MaxConcurrentRequests),
+		// the config and the CR are base64 encoded in the JSON requests
+		maxBodySize: int64(base64.StdEncoding.EncodedLen(int(config.MaxCompressedSize.Value()))) +
+			int64(base64.StdEncoding.EncodedLen(kuzMaxCRSize)) + kuzMaxRequestOverhead,
+	}
+}
+
+// wrap passes the requests to next while there are less than the maximum number of concurrent requests, requests are
+// passed through unchanged when there is no limiter
+func (l *kuzLimiter) wrap(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case l.slots <- struct{}{}:
+			defer func() { <-l.slots }()
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many kustomize build requests", http.StatusTooManyRequests)
+			return
+		}
+		r.Body = &kuzLimitedBody{
+			kuzLimitedReader: kuzLimitedReader{
+				r:   r.Body,
+				n:   l.maxBodySize,
+				err: fmt.Errorf("%w: the request body is larger than %v bytes", errKuzRequestTooLarge, l.maxBodySize),
+			},
+			Closer: r.Body,
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type kuzLimitedBody struct {
+	kuzLimitedReader
+	io.Closer
+}
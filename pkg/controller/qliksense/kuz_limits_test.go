@@ -0,0 +1,80 @@
+package qliksense
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func Test_kuzLimiter(t *testing.T) {
+	config := defaultOperatorConfig()
+	config.Kuz.Limits = KuzLimitsConfig{
+		MaxConcurrentRequests: 1,
+		MaxCompressedSize:     resource.MustParse("1Ki"),
+		MaxUncompressedSize:   resource.MustParse("1Ki"),
+		MaxFiles:              10,
+	}
+	setOperatorConfig(config)
+	defer setOperatorConfig(nil)
+
+	limiter := newKuzLimiter(config.Kuz.Limits)
+	started, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(limiter.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+			return
+		}
+		kuzHandler(w, r)
+	})))
+	defer server.Close()
+
+	post := func(path string, config []byte) (int, string) {
+		t.Helper()
+		body, _ := json.Marshal(map[string]string{
+			"cr":     base64.StdEncoding.EncodeToString([]byte("metadata:\n  name: qlik-default\n")),
+			"config": base64.StdEncoding.EncodeToString(config),
+		})
+		response, err := http.Post(server.URL+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer response.Body.Close()
+		responseBytes, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return response.StatusCode, string(responseBytes)
+	}
+
+	// requests beyond the concurrency limit are rejected until a request finishes
+	done := make(chan int)
+	go func() {
+		status, _ := post("/slow", nil)
+		done <- status
+	}()
+	<-started
+	if status, _ := post("/kuz", nil); status != http.StatusTooManyRequests {
+		t.Fatalf("expected the request to be rejected, but got: %v", status)
+	}
+	close(release)
+	if status := <-done; status != http.StatusOK {
+		t.Fatalf("unexpected status: %v", status)
+	}
+
+	// bodies larger than the config limit and unsafe config tarballs are rejected
+	if status, _ := post("/kuz", bytes.Repeat([]byte{0}, 4096)); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected the request to be too large, but got: %v", status)
+	} else if status, message := post("/kuz", gzipKuzConfigTar(t, createKuzConfigTar(t, kuzConfigFile("../passwd", "root")))); status != http.StatusBadRequest {
+		t.Fatalf("expected the config to be rejected, but got: %v", status)
+	} else if !strings.Contains(message, "outside of the config") {
+		t.Fatalf("unexpected message: %v", message)
+	}
+}
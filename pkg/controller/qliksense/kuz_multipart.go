@@ -0,0 +1,132 @@
+package qliksense
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	kuzV2Path = "/v2/kuz"
+
+	kuzCRPartName     = "cr"
+	kuzConfigPartName = "config"
+	// kuzLayoutParameter is the query parameter of the layout of the tarball
+	kuzLayoutParameter = "layout"
+
+	kuzTarGzMediaType = "application/gzip"
+	kuzYamlMediaType  = "application/yaml"
+)
+
+// kuzManifestsMediaTypes maps the accepted media types to the media type of the response
+var kuzManifestsMediaTypes = map[string]string{
+	kuzTarGzMediaType:    kuzTarGzMediaType,
+	"application/x-gzip": kuzTarGzMediaType,
+	kuzYamlMediaType:     kuzYamlMediaType,
+	"application/x-yaml": kuzYamlMediaType,
+	"text/yaml":          kuzYamlMediaType,
+	"application/*":      kuzTarGzMediaType,
+	"*/*":                kuzTarGzMediaType,
+}
+
+// negotiateKuzManifestsMediaType returns the first media type of the Accept header the manifests can be sent as,
+// the tarball when the header is empty
+func negotiateKuzManifestsMediaType(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return kuzTarGzMediaType, true
+	}
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		} else if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			// not acceptable
+			continue
+		} else if responseType, ok := kuzManifestsMediaTypes[mediaType]; ok {
+			return responseType, true
+		}
+	}
+	return "", false
+}
+
+// kuzV2Handler renders a multipart/form-data request with a cr part followed by a config part holding the config
+// tarball, which is streamed to disk. The manifests are sent back as a tarball in the layout of the layout query
+// parameter, or as multi-document yaml, according to the Accept header.
+func kuzV2Handler(w http.ResponseWriter, r *http.Request) {
+	mediaType, ok := negotiateKuzManifestsMediaType(r.Header.Get("Accept"))
+	if !ok {
+		http.Error(w, fmt.Sprintf("the manifests can only be sent as %v or %v", kuzTarGzMediaType, kuzYamlMediaType), http.StatusNotAcceptable)
+		return
+	}
+	layout, err := parseKuzLayout(r.URL.Query().Get(kuzLayoutParameter))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if mediaType == kuzYamlMediaType && layout != kuzLayoutDefault && layout != kuzLayoutYaml {
+		http.Error(w, fmt.Sprintf("the %v layout is only sent as %v", layout, kuzTarGzMediaType), http.StatusBadRequest)
+		return
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "expected a multipart/form-data request", http.StatusBadRequest)
+		return
+	}
+
+	// the cr part comes first, so that the caller is authorized before the config is read
+	crPart, err := reader.NextPart()
+	if err != nil || crPart.FormName() != kuzCRPartName {
+		http.Error(w, fmt.Sprintf("expected the %v part first", kuzCRPartName), http.StatusBadRequest)
+		return
+	}
+	crBytes, err := ioutil.ReadAll(&kuzLimitedReader{
+		r:   crPart,
+		n:   kuzMaxCRSize,
+		err: fmt.Errorf("%w: the %v part is larger than %v bytes", errKuzRequestTooLarge, kuzCRPartName, kuzMaxCRSize),
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading the cr part: %v", err), getKuzErrorStatus(err, http.StatusBadRequest))
+		return
+	} else if status, err := authorizeKuzRequest(r, crBytes); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	configPart, err := reader.NextPart()
+	if err != nil || configPart.FormName() != kuzConfigPartName {
+		http.Error(w, fmt.Sprintf("expected the %v part after the %v part", kuzConfigPartName, kuzCRPartName), http.StatusBadRequest)
+		return
+	}
+	configDir, configDirCleanup, err := stageKuzRequestConfig(configPart)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading the config tarball: %v", err), getKuzErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+	defer configDirCleanup()
+
+	manifestBytes, err := renderKuzConfig(r.Context(), crBytes, configDir)
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	var items []kuzTarItem
+	if mediaType == kuzTarGzMediaType {
+		if items, err = layoutKuzManifests(layout, manifestBytes); err != nil {
+			serverLog.Error(err, "cannot lay out the manifests")
+			writeKuzRenderError(w, fmt.Errorf("cannot lay out the manifests: %w", err))
+			return
+		}
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(http.StatusOK)
+	if mediaType == kuzYamlMediaType {
+		_, err = w.Write(manifestBytes)
+	} else {
+		err = writeTarGz(w, items...)
+	}
+	if err != nil {
+		serverLog.Error(err, "error writing the manifests")
+	}
+}
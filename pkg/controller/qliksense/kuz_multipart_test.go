@@ -0,0 +1,132 @@
+package qliksense
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func Test_negotiateKuzManifestsMediaType(t *testing.T) {
+	testCases := []struct {
+		accept     string
+		expected   string
+		acceptable bool
+	}{
+		{accept: "", expected: kuzTarGzMediaType, acceptable: true},
+		{accept: "application/x-yaml", expected: kuzYamlMediaType, acceptable: true},
+		{accept: "text/html, application/yaml;q=0.9, */*;q=0.1", expected: kuzYamlMediaType, acceptable: true},
+		{accept: "application/yaml;q=0, application/gzip", expected: kuzTarGzMediaType, acceptable: true},
+		{accept: "*/*", expected: kuzTarGzMediaType, acceptable: true},
+		{accept: "text/html", acceptable: false},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.accept, func(t *testing.T) {
+			if mediaType, acceptable := negotiateKuzManifestsMediaType(testCase.accept); acceptable != testCase.acceptable {
+				t.Fatalf("expected acceptable: %v, but got: %v", testCase.acceptable, acceptable)
+			} else if mediaType != testCase.expected {
+				t.Fatalf("expected: %v, but got: %v", testCase.expected, mediaType)
+			}
+		})
+	}
+}
+
+func Test_kuzV2Handler(t *testing.T) {
+	defer func(kustomize func([]byte, string) ([]byte, error)) { kustomizeKuzConfig = kustomize }(kustomizeKuzConfig)
+	kustomizeKuzConfig = func(crBytes []byte, configDir string) ([]byte, error) {
+		kustomizationBytes, err := ioutil.ReadFile(filepath.Join(configDir, "kustomization.yaml"))
+		if err != nil {
+			return nil, err
+		}
+		return append(append(crBytes, "---\n"...), kustomizationBytes...), nil
+	}
+	server := httptest.NewServer(http.HandlerFunc(kuzV2Handler))
+	defer server.Close()
+
+	const crYaml = "kind: Qliksense\n"
+	const kustomizationYaml = "kind: Kustomization\n"
+	configTarZipBytes, err := createTarGz("kustomization.yaml", []byte(kustomizationYaml))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	post := func(accept string, parts ...string) (*http.Response, []byte) {
+		t.Helper()
+		// the request body is streamed
+		bodyReader, bodyWriter := io.Pipe()
+		multipartWriter := multipart.NewWriter(bodyWriter)
+		go func() {
+			for _, part := range parts {
+				content := crYaml
+				if part == kuzConfigPartName {
+					content = string(configTarZipBytes)
+				}
+				if partWriter, err := multipartWriter.CreateFormFile(part, part); err != nil {
+					bodyWriter.CloseWithError(err)
+					return
+				} else if _, err := partWriter.Write([]byte(content)); err != nil {
+					bodyWriter.CloseWithError(err)
+					return
+				}
+			}
+			bodyWriter.CloseWithError(multipartWriter.Close())
+		}()
+		request, err := http.NewRequest(http.MethodPost, server.URL, bodyReader)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		request.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+		request.Header.Set("Accept", accept)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return response, body
+	}
+	expectedManifests := crYaml + "---\n" + kustomizationYaml
+
+	if response, body := post("application/yaml", kuzCRPartName, kuzConfigPartName); response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %v, %v", response.StatusCode, string(body))
+	} else if contentType := response.Header.Get("Content-Type"); contentType != kuzYamlMediaType {
+		t.Fatalf("unexpected content type: %v", contentType)
+	} else if string(body) != expectedManifests {
+		t.Fatalf("unexpected manifests: %v", string(body))
+	}
+
+	response, body := post("", kuzCRPartName, kuzConfigPartName)
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != kuzTarGzMediaType {
+		t.Fatalf("unexpected status: %v, content type: %v", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+	gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	if header, err := tarReader.Next(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if header.Name != "manifest.yaml" {
+		t.Fatalf("unexpected tarball item: %v", header.Name)
+	} else if manifestBytes, err := ioutil.ReadAll(tarReader); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if string(manifestBytes) != expectedManifests {
+		t.Fatalf("unexpected manifests: %v", string(manifestBytes))
+	}
+
+	if response, _ := post("text/html", kuzCRPartName, kuzConfigPartName); response.StatusCode != http.StatusNotAcceptable {
+		t.Fatalf("expected the request not to be acceptable, but got: %v", response.StatusCode)
+	} else if response, _ := post("", kuzConfigPartName, kuzCRPartName); response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected the config part before the cr part to be rejected, but got: %v", response.StatusCode)
+	} else if response, _ := post("", kuzCRPartName); response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected the missing config part to be rejected, but got: %v", response.StatusCode)
+	}
+}
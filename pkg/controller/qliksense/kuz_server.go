@@ -5,62 +5,154 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
-	"time"
 
 	kapis_config "github.com/qlik-oss/k-apis/pkg/config"
+	"github.com/qlik-oss/qliksense-operator/pkg/apis"
 
 	"github.com/gorilla/mux"
-	"github.com/mholt/archiver/v3"
 	"github.com/operator-framework/operator-sdk/pkg/k8sutil"
 	v1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	machine_yaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
 	crclient "sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 )
 
-var (
-	kuzServerHost        = "0.0.0.0"
-	kuzServicePort int32 = 7000
-	kuzPortName          = "kuz-port"
-	serverLog            = logf.Log.WithName("kuz_server")
-)
+var serverLog = logf.Log.WithName("kuz_server")
+
+// kustomizeKuzConfig patches and kustomizes the staged config with the CR, it is replaced in tests
+var kustomizeKuzConfig = patchAndKustomizeConfig
 
-func ConfigureAndStartKuzServer(ctx context.Context, cfg *rest.Config, _ string) (*http.Server, error) {
-	if _, err := createKuzK8sService(ctx, cfg, kuzServicePort); err != nil {
+func ConfigureAndStartKuzServer(ctx context.Context, cfg *rest.Config, namespace string) (*http.Server, error) {
+	kuzConfig := getOperatorConfig().Kuz
+	if _, err := createKuzK8sService(ctx, cfg, kuzConfig.Port, kuzConfig.PortName); err != nil {
 		serverLog.Info("Could not create kustomize k8s Service", "error", err.Error())
 		return nil, err
 	}
-	return startKuzHttpServer(kuzServerHost, kuzServicePort), nil
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, err
+	} else if err := apis.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	client, err := crclient.New(cfg, crclient.Options{Scheme: scheme})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new client: %w", err)
+	}
+	kubeClient, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new kubernetes client: %w", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new dynamic client: %w", err)
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(kubeClient.Discovery()))
+	options := kuzServerOptions{
+		auth:       newKuzAuthenticator(kubeClient, namespace),
+		builds:     newKuzBuilds(kuzConfig.Builds),
+		limiter:    newKuzLimiter(kuzConfig.Limits),
+		diff:       newKuzDiffer(dynamicClient, mapper, namespace),
+		validate:   newKuzValidator(dynamicClient, mapper, namespace),
+		gitWebhook: &gitWebhookHandler{client: client, namespace: namespace},
+	}
+	if kuzConfig.Cache.Enabled {
+		if options.cache, err = newKuzRenderCache(kubeClient, namespace, kuzConfig.Cache); err != nil {
+			return nil, fmt.Errorf("cannot create the kustomize build cache: %w", err)
+		}
+	}
+	if kuzConfig.TLS.Enabled {
+		if options.certificates, err = newKuzCertificates(client, namespace, kuzConfig.TLS); err != nil {
+			return nil, err
+		} else if err := options.certificates.start(ctx, kuzTLSRotationPeriod); err != nil {
+			return nil, fmt.Errorf("cannot generate the kustomize server certificates: %w", err)
+		}
+	}
+	options.builds.start(ctx)
+	return startKuzHttpServer(kuzConfig.Host, kuzConfig.Port, options), nil
+}
+
+// kuzServerOptions are the optional parts of the kustomize server, they are disabled when nil
+type kuzServerOptions struct {
+	// auth only lets authorized callers build
+	auth *kuzAuthenticator
+	// certificates serve https
+	certificates *kuzCertificates
+	// builds serve the asynchronous builds
+	builds *kuzBuilds
+	// cache keeps the rendered manifests
+	cache *kuzRenderCache
+	// limiter bounds the concurrent requests and their size
+	limiter *kuzLimiter
+	// diff serves the diffs of the rendered objects with the live objects
+	diff *kuzDiffer
+	// validate serves the server-side dry-run applies of the rendered objects
+	validate   *kuzValidator
+	gitWebhook http.Handler
 }
 
-func startKuzHttpServer(host string, port int32) *http.Server {
+func startKuzHttpServer(host string, port int32, options kuzServerOptions) *http.Server {
+	auth, certificates, limiter := options.auth, options.certificates, options.limiter
 	r := mux.NewRouter()
+	if options.cache != nil {
+		r.Use(options.cache.wrap)
+	}
 	r.HandleFunc("/health", healthCheckHandler).Methods("GET")
-	r.HandleFunc("/kuz", kuzHandler).Methods("POST")
+	r.Handle("/kuz", limiter.wrap(auth.wrap(http.HandlerFunc(kuzHandler)))).Methods("POST")
+	r.Handle(kuzV2Path, limiter.wrap(auth.wrap(http.HandlerFunc(kuzV2Handler)))).Methods("POST")
+	if options.builds != nil {
+		options.builds.register(r, auth, limiter)
+	}
+	if options.diff != nil {
+		r.Handle(kuzDiffPath, limiter.wrap(auth.wrap(http.HandlerFunc(options.diff.handler)))).Methods("POST")
+	}
+	if options.validate != nil {
+		r.Handle(kuzValidatePath, limiter.wrap(auth.wrap(http.HandlerFunc(options.validate.handler)))).Methods("POST")
+	}
+	if options.gitWebhook != nil {
+		r.Handle(gitWebhookPath, options.gitWebhook).Methods("POST")
+	}
 
+	timeouts := getOperatorConfig().Timeouts
 	srv := &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", host, port),
-		WriteTimeout: time.Second * 60 * 10,
-		ReadTimeout:  time.Second * 60 * 10,
+		WriteTimeout: timeouts.KuzWrite.Duration,
+		ReadTimeout:  timeouts.KuzRead.Duration,
 		Handler:      r, // Pass our instance of gorilla/mux in.
 	}
-	serverLog.Info("starting kustomize HTTP server...")
+	if certificates != nil {
+		srv.TLSConfig = &tls.Config{GetCertificate: certificates.getCertificate, MinVersion: tls.VersionTLS12}
+	}
+	serverLog.Info("starting kustomize HTTP server...", "tls", certificates != nil)
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
+		var err error
+		if certificates != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil {
 			serverLog.Info(fmt.Sprintf("kustomize HTTP server terminated with error: %v", err))
 		}
 	}()
@@ -72,61 +164,132 @@ func healthCheckHandler(w http.ResponseWriter, _ *http.Request) {
 }
 
 func kuzHandler(w http.ResponseWriter, r *http.Request) {
-	if crBytes, configTarZipBytes, err := parseKuzRequest(r); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if crBytes, configTarZipBytes, layout, err := parseKuzRequest(r); err != nil {
+		http.Error(w, err.Error(), getKuzErrorStatus(err, http.StatusBadRequest))
+		return
+	} else if status, err := authorizeKuzRequest(r, crBytes); err != nil {
+		http.Error(w, err.Error(), status)
 		return
-	} else if configDir, configDirCleanup, err := stageKuzRequestConfig(configTarZipBytes); err != nil {
-		http.Error(w, "", http.StatusInternalServerError)
+	} else if manifestTarZipBytes, err := renderKuzRequest(r.Context(), crBytes, configTarZipBytes, layout, nil); err != nil {
+		writeKuzRenderError(w, err)
 		return
 	} else {
-		defer configDirCleanup()
+		writeKuzManifests(w, manifestTarZipBytes)
+	}
+}
 
-		if manifestBytes, err := patchAndKustomizeConfig(crBytes, configDir); err != nil {
-			serverLog.Error(err, "error patching/kustomizing config")
-			http.Error(w, "", http.StatusInternalServerError)
-			return
-		} else if manifestTarZipBytes, err := createTarGz("manifest.yaml", manifestBytes); err != nil {
-			serverLog.Error(err, "error creating a result tarball")
-			http.Error(w, "", http.StatusInternalServerError)
-			return
-		} else {
-			manifestTarZipBase64 := base64.StdEncoding.EncodeToString(manifestTarZipBytes)
-			responseMap := map[string]string{"manifests": manifestTarZipBase64}
-
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			if err := json.NewEncoder(w).Encode(responseMap); err != nil {
-				serverLog.Error(err, "error marshalling result to json")
-			}
-		}
+// writeKuzRenderError responds with the error of a config tarball exceeding the limits or invalid, or of manifests that
+// cannot be laid out, and with an internal server error otherwise
+func writeKuzRenderError(w http.ResponseWriter, err error) {
+	if status := getKuzErrorStatus(err, http.StatusInternalServerError); status != http.StatusInternalServerError {
+		http.Error(w, err.Error(), status)
+	} else {
+		http.Error(w, "", status)
 	}
 }
 
-func createTarGz(itemName string, itemBytes []byte) ([]byte, error) {
-	buffer := &bytes.Buffer{}
+// writeKuzManifests responds with the base64 encoded manifests tarball in a JSON object
+func writeKuzManifests(w http.ResponseWriter, manifestTarZipBytes []byte) {
+	manifestTarZipBase64 := base64.StdEncoding.EncodeToString(manifestTarZipBytes)
+	responseMap := map[string]string{"manifests": manifestTarZipBase64}
 
-	gzipWriter := gzip.NewWriter(buffer)
-	defer gzipWriter.Close()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(responseMap); err != nil {
+		serverLog.Error(err, "error marshalling result to json")
+	}
+}
 
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer tarWriter.Close()
+// renderKuzRequest stages the config, patches and kustomizes it with the CR, and packs the manifests in a tarball in
+// layout. It stops between the steps when ctx is done, and reports the steps to progress when it is not nil.
+func renderKuzRequest(ctx context.Context, crBytes []byte, configTarZipBytes []byte, layout kuzLayout, progress func(string)) ([]byte, error) {
+	if progress == nil {
+		progress = func(string) {}
+	}
+	manifestBytes, err := renderKuzManifests(ctx, crBytes, configTarZipBytes, progress)
+	if err != nil {
+		return nil, err
+	}
 
-	header := &tar.Header{
-		Name: itemName,
-		Mode: 0666,
-		Size: int64(len(itemBytes)),
+	progress("packing the manifests")
+	items, err := layoutKuzManifests(layout, manifestBytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot lay out the manifests: %w", err)
 	}
-	if err := tarWriter.WriteHeader(header); err != nil {
+	buffer := &bytes.Buffer{}
+	if err := writeTarGz(buffer, items...); err != nil {
+		serverLog.Error(err, "error creating a result tarball")
 		return nil, err
-	} else if _, err := tarWriter.Write(itemBytes); err != nil {
+	}
+	return buffer.Bytes(), nil
+}
+
+// renderKuzManifests stages the config, and patches and kustomizes it with the CR
+func renderKuzManifests(ctx context.Context, crBytes []byte, configTarZipBytes []byte, progress func(string)) ([]byte, error) {
+	progress("staging the config")
+	configDir, configDirCleanup, err := stageKuzRequestConfig(bytes.NewReader(configTarZipBytes))
+	if err != nil {
+		return nil, fmt.Errorf("cannot stage the config: %w", err)
+	}
+	defer configDirCleanup()
+	if err := ctx.Err(); err != nil {
 		return nil, err
-	} else if err := tarWriter.Close(); err != nil {
+	}
+
+	progress("patching and kustomizing the config")
+	return renderKuzConfig(ctx, crBytes, configDir)
+}
+
+// renderKuzConfig patches and kustomizes the staged config with the CR, and returns the manifests. They are taken from
+// the cache of the request, if any.
+func renderKuzConfig(ctx context.Context, crBytes []byte, configDir string) ([]byte, error) {
+	render := func() ([]byte, error) {
+		manifestBytes, err := kustomizeKuzConfig(crBytes, configDir)
+		if err != nil {
+			serverLog.Error(err, "error patching/kustomizing config")
+			return nil, fmt.Errorf("cannot patch and kustomize the config: %w", err)
+		}
+		return manifestBytes, nil
+	}
+	var manifestBytes []byte
+	var err error
+	if cacheRequest := getKuzCacheRequest(ctx); cacheRequest != nil {
+		manifestBytes, err = cacheRequest.render(crBytes, configDir, render)
+	} else {
+		manifestBytes, err = render()
+	}
+	if err != nil {
 		return nil, err
-	} else if err := gzipWriter.Close(); err != nil {
+	} else if err := ctx.Err(); err != nil {
 		return nil, err
 	}
+	return manifestBytes, nil
+}
 
-	return buffer.Bytes(), nil
+// writeTarGz writes a tarball of the items to w, the directories of the items are implied
+func writeTarGz(w io.Writer, items ...kuzTarItem) error {
+	gzipWriter := gzip.NewWriter(w)
+	defer gzipWriter.Close()
+
+	tarWriter := tar.NewWriter(gzipWriter)
+	defer tarWriter.Close()
+
+	for _, item := range items {
+		header := &tar.Header{
+			Name: item.name,
+			Mode: 0666,
+			Size: int64(len(item.bytes)),
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		} else if _, err := tarWriter.Write(item.bytes); err != nil {
+			return err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
 }
 
 func patchAndKustomizeConfig(cr []byte, configPath string) ([]byte, error) {
@@ -142,30 +305,37 @@ func patchAndKustomizeConfig(cr []byte, configPath string) ([]byte, error) {
 	}
 }
 
-func parseKuzRequest(r *http.Request) (crBytes []byte, configTarZipBytes []byte, err error) {
+func parseKuzRequest(r *http.Request) (crBytes []byte, configTarZipBytes []byte, layout kuzLayout, err error) {
 	type kuzRequestObjectT struct {
 		Cr     string `json:"cr,omitempty"`
 		Config string `json:"config,omitempty"`
+		Layout string `json:"layout,omitempty"`
 	}
 	var kuzObject kuzRequestObjectT
-	if err := json.NewDecoder(r.Body).Decode(&kuzObject); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&kuzObject); errors.Is(err, errKuzRequestTooLarge) {
+		return nil, nil, "", err
+	} else if err != nil {
 		msg := "error decoding expected SON object from the HTTP request body"
 		serverLog.Error(err, msg)
-		return nil, nil, errors.New(msg)
+		return nil, nil, "", errors.New(msg)
 	} else if crBytes, err := base64.StdEncoding.DecodeString(kuzObject.Cr); err != nil {
 		msg := "error base64 decoding cr"
 		serverLog.Error(err, msg)
-		return nil, nil, errors.New(msg)
+		return nil, nil, "", errors.New(msg)
 	} else if configTarZipBytes, err := base64.StdEncoding.DecodeString(kuzObject.Config); err != nil {
 		msg := "error base64 decoding config"
 		serverLog.Error(err, msg)
-		return nil, nil, errors.New(msg)
+		return nil, nil, "", errors.New(msg)
+	} else if layout, err := parseKuzLayout(kuzObject.Layout); err != nil {
+		return nil, nil, "", err
 	} else {
-		return crBytes, configTarZipBytes, nil
+		return crBytes, configTarZipBytes, layout, nil
 	}
 }
 
-func stageKuzRequestConfig(configTarZipBytes []byte) (configDir string, cleanup func(), err error) {
+// stageKuzRequestConfig unpacks the config tarball read from configTarZip in a temporary directory, within the limits
+// of the operator config
+func stageKuzRequestConfig(configTarZip io.Reader) (configDir string, cleanup func(), err error) {
 	tmpDir, err := ioutil.TempDir("", "test_kuz_server")
 	if err != nil {
 		serverLog.Error(err, "error creating tmp directory")
@@ -177,17 +347,12 @@ func stageKuzRequestConfig(configTarZipBytes []byte) (configDir string, cleanup
 		}
 	}()
 
-	configArchive := filepath.Join(tmpDir, "config.tgz")
 	configDir = filepath.Join(tmpDir, "config")
-
-	if err = ioutil.WriteFile(configArchive, configTarZipBytes, os.ModePerm); err != nil {
-		serverLog.Error(err, "error writing config.tgz to tmp directory")
-		return "", nil, err
-	} else if err = os.MkdirAll(configDir, os.ModePerm); err != nil {
+	if err = os.MkdirAll(configDir, os.ModePerm); err != nil {
 		serverLog.Error(err, "error creating config directory")
 		return "", nil, err
-	} else if err = archiver.NewTarGz().Unarchive(configArchive, configDir); err != nil {
-		serverLog.Error(err, fmt.Sprintf("error uncompressing: %v to %v", configArchive, configDir))
+	} else if err = extractKuzConfig(configTarZip, configDir, newKuzConfigLimits(getOperatorConfig().Kuz.Limits)); err != nil {
+		serverLog.Error(err, fmt.Sprintf("error uncompressing the config to %v", configDir))
 		return "", nil, err
 	}
 
@@ -196,11 +361,11 @@ func stageKuzRequestConfig(configTarZipBytes []byte) (configDir string, cleanup
 	}, nil
 }
 
-func createKuzK8sService(ctx context.Context, cfg *rest.Config, port int32) (*v1.Service, error) {
+func createKuzK8sService(ctx context.Context, cfg *rest.Config, port int32, portName string) (*v1.Service, error) {
 	servicePorts := []v1.ServicePort{
 		{
 			Port:     port,
-			Name:     kuzPortName,
+			Name:     portName,
 			Protocol: v1.ProtocolTCP,
 			TargetPort: intstr.IntOrString{
 				Type:   intstr.Int,
@@ -275,7 +440,7 @@ func initOperatorService(ctx context.Context, client crclient.Client, sp []v1.Se
 
 	service := &v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      fmt.Sprintf("%s-kuztomize", operatorName),
+			Name:      getKuzServiceName(operatorName),
 			Namespace: namespace,
 			Labels:    label,
 		},
@@ -6,8 +6,10 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"sigs.k8s.io/kustomize/api/k8sdeps/kunstruct"
@@ -24,7 +26,7 @@ func Test_startKuzHttpServer_kuzHandler(t *testing.T) {
 		t.SkipNow()
 	}
 
-	srv := startKuzHttpServer("localhost", 8080)
+	srv := startKuzHttpServer("localhost", 8080, kuzServerOptions{})
 	defer srv.Close()
 
 	tmpDir, err := ioutil.TempDir("", "")
@@ -121,7 +123,16 @@ spec:
 	}
 }
 
-func Test_createTarGz(t *testing.T) {
+// createTarGz returns a tarball of a single item, like the config tarballs of the kuz requests
+func createTarGz(itemName string, itemBytes []byte) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	if err := writeTarGz(buffer, kuzTarItem{name: itemName, bytes: itemBytes}); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func Test_writeTarGz(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
@@ -142,3 +153,31 @@ func Test_createTarGz(t *testing.T) {
 		t.Fatalf("expected: %v, but got: %v", "foobar", string(fooBytes))
 	}
 }
+
+func Test_kuzHandler_layoutError(t *testing.T) {
+	defer func(kustomize func([]byte, string) ([]byte, error)) { kustomizeKuzConfig = kustomize }(kustomizeKuzConfig)
+	kustomizeKuzConfig = func(crBytes []byte, configDir string) ([]byte, error) {
+		return []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: qlik-config\n---\n" +
+			"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: qlik-config\n"), nil
+	}
+
+	configTarZipBytes, err := createTarGz("kustomization.yaml", []byte("kind: Kustomization\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, err := json.Marshal(map[string]string{
+		"cr":     base64.StdEncoding.EncodeToString([]byte("metadata:\n  name: qlik-default\n")),
+		"config": base64.StdEncoding.EncodeToString(configTarZipBytes),
+		"layout": string(kuzLayoutKinds),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	kuzHandler(recorder, httptest.NewRequest(http.MethodPost, "/kuz", bytes.NewReader(body)))
+	if recorder.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status: %v, but got: %v", http.StatusUnprocessableEntity, recorder.Code)
+	} else if !strings.Contains(recorder.Body.String(), `duplicate resource v1 ConfigMap "qlik-config"`) {
+		t.Fatalf("expected the duplicate resource in the response, but got: %v", recorder.Body.String())
+	}
+}
@@ -0,0 +1,437 @@
+package qliksense
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/operator-framework/operator-sdk/pkg/k8sutil"
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	crclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	kuzServiceNameSuffix   = "-kuztomize"
+	kuzCASecretNameSuffix  = "-kuztomize-ca"
+	kuzTLSSecretNameSuffix = "-kuztomize-tls"
+	// kuzCABundleNameSuffix is the suffix of the ConfigMap holding the CAs the ops runner pods trust
+	kuzCABundleNameSuffix = "-kuztomize-ca-bundle"
+	kuzCABundleKey        = "ca.crt"
+	kuzCABundleVolumeName = "kuztomize-ca-bundle"
+	kuzCABundleMountPath  = "/etc/qliksense-operator/kuztomize"
+	// kuzTLSRotationPeriod is how often the certificates are checked for rotation
+	kuzTLSRotationPeriod = time.Hour
+)
+
+func getKuzServiceName(operatorName string) string {
+	return operatorName + kuzServiceNameSuffix
+}
+
+// getKuzServiceDNSNames returns the names the kuztomize Service is reached with, and localhost for an operator running locally
+func getKuzServiceDNSNames(operatorName, namespace string) []string {
+	serviceName := getKuzServiceName(operatorName)
+	return []string{
+		serviceName,
+		fmt.Sprintf("%v.%v", serviceName, namespace),
+		fmt.Sprintf("%v.%v.svc", serviceName, namespace),
+		fmt.Sprintf("%v.%v.svc.cluster.local", serviceName, namespace),
+		"localhost",
+	}
+}
+
+// kuzCertificates generates a self-signed CA stored in a Secret, issues the serving certificate of the kuztomize
+// Service with it, and rotates both before they expire. The CAs the serving certificate may be issued by are published
+// in a ConfigMap, mounted in the ops runner pods to verify the server.
+type kuzCertificates struct {
+	client crclient.Client
+	// namespace of the Secrets and of the CA bundle ConfigMap, the namespace of the ops runner pods
+	namespace    string
+	operatorName string
+	dnsNames     []string
+	caValidity   time.Duration
+	certValidity time.Duration
+	now          func() time.Time
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+}
+
+// keyPair is a parsed certificate with its key, and their PEM encoding
+type keyPair struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// getKuzCertificatesNamespace returns the namespace of the certificates and of the CA bundle, the watched namespace, or
+// the namespace of the operator when all namespaces are watched, and the namespace of the kuztomize Service
+func getKuzCertificatesNamespace(namespace string) (string, string, error) {
+	serviceNamespace, err := k8sutil.GetOperatorNamespace()
+	if err == k8sutil.ErrNoNamespace || err == k8sutil.ErrRunLocal {
+		serviceNamespace = namespace
+	} else if err != nil {
+		return "", "", err
+	}
+	if namespace == "" {
+		namespace = serviceNamespace
+	}
+	if namespace == "" {
+		return "", "", errors.New("cannot find the namespace of the kustomize server certificates")
+	}
+	return namespace, serviceNamespace, nil
+}
+
+// newKuzCertificates manages the certificates in the watched namespace, or in the namespace of the operator when
+// all namespaces are watched
+func newKuzCertificates(client crclient.Client, namespace string, config KuzTLSConfig) (*kuzCertificates, error) {
+	operatorName, err := k8sutil.GetOperatorName()
+	if err != nil {
+		return nil, err
+	}
+	namespace, serviceNamespace, err := getKuzCertificatesNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return &kuzCertificates{
+		client:       client,
+		namespace:    namespace,
+		operatorName: operatorName,
+		dnsNames:     getKuzServiceDNSNames(operatorName, serviceNamespace),
+		caValidity:   config.CAValidity.Duration,
+		certValidity: config.CertValidity.Duration,
+		now:          time.Now,
+	}, nil
+}
+
+// getCertificate returns the current serving certificate, it implements tls.Config.GetCertificate
+func (c *kuzCertificates) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.certificate == nil {
+		return nil, errors.New("no kustomize server certificate")
+	}
+	return c.certificate, nil
+}
+
+// start rotates the certificates, so that the server can be started, and keeps rotating them every period until ctx is done
+func (c *kuzCertificates) start(ctx context.Context, period time.Duration) error {
+	if err := c.rotate(ctx); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := c.rotate(ctx); err != nil {
+					serverLog.Error(err, "cannot rotate the kustomize server certificates")
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// rotate renews the CA and the serving certificate when they are missing or two thirds of their validity have elapsed.
+// A renewed CA is published in the CA bundle next to the previous ones, the serving certificate issued by a previous
+// CA is kept until it is renewed, so that the ops runner pods have time to trust the new CA.
+func (c *kuzCertificates) rotate(ctx context.Context) error {
+	now := c.now()
+
+	caSecretName := c.operatorName + kuzCASecretNameSuffix
+	caSecret, err := c.getSecret(ctx, caSecretName)
+	if err != nil {
+		return err
+	}
+	ca, err := parseKeyPairSecret(caSecret)
+	if err != nil || isDueForRenewal(ca.cert, now) {
+		serverLog.Info("Generating the kustomize server CA", "Secret.Name", caSecretName)
+		if ca, err = c.generateKeyPair(now, c.caValidity, nil); err != nil {
+			return err
+		} else if err := c.saveSecret(ctx, caSecret, caSecretName, ca); err != nil {
+			return err
+		}
+	}
+
+	cas, err := c.updateCABundle(ctx, ca.cert, now)
+	if err != nil {
+		return err
+	}
+
+	tlsSecretName := c.operatorName + kuzTLSSecretNameSuffix
+	tlsSecret, err := c.getSecret(ctx, tlsSecretName)
+	if err != nil {
+		return err
+	}
+	serving, err := parseKeyPairSecret(tlsSecret)
+	if err != nil || isDueForRenewal(serving.cert, now) || !isIssuedByOneOf(serving.cert, cas) ||
+		!reflect.DeepEqual(serving.cert.DNSNames, c.dnsNames) {
+		serverLog.Info("Issuing the kustomize server certificate", "Secret.Name", tlsSecretName, "dnsNames", c.dnsNames)
+		if serving, err = c.generateKeyPair(now, c.certValidity, ca); err != nil {
+			return err
+		} else if err := c.saveSecret(ctx, tlsSecret, tlsSecretName, serving); err != nil {
+			return err
+		}
+	}
+
+	certificate, err := tls.X509KeyPair(serving.certPEM, serving.keyPEM)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.certificate = &certificate
+	return nil
+}
+
+// updateCABundle publishes the CA, and the previous CAs that have not expired yet, it returns the published CAs
+func (c *kuzCertificates) updateCABundle(ctx context.Context, ca *x509.Certificate, now time.Time) ([]*x509.Certificate, error) {
+	name := c.operatorName + kuzCABundleNameSuffix
+	configMap := &corev1.ConfigMap{}
+	exists := true
+	if err := c.client.Get(ctx, types.NamespacedName{Name: name, Namespace: c.namespace}, configMap); apierrors.IsNotFound(err) {
+		exists = false
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: c.namespace, Labels: map[string]string{"name": c.operatorName}},
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	cas := []*x509.Certificate{ca}
+	bundle := &bytes.Buffer{}
+	_ = pem.Encode(bundle, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	for _, previous := range parseCertificates([]byte(configMap.Data[kuzCABundleKey])) {
+		if previous.Equal(ca) || now.After(previous.NotAfter) {
+			continue
+		}
+		cas = append(cas, previous)
+		_ = pem.Encode(bundle, &pem.Block{Type: "CERTIFICATE", Bytes: previous.Raw})
+	}
+	if exists && configMap.Data[kuzCABundleKey] == bundle.String() {
+		return cas, nil
+	}
+
+	serverLog.Info("Publishing the kustomize server CA bundle", "ConfigMap.Name", name, "cas", len(cas))
+	configMap.Data = map[string]string{kuzCABundleKey: bundle.String()}
+	if !exists {
+		return cas, c.client.Create(ctx, configMap)
+	}
+	return cas, c.client.Update(ctx, configMap)
+}
+
+// getSecret returns the Secret, or nil when it does not exist
+func (c *kuzCertificates) getSecret(ctx context.Context, name string) (*corev1.Secret, error) {
+	secret := &corev1.Secret{}
+	if err := c.client.Get(ctx, types.NamespacedName{Name: name, Namespace: c.namespace}, secret); apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// saveSecret stores the key pair in the current Secret, or in a new Secret when current is nil
+func (c *kuzCertificates) saveSecret(ctx context.Context, current *corev1.Secret, name string, pair *keyPair) error {
+	data := map[string][]byte{corev1.TLSCertKey: pair.certPEM, corev1.TLSPrivateKeyKey: pair.keyPEM}
+	if current == nil {
+		return c.client.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: c.namespace, Labels: map[string]string{"name": c.operatorName}},
+			Type:       corev1.SecretTypeTLS,
+			Data:       data,
+		})
+	}
+	current.Data = data
+	return c.client.Update(ctx, current)
+}
+
+// generateKeyPair generates a CA when issuer is nil, or a serving certificate for the DNS names of the Service issued
+// by issuer, it expires with its issuer at the latest
+func (c *kuzCertificates) generateKeyPair(now time.Time, validity time.Duration, issuer *keyPair) (*keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(validity),
+	}
+	parent, parentKey := template, key
+	if issuer == nil {
+		template.Subject = pkix.Name{CommonName: c.operatorName + kuzCASecretNameSuffix}
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	} else {
+		template.Subject = pkix.Name{CommonName: getKuzServiceName(c.operatorName)}
+		template.DNSNames = c.dnsNames
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+		template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		if template.NotAfter.After(issuer.cert.NotAfter) {
+			template.NotAfter = issuer.cert.NotAfter
+		}
+		parent, parentKey = issuer.cert, issuer.key
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	)
+}
+
+func parseKeyPairSecret(secret *corev1.Secret) (*keyPair, error) {
+	if secret == nil {
+		return nil, errors.New("missing Secret")
+	}
+	return parseKeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+}
+
+func parseKeyPair(certPEM, keyPEM []byte) (*keyPair, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, errors.New("no PEM encoded certificate")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, errors.New("no PEM encoded key")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair{cert: cert, key: key, certPEM: certPEM, keyPEM: keyPEM}, nil
+}
+
+// parseCertificates returns the certificates of a PEM bundle, skipping the ones that cannot be parsed
+func parseCertificates(bundle []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, bundle = pem.Decode(bundle); block == nil {
+			return certs
+		} else if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+// isDueForRenewal tells whether two thirds of the validity of the certificate have elapsed
+func isDueForRenewal(cert *x509.Certificate, now time.Time) bool {
+	validity := cert.NotAfter.Sub(cert.NotBefore)
+	return !now.Before(cert.NotBefore.Add(validity * 2 / 3))
+}
+
+func isIssuedByOneOf(cert *x509.Certificate, cas []*x509.Certificate) bool {
+	for _, ca := range cas {
+		if cert.CheckSignatureFrom(ca) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// publishKuzCABundle copies the CA bundle to the namespace of the CR, when it is not the namespace of the certificates,
+// so that the ops runner pods of the CR can mount it. The copy is shared by the CRs of the namespace.
+func (r *ReconcileQliksense) publishKuzCABundle(reqLogger logr.Logger, m *qlikv1.Qliksense) error {
+	if !getOperatorConfig().Kuz.TLS.Enabled || r.kuzCABundleNamespace == "" || m.Namespace == r.kuzCABundleNamespace {
+		return nil
+	}
+	operatorName, err := k8sutil.GetOperatorName()
+	if err != nil {
+		return err
+	}
+	name := operatorName + kuzCABundleNameSuffix
+	bundle := &corev1.ConfigMap{}
+	if err := r.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: r.kuzCABundleNamespace}, bundle); apierrors.IsNotFound(err) {
+		// the copy is published when the kustomize server publishes the bundle
+		reqLogger.Info("The kustomize server CA bundle is not published yet", "ConfigMap.Name", name)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: m.Namespace}}
+	result, err := controllerutil.CreateOrUpdate(context.TODO(), r.client, configMap, func() error {
+		labels := configMap.GetLabels()
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels["name"] = operatorName
+		configMap.SetLabels(labels)
+		configMap.Data = map[string]string{kuzCABundleKey: bundle.Data[kuzCABundleKey]}
+		return nil
+	})
+	if err != nil {
+		return err
+	} else if result != controllerutil.OperationResultNone {
+		reqLogger.Info("Published the kustomize server CA bundle", "ConfigMap.Name", name, "result", result)
+	}
+	return nil
+}
+
+// getKuzCABundleEventHandler requeues the Qliksense CRs of the other namespaces when the CA bundle changes, so that
+// their copies of the bundle are updated
+func getKuzCABundleEventHandler(c crclient.Client, namespace string) handler.EventHandler {
+	return &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(a handler.MapObject) []reconcile.Request {
+			operatorName, err := k8sutil.GetOperatorName()
+			if err != nil || a.Meta.GetNamespace() != namespace || a.Meta.GetName() != operatorName+kuzCABundleNameSuffix {
+				return nil
+			}
+			qliksenseList := &qlikv1.QliksenseList{}
+			if err := c.List(context.TODO(), qliksenseList); err != nil {
+				log.Error(err, "cannot list the Qliksense CRs to publish the kustomize server CA bundle to")
+				return nil
+			}
+			var requests []reconcile.Request
+			for _, m := range qliksenseList.Items {
+				if m.Namespace != namespace {
+					requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: m.Name, Namespace: m.Namespace}})
+				}
+			}
+			return requests
+		}),
+	}
+}
@@ -0,0 +1,263 @@
+package qliksense
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/qlik-oss/qliksense-operator/pkg/apis"
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+)
+
+func newTestKuzCertificates(now *time.Time) *kuzCertificates {
+	return &kuzCertificates{
+		client:       fake.NewFakeClientWithScheme(clientgoscheme.Scheme),
+		namespace:    "qlik",
+		operatorName: "qliksense-operator",
+		dnsNames:     getKuzServiceDNSNames("qliksense-operator", "qlik"),
+		caValidity:   90 * 24 * time.Hour,
+		certValidity: 30 * 24 * time.Hour,
+		now:          func() time.Time { return *now },
+	}
+}
+
+func Test_kuzCertificates_rotate(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	c := newTestKuzCertificates(&now)
+
+	getSerialNumbers := func() (ca string, serving string) {
+		t.Helper()
+		for name, serialNumber := range map[string]*string{"qliksense-operator-kuztomize-ca": &ca, "qliksense-operator-kuztomize-tls": &serving} {
+			secret := &corev1.Secret{}
+			if err := c.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: c.namespace}, secret); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if pair, err := parseKeyPairSecret(secret); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else {
+				*serialNumber = pair.cert.SerialNumber.String()
+			}
+		}
+		return ca, serving
+	}
+	getCABundle := func() []*x509.Certificate {
+		t.Helper()
+		configMap := &corev1.ConfigMap{}
+		if err := c.client.Get(context.TODO(), types.NamespacedName{Name: "qliksense-operator-kuztomize-ca-bundle", Namespace: c.namespace}, configMap); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return parseCertificates([]byte(configMap.Data[kuzCABundleKey]))
+	}
+	verify := func() {
+		t.Helper()
+		roots := x509.NewCertPool()
+		for _, ca := range getCABundle() {
+			roots.AddCert(ca)
+		}
+		certificate, err := c.getCertificate(nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "qliksense-operator-kuztomize.qlik.svc", Roots: roots, CurrentTime: now}); err != nil {
+			t.Fatalf("expected the serving certificate to be verified with the CA bundle, but got: %v", err)
+		}
+	}
+
+	if _, err := c.getCertificate(nil); err == nil {
+		t.Fatal("expected no certificate before the first rotation")
+	}
+	if err := c.rotate(context.TODO()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	verify()
+	ca, serving := getSerialNumbers()
+
+	// the certificates are kept until they are due for renewal, e.g. when the operator restarts
+	now = now.Add(19 * 24 * time.Hour)
+	if err := newTestKuzCertificates(&now).rotate(context.TODO()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if newCA, newServing := getSerialNumbers(); newCA != ca || newServing != serving {
+		t.Fatal("expected the certificates to be kept")
+	}
+
+	// the serving certificate is renewed after two thirds of its validity
+	now = now.Add(22 * 24 * time.Hour)
+	if err := c.rotate(context.TODO()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	verify()
+	if newCA, newServing := getSerialNumbers(); newCA != ca || newServing == serving {
+		t.Fatal("expected only the serving certificate to be renewed")
+	} else {
+		serving = newServing
+	}
+
+	// the renewed CA is published next to the previous one, and the serving certificate it issued is kept until it is renewed
+	now = now.Add(19*24*time.Hour + 12*time.Hour)
+	if err := c.rotate(context.TODO()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	verify()
+	if newCA, newServing := getSerialNumbers(); newCA == ca || newServing != serving {
+		t.Fatal("expected only the CA to be renewed")
+	} else if bundle := getCABundle(); len(bundle) != 2 || bundle[1].SerialNumber.String() != ca {
+		t.Fatalf("expected the new and the previous CA in the bundle, but got %v CAs", len(bundle))
+	}
+
+	// the previous CA is removed from the bundle once it expired, the serving certificate it issued is renewed
+	now = now.Add(30*24*time.Hour + 12*time.Hour)
+	if err := c.rotate(context.TODO()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	verify()
+	if bundle := getCABundle(); len(bundle) != 1 {
+		t.Fatalf("expected the expired CA to be removed from the bundle, but got %v CAs", len(bundle))
+	} else if _, newServing := getSerialNumbers(); newServing == serving {
+		t.Fatal("expected the serving certificate issued by the expired CA to be renewed")
+	}
+}
+
+func Test_kuzCertificates_serve(t *testing.T) {
+	now := time.Now()
+	c := newTestKuzCertificates(&now)
+	if err := c.rotate(context.TODO()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(healthCheckHandler))
+	server.TLS = &tls.Config{GetCertificate: c.getCertificate}
+	server.StartTLS()
+	defer server.Close()
+
+	configMap := &corev1.ConfigMap{}
+	if err := c.client.Get(context.TODO(), types.NamespacedName{Name: "qliksense-operator-kuztomize-ca-bundle", Namespace: c.namespace}, configMap); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(configMap.Data[kuzCABundleKey])) {
+		t.Fatal("expected the CA bundle to hold certificates")
+	}
+	// the ops runner reaches the server with the name of the Service
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "qliksense-operator-kuztomize.qlik.svc"}}}
+	if response, err := client.Get(server.URL); err != nil {
+		t.Fatalf("expected the server to be verified with the CA bundle, but got: %v", err)
+	} else if response.Body.Close(); response.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status: %v", response.StatusCode)
+	}
+
+	untrusted := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{ServerName: "qliksense-operator-kuztomize.qlik.svc"}}}
+	if _, err := untrusted.Get(server.URL); err == nil {
+		t.Fatal("expected the server not to be verified without the CA bundle")
+	}
+}
+
+func Test_updateJobPodSpec_kuzTLS(t *testing.T) {
+	// TLS is disabled by default
+	config := defaultOperatorConfig()
+	config.Kuz.TLS.Enabled = true
+	setOperatorConfig(config)
+	defer setOperatorConfig(nil)
+
+	m := &qlikv1.Qliksense{
+		ObjectMeta: metav1.ObjectMeta{Name: "qlik-default", Namespace: "qlik"},
+		Spec:       &qlikv1.QliksenseSpec{OpsRunner: &qlikv1.OpsRunnerSpec{}},
+	}
+	r := &ReconcileQliksense{}
+	getEnv := func(podSpec *corev1.PodSpec) map[string]string {
+		env := make(map[string]string)
+		for _, envVar := range podSpec.Containers[0].Env {
+			env[envVar.Name] = envVar.Value
+		}
+		return env
+	}
+
+	podSpec := &corev1.PodSpec{}
+	if err := r.updateJobPodSpec(podSpec, log, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	env := getEnv(podSpec)
+	if env["OPERATOR_SERVICE_SCHEME"] != "https" || env["OPERATOR_SERVICE_CA_FILE"] != path.Join(kuzCABundleMountPath, kuzCABundleKey) {
+		t.Fatalf("expected the ops runner to verify the server with the CA bundle, but got: %v", env)
+	} else if len(podSpec.Volumes) != 1 || podSpec.Volumes[0].ConfigMap == nil || podSpec.Volumes[0].ConfigMap.Name != "qliksense-operator-kuztomize-ca-bundle" {
+		t.Fatalf("expected the CA bundle volume, but got: %v", podSpec.Volumes)
+	} else if mounts := podSpec.Containers[0].VolumeMounts; len(mounts) != 1 || mounts[0].MountPath != kuzCABundleMountPath {
+		t.Fatalf("expected the CA bundle to be mounted, but got: %v", mounts)
+	}
+
+	config.Kuz.TLS.Enabled = false
+	setOperatorConfig(config)
+	podSpec = &corev1.PodSpec{}
+	if err := r.updateJobPodSpec(podSpec, log, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if env := getEnv(podSpec); env["OPERATOR_SERVICE_SCHEME"] != "http" || len(podSpec.Volumes) != 0 {
+		t.Fatalf("expected the ops runner to reach the server over http, but got: %v, volumes: %v", env, podSpec.Volumes)
+	}
+}
+
+func Test_publishKuzCABundle(t *testing.T) {
+	config := defaultOperatorConfig()
+	config.Kuz.TLS.Enabled = true
+	setOperatorConfig(config)
+	defer setOperatorConfig(nil)
+
+	bundle := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "qliksense-operator-kuztomize-ca-bundle", Namespace: "qlik"},
+		Data:       map[string]string{kuzCABundleKey: "first"},
+	}
+	m := &qlikv1.Qliksense{ObjectMeta: metav1.ObjectMeta{Name: "qlik-default", Namespace: "other"}}
+	r := &ReconcileQliksense{client: fake.NewFakeClientWithScheme(clientgoscheme.Scheme, bundle), kuzCABundleNamespace: "qlik"}
+	getCopy := func() *corev1.ConfigMap {
+		t.Helper()
+		configMap := &corev1.ConfigMap{}
+		if err := r.client.Get(context.TODO(), types.NamespacedName{Name: bundle.Name, Namespace: m.Namespace}, configMap); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return configMap
+	}
+
+	if err := r.publishKuzCABundle(log, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if configMap := getCopy(); configMap.Data[kuzCABundleKey] != "first" {
+		t.Fatalf("expected the bundle to be copied to the namespace of the CR, but got: %v", configMap.Data)
+	}
+
+	// a renewed CA is copied again
+	bundle.Data[kuzCABundleKey] = "second"
+	if err := r.client.Update(context.TODO(), bundle); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := r.publishKuzCABundle(log, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if configMap := getCopy(); configMap.Data[kuzCABundleKey] != "second" {
+		t.Fatalf("expected the copy of the bundle to be updated, but got: %v", configMap.Data)
+	}
+
+	// the CRs of the other namespaces are requeued when the bundle changes
+	other := &qlikv1.Qliksense{ObjectMeta: metav1.ObjectMeta{Name: "qlik-other", Namespace: "qlik"}}
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := apis.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	eventHandler := getKuzCABundleEventHandler(fake.NewFakeClientWithScheme(scheme, m, other), "qlik").(*handler.EnqueueRequestsFromMapFunc)
+	if requests := eventHandler.ToRequests.Map(handler.MapObject{Meta: bundle, Object: bundle}); len(requests) != 1 ||
+		requests[0].NamespacedName != (types.NamespacedName{Name: m.Name, Namespace: m.Namespace}) {
+		t.Fatalf("expected the CR of the other namespace to be requeued, but got: %v", requests)
+	} else if requests := eventHandler.ToRequests.Map(handler.MapObject{Meta: getCopy(), Object: getCopy()}); len(requests) != 0 {
+		t.Fatalf("expected the copies of the bundle not to requeue the CRs, but got: %v", requests)
+	}
+}
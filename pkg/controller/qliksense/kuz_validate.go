@@ -0,0 +1,155 @@
+package qliksense
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	kuzValidatePath = "/kuz/validate"
+
+	// kuzFieldManager is the field manager of the dry-run applies, the applied fields are not stored
+	kuzFieldManager = "qliksense-operator-kuz"
+)
+
+type kuzObjectValidationStatus string
+
+const (
+	// kuzObjectAccepted objects would be applied
+	kuzObjectAccepted kuzObjectValidationStatus = "Accepted"
+	// kuzObjectInvalid objects do not match the schema of their type
+	kuzObjectInvalid kuzObjectValidationStatus = "Invalid"
+	// kuzObjectDenied objects are denied by an admission webhook
+	kuzObjectDenied kuzObjectValidationStatus = "Denied"
+	// kuzObjectRejected objects are rejected for other reasons, or could not be validated
+	kuzObjectRejected kuzObjectValidationStatus = "Rejected"
+)
+
+// kuzValidateResponse is the validation of the rendered objects, in the order of the manifests
+type kuzValidateResponse struct {
+	// Valid tells whether all the objects are accepted
+	Valid   bool                  `json:"valid"`
+	Objects []kuzObjectValidation `json:"objects"`
+}
+
+type kuzObjectValidation struct {
+	APIVersion string                    `json:"apiVersion"`
+	Kind       string                    `json:"kind"`
+	Namespace  string                    `json:"namespace,omitempty"`
+	Name       string                    `json:"name"`
+	Status     kuzObjectValidationStatus `json:"status"`
+	// Webhook is the name of the admission webhook denying the object
+	Webhook string `json:"webhook,omitempty"`
+	// Causes are the invalid fields reported by the API server
+	Causes []kuzValidationCause `json:"causes,omitempty"`
+	Error  string               `json:"error,omitempty"`
+}
+
+type kuzValidationCause struct {
+	Type    string `json:"type,omitempty"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// kuzValidator validates the manifests rendered for the CR and config of POST /kuz/validate with server-side dry-run
+// applies of their objects
+type kuzValidator struct {
+	client dynamic.Interface
+	mapper meta.RESTMapper
+	// namespace of the CRs that do not set one, the namespace watched by the operator
+	namespace string
+}
+
+func newKuzValidator(client dynamic.Interface, mapper meta.RESTMapper, namespace string) *kuzValidator {
+	return &kuzValidator{client: client, mapper: mapper, namespace: namespace}
+}
+
+// handler responds with the validation of the objects, the objects the caller cannot apply are not validated
+func (v *kuzValidator) handler(w http.ResponseWriter, r *http.Request) {
+	objects, namespace, ok := renderKuzObjects(w, r, v.namespace)
+	if !ok {
+		return
+	}
+
+	caller := getKuzCaller(r)
+	response := &kuzValidateResponse{Valid: true, Objects: make([]kuzObjectValidation, 0, len(objects))}
+	for _, object := range objects {
+		validation := v.validate(caller, namespace, object)
+		response.Valid = response.Valid && validation.Status == kuzObjectAccepted
+		response.Objects = append(response.Objects, validation)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		serverLog.Error(err, "error marshalling result to json")
+	}
+}
+
+// validate applies the rendered object with a server-side dry-run, in namespace when it is namespaced and has none.
+// The caller must be allowed to both create and patch the object: the object is not looked up with the permissions of
+// the operator, so that the denials do not tell whether it exists.
+func (v *kuzValidator) validate(caller *kuzCaller, namespace string, object *unstructured.Unstructured) kuzObjectValidation {
+	mapping, err := mapKuzObject(v.mapper, namespace, object)
+	if err != nil {
+		return newKuzObjectValidationError(object, err)
+	} else if err := authorizeKuzObjectVerbs(caller, "apply", []string{"create", "patch"}, mapping, object); err != nil {
+		return newKuzObjectValidationError(object, err)
+	}
+	objectBytes, err := json.Marshal(object)
+	if err != nil {
+		return newKuzObjectValidationError(object, err)
+	}
+	force := true
+	_, err = v.client.Resource(mapping.Resource).Namespace(object.GetNamespace()).Patch(object.GetName(), types.ApplyPatchType, objectBytes, metav1.PatchOptions{
+		DryRun:       []string{metav1.DryRunAll},
+		Force:        &force,
+		FieldManager: kuzFieldManager,
+	})
+	if err != nil {
+		return newKuzObjectValidationError(object, err)
+	}
+	return newKuzObjectValidation(object, kuzObjectAccepted)
+}
+
+func newKuzObjectValidation(object *unstructured.Unstructured, status kuzObjectValidationStatus) kuzObjectValidation {
+	return kuzObjectValidation{
+		APIVersion: object.GetAPIVersion(),
+		Kind:       object.GetKind(),
+		Namespace:  object.GetNamespace(),
+		Name:       object.GetName(),
+		Status:     status,
+	}
+}
+
+var kuzWebhookDenial = regexp.MustCompile(`admission webhook "([^"]+)" denied the request`)
+
+// newKuzObjectValidationError returns the validation of an object rejected with err, which tells the admission webhook
+// denying the object, or the invalid fields, when the API server reports them
+func newKuzObjectValidationError(object *unstructured.Unstructured, err error) kuzObjectValidation {
+	validation := newKuzObjectValidation(object, kuzObjectRejected)
+	validation.Error = err.Error()
+	statusErr, ok := err.(errors.APIStatus)
+	if !ok {
+		return validation
+	}
+	status := statusErr.Status()
+	if match := kuzWebhookDenial.FindStringSubmatch(status.Message); match != nil {
+		validation.Status, validation.Webhook = kuzObjectDenied, match[1]
+	} else if status.Reason == metav1.StatusReasonInvalid || status.Reason == metav1.StatusReasonBadRequest {
+		validation.Status = kuzObjectInvalid
+	}
+	if status.Details != nil {
+		for _, cause := range status.Details.Causes {
+			validation.Causes = append(validation.Causes, kuzValidationCause{Type: string(cause.Type), Field: cause.Field, Message: cause.Message})
+		}
+	}
+	return validation
+}
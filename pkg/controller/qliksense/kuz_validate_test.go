@@ -0,0 +1,185 @@
+package qliksense
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_kuzValidator(t *testing.T) {
+	defer func(kustomize func([]byte, string) ([]byte, error)) { kustomizeKuzConfig = kustomize }(kustomizeKuzConfig)
+	kustomizeKuzConfig = func(crBytes []byte, configDir string) ([]byte, error) {
+		return []byte(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: qlik-config
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: qlik-engine
+spec:
+  replicas: -1
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: qlik-engine
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: qlik-secret
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: qlik
+---
+apiVersion: qlik.com/v1
+kind: Engine
+metadata:
+  name: qlik-engine
+`), nil
+	}
+
+	mapper := meta.NewDefaultRESTMapper(nil)
+	for _, gvk := range []schema.GroupVersionKind{
+		{Version: "v1", Kind: "ConfigMap"},
+		{Version: "v1", Kind: "Secret"},
+		{Version: "v1", Kind: "Service"},
+		{Group: "apps", Version: "v1", Kind: "Deployment"},
+	} {
+		mapper.Add(gvk, meta.RESTScopeNamespace)
+	}
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+
+	// the Secret exists, the denial must not tell it
+	secret := &unstructured.Unstructured{}
+	secret.SetAPIVersion("v1")
+	secret.SetKind("Secret")
+	secret.SetNamespace("qlik")
+	secret.SetName("qlik-secret")
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), secret)
+	dynamicClient.PrependReactor("get", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("unexpected lookup of a live object")
+	})
+	dynamicClient.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patchAction := action.(k8stesting.PatchAction)
+		if patchAction.GetPatchType() != types.ApplyPatchType {
+			return true, nil, errors.New("unexpected patch type")
+		} else if patchAction.GetNamespace() != "qlik" && patchAction.GetResource().Resource != "namespaces" {
+			return true, nil, errors.New("unexpected namespace")
+		}
+		object := &unstructured.Unstructured{}
+		if err := json.Unmarshal(patchAction.GetPatch(), &object.Object); err != nil {
+			return true, nil, err
+		}
+		switch object.GetKind() {
+		case "Deployment":
+			return true, nil, apierrors.NewInvalid(schema.GroupKind{Group: "apps", Kind: "Deployment"}, object.GetName(), field.ErrorList{
+				field.Invalid(field.NewPath("spec", "replicas"), -1, "must be greater than or equal to 0"),
+			})
+		case "Service":
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "services"}, object.GetName(),
+				errors.New(`admission webhook "policy.qlik.com" denied the request: services must have a port`))
+		}
+		return true, object, nil
+	})
+
+	verbs := make(map[string][]string)
+	kubeClient := kubefake.NewSimpleClientset()
+	kubeClient.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview).DeepCopy()
+		if review.Spec.ResourceAttributes.Subresource == "" {
+			verbs[review.Spec.ResourceAttributes.Resource] = append(verbs[review.Spec.ResourceAttributes.Resource], review.Spec.ResourceAttributes.Verb)
+		}
+		review.Status.Allowed = review.Spec.ResourceAttributes.Resource != "secrets"
+		return true, review, nil
+	})
+	caller := &kuzCaller{auth: newKuzAuthenticator(kubeClient, "qlik"), user: authenticationv1.UserInfo{Username: "alice"}}
+	validator := newKuzValidator(dynamicClient, mapper, "qlik")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		validator.handler(w, r.WithContext(context.WithValue(r.Context(), kuzCallerKey{}, caller)))
+	}))
+	defer server.Close()
+
+	configTarZipBytes, err := createTarGz("kustomization.yaml", []byte("kind: Kustomization\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, err := json.Marshal(map[string]string{
+		"cr":     base64.StdEncoding.EncodeToString([]byte("metadata:\n  name: qlik-default\n")),
+		"config": base64.StdEncoding.EncodeToString(configTarZipBytes),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	response, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer response.Body.Close()
+	responseBytes, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %v, %v", response.StatusCode, string(responseBytes))
+	}
+	var validateResponse kuzValidateResponse
+	if err := json.Unmarshal(responseBytes, &validateResponse); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if validateResponse.Valid {
+		t.Fatalf("expected the objects to be invalid")
+	}
+
+	expected := []kuzObjectValidation{
+		{APIVersion: "v1", Kind: "ConfigMap", Namespace: "qlik", Name: "qlik-config", Status: kuzObjectAccepted},
+		{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "qlik", Name: "qlik-engine", Status: kuzObjectInvalid,
+			Causes: []kuzValidationCause{{Type: string(metav1.CauseTypeFieldValueInvalid), Field: "spec.replicas", Message: "Invalid value: -1: must be greater than or equal to 0"}},
+			Error:  `Deployment.apps "qlik-engine" is invalid: spec.replicas: Invalid value: -1: must be greater than or equal to 0`},
+		{APIVersion: "v1", Kind: "Service", Namespace: "qlik", Name: "qlik-engine", Status: kuzObjectDenied, Webhook: "policy.qlik.com",
+			Error: `services "qlik-engine" is forbidden: admission webhook "policy.qlik.com" denied the request: services must have a port`},
+		{APIVersion: "v1", Kind: "Secret", Namespace: "qlik", Name: "qlik-secret", Status: kuzObjectRejected,
+			Error: `user "alice" cannot apply secrets "qlik-secret" in namespace "qlik"`},
+		{APIVersion: "v1", Kind: "Namespace", Name: "qlik", Status: kuzObjectAccepted},
+		{APIVersion: "qlik.com/v1", Kind: "Engine", Name: "qlik-engine", Status: kuzObjectRejected,
+			Error: `no matches for kind "Engine" in version "qlik.com/v1"`},
+	}
+	if !reflect.DeepEqual(validateResponse.Objects, expected) {
+		t.Fatalf("expected: %#v, but got: %#v", expected, validateResponse.Objects)
+	}
+	// the reviews of the Secret stop at the denial of create
+	expectedVerbs := map[string][]string{
+		"configmaps":  {"create", "patch"},
+		"deployments": {"create", "patch"},
+		"services":    {"create", "patch"},
+		"secrets":     {"create"},
+		"namespaces":  {"create", "patch"},
+	}
+	if !reflect.DeepEqual(verbs, expectedVerbs) {
+		t.Fatalf("expected the verbs: %v, but got: %v", expectedVerbs, verbs)
+	}
+}
@@ -0,0 +1,489 @@
+package qliksense
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	operatorConfigAPIVersion = "qlik.com/v1alpha1"
+	operatorConfigKind       = "OperatorConfig"
+)
+
+var (
+	operatorConfigPath string
+	operatorFlags      = newOperatorConfigFlags()
+
+	operatorConfigMu sync.RWMutex
+	operatorConfig   *OperatorConfig
+)
+
+// OperatorConfig is the versioned configuration of the operator, read from a yaml file usually mounted from a ConfigMap.
+// Fields that are not set keep their defaults, flags set on the command line override the file.
+type OperatorConfig struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	Kuz       KuzServerConfig `json:"kuz"`
+	Metrics   MetricsConfig   `json:"metrics"`
+	OpsRunner OpsRunnerConfig `json:"opsRunner"`
+	Timeouts  TimeoutsConfig  `json:"timeouts"`
+	// CustomResources declares the custom resource types managed by the operator, the --custom-resources-config
+	// flag takes precedence over it
+	CustomResources *CustomResourcesConfig `json:"customResources,omitempty"`
+	Features        FeaturesConfig         `json:"features"`
+	// ReloadPeriod is how often the file is checked for changes, 0 disables the reload
+	ReloadPeriod metav1.Duration `json:"reloadPeriod"`
+}
+
+// KuzServerConfig is the kustomize build server the ops runner sends the CR to
+type KuzServerConfig struct {
+	Host     string `json:"host"`
+	Port     int32  `json:"port"`
+	PortName string `json:"portName"`
+	// TLS serves the kustomize builds over https, with a serving certificate issued by a CA generated by the operator
+	TLS KuzTLSConfig `json:"tls"`
+	// Builds runs the asynchronous kustomize builds
+	Builds KuzBuildsConfig `json:"builds"`
+	// Cache keeps the rendered manifests on disk
+	Cache KuzCacheConfig `json:"cache"`
+	// Limits bounds the kustomize build requests
+	Limits KuzLimitsConfig `json:"limits"`
+}
+
+// KuzLimitsConfig bounds the kustomize build requests, at most MaxConcurrentRequests of them are handled at a time.
+// The config tarball of a request is rejected when it is larger than MaxCompressedSize, or when it holds more than
+// MaxFiles entries or MaxUncompressedSize of files.
+type KuzLimitsConfig struct {
+	MaxConcurrentRequests int32             `json:"maxConcurrentRequests"`
+	MaxCompressedSize     resource.Quantity `json:"maxCompressedSize"`
+	MaxUncompressedSize   resource.Quantity `json:"maxUncompressedSize"`
+	MaxFiles              int32             `json:"maxFiles"`
+}
+
+// KuzCacheConfig bounds the cache of the rendered manifests in Dir, the least recently used manifests are evicted
+// when there are more than MaxEntries of them, or when they take more than MaxSize
+type KuzCacheConfig struct {
+	Enabled bool `json:"enabled"`
+	// Dir defaults to a directory in the temporary directory of the operator
+	Dir        string            `json:"dir,omitempty"`
+	MaxEntries int32             `json:"maxEntries"`
+	MaxSize    resource.Quantity `json:"maxSize"`
+}
+
+// KuzBuildsConfig bounds the asynchronous kustomize builds, Workers builds run at a time and at most QueueSize
+// builds wait for a worker. The results of the builds are kept for ResultTTL after they finished.
+type KuzBuildsConfig struct {
+	Workers   int32           `json:"workers"`
+	QueueSize int32           `json:"queueSize"`
+	ResultTTL metav1.Duration `json:"resultTTL"`
+}
+
+// KuzTLSConfig enables https on the kustomize build server, disabled by default since older ops runner images only
+// speak http, and holds the validities of its CA and serving certificates, rotated when two thirds have elapsed
+type KuzTLSConfig struct {
+	Enabled      bool            `json:"enabled"`
+	CAValidity   metav1.Duration `json:"caValidity"`
+	CertValidity metav1.Duration `json:"certValidity"`
+}
+
+// MetricsConfig is where the operator and custom resource metrics are served
+type MetricsConfig struct {
+	Host         string `json:"host"`
+	Port         int32  `json:"port"`
+	OperatorPort int32  `json:"operatorPort"`
+}
+
+// OpsRunnerConfig holds the defaults of the ops runner jobs
+type OpsRunnerConfig struct {
+	// DefaultImage is used when the CR does not set opsRunner.image
+	DefaultImage     string               `json:"defaultImage"`
+	ImagePullPolicy  corev1.PullPolicy    `json:"imagePullPolicy"`
+	RestartPolicy    corev1.RestartPolicy `json:"restartPolicy"`
+	FailureThreshold int32                `json:"failureThreshold"`
+}
+
+// TimeoutsConfig holds the timeouts and periods of the operator
+type TimeoutsConfig struct {
+	KuzRead             metav1.Duration `json:"kuzRead"`
+	KuzWrite            metav1.Duration `json:"kuzWrite"`
+	InformerResync      metav1.Duration `json:"informerResync"`
+	InformerSync        metav1.Duration `json:"informerSync"`
+	DiscoveryInvalidate metav1.Duration `json:"discoveryInvalidate"`
+	DeletionWait        metav1.Duration `json:"deletionWait"`
+}
+
+// FeaturesConfig toggles features of the operator
+type FeaturesConfig struct {
+	// OpsRunnerServiceAccount creates a least-privilege ServiceAccount for the ops runner, when disabled the
+	// ops runner runs with the default ServiceAccount of the namespace unless the CR brings its own
+	OpsRunnerServiceAccount bool `json:"opsRunnerServiceAccount"`
+	// SyncRequests spawns an ops runner job when the qlik.com/sync-requested annotation of the CR changes
+	SyncRequests bool `json:"syncRequests"`
+	// GitWebhooks triggers a sync of the CRs watching the repository and branch of git push webhooks
+	GitWebhooks bool `json:"gitWebhooks"`
+	// KuzAuthentication requires a bearer token of a caller allowed to create the kuz subresource of the rendered
+	// CR for the kustomize builds, it is disabled by default for the ops runner images that do not send the token
+	KuzAuthentication bool `json:"kuzAuthentication"`
+}
+
+func defaultOperatorConfig() *OperatorConfig {
+	return &OperatorConfig{
+		APIVersion: operatorConfigAPIVersion,
+		Kind:       operatorConfigKind,
+		Kuz: KuzServerConfig{
+			Host:     "0.0.0.0",
+			Port:     7000,
+			PortName: "kuz-port",
+			TLS: KuzTLSConfig{
+				CAValidity:   metav1.Duration{Duration: 365 * 24 * time.Hour},
+				CertValidity: metav1.Duration{Duration: 90 * 24 * time.Hour},
+			},
+			Builds: KuzBuildsConfig{
+				Workers:   2,
+				QueueSize: 10,
+				ResultTTL: metav1.Duration{Duration: time.Hour},
+			},
+			Cache: KuzCacheConfig{
+				Enabled:    true,
+				MaxEntries: 100,
+				MaxSize:    resource.MustParse("256Mi"),
+			},
+			Limits: KuzLimitsConfig{
+				MaxConcurrentRequests: 8,
+				MaxCompressedSize:     resource.MustParse("32Mi"),
+				MaxUncompressedSize:   resource.MustParse("256Mi"),
+				MaxFiles:              10000,
+			},
+		},
+		Metrics: MetricsConfig{Host: "0.0.0.0", Port: 8383, OperatorPort: 8686},
+		OpsRunner: OpsRunnerConfig{
+			ImagePullPolicy:  corev1.PullAlways,
+			RestartPolicy:    corev1.RestartPolicyOnFailure,
+			FailureThreshold: 3,
+		},
+		Timeouts: TimeoutsConfig{
+			KuzRead:             metav1.Duration{Duration: 10 * time.Minute},
+			KuzWrite:            metav1.Duration{Duration: 10 * time.Minute},
+			InformerResync:      metav1.Duration{Duration: 10 * time.Minute},
+			InformerSync:        metav1.Duration{Duration: time.Minute},
+			DiscoveryInvalidate: metav1.Duration{Duration: time.Minute},
+			DeletionWait:        metav1.Duration{Duration: 90 * time.Second},
+		},
+		Features:     FeaturesConfig{OpsRunnerServiceAccount: true, SyncRequests: true, GitWebhooks: true},
+		ReloadPeriod: metav1.Duration{Duration: 30 * time.Second},
+	}
+}
+
+// operatorConfigFlags override the fields of the config file they are set for
+type operatorConfigFlags struct {
+	flagSet *pflag.FlagSet
+
+	kuzPort                   int32
+	metricsPort               int32
+	operatorMetricsPort       int32
+	opsRunnerImage            string
+	opsRunnerImagePullPolicy  string
+	opsRunnerRestartPolicy    string
+	opsRunnerFailureThreshold int32
+}
+
+func newOperatorConfigFlags() *operatorConfigFlags {
+	defaults := defaultOperatorConfig()
+	f := &operatorConfigFlags{flagSet: pflag.NewFlagSet("qliksense", pflag.ExitOnError)}
+	f.flagSet.StringVar(&operatorConfigPath, "config", "",
+		"path to the versioned operator config yaml file (usually mounted from a ConfigMap)")
+	f.flagSet.StringVar(&customResourcesConfigPath, "custom-resources-config", "",
+		"path to a yaml file (usually mounted from a ConfigMap) declaring the custom resource types managed by the operator")
+	f.flagSet.StringVar(&registryMirrorsConfigPath, "registry-mirrors-config", "",
+		"path to a yaml file (usually mounted from a ConfigMap) declaring the registry mirrors of the images of the pods created by the operator")
+	f.flagSet.Int32Var(&f.kuzPort, "kuz-port", defaults.Kuz.Port,
+		"port of the kustomize build server, overrides kuz.port of the config")
+	f.flagSet.Int32Var(&f.metricsPort, "metrics-port", defaults.Metrics.Port,
+		"port of the operator metrics, overrides metrics.port of the config")
+	f.flagSet.Int32Var(&f.operatorMetricsPort, "operator-metrics-port", defaults.Metrics.OperatorPort,
+		"port of the custom resource metrics, overrides metrics.operatorPort of the config")
+	f.flagSet.StringVar(&f.opsRunnerImage, "ops-runner-image", defaults.OpsRunner.DefaultImage,
+		"image of the ops runner when the CR does not set one, overrides opsRunner.defaultImage of the config")
+	f.flagSet.StringVar(&f.opsRunnerImagePullPolicy, "ops-runner-image-pull-policy", string(defaults.OpsRunner.ImagePullPolicy),
+		"image pull policy of the ops runner container, overrides opsRunner.imagePullPolicy of the config")
+	f.flagSet.StringVar(&f.opsRunnerRestartPolicy, "ops-runner-restart-policy", string(defaults.OpsRunner.RestartPolicy),
+		"restart policy of the ops runner pod, overrides opsRunner.restartPolicy of the config")
+	f.flagSet.Int32Var(&f.opsRunnerFailureThreshold, "ops-runner-failure-threshold", defaults.OpsRunner.FailureThreshold,
+		"number of consecutive failed ops runner jobs after which the Qliksense CR is marked as degraded, 0 disables it")
+	return f
+}
+
+// apply overrides the config with the flags set on the command line
+func (f *operatorConfigFlags) apply(c *OperatorConfig) {
+	if f.flagSet.Changed("kuz-port") {
+		c.Kuz.Port = f.kuzPort
+	}
+	if f.flagSet.Changed("metrics-port") {
+		c.Metrics.Port = f.metricsPort
+	}
+	if f.flagSet.Changed("operator-metrics-port") {
+		c.Metrics.OperatorPort = f.operatorMetricsPort
+	}
+	if f.flagSet.Changed("ops-runner-image") {
+		c.OpsRunner.DefaultImage = f.opsRunnerImage
+	}
+	if f.flagSet.Changed("ops-runner-image-pull-policy") {
+		c.OpsRunner.ImagePullPolicy = corev1.PullPolicy(f.opsRunnerImagePullPolicy)
+	}
+	if f.flagSet.Changed("ops-runner-restart-policy") {
+		c.OpsRunner.RestartPolicy = corev1.RestartPolicy(f.opsRunnerRestartPolicy)
+	}
+	if f.flagSet.Changed("ops-runner-failure-threshold") {
+		c.OpsRunner.FailureThreshold = f.opsRunnerFailureThreshold
+	}
+}
+
+// FlagSet returns the operator flags for the qliksense controller
+func FlagSet() *pflag.FlagSet {
+	return operatorFlags.flagSet
+}
+
+// LoadOperatorConfig loads and validates the operator config from the file and the flags, it must be called
+// after the flags are parsed and before the controller is added to the manager
+func LoadOperatorConfig() (*OperatorConfig, error) {
+	config, _, err := loadOperatorConfig(operatorConfigPath, operatorFlags)
+	if err != nil {
+		return nil, err
+	}
+	setOperatorConfig(config)
+	return config, nil
+}
+
+// getOperatorConfig returns the current operator config, it must not be modified
+func getOperatorConfig() *OperatorConfig {
+	operatorConfigMu.RLock()
+	defer operatorConfigMu.RUnlock()
+	if operatorConfig == nil {
+		config := defaultOperatorConfig()
+		config.CustomResources = defaultCustomResourcesConfig()
+		return config
+	}
+	return operatorConfig
+}
+
+func setOperatorConfig(config *OperatorConfig) {
+	operatorConfigMu.Lock()
+	defer operatorConfigMu.Unlock()
+	operatorConfig = config
+}
+
+// loadOperatorConfig reads the config from path, or starts from the defaults when path is empty, applies the flags
+// and validates it. It also returns the content of the file, so that reloads can skip unchanged files.
+func loadOperatorConfig(path string, flags *operatorConfigFlags) (*OperatorConfig, []byte, error) {
+	config := defaultOperatorConfig()
+	var configBytes []byte
+	if path != "" {
+		var err error
+		if configBytes, err = ioutil.ReadFile(path); err != nil {
+			return nil, nil, err
+		} else if err := yaml.UnmarshalStrict(configBytes, config); err != nil {
+			return nil, nil, fmt.Errorf("cannot parse operator config %v: %w", path, err)
+		}
+	}
+	if flags != nil {
+		flags.apply(config)
+	}
+	if customResourcesConfigPath != "" || config.CustomResources == nil {
+		customResources, err := loadCustomResourcesConfig(customResourcesConfigPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		config.CustomResources = customResources
+	}
+	if err := config.validate(); err != nil {
+		if path == "" {
+			return nil, nil, fmt.Errorf("invalid operator config (no config file, defaults and flags only): %w", err)
+		}
+		return nil, nil, fmt.Errorf("invalid operator config %v: %w", path, err)
+	}
+	return config, configBytes, nil
+}
+
+func (c *OperatorConfig) validate() error {
+	if c.APIVersion != operatorConfigAPIVersion {
+		return fmt.Errorf("unsupported apiVersion %v, expected %v", c.APIVersion, operatorConfigAPIVersion)
+	} else if c.Kind != operatorConfigKind {
+		return fmt.Errorf("unsupported kind %v, expected %v", c.Kind, operatorConfigKind)
+	}
+
+	ports := map[string]int32{"kuz.port": c.Kuz.Port, "metrics.port": c.Metrics.Port, "metrics.operatorPort": c.Metrics.OperatorPort}
+	seen := make(map[int32]string)
+	for _, name := range []string{"kuz.port", "metrics.port", "metrics.operatorPort"} {
+		port := ports[name]
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("%v: invalid port %v", name, port)
+		} else if other, ok := seen[port]; ok {
+			return fmt.Errorf("%v: port %v is already used by %v", name, port, other)
+		}
+		seen[port] = name
+	}
+	if c.Kuz.PortName == "" {
+		return errors.New("kuz.portName must be set")
+	}
+	if c.Kuz.TLS.Enabled {
+		if c.Kuz.TLS.CAValidity.Duration <= 0 {
+			return errors.New("kuz.tls.caValidity: must be positive")
+		} else if c.Kuz.TLS.CertValidity.Duration <= 0 {
+			return errors.New("kuz.tls.certValidity: must be positive")
+		} else if c.Kuz.TLS.CertValidity.Duration > c.Kuz.TLS.CAValidity.Duration {
+			return errors.New("kuz.tls.certValidity: must not be longer than kuz.tls.caValidity")
+		}
+	}
+	if c.Kuz.Builds.Workers <= 0 {
+		return errors.New("kuz.builds.workers: must be positive")
+	} else if c.Kuz.Builds.QueueSize < 0 {
+		return errors.New("kuz.builds.queueSize: must not be negative")
+	} else if c.Kuz.Builds.ResultTTL.Duration <= 0 {
+		return errors.New("kuz.builds.resultTTL: must be positive")
+	}
+	if c.Kuz.Cache.Enabled {
+		if c.Kuz.Cache.MaxEntries <= 0 {
+			return errors.New("kuz.cache.maxEntries: must be positive")
+		} else if c.Kuz.Cache.MaxSize.Sign() <= 0 {
+			return errors.New("kuz.cache.maxSize: must be positive")
+		}
+	}
+	if c.Kuz.Limits.MaxConcurrentRequests <= 0 {
+		return errors.New("kuz.limits.maxConcurrentRequests: must be positive")
+	} else if c.Kuz.Limits.MaxCompressedSize.Sign() <= 0 {
+		return errors.New("kuz.limits.maxCompressedSize: must be positive")
+	} else if c.Kuz.Limits.MaxUncompressedSize.Sign() <= 0 {
+		return errors.New("kuz.limits.maxUncompressedSize: must be positive")
+	} else if c.Kuz.Limits.MaxFiles <= 0 {
+		return errors.New("kuz.limits.maxFiles: must be positive")
+	}
+
+	switch c.OpsRunner.ImagePullPolicy {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+	default:
+		return fmt.Errorf("opsRunner.imagePullPolicy: unsupported policy %v", c.OpsRunner.ImagePullPolicy)
+	}
+	// pods of jobs cannot be restarted always
+	switch c.OpsRunner.RestartPolicy {
+	case corev1.RestartPolicyOnFailure, corev1.RestartPolicyNever:
+	default:
+		return fmt.Errorf("opsRunner.restartPolicy: unsupported policy %v", c.OpsRunner.RestartPolicy)
+	}
+	if c.OpsRunner.FailureThreshold < 0 {
+		return fmt.Errorf("opsRunner.failureThreshold: must not be negative")
+	}
+
+	timeouts := map[string]metav1.Duration{
+		"kuzRead":             c.Timeouts.KuzRead,
+		"kuzWrite":            c.Timeouts.KuzWrite,
+		"informerResync":      c.Timeouts.InformerResync,
+		"informerSync":        c.Timeouts.InformerSync,
+		"discoveryInvalidate": c.Timeouts.DiscoveryInvalidate,
+		"deletionWait":        c.Timeouts.DeletionWait,
+	}
+	for name, timeout := range timeouts {
+		if timeout.Duration <= 0 {
+			return fmt.Errorf("timeouts.%v: must be positive", name)
+		}
+	}
+	if c.ReloadPeriod.Duration < 0 {
+		return errors.New("reloadPeriod: must not be negative")
+	}
+
+	if c.CustomResources != nil {
+		if err := c.CustomResources.validate(); err != nil {
+			return fmt.Errorf("customResources: %w", err)
+		}
+	}
+	return nil
+}
+
+// reload returns the current config with the fields of the loaded config that can be changed while the operator
+// is running, and the names of the changed fields that are only applied after a restart
+func (c *OperatorConfig) reload(loaded *OperatorConfig) (*OperatorConfig, []string) {
+	reloaded := *c
+	reloaded.OpsRunner = loaded.OpsRunner
+	reloaded.Features = loaded.Features
+	reloaded.Timeouts.InformerSync = loaded.Timeouts.InformerSync
+	reloaded.Timeouts.DiscoveryInvalidate = loaded.Timeouts.DiscoveryInvalidate
+	reloaded.Timeouts.DeletionWait = loaded.Timeouts.DeletionWait
+
+	var restartRequired []string
+	if !reflect.DeepEqual(reloaded.Kuz, loaded.Kuz) {
+		restartRequired = append(restartRequired, "kuz")
+	}
+	if !reflect.DeepEqual(reloaded.Metrics, loaded.Metrics) {
+		restartRequired = append(restartRequired, "metrics")
+	}
+	if !reflect.DeepEqual(reloaded.Timeouts, loaded.Timeouts) {
+		restartRequired = append(restartRequired, "timeouts")
+	}
+	if !reflect.DeepEqual(reloaded.CustomResources, loaded.CustomResources) {
+		restartRequired = append(restartRequired, "customResources")
+	}
+	if reloaded.ReloadPeriod != loaded.ReloadPeriod {
+		restartRequired = append(restartRequired, "reloadPeriod")
+	}
+	return &reloaded, restartRequired
+}
+
+// operatorConfigReloader implements manager.Runnable, it checks the config file for changes and applies
+// the fields that can be changed while the operator is running
+type operatorConfigReloader struct {
+	path        string
+	flags       *operatorConfigFlags
+	period      time.Duration
+	configBytes []byte
+}
+
+func newOperatorConfigReloader(path string, flags *operatorConfigFlags, config *OperatorConfig) (*operatorConfigReloader, error) {
+	configBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &operatorConfigReloader{path: path, flags: flags, period: config.ReloadPeriod.Duration, configBytes: configBytes}, nil
+}
+
+func (r *operatorConfigReloader) Start(stop <-chan struct{}) error {
+	wait.Until(func() {
+		if err := r.reload(); err != nil {
+			log.Error(err, "cannot reload the operator config, keeping the current config", "path", r.path)
+		}
+	}, r.period, stop)
+	return nil
+}
+
+func (r *operatorConfigReloader) reload() error {
+	configBytes, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return err
+	} else if bytes.Equal(configBytes, r.configBytes) {
+		return nil
+	}
+	loaded, configBytes, err := loadOperatorConfig(r.path, r.flags)
+	if err != nil {
+		return err
+	}
+	r.configBytes = configBytes
+
+	reloaded, restartRequired := getOperatorConfig().reload(loaded)
+	setOperatorConfig(reloaded)
+	log.Info("Reloaded the operator config", "path", r.path)
+	if len(restartRequired) > 0 {
+		log.Info("The operator must be restarted to apply the changed operator config", "fields", restartRequired)
+	}
+	return nil
+}
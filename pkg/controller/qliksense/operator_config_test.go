@@ -0,0 +1,258 @@
+package qliksense
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_loadOperatorConfig(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	testCases := []struct {
+		name        string
+		config      string
+		args        []string
+		expectError bool
+		errorPrefix string
+		verify      func(t *testing.T, config *OperatorConfig)
+	}{
+		{
+			name: "defaults",
+			verify: func(t *testing.T, config *OperatorConfig) {
+				if config.Kuz.Port != 7000 || config.Metrics.Port != 8383 || config.Metrics.OperatorPort != 8686 {
+					t.Fatalf("unexpected default ports: %v, %v", config.Kuz, config.Metrics)
+				} else if config.OpsRunner.ImagePullPolicy != corev1.PullAlways || config.OpsRunner.RestartPolicy != corev1.RestartPolicyOnFailure {
+					t.Fatalf("unexpected default policies: %v", config.OpsRunner)
+				} else if config.CustomResources == nil || config.CustomResources.Engine.Resource != "engines" {
+					t.Fatalf("expected the default custom resources, but got: %v", config.CustomResources)
+				}
+			},
+		},
+		{
+			name: "config file",
+			config: `
+apiVersion: qlik.com/v1alpha1
+kind: OperatorConfig
+kuz:
+  port: 7001
+opsRunner:
+  defaultImage: qlik-docker-oss.bintray.io/qliksense-repo-watcher
+  imagePullPolicy: IfNotPresent
+timeouts:
+  deletionWait: 2m
+features:
+  syncRequests: false
+customResources:
+  engine:
+    group: qixmanager.qlik.com
+    versions: [v1]
+    resource: engines
+`,
+			verify: func(t *testing.T, config *OperatorConfig) {
+				if config.Kuz.Port != 7001 || config.Kuz.PortName != "kuz-port" {
+					t.Fatalf("expected the kuz port to be set and the port name to be defaulted, but got: %v", config.Kuz)
+				} else if config.OpsRunner.ImagePullPolicy != corev1.PullIfNotPresent || config.OpsRunner.RestartPolicy != corev1.RestartPolicyOnFailure {
+					t.Fatalf("unexpected policies: %v", config.OpsRunner)
+				} else if config.Timeouts.DeletionWait.Duration != 2*time.Minute || config.Timeouts.InformerSync.Duration != time.Minute {
+					t.Fatalf("unexpected timeouts: %v", config.Timeouts)
+				} else if config.Features.SyncRequests || !config.Features.OpsRunnerServiceAccount {
+					t.Fatalf("unexpected features: %v", config.Features)
+				} else if len(config.CustomResources.Owned) != 0 {
+					t.Fatalf("expected no owned custom resources, but got: %v", config.CustomResources.Owned)
+				}
+			},
+		},
+		{
+			name: "flags override the config file",
+			config: `
+apiVersion: qlik.com/v1alpha1
+kind: OperatorConfig
+kuz:
+  port: 7001
+opsRunner:
+  restartPolicy: Never
+`,
+			args: []string{"--kuz-port=7002", "--ops-runner-failure-threshold=5"},
+			verify: func(t *testing.T, config *OperatorConfig) {
+				if config.Kuz.Port != 7002 {
+					t.Fatalf("expected the kuz port of the flag, but got: %v", config.Kuz.Port)
+				} else if config.OpsRunner.RestartPolicy != corev1.RestartPolicyNever || config.OpsRunner.FailureThreshold != 5 {
+					t.Fatalf("unexpected ops runner config: %v", config.OpsRunner)
+				}
+			},
+		},
+		{
+			name: "unsupported version",
+			config: `
+apiVersion: qlik.com/v2
+kind: OperatorConfig
+`,
+			expectError: true,
+		},
+		{
+			name: "unknown field",
+			config: `
+apiVersion: qlik.com/v1alpha1
+kind: OperatorConfig
+kuz:
+  prot: 7001
+`,
+			expectError: true,
+		},
+		{
+			name: "conflicting ports",
+			config: `
+apiVersion: qlik.com/v1alpha1
+kind: OperatorConfig
+metrics:
+  port: 7000
+`,
+			expectError: true,
+		},
+		{
+			name: "serving certificate outliving the CA",
+			config: `
+apiVersion: qlik.com/v1alpha1
+kind: OperatorConfig
+kuz:
+  tls:
+    enabled: true
+    certValidity: 9000h
+`,
+			expectError: true,
+		},
+		{
+			name: "no build workers",
+			config: `
+apiVersion: qlik.com/v1alpha1
+kind: OperatorConfig
+kuz:
+  builds:
+    workers: 0
+`,
+			expectError: true,
+		},
+		{
+			name: "empty cache",
+			config: `
+apiVersion: qlik.com/v1alpha1
+kind: OperatorConfig
+kuz:
+  cache:
+    maxSize: "0"
+`,
+			expectError: true,
+		},
+		{
+			name: "no concurrent requests",
+			config: `
+apiVersion: qlik.com/v1alpha1
+kind: OperatorConfig
+kuz:
+  limits:
+    maxConcurrentRequests: 0
+`,
+			expectError: true,
+		},
+		{
+			name:        "invalid restart policy flag",
+			args:        []string{"--ops-runner-restart-policy=Always"},
+			expectError: true,
+			errorPrefix: "invalid operator config (no config file, defaults and flags only): ",
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			flags := newOperatorConfigFlags()
+			if err := flags.flagSet.Parse(testCase.args); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			configPath := ""
+			if testCase.config != "" {
+				configPath = filepath.Join(tmpDir, "config.yaml")
+				if err := ioutil.WriteFile(configPath, []byte(testCase.config), os.ModePerm); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			config, _, err := loadOperatorConfig(configPath, flags)
+			if testCase.expectError {
+				if err == nil {
+					t.Fatal("expected an error, but got none")
+				} else if !strings.HasPrefix(err.Error(), testCase.errorPrefix) {
+					t.Fatalf("expected an error starting with %q, but got: %v", testCase.errorPrefix, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			testCase.verify(t, config)
+		})
+	}
+}
+
+func Test_operatorConfigReloader(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	defer setOperatorConfig(nil)
+
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	if err := ioutil.WriteFile(configPath, []byte(`
+apiVersion: qlik.com/v1alpha1
+kind: OperatorConfig
+`), os.ModePerm); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	flags := newOperatorConfigFlags()
+	config, _, err := loadOperatorConfig(configPath, flags)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	setOperatorConfig(config)
+	reloader, err := newOperatorConfigReloader(configPath, flags, config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := ioutil.WriteFile(configPath, []byte(`
+apiVersion: qlik.com/v1alpha1
+kind: OperatorConfig
+kuz:
+  port: 7001
+opsRunner:
+  imagePullPolicy: IfNotPresent
+`), os.ModePerm); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := reloader.reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if reloaded := getOperatorConfig(); reloaded.OpsRunner.ImagePullPolicy != corev1.PullIfNotPresent {
+		t.Fatalf("expected the image pull policy to be reloaded, but got: %v", reloaded.OpsRunner.ImagePullPolicy)
+	} else if reloaded.Kuz.Port != 7000 {
+		t.Fatalf("expected the kuz port to be kept until a restart, but got: %v", reloaded.Kuz.Port)
+	}
+
+	if err := ioutil.WriteFile(configPath, []byte(`
+apiVersion: qlik.com/v1alpha1
+kind: OperatorConfig
+opsRunner:
+  imagePullPolicy: Sometimes
+`), os.ModePerm); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := reloader.reload(); err == nil {
+		t.Fatal("expected an error for an invalid config")
+	} else if reloaded := getOperatorConfig(); reloaded.OpsRunner.ImagePullPolicy != corev1.PullIfNotPresent {
+		t.Fatalf("expected the current config to be kept, but got: %v", reloaded.OpsRunner.ImagePullPolicy)
+	}
+}
@@ -0,0 +1,169 @@
+package qliksense
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	kapis_config "github.com/qlik-oss/k-apis/pkg/config"
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	opsRunnerConfigSecretSuffix   = "-ops-runner-config"
+	opsRunnerConfigSecretKey      = "cr.yaml"
+	opsRunnerConfigHashAnnotation = "qlik.com/ops-runner-config-hash"
+	// secretRefsIndex indexes the Qliksense CRs by the Secrets they reference
+	secretRefsIndex = "spec.secretRefs"
+)
+
+func getOpsRunnerConfigSecretName(m *qlikv1.Qliksense) string {
+	return fmt.Sprintf("%v%v", m.Name, opsRunnerConfigSecretSuffix)
+}
+
+// renderOpsRunnerConfig renders the CR passed to the ops runner, with the values referenced from Secrets resolved
+func (r *ReconcileQliksense) renderOpsRunnerConfig(m *qlikv1.Qliksense) ([]byte, error) {
+	rendered, err := r.resolveSecretRefs(m)
+	if err != nil {
+		return nil, err
+	}
+	return crToYaml(rendered)
+}
+
+// resolveSecretRefs returns a copy of the CR with the values referenced from Secrets resolved
+func (r *ReconcileQliksense) resolveSecretRefs(m *qlikv1.Qliksense) (*qlikv1.Qliksense, error) {
+	rendered := m.DeepCopy()
+	if git := rendered.Spec.Git; git != nil && git.AccessTokenSecretKeyRef != nil {
+		accessToken, err := getSecretKeyValue(r.client, m.Namespace, git.AccessTokenSecretKeyRef.Name, git.AccessTokenSecretKeyRef.Key)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get the git access token: %w", err)
+		}
+		git.AccessToken = accessToken
+		git.AccessTokenSecretKeyRef = nil
+	}
+	// the k-apis deep copy shares the secrets with the CR, so they are copied before they are resolved
+	if rendered.Spec.Secrets != nil {
+		secrets := make(map[string]kapis_config.NameValues, len(rendered.Spec.Secrets))
+		for svcName, nameValues := range rendered.Spec.Secrets {
+			resolved := make(kapis_config.NameValues, len(nameValues))
+			for i, nameValue := range nameValues {
+				resolved[i] = nameValue
+				if nameValue.ValueFrom == nil || nameValue.ValueFrom.SecretKeyRef == nil {
+					continue
+				}
+				value, err := getSecretKeyValue(r.client, m.Namespace, nameValue.ValueFrom.SecretKeyRef.Name, nameValue.ValueFrom.SecretKeyRef.Key)
+				if err != nil {
+					return nil, fmt.Errorf("cannot get the secret %v of %v: %w", nameValue.Name, svcName, err)
+				}
+				resolved[i].Value = value
+				resolved[i].ValueFrom = nil
+			}
+			secrets[svcName] = resolved
+		}
+		rendered.Spec.Secrets = secrets
+	}
+	return rendered, nil
+}
+
+func getSecretKeyValue(c client.Client, namespace, name, key string) (string, error) {
+	secret := &corev1.Secret{}
+	if err := c.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, secret); err != nil {
+		return "", err
+	}
+	value, ok := secret.Data[key]
+	if !ok {
+		return "", fmt.Errorf("key %v not found in the secret %v", key, name)
+	}
+	return string(value), nil
+}
+
+// getOpsRunnerConfigHash returns the hash of the rendered CR, it is set on the pod template of the ops runner
+// job, so that the job is rolled out when the rendered CR changes
+func getOpsRunnerConfigHash(config []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(config))
+}
+
+// setupOpsRunnerConfigSecret writes the rendered CR into the Secret the ops runner reads the YAML_CONF from,
+// or deletes the Secret when the ops runner is disabled
+func (r *ReconcileQliksense) setupOpsRunnerConfigSecret(reqLogger logr.Logger, m *qlikv1.Qliksense) error {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: getOpsRunnerConfigSecretName(m), Namespace: m.Namespace}}
+	if getRequiredOpsRunnerJobKind(m) == OpsRunnerJobKindNone {
+		if err := r.client.Delete(context.TODO(), secret); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+
+	config, err := r.renderOpsRunnerConfig(m)
+	if err != nil {
+		reqLogger.Error(err, "Error rendering the OpsRunner config")
+		return err
+	}
+	return r.createOrUpdateOpsRunnerObject(reqLogger, m, secret, func() error {
+		labels := secret.GetLabels()
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[searchingLabel] = m.Name
+		labels[opsRunnerJobLabel] = m.Name
+		secret.SetLabels(labels)
+		secret.Type = corev1.SecretTypeOpaque
+		secret.Data = map[string][]byte{opsRunnerConfigSecretKey: config}
+		return nil
+	})
+}
+
+// getSecretRefs returns the names of the Secrets referenced by the CR, their values are rendered into the ops runner config
+func getSecretRefs(obj runtime.Object) []string {
+	m, ok := obj.(*qlikv1.Qliksense)
+	if !ok || m.Spec == nil {
+		return nil
+	}
+	var secretRefs []string
+	seen := make(map[string]bool)
+	addSecretRef := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			secretRefs = append(secretRefs, name)
+		}
+	}
+	if m.Spec.Git != nil && m.Spec.Git.AccessTokenSecretKeyRef != nil {
+		addSecretRef(m.Spec.Git.AccessTokenSecretKeyRef.Name)
+	}
+	for _, nameValues := range m.Spec.Secrets {
+		for _, nameValue := range nameValues {
+			if nameValue.ValueFrom != nil && nameValue.ValueFrom.SecretKeyRef != nil {
+				addSecretRef(nameValue.ValueFrom.SecretKeyRef.Name)
+			}
+		}
+	}
+	return secretRefs
+}
+
+// getSecretRefsEventHandler requeues the Qliksense CRs referencing a Secret, so that the ops runner config is rendered again
+func getSecretRefsEventHandler(c client.Client) handler.EventHandler {
+	return &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(a handler.MapObject) []reconcile.Request {
+			qliksenseList := &qlikv1.QliksenseList{}
+			if err := c.List(context.TODO(), qliksenseList, client.InNamespace(a.Meta.GetNamespace()),
+				client.MatchingFields{secretRefsIndex: a.Meta.GetName()}); err != nil {
+				log.Error(err, "cannot list the Qliksense CRs referencing the secret", "secret", a.Meta.GetName())
+				return nil
+			}
+			requests := make([]reconcile.Request, 0, len(qliksenseList.Items))
+			for _, q := range qliksenseList.Items {
+				requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: q.Name, Namespace: q.Namespace}})
+			}
+			return requests
+		}),
+	}
+}
@@ -0,0 +1,120 @@
+package qliksense
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/qlik-oss/qliksense-operator/pkg/apis"
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+)
+
+func Test_setupOpsRunnerConfigSecret(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := apis.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cr := `
+apiVersion: qlik.com/v1
+kind: Qliksense
+metadata:
+  name: qlik-default
+  namespace: default
+  uid: qlik-default-uid
+  annotations:
+    qlik.com/sync-requested: "2020-04-01T10:00:00Z"
+spec:
+  profile: docker-desktop
+  git:
+    repository: https://github.com/my-org/qliksense-k8s
+    accessTokenSecretKeyRef:
+      name: git-credentials
+      key: token
+  secrets:
+    qliksense:
+    - name: mongoDbUri
+      valueFrom:
+        secretKeyRef:
+          name: mongodb
+          key: uri
+  opsRunner:
+    enabled: "yes"
+    schedule: "*/10 * * * *"
+    watchBranch: master
+`
+	m := &qlikv1.Qliksense{}
+	if err := yaml.Unmarshal([]byte(cr), m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if secretRefs := getSecretRefs(m); len(secretRefs) != 2 || secretRefs[0] != "git-credentials" || secretRefs[1] != "mongodb" {
+		t.Fatalf("expected the CR to reference the git-credentials and mongodb secrets, but got: %v", secretRefs)
+	}
+
+	gitCredentials := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "git-credentials", Namespace: m.Namespace},
+		Data:       map[string][]byte{"token": []byte("my-token")},
+	}
+	mongodb := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "mongodb", Namespace: m.Namespace},
+		Data:       map[string][]byte{"uri": []byte("mongodb://mongo:27017/qliksense")},
+	}
+	r := &ReconcileQliksense{
+		client: fake.NewFakeClientWithScheme(scheme, m, gitCredentials, mongodb),
+		scheme: scheme,
+	}
+	reqLogger := log.WithName("test")
+
+	if err := r.setupOpsRunnerConfigSecret(reqLogger, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secret := &corev1.Secret{}
+	if err := r.client.Get(context.TODO(), client.ObjectKey{Name: "qlik-default-ops-runner-config", Namespace: m.Namespace}, secret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if owner := metav1.GetControllerOf(secret); owner == nil || owner.UID != m.UID {
+		t.Fatalf("expected the config secret to be owned by the CR, but got: %v", owner)
+	}
+	rendered := &qlikv1.Qliksense{}
+	if err := yaml.Unmarshal(secret.Data[opsRunnerConfigSecretKey], rendered); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rendered.Spec.Git.AccessToken != "my-token" || rendered.Spec.Git.AccessTokenSecretKeyRef != nil {
+		t.Fatalf("expected the access token to be resolved, but got: %v", rendered.Spec.Git)
+	} else if nameValue := rendered.Spec.Secrets["qliksense"][0]; nameValue.Value != "mongodb://mongo:27017/qliksense" || nameValue.ValueFrom != nil {
+		t.Fatalf("expected the mongoDbUri to be resolved, but got: %v", nameValue)
+	} else if _, ok := rendered.Annotations[syncRequestedAnnotation]; ok {
+		t.Fatal("expected the sync request annotation to be removed")
+	}
+	if m.Spec.Git.AccessTokenSecretKeyRef == nil || m.Spec.Secrets["qliksense"][0].ValueFrom == nil {
+		t.Fatal("expected the CR to be left unchanged")
+	}
+
+	podTemplate, err := r.getOpsRunnerPodTemplate(reqLogger, m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, envVar := range podTemplate.Spec.Containers[0].Env {
+		if strings.Contains(envVar.Value, "my-token") {
+			t.Fatalf("expected no credentials in the env vars, but got: %v", envVar)
+		}
+	}
+	hash := podTemplate.Annotations[opsRunnerConfigHashAnnotation]
+
+	mongodb.Data["uri"] = []byte("mongodb://other-mongo:27017/qliksense")
+	if err := r.client.Update(context.TODO(), mongodb); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if podTemplate, err := r.getOpsRunnerPodTemplate(reqLogger, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if podTemplate.Annotations[opsRunnerConfigHashAnnotation] == hash {
+		t.Fatal("expected the config hash to change after the referenced secret changed")
+	}
+}
@@ -0,0 +1,201 @@
+package qliksense
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// opsRunnerVerbs are the verbs the ops runner needs to apply and prune the manifests, they never include escalate or
+// bind, so that the ops runner cannot grant permissions the operator does not hold through the Roles it applies
+var opsRunnerVerbs = []string{"get", "list", "watch", "create", "update", "patch", "delete"}
+
+// opsRunnerPolicyRules are the namespaced kinds the ops runner applies from the manifests of a release.
+// The owned custom resources of the custom resources config are added to them. The ops runner has no permissions on
+// the cluster-scoped resources of a release (see clusterScopedResources), they are applied outside of it.
+var opsRunnerPolicyRules = []rbacv1.PolicyRule{
+	{
+		APIGroups: []string{""},
+		Resources: []string{"configmaps", "secrets", "services", "serviceaccounts", "persistentvolumeclaims"},
+		Verbs:     opsRunnerVerbs,
+	},
+	{
+		APIGroups: []string{""},
+		Resources: []string{"pods", "pods/log", "endpoints", "events"},
+		Verbs:     []string{"get", "list", "watch"},
+	},
+	{
+		APIGroups: []string{"apps"},
+		Resources: []string{"deployments", "statefulsets", "daemonsets", "replicasets"},
+		Verbs:     opsRunnerVerbs,
+	},
+	{
+		APIGroups: []string{"batch"},
+		Resources: []string{"cronjobs", "jobs"},
+		Verbs:     opsRunnerVerbs,
+	},
+	{
+		APIGroups: []string{"extensions", "networking.k8s.io"},
+		Resources: []string{"ingresses", "networkpolicies"},
+		Verbs:     opsRunnerVerbs,
+	},
+	{
+		APIGroups: []string{"autoscaling"},
+		Resources: []string{"horizontalpodautoscalers"},
+		Verbs:     opsRunnerVerbs,
+	},
+	{
+		APIGroups: []string{"rbac.authorization.k8s.io"},
+		Resources: []string{"roles", "rolebindings"},
+		Verbs:     opsRunnerVerbs,
+	},
+	{
+		APIGroups: []string{"qlik.com"},
+		Resources: []string{"qliksenses"},
+		Verbs:     []string{"get", "list", "watch"},
+	},
+}
+
+func getOpsRunnerRBACName(m *qlikv1.Qliksense) string {
+	return fmt.Sprintf("%v%v", m.Name, opsRunnerJobNameSuffix)
+}
+
+// getOpsRunnerServiceAccountName returns the ServiceAccount brought by the CR, or the one created by the operator.
+// It is empty, i.e. the default ServiceAccount of the namespace, when the opsRunnerServiceAccount feature is disabled.
+func getOpsRunnerServiceAccountName(m *qlikv1.Qliksense) string {
+	if m.Spec.OpsRunner != nil && m.Spec.OpsRunner.ServiceAccountName != "" {
+		return m.Spec.OpsRunner.ServiceAccountName
+	} else if !getOperatorConfig().Features.OpsRunnerServiceAccount {
+		return ""
+	}
+	return getOpsRunnerRBACName(m)
+}
+
+// getOpsRunnerPolicyRules returns the rules of the ops runner Role of the CR
+func (r *ReconcileQliksense) getOpsRunnerPolicyRules(m *qlikv1.Qliksense) []rbacv1.PolicyRule {
+	rules := make([]rbacv1.PolicyRule, 0, len(opsRunnerPolicyRules)+2)
+	for _, rule := range opsRunnerPolicyRules {
+		rules = append(rules, *rule.DeepCopy())
+	}
+	// the kustomize builds of the operator, only for the CR of the ops runner
+	rules = append(rules, rbacv1.PolicyRule{
+		APIGroups:     []string{"qlik.com"},
+		Resources:     []string{"qliksenses/" + kuzSubresource},
+		ResourceNames: []string{m.Name},
+		Verbs:         []string{kuzVerb},
+	})
+	if r.customResources == nil {
+		return rules
+	}
+	// one rule per owned resource
+	seen := make(map[schema.GroupResource]bool)
+	for _, owned := range r.customResources.Owned {
+		groupResource := schema.GroupResource{Group: owned.Group, Resource: owned.Resource}
+		if seen[groupResource] {
+			continue
+		}
+		seen[groupResource] = true
+		rules = append(rules, rbacv1.PolicyRule{APIGroups: []string{owned.Group}, Resources: []string{owned.Resource}, Verbs: append([]string{}, opsRunnerVerbs...)})
+	}
+	return rules
+}
+
+// setupOpsRunnerRBAC creates the ServiceAccount, Role and RoleBinding the ops runner job runs with,
+// or deletes them when the CR brings its own ServiceAccount, the ops runner or the opsRunnerServiceAccount feature is disabled
+func (r *ReconcileQliksense) setupOpsRunnerRBAC(reqLogger logr.Logger, m *qlikv1.Qliksense) error {
+	if getRequiredOpsRunnerJobKind(m) == OpsRunnerJobKindNone || getOpsRunnerServiceAccountName(m) != getOpsRunnerRBACName(m) {
+		return r.deleteOpsRunnerRBAC(reqLogger, m)
+	}
+
+	objectMeta := func(obj metav1.Object) {
+		labels := obj.GetLabels()
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[searchingLabel] = m.Name
+		labels[opsRunnerJobLabel] = m.Name
+		obj.SetLabels(labels)
+	}
+
+	serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: getOpsRunnerRBACName(m), Namespace: m.Namespace}}
+	if err := r.createOrUpdateOpsRunnerObject(reqLogger, m, serviceAccount, func() error {
+		objectMeta(serviceAccount)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	role := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: getOpsRunnerRBACName(m), Namespace: m.Namespace}}
+	if err := r.createOrUpdateOpsRunnerObject(reqLogger, m, role, func() error {
+		objectMeta(role)
+		role.Rules = r.getOpsRunnerPolicyRules(m)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	roleBinding := &rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: getOpsRunnerRBACName(m), Namespace: m.Namespace}}
+	return r.createOrUpdateOpsRunnerObject(reqLogger, m, roleBinding, func() error {
+		if roleBinding.RoleRef.Name != "" && roleBinding.RoleRef.Name != role.Name {
+			return fmt.Errorf("RoleBinding %v refers to the Role %v and cannot be changed", roleBinding.Name, roleBinding.RoleRef.Name)
+		}
+		objectMeta(roleBinding)
+		roleBinding.RoleRef = rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: role.Name}
+		roleBinding.Subjects = []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: serviceAccount.Name, Namespace: serviceAccount.Namespace}}
+		return nil
+	})
+}
+
+type opsRunnerObject interface {
+	metav1.Object
+	runtime.Object
+}
+
+func (r *ReconcileQliksense) createOrUpdateOpsRunnerObject(reqLogger logr.Logger, m *qlikv1.Qliksense, obj opsRunnerObject, mutate controllerutil.MutateFn) error {
+	result, err := controllerutil.CreateOrUpdate(context.TODO(), r.client, obj, func() error {
+		if err := mutate(); err != nil {
+			return err
+		}
+		return controllerutil.SetControllerReference(m, obj, r.scheme)
+	})
+	if err != nil {
+		reqLogger.Error(err, "Failed to apply the OpsRunner RBAC object", "kind", fmt.Sprintf("%T", obj), "name", obj.GetName())
+		return err
+	}
+	if result != controllerutil.OperationResultNone {
+		reqLogger.Info("Applied the OpsRunner RBAC object", "kind", fmt.Sprintf("%T", obj), "name", obj.GetName(), "result", result)
+	}
+	return nil
+}
+
+// deleteOpsRunnerRBAC deletes the ServiceAccount, Role and RoleBinding created by the operator for the ops runner
+func (r *ReconcileQliksense) deleteOpsRunnerRBAC(reqLogger logr.Logger, m *qlikv1.Qliksense) error {
+	name := types.NamespacedName{Name: getOpsRunnerRBACName(m), Namespace: m.Namespace}
+	for _, obj := range []runtime.Object{&rbacv1.RoleBinding{}, &rbacv1.Role{}, &corev1.ServiceAccount{}} {
+		if err := r.client.Get(context.TODO(), name, obj); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		// never delete an object that was not created by the operator for this CR, e.g. a bring-your-own ServiceAccount with the same name
+		if owner := metav1.GetControllerOf(obj.(metav1.Object)); owner == nil || owner.UID != m.UID {
+			continue
+		}
+		reqLogger.Info("Deleting the OpsRunner RBAC object", "kind", fmt.Sprintf("%T", obj), "name", name.Name)
+		if err := r.client.Delete(context.TODO(), obj); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
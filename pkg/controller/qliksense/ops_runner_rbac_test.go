@@ -0,0 +1,106 @@
+package qliksense
+
+import (
+	"context"
+	"testing"
+
+	"github.com/qlik-oss/qliksense-operator/pkg/apis"
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func Test_setupOpsRunnerRBAC(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := apis.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m := &qlikv1.Qliksense{
+		ObjectMeta: metav1.ObjectMeta{Name: "qlik-default", Namespace: "default", UID: "qlik-default-uid"},
+		Spec: &qlikv1.QliksenseSpec{
+			OpsRunner: &qlikv1.OpsRunnerSpec{},
+		},
+	}
+	m.Spec.OpsRunner.Enabled = "yes"
+	m.Spec.OpsRunner.Schedule = "*/10 * * * *"
+
+	r := &ReconcileQliksense{
+		client:          fake.NewFakeClientWithScheme(scheme, m),
+		scheme:          scheme,
+		customResources: defaultCustomResourcesConfig(),
+	}
+	reqLogger := log.WithName("test")
+	name := types.NamespacedName{Name: "qlik-default-ops-runner", Namespace: m.Namespace}
+
+	if err := r.setupOpsRunnerRBAC(reqLogger, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	serviceAccount := &corev1.ServiceAccount{}
+	if err := r.client.Get(context.TODO(), name, serviceAccount); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if owner := metav1.GetControllerOf(serviceAccount); owner == nil || owner.UID != m.UID {
+		t.Fatalf("expected the ServiceAccount to be owned by the CR, but got: %v", owner)
+	}
+	role := &rbacv1.Role{}
+	if err := r.client.Get(context.TODO(), name, role); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if expected := len(opsRunnerPolicyRules) + 5; len(role.Rules) != expected {
+		t.Fatalf("expected %v rules, but got: %v", expected, len(role.Rules))
+	}
+	kuzRules := 0
+	for _, rule := range role.Rules {
+		for _, resource := range rule.Resources {
+			if resource != "qliksenses/"+kuzSubresource {
+				continue
+			} else if kuzRules++; len(rule.ResourceNames) != 1 || rule.ResourceNames[0] != m.Name {
+				t.Fatalf("expected the kuz rule to be limited to %v, but got: %v", m.Name, rule.ResourceNames)
+			}
+		}
+	}
+	if kuzRules != 1 {
+		t.Fatalf("expected a kuz rule, but got: %v", kuzRules)
+	}
+	for _, rule := range role.Rules {
+		for _, verb := range rule.Verbs {
+			if verb == "*" || verb == "escalate" || verb == "bind" {
+				t.Fatalf("expected the rules not to grant %v, but got: %v", verb, rule)
+			}
+		}
+	}
+	roleBinding := &rbacv1.RoleBinding{}
+	if err := r.client.Get(context.TODO(), name, roleBinding); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if roleBinding.RoleRef.Name != role.Name || len(roleBinding.Subjects) != 1 || roleBinding.Subjects[0].Name != serviceAccount.Name {
+		t.Fatalf("expected the RoleBinding to bind the Role to the ServiceAccount, but got: %v", roleBinding)
+	}
+
+	podTemplate, err := r.getOpsRunnerPodTemplate(reqLogger, m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if podTemplate.Spec.ServiceAccountName != serviceAccount.Name {
+		t.Fatalf("expected the ops runner to run as %v, but got: %v", serviceAccount.Name, podTemplate.Spec.ServiceAccountName)
+	}
+
+	m.Spec.OpsRunner.ServiceAccountName = "my-service-account"
+	if err := r.setupOpsRunnerRBAC(reqLogger, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, obj := range []runtime.Object{&corev1.ServiceAccount{}, &rbacv1.Role{}, &rbacv1.RoleBinding{}} {
+		if err := r.client.Get(context.TODO(), name, obj); !errors.IsNotFound(err) {
+			t.Fatalf("expected %T to be deleted, but got: %v", obj, err)
+		}
+	}
+	if podTemplate, err := r.getOpsRunnerPodTemplate(reqLogger, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if podTemplate.Spec.ServiceAccountName != "my-service-account" {
+		t.Fatalf("expected the ops runner to run as my-service-account, but got: %v", podTemplate.Spec.ServiceAccountName)
+	}
+}
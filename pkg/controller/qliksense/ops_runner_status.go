@@ -0,0 +1,216 @@
+package qliksense
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	batch_v1 "k8s.io/api/batch/v1"
+	batch_v1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+const (
+	opsRunnerJobLabel     = "qlik.com/ops-runner"
+	opsRunnerDegradedType = "OpsRunnerDegraded"
+)
+
+// getOpsRunnerJobPredicate lets status changes of the ops runner and scheduled operation jobs through, so that their results can be recorded
+func getOpsRunnerJobPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if _, ok := e.MetaNew.GetLabels()[opsRunnerJobLabel]; ok {
+				return true
+			} else if _, ok := e.MetaNew.GetLabels()[operationLabel]; ok {
+				return true
+			}
+			return e.MetaOld.GetGeneration() != e.MetaNew.GetGeneration()
+		},
+	}
+}
+
+// updateOpsRunnerStatus records the results of the ops runner jobs that finished since the last reconcile
+// and raises the degraded condition after opsRunner.failureThreshold consecutive failures of the operator config
+func (r *ReconcileQliksense) updateOpsRunnerStatus(reqLogger logr.Logger, m *qlikv1.Qliksense) error {
+	jobList := &batch_v1.JobList{}
+	if err := r.client.List(context.TODO(), jobList, client.InNamespace(m.Namespace), client.MatchingLabels{
+		searchingLabel:    m.Name,
+		opsRunnerJobLabel: m.Name,
+	}); err != nil {
+		return err
+	}
+
+	opsRunnerStatus := m.Status.OpsRunner.DeepCopy()
+	if opsRunnerStatus == nil {
+		opsRunnerStatus = &qlikv1.OpsRunnerStatus{}
+	}
+
+	cronJob := &batch_v1beta1.CronJob{}
+	if err := r.getCronJob(types.NamespacedName{Name: m.Name + opsRunnerJobNameSuffix, Namespace: m.Namespace}, cronJob); err == nil {
+		if cronJob.Status.LastScheduleTime != nil {
+			opsRunnerStatus.LastScheduleTime = cronJob.Status.LastScheduleTime.DeepCopy()
+		}
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+
+	if lastFailedJob := recordFinishedOpsRunnerJobs(opsRunnerStatus, jobList.Items); lastFailedJob != nil {
+		podName, reason := r.getFailedJobPodDetails(reqLogger, lastFailedJob)
+		if reason != "" {
+			opsRunnerStatus.LastExitReason = fmt.Sprintf("%v (%v)", opsRunnerStatus.LastExitReason, reason)
+		}
+		opsRunnerStatus.LastFailedPodName = podName
+	}
+	recordSyncJobResult(opsRunnerStatus.LastSyncRequest, jobList.Items)
+
+	failureThreshold := getOperatorConfig().OpsRunner.FailureThreshold
+	degraded := failureThreshold > 0 && opsRunnerStatus.ConsecutiveFailures >= failureThreshold
+	degradedCondition := m.Status.Conditions.GetCondition(opsRunnerDegradedType)
+	wasDegraded := degradedCondition != nil && degradedCondition.IsTrue()
+	if equalOpsRunnerStatus(m.Status.OpsRunner, opsRunnerStatus) && degraded == wasDegraded {
+		return nil
+	}
+
+	m.Status.OpsRunner = opsRunnerStatus
+	if degraded {
+		reqLogger.Info("OpsRunner is degraded", "consecutiveFailures", opsRunnerStatus.ConsecutiveFailures)
+		return r.setCrStatus(reqLogger, m, string(corev1.ConditionTrue), opsRunnerDegradedType,
+			fmt.Sprintf("%v consecutive ops runner jobs failed", opsRunnerStatus.ConsecutiveFailures))
+	} else if degradedCondition != nil {
+		return r.setCrStatus(reqLogger, m, string(corev1.ConditionFalse), opsRunnerDegradedType, "")
+	}
+	return r.client.Status().Update(context.TODO(), m)
+}
+
+// recordFinishedOpsRunnerJobs updates the status with the jobs that finished after the last recorded one,
+// in the order they finished. It returns the last failed job that was recorded, if any.
+func recordFinishedOpsRunnerJobs(opsRunnerStatus *qlikv1.OpsRunnerStatus, jobs []batch_v1.Job) *batch_v1.Job {
+	var lastFailedJob *batch_v1.Job
+	for _, finished := range getFinishedJobs(jobs, opsRunnerStatus.LastFinishedTime) {
+		finishTime := finished.finishTime
+		opsRunnerStatus.LastJobName = finished.job.Name
+		opsRunnerStatus.LastFinishedTime = &finishTime
+		if startTime := finished.job.Status.StartTime; startTime != nil {
+			opsRunnerStatus.LastDuration = &metav1.Duration{Duration: finishTime.Sub(startTime.Time).Round(time.Second)}
+			if opsRunnerStatus.LastScheduleTime == nil || opsRunnerStatus.LastScheduleTime.Before(startTime) {
+				opsRunnerStatus.LastScheduleTime = startTime.DeepCopy()
+			}
+		}
+		if finished.succeeded {
+			opsRunnerStatus.LastSuccessTime = &finishTime
+			opsRunnerStatus.ConsecutiveFailures = 0
+			lastFailedJob = nil
+		} else {
+			opsRunnerStatus.LastFailureTime = &finishTime
+			opsRunnerStatus.LastExitReason = finished.reason
+			opsRunnerStatus.ConsecutiveFailures++
+			lastFailedJob = finished.job
+		}
+	}
+	return lastFailedJob
+}
+
+type finishedJob struct {
+	job        *batch_v1.Job
+	succeeded  bool
+	finishTime metav1.Time
+	reason     string
+}
+
+// getFinishedJobs returns the jobs that finished after the last recorded finish time, in the order they finished
+func getFinishedJobs(jobs []batch_v1.Job, lastFinishedTime *metav1.Time) []finishedJob {
+	var finishedJobs []finishedJob
+	for i := range jobs {
+		if finished, succeeded, finishTime, reason := getJobResult(&jobs[i]); finished {
+			if lastFinishedTime != nil && !finishTime.After(lastFinishedTime.Time) {
+				continue
+			}
+			finishedJobs = append(finishedJobs, finishedJob{job: &jobs[i], succeeded: succeeded, finishTime: finishTime, reason: reason})
+		}
+	}
+	sort.SliceStable(finishedJobs, func(i, j int) bool {
+		return finishedJobs[i].finishTime.Before(&finishedJobs[j].finishTime)
+	})
+	return finishedJobs
+}
+
+// getJobResult tells if the job finished, if it succeeded, when it finished and why it failed
+func getJobResult(job *batch_v1.Job) (finished bool, succeeded bool, finishTime metav1.Time, reason string) {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batch_v1.JobComplete:
+			if job.Status.CompletionTime != nil {
+				return true, true, *job.Status.CompletionTime, ""
+			}
+			return true, true, condition.LastTransitionTime, ""
+		case batch_v1.JobFailed:
+			reason := condition.Reason
+			if condition.Message != "" {
+				reason = fmt.Sprintf("%v: %v", condition.Reason, condition.Message)
+			}
+			return true, false, condition.LastTransitionTime, reason
+		}
+	}
+	return false, false, metav1.Time{}, ""
+}
+
+// getFailedJobPodDetails returns the name and the termination reason of the last failed pod of the job. The log of the
+// pod is not recorded, it can hold the rendered secrets, and is left to the users allowed to read it with kubectl logs.
+func (r *ReconcileQliksense) getFailedJobPodDetails(reqLogger logr.Logger, job *batch_v1.Job) (string, string) {
+	podList := &corev1.PodList{}
+	if err := r.client.List(context.TODO(), podList, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		reqLogger.Error(err, "cannot list pods of the failed ops runner job", "job", job.Name)
+		return "", ""
+	}
+
+	var failedPod *corev1.Pod
+	var terminated *corev1.ContainerStateTerminated
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		for _, containerStatus := range pod.Status.ContainerStatuses {
+			state := containerStatus.State.Terminated
+			if state == nil {
+				state = containerStatus.LastTerminationState.Terminated
+			}
+			if state != nil && state.ExitCode != 0 && (terminated == nil || terminated.FinishedAt.Before(&state.FinishedAt)) {
+				failedPod, terminated = pod, state
+			}
+		}
+	}
+	if failedPod == nil {
+		return "", ""
+	}
+
+	return failedPod.Name, fmt.Sprintf("container exited with code %v: %v", terminated.ExitCode, terminated.Reason)
+}
+
+func equalOpsRunnerStatus(a, b *qlikv1.OpsRunnerStatus) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.LastJobName == b.LastJobName &&
+		a.ConsecutiveFailures == b.ConsecutiveFailures &&
+		a.LastExitReason == b.LastExitReason &&
+		equalTime(a.LastScheduleTime, b.LastScheduleTime) &&
+		equalTime(a.LastFinishedTime, b.LastFinishedTime) &&
+		equalSyncRequestStatus(a.LastSyncRequest, b.LastSyncRequest)
+}
+
+func equalTime(a, b *metav1.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(b)
+}
@@ -0,0 +1,121 @@
+package qliksense
+
+import (
+	"testing"
+	"time"
+
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	batch_v1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func Test_recordFinishedOpsRunnerJobs(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	finishedJob := func(name string, minutesAgo int, succeeded bool) batch_v1.Job {
+		startTime := metav1.NewTime(now.Add(-time.Duration(minutesAgo)*time.Minute - 30*time.Second))
+		finishTime := metav1.NewTime(now.Add(-time.Duration(minutesAgo) * time.Minute))
+		job := batch_v1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status:     batch_v1.JobStatus{StartTime: &startTime},
+		}
+		if succeeded {
+			job.Status.CompletionTime = &finishTime
+			job.Status.Conditions = []batch_v1.JobCondition{{Type: batch_v1.JobComplete, Status: corev1.ConditionTrue, LastTransitionTime: finishTime}}
+		} else {
+			job.Status.Conditions = []batch_v1.JobCondition{{Type: batch_v1.JobFailed, Status: corev1.ConditionTrue, LastTransitionTime: finishTime, Reason: "BackoffLimitExceeded"}}
+		}
+		return job
+	}
+	runningJob := batch_v1.Job{ObjectMeta: metav1.ObjectMeta{Name: "running"}}
+
+	var testCases = []struct {
+		name                string
+		status              qlikv1.OpsRunnerStatus
+		jobs                []batch_v1.Job
+		expectedLastJob     string
+		expectedFailures    int32
+		expectLastFailedJob bool
+	}{
+		{
+			name:             "no finished jobs",
+			jobs:             []batch_v1.Job{runningJob},
+			expectedFailures: 0,
+		},
+		{
+			name:                "failures after a success are counted",
+			jobs:                []batch_v1.Job{finishedJob("job-2", 10, false), finishedJob("job-1", 20, true), finishedJob("job-3", 0, false), runningJob},
+			expectedLastJob:     "job-3",
+			expectedFailures:    2,
+			expectLastFailedJob: true,
+		},
+		{
+			name:             "success resets failures",
+			status:           qlikv1.OpsRunnerStatus{ConsecutiveFailures: 5},
+			jobs:             []batch_v1.Job{finishedJob("job-1", 20, false), finishedJob("job-2", 10, true)},
+			expectedLastJob:  "job-2",
+			expectedFailures: 0,
+		},
+		{
+			name: "already recorded jobs are not counted again",
+			status: func() qlikv1.OpsRunnerStatus {
+				lastFinishedTime := metav1.NewTime(now.Add(-10 * time.Minute))
+				return qlikv1.OpsRunnerStatus{LastJobName: "job-2", LastFinishedTime: &lastFinishedTime, ConsecutiveFailures: 2}
+			}(),
+			jobs:                []batch_v1.Job{finishedJob("job-1", 20, false), finishedJob("job-2", 10, false), finishedJob("job-3", 0, false)},
+			expectedLastJob:     "job-3",
+			expectedFailures:    3,
+			expectLastFailedJob: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			status := testCase.status.DeepCopy()
+			lastFailedJob := recordFinishedOpsRunnerJobs(status, testCase.jobs)
+			if status.LastJobName != testCase.expectedLastJob {
+				t.Fatalf("expected last job to be: %v, but got: %v", testCase.expectedLastJob, status.LastJobName)
+			} else if status.ConsecutiveFailures != testCase.expectedFailures {
+				t.Fatalf("expected %v consecutive failures, but got: %v", testCase.expectedFailures, status.ConsecutiveFailures)
+			} else if (lastFailedJob != nil) != testCase.expectLastFailedJob {
+				t.Fatalf("expected a last failed job: %v, but got: %v", testCase.expectLastFailedJob, lastFailedJob)
+			}
+			if testCase.expectLastFailedJob {
+				if status.LastExitReason != "BackoffLimitExceeded" {
+					t.Fatalf("unexpected exit reason: %v", status.LastExitReason)
+				} else if status.LastDuration == nil || status.LastDuration.Duration != 30*time.Second {
+					t.Fatalf("unexpected duration: %v", status.LastDuration)
+				}
+			}
+		})
+	}
+}
+
+func Test_getFailedJobPodDetails(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := metav1.Now()
+	failedPod := func(name string, finishedAt metav1.Time) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"job-name": "qlik-default-ops-runner-1"}},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1, Reason: "Error", FinishedAt: finishedAt}},
+			}}},
+		}
+	}
+	r := &ReconcileQliksense{client: fake.NewFakeClientWithScheme(scheme,
+		failedPod("qlik-default-ops-runner-1-a", metav1.NewTime(now.Add(-time.Minute))),
+		failedPod("qlik-default-ops-runner-1-b", now),
+	)}
+	job := &batch_v1.Job{ObjectMeta: metav1.ObjectMeta{Name: "qlik-default-ops-runner-1", Namespace: "default"}}
+	if podName, reason := r.getFailedJobPodDetails(log, job); podName != "qlik-default-ops-runner-1-b" {
+		t.Fatalf("expected the last failed pod, but got: %v", podName)
+	} else if reason != "container exited with code 1: Error" {
+		t.Fatalf("unexpected reason: %v", reason)
+	}
+}
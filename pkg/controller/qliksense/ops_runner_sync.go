@@ -0,0 +1,135 @@
+package qliksense
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/go-logr/logr"
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	batch_v1 "k8s.io/api/batch/v1"
+	batch_v1beta1 "k8s.io/api/batch/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	syncRequestedAnnotation = "qlik.com/sync-requested"
+	syncRequestJobLabel     = "qlik.com/sync-request"
+	syncJobNameSuffix       = "-sync-"
+
+	syncResultRunning   = "Running"
+	syncResultSucceeded = "Succeeded"
+	syncResultFailed    = "Failed"
+	syncResultSkipped   = "Skipped"
+
+	syncJobCacheGracePeriod = time.Minute
+)
+
+// handleSyncRequest spawns a one-off job from the template of the ops runner CronJob when the value of the
+// qlik.com/sync-requested annotation differs from the last handled one, the same way `kubectl create job --from` does
+func (r *ReconcileQliksense) handleSyncRequest(reqLogger logr.Logger, m *qlikv1.Qliksense) error {
+	requested := m.GetAnnotations()[syncRequestedAnnotation]
+	if requested == "" {
+		return nil
+	}
+	opsRunnerStatus := m.Status.OpsRunner.DeepCopy()
+	if opsRunnerStatus == nil {
+		opsRunnerStatus = &qlikv1.OpsRunnerStatus{}
+	}
+	if opsRunnerStatus.LastSyncRequest != nil && opsRunnerStatus.LastSyncRequest.Requested == requested {
+		return nil
+	}
+	if isSyncWindowClosed(m) {
+		reqLogger.Info("The sync request will be handled when the sync windows open", "requested", requested)
+		addPendingChange(m, "sync request "+requested)
+		return nil
+	}
+
+	now := metav1.Now()
+	syncRequest := &qlikv1.SyncRequestStatus{Requested: requested, HandledTime: &now}
+	cronJob := &batch_v1beta1.CronJob{}
+	if getRequiredOpsRunnerJobKind(m) != OpsRunnerJobKindCronJob {
+		syncRequest.Result = syncResultSkipped
+		syncRequest.Message = "the ops runner is not scheduled with a CronJob"
+	} else if err := r.getCronJob(types.NamespacedName{Name: m.Name + opsRunnerJobNameSuffix, Namespace: m.Namespace}, cronJob); err != nil {
+		return err
+	} else if job, err := r.getSyncJob(cronJob, requested); err != nil {
+		return err
+	} else {
+		reqLogger.Info("Creating the OpsRunner sync job", "requested", requested, "Job.Name", job.Name)
+		if err := r.client.Create(context.TODO(), job); err != nil && !errors.IsAlreadyExists(err) {
+			reqLogger.Error(err, "Failed to create the OpsRunner sync job", "Job.Name", job.Name)
+			return err
+		}
+		syncRequest.JobName = job.Name
+		syncRequest.Result = syncResultRunning
+	}
+
+	opsRunnerStatus.LastSyncRequest = syncRequest
+	m.Status.OpsRunner = opsRunnerStatus
+	return r.client.Status().Update(context.TODO(), m)
+}
+
+// getSyncJob returns a job created from the job template of the CronJob. The name is derived from the requested
+// value, so that a request is not run twice when the status could not be updated after the job was created.
+func (r *ReconcileQliksense) getSyncJob(cronJob *batch_v1beta1.CronJob, requested string) (*batch_v1.Job, error) {
+	hash := fnv.New32a()
+	hash.Write([]byte(requested))
+	requestHash := fmt.Sprintf("%08x", hash.Sum32())
+
+	job := &batch_v1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("%v%v%v", cronJob.Name, syncJobNameSuffix, requestHash),
+			Namespace:   cronJob.Namespace,
+			Labels:      make(map[string]string),
+			Annotations: map[string]string{"cronjob.kubernetes.io/instantiate": "manual"},
+		},
+		Spec: *cronJob.Spec.JobTemplate.Spec.DeepCopy(),
+	}
+	for key, value := range cronJob.Spec.JobTemplate.Labels {
+		job.Labels[key] = value
+	}
+	job.Labels[syncRequestJobLabel] = requestHash
+	for key, value := range cronJob.Spec.JobTemplate.Annotations {
+		job.Annotations[key] = value
+	}
+	job.OwnerReferences = []metav1.OwnerReference{*r.getCronJobControllerRef(cronJob)}
+	return job, nil
+}
+
+// recordSyncJobResult updates the result of a running sync request from its job
+func recordSyncJobResult(syncRequest *qlikv1.SyncRequestStatus, jobs []batch_v1.Job) {
+	if syncRequest == nil || syncRequest.Result != syncResultRunning {
+		return
+	}
+	for i := range jobs {
+		if jobs[i].Name != syncRequest.JobName {
+			continue
+		}
+		if finished, succeeded, finishTime, reason := getJobResult(&jobs[i]); finished {
+			syncRequest.FinishedTime = &finishTime
+			if succeeded {
+				syncRequest.Result = syncResultSucceeded
+			} else {
+				syncRequest.Result = syncResultFailed
+				syncRequest.Message = reason
+			}
+		}
+		return
+	}
+	// the job may not be in the cache yet right after it was created
+	if syncRequest.HandledTime == nil || time.Since(syncRequest.HandledTime.Time) > syncJobCacheGracePeriod {
+		syncRequest.Result = syncResultFailed
+		syncRequest.Message = fmt.Sprintf("job %v was deleted before it finished", syncRequest.JobName)
+	}
+}
+
+func equalSyncRequestStatus(a, b *qlikv1.SyncRequestStatus) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Requested == b.Requested && a.JobName == b.JobName && a.Result == b.Result
+}
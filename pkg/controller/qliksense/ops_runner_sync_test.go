@@ -0,0 +1,145 @@
+package qliksense
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/qlik-oss/qliksense-operator/pkg/apis"
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	batch_v1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func Test_handleSyncRequest(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := apis.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m := &qlikv1.Qliksense{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "qlik-default",
+			Namespace:   "default",
+			UID:         "qlik-default-uid",
+			Annotations: map[string]string{syncRequestedAnnotation: "2020-04-01T10:00:00Z"},
+		},
+		Spec: &qlikv1.QliksenseSpec{
+			OpsRunner: &qlikv1.OpsRunnerSpec{},
+		},
+	}
+	m.Spec.OpsRunner.Enabled = "yes"
+	m.Spec.OpsRunner.Schedule = "*/10 * * * *"
+	m.Spec.OpsRunner.Image = "qliksense-repo-watcher"
+
+	r := &ReconcileQliksense{scheme: scheme}
+	reqLogger := log.WithName("test")
+	cronJob, err := r.getOpsRunnerCronJob(reqLogger, m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r.client = fake.NewFakeClientWithScheme(scheme, m, cronJob)
+
+	for i := 0; i < 2; i++ {
+		if err := r.handleSyncRequest(reqLogger, m); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	jobList := &batch_v1.JobList{}
+	if err := r.client.List(context.TODO(), jobList, client.InNamespace(m.Namespace)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(jobList.Items) != 1 {
+		t.Fatalf("expected 1 sync job, but got: %v", len(jobList.Items))
+	}
+	job := jobList.Items[0]
+	if job.Labels[opsRunnerJobLabel] != m.Name || job.Labels[syncRequestJobLabel] == "" {
+		t.Fatalf("expected the sync job to be labelled as an ops runner job, but got: %v", job.Labels)
+	} else if owner := metav1.GetControllerOf(&job); owner == nil || owner.Kind != "CronJob" {
+		t.Fatalf("expected the sync job to be owned by the CronJob, but got: %v", owner)
+	} else if job.Spec.Template.Spec.Containers[0].Image != "qliksense-repo-watcher" {
+		t.Fatalf("expected the sync job to be created from the CronJob template, but got: %v", job.Spec.Template.Spec.Containers[0].Image)
+	}
+
+	syncRequest := m.Status.OpsRunner.LastSyncRequest
+	if syncRequest == nil || syncRequest.Requested != "2020-04-01T10:00:00Z" || syncRequest.JobName != job.Name || syncRequest.Result != syncResultRunning {
+		t.Fatalf("expected the sync request to be recorded as running, but got: %v", syncRequest)
+	}
+
+	m.Annotations[syncRequestedAnnotation] = "2020-04-01T11:00:00Z"
+	m.Spec.OpsRunner.Schedule = ""
+	if err := r.handleSyncRequest(reqLogger, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if syncRequest := m.Status.OpsRunner.LastSyncRequest; syncRequest.Result != syncResultSkipped {
+		t.Fatalf("expected the sync request to be skipped without a CronJob, but got: %v", syncRequest.Result)
+	}
+}
+
+func Test_recordSyncJobResult(t *testing.T) {
+	finishTime := metav1.NewTime(time.Date(2020, 4, 1, 10, 5, 0, 0, time.UTC))
+	recently := metav1.Now()
+	longAgo := metav1.NewTime(time.Now().Add(-time.Hour))
+	testCases := []struct {
+		name            string
+		syncRequest     *qlikv1.SyncRequestStatus
+		jobs            []batch_v1.Job
+		expectedResult  string
+		expectedMessage string
+	}{
+		{
+			name:           "job succeeded",
+			syncRequest:    &qlikv1.SyncRequestStatus{JobName: "sync", Result: syncResultRunning, HandledTime: &recently},
+			jobs:           []batch_v1.Job{testSyncJob("sync", batch_v1.JobComplete, "", finishTime)},
+			expectedResult: syncResultSucceeded,
+		},
+		{
+			name:            "job failed",
+			syncRequest:     &qlikv1.SyncRequestStatus{JobName: "sync", Result: syncResultRunning, HandledTime: &recently},
+			jobs:            []batch_v1.Job{testSyncJob("sync", batch_v1.JobFailed, "BackoffLimitExceeded", finishTime)},
+			expectedResult:  syncResultFailed,
+			expectedMessage: "BackoffLimitExceeded",
+		},
+		{
+			name:           "job not in the cache yet",
+			syncRequest:    &qlikv1.SyncRequestStatus{JobName: "sync", Result: syncResultRunning, HandledTime: &recently},
+			expectedResult: syncResultRunning,
+		},
+		{
+			name:            "job deleted",
+			syncRequest:     &qlikv1.SyncRequestStatus{JobName: "sync", Result: syncResultRunning, HandledTime: &longAgo},
+			expectedResult:  syncResultFailed,
+			expectedMessage: "job sync was deleted before it finished",
+		},
+		{
+			name:           "already finished",
+			syncRequest:    &qlikv1.SyncRequestStatus{JobName: "sync", Result: syncResultSucceeded, HandledTime: &longAgo},
+			expectedResult: syncResultSucceeded,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			recordSyncJobResult(testCase.syncRequest, testCase.jobs)
+			if testCase.syncRequest.Result != testCase.expectedResult {
+				t.Fatalf("expected result: %v, but got: %v", testCase.expectedResult, testCase.syncRequest.Result)
+			} else if testCase.syncRequest.Message != testCase.expectedMessage {
+				t.Fatalf("expected message: %v, but got: %v", testCase.expectedMessage, testCase.syncRequest.Message)
+			}
+		})
+	}
+}
+
+func testSyncJob(name string, conditionType batch_v1.JobConditionType, reason string, finishTime metav1.Time) batch_v1.Job {
+	return batch_v1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: batch_v1.JobStatus{
+			Conditions: []batch_v1.JobCondition{
+				{Type: conditionType, Status: corev1.ConditionTrue, Reason: reason, LastTransitionTime: finishTime},
+			},
+		},
+	}
+}
@@ -2,8 +2,7 @@ package qliksense
 
 import (
 	"context"
-
-	"k8s.io/apimachinery/pkg/api/errors"
+	"encoding/json"
 
 	"github.com/go-logr/logr"
 	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
@@ -15,14 +14,20 @@ import (
 	networking_v1beta1 "k8s.io/api/networking/v1beta1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/client-go/dynamic"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
+// clusterScopedResources cannot carry an owner reference to the namespaced Qliksense CR,
+// they are tracked with the ownerNamespaceLabel instead
+var clusterScopedResources = []schema.GroupVersionResource{
+	{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"},
+	{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterrolebindings"},
+	{Group: "scheduling.k8s.io", Version: "v1", Resource: "priorityclasses"},
+}
+
 func (r *ReconcileQliksense) updateResourceOwner(reqLogger logr.Logger, instance *qlikv1.Qliksense) error {
 	if err := r.updateServiceOwner(reqLogger, instance); err != nil {
 		reqLogger.Error(err, "cannot update service owner")
@@ -77,15 +82,17 @@ func (r *ReconcileQliksense) updateResourceOwner(reqLogger logr.Logger, instance
 		return err
 	}
 
-	customResources := []schema.GroupVersionResource{
-		{Group: "qixmanager.qlik.com", Version: "v1", Resource: "engines"},
-		{Group: "qixengine.qlik.com", Version: "v1", Resource: "engines"},
-		{Group: "qixengine.qlik.com", Version: "v1", Resource: "enginetemplates"},
-		{Group: "qixengine.qlik.com", Version: "v1", Resource: "enginevariants"},
-	}
-	for _, customResource := range customResources {
-		if err := r.updateGroupVersionResourceOwner(reqLogger, instance, customResource); err != nil {
-			reqLogger.Error(err, "cannot update custom resource owner using dynamic client", "GroupVersionResource", customResource)
+	for _, customResource := range r.customResources.Owned {
+		groupVersionResource, served, err := r.clients.resolve(customResource)
+		if err != nil {
+			reqLogger.Error(err, "cannot resolve custom resource version", "GroupVersionsResource", customResource)
+			return err
+		} else if !served {
+			reqLogger.Info("WARNING: cannot update ownership because no version of the custom resource is served", "GroupVersionsResource", customResource)
+			continue
+		}
+		if err := r.updateGroupVersionResourceOwner(reqLogger, instance, groupVersionResource); err != nil {
+			reqLogger.Error(err, "cannot update custom resource owner using dynamic client", "GroupVersionResource", groupVersionResource)
 			return err
 		}
 	}
@@ -100,6 +107,13 @@ func (r *ReconcileQliksense) updateResourceOwner(reqLogger logr.Logger, instance
 		}
 	}
 
+	for _, clusterResource := range clusterScopedResources {
+		if err := r.updateClusterScopedResourceOwner(reqLogger, instance, clusterResource); err != nil {
+			reqLogger.Error(err, "cannot track cluster-scoped resource using dynamic client", "GroupVersionResource", clusterResource)
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -295,7 +309,7 @@ func (r *ReconcileQliksense) updatePvcOwner(reqLogger logr.Logger, q *qlikv1.Qli
 func (r *ReconcileQliksense) updateCronJobOwner(reqLogger logr.Logger, q *qlikv1.Qliksense) error {
 
 	listObj := &batch_v1beta1.CronJobList{}
-	if err := r.client.List(context.TODO(), listObj, client.MatchingLabels{searchingLabel: q.Name}); err != nil {
+	if err := r.listCronJobs(listObj, client.MatchingLabels{searchingLabel: q.Name}); err != nil {
 		return err
 	}
 	for _, cm := range listObj.Items {
@@ -311,7 +325,7 @@ func (r *ReconcileQliksense) updateCronJobOwner(reqLogger logr.Logger, q *qlikv1
 		}
 		if err := controllerutil.SetControllerReference(q, &cm, r.scheme); err != nil {
 			return err
-		} else if err := r.client.Update(context.TODO(), &cm); err != nil {
+		} else if err := r.updateCronJob(&cm); err != nil {
 			return err
 		}
 		reqLogger.Info("update owner for CronJob [ " + cm.Name + " ]")
@@ -456,52 +470,98 @@ func (r *ReconcileQliksense) updateNetworkPolicyOwner(reqLogger logr.Logger, q *
 	return nil
 }
 
-// TODO: use dynamic client for all other standard resources, so that only one method can be used
+// TODO: use metadata client for all other standard resources, so that only one method can be used
 func (r *ReconcileQliksense) updateGroupVersionResourceOwner(reqLogger logr.Logger, q *qlikv1.Qliksense, groupVersionResource schema.GroupVersionResource) error {
-	// Get a config to talk to the apiserver
-	cfg, err := config.GetConfig()
+	list, err := r.clients.listReleaseMetadata(groupVersionResource, q.Namespace, releaseSelector(q))
 	if err != nil {
 		return err
 	}
+	// create owner reference object
+	ref := *metav1.NewControllerRef(q, q.GroupVersionKind())
 
-	dynamicClient, err := dynamic.NewForConfig(cfg)
-	if err != nil {
-		return err
+	for _, d := range list {
+		alreadySet := false
+		for _, or := range d.GetOwnerReferences() {
+			if or.Name == q.GetName() {
+				alreadySet = true
+				break
+			}
+		}
+		if alreadySet {
+			continue
+		}
+		patchBytes, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": d.GetResourceVersion(),
+				"ownerReferences": mergeOwnerReference(d.GetOwnerReferences(), ref),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := r.clients.metadata.Resource(groupVersionResource).Namespace(q.Namespace).Patch(d.GetName(), types.MergePatchType, patchBytes, metav1.PatchOptions{}); err != nil {
+			return err
+		}
+		reqLogger.Info("update owner for resource [ "+d.GetName()+" ]", "GroupVersionResource", groupVersionResource)
 	}
+	return nil
+}
 
-	list, err := dynamicClient.Resource(groupVersionResource).Namespace(q.Namespace).List(metav1.ListOptions{})
-	if err != nil {
-		if errors.IsNotFound(err) {
-			reqLogger.Info("WARNING: cannot update ownership because resources are not found", "GroupVersionResource", groupVersionResource)
-			return nil
+// mergeOwnerReference adds ref to the existing owner references without dropping any of them.
+// An object can only have one controller, so ref is demoted to a plain owner reference
+// if some other owner is already the controller.
+func mergeOwnerReference(refs []metav1.OwnerReference, ref metav1.OwnerReference) []metav1.OwnerReference {
+	merged := make([]metav1.OwnerReference, 0, len(refs)+1)
+	hasOtherController := false
+	for _, or := range refs {
+		if or.UID == ref.UID {
+			continue
 		}
+		if or.Controller != nil && *or.Controller {
+			hasOtherController = true
+		}
+		merged = append(merged, or)
+	}
+	if hasOtherController {
+		isController := false
+		ref.Controller = &isController
+	}
+	return append(merged, ref)
+}
+
+// updateClusterScopedResourceOwner marks cluster-scoped resources of the release (ClusterRoles, ClusterRoleBindings, PriorityClasses ...)
+// as belonging to this instance. Cluster-scoped objects cannot have a namespaced owner, so they are
+// tracked by labels/annotations and deleted explicitly by the finalizer. The owner uid of the resources tracked for a
+// previous CR of the same name and namespace is replaced with the uid of this instance.
+func (r *ReconcileQliksense) updateClusterScopedResourceOwner(reqLogger logr.Logger, q *qlikv1.Qliksense, groupVersionResource schema.GroupVersionResource) error {
+	list, err := r.clients.listClusterScopedReleaseMetadata(groupVersionResource, releaseSelector(q))
+	if err != nil {
 		return err
 	}
-	// create owner reference object
-	ref := *metav1.NewControllerRef(q, q.GroupVersionKind())
 
-	for _, d := range list.Items {
-		rls, _, err := unstructured.NestedString(d.Object, "metadata", "labels", searchingLabel)
+	for _, d := range list {
+		if ownerNamespace, ok := d.GetLabels()[ownerNamespaceLabel]; ok {
+			if ownerNamespace != q.GetNamespace() {
+				reqLogger.Info("WARNING: cluster-scoped resource is already tracked by another namespace", "GroupVersionResource", groupVersionResource, "name", d.GetName(), "namespace", ownerNamespace)
+				continue
+			} else if d.GetAnnotations()[ownerUidAnnotation] == string(q.GetUID()) {
+				continue
+			}
+		}
+		patchBytes, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": d.GetResourceVersion(),
+				"labels":          map[string]string{ownerNamespaceLabel: q.GetNamespace()},
+				"annotations":     map[string]string{ownerUidAnnotation: string(q.GetUID())},
+			},
+		})
 		if err != nil {
 			return err
 		}
-		if rls == q.Name {
-			alreadySet := false
-			for _, or := range d.GetOwnerReferences() {
-				if or.Name == q.GetName() {
-					alreadySet = true
-					break
-				}
-			}
-			if alreadySet {
-				continue
-			}
-			d.SetOwnerReferences([]metav1.OwnerReference{ref})
-			if _, updateErr := dynamicClient.Resource(groupVersionResource).Namespace(q.Namespace).Update(&d, metav1.UpdateOptions{}); updateErr != nil {
-				return err
-			}
+		if _, err := r.clients.metadata.Resource(groupVersionResource).Patch(d.GetName(), types.MergePatchType, patchBytes, metav1.PatchOptions{}); err != nil {
+			return err
 		}
-		reqLogger.Info("update owner for resource", "GroupVersionResource", groupVersionResource)
+		reqLogger.Info("tracking cluster-scoped resource [ "+d.GetName()+" ]", "GroupVersionResource", groupVersionResource)
 	}
 	return nil
 }
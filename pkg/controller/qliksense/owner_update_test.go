@@ -0,0 +1,116 @@
+package qliksense
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func Test_mergeOwnerReference(t *testing.T) {
+	isController := true
+	qliksenseRef := metav1.OwnerReference{APIVersion: "qlik.com/v1", Kind: "Qliksense", Name: "qlik-default", UID: types.UID("qliksense-uid"), Controller: &isController}
+	otherRef := metav1.OwnerReference{APIVersion: "v1", Kind: "ConfigMap", Name: "other", UID: types.UID("other-uid")}
+	otherControllerRef := metav1.OwnerReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "other-controller", UID: types.UID("other-controller-uid"), Controller: &isController}
+
+	var testCases = []struct {
+		name             string
+		refs             []metav1.OwnerReference
+		expectedLen      int
+		expectController bool
+	}{
+		{
+			name:             "no existing owners",
+			refs:             nil,
+			expectedLen:      1,
+			expectController: true,
+		},
+		{
+			name:             "existing owner is kept",
+			refs:             []metav1.OwnerReference{otherRef},
+			expectedLen:      2,
+			expectController: true,
+		},
+		{
+			name:             "existing controller is kept and new reference is not a controller",
+			refs:             []metav1.OwnerReference{otherRef, otherControllerRef},
+			expectedLen:      3,
+			expectController: false,
+		},
+		{
+			name:             "same owner is not duplicated",
+			refs:             []metav1.OwnerReference{qliksenseRef, otherRef},
+			expectedLen:      2,
+			expectController: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			merged := mergeOwnerReference(testCase.refs, qliksenseRef)
+			if len(merged) != testCase.expectedLen {
+				t.Fatalf("expected %v owner references, but got: %v", testCase.expectedLen, len(merged))
+			}
+			added := merged[len(merged)-1]
+			if added.UID != qliksenseRef.UID {
+				t.Fatalf("expected the last owner reference to be: %v, but got: %v", qliksenseRef.UID, added.UID)
+			}
+			if isAddedController := added.Controller != nil && *added.Controller; isAddedController != testCase.expectController {
+				t.Fatalf("expected controller to be: %v, but got: %v", testCase.expectController, isAddedController)
+			}
+		})
+	}
+	if *qliksenseRef.Controller != true {
+		t.Fatal("expected the original owner reference not to be modified")
+	}
+}
+
+func Test_updateClusterScopedResourceOwner(t *testing.T) {
+	q := &qlikv1.Qliksense{ObjectMeta: metav1.ObjectMeta{Name: "qlik-default", Namespace: "default", UID: types.UID("qliksense-uid")}}
+	clusterRole := func(name string, ownerNamespace string, ownerUid string) metav1.PartialObjectMetadata {
+		clusterRole := metav1.PartialObjectMetadata{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{searchingLabel: q.Name}, Annotations: map[string]string{}},
+		}
+		if ownerNamespace != "" {
+			clusterRole.Labels[ownerNamespaceLabel] = ownerNamespace
+			clusterRole.Annotations[ownerUidAnnotation] = ownerUid
+		}
+		return clusterRole
+	}
+	metadataClient := &countingMetadataClient{
+		objects: []metav1.PartialObjectMetadata{
+			clusterRole("untracked", "", ""),
+			clusterRole("tracked", q.Namespace, string(q.UID)),
+			// tracked for a deleted CR of the same name and namespace
+			clusterRole("stale", q.Namespace, "deleted-uid"),
+			clusterRole("other-namespace", "other", "other-uid"),
+		},
+		patches: map[string][]byte{},
+	}
+	clients := newTestSharedClients(metadataClient, q.Namespace)
+	defer close(clients.stopCh)
+	r := &ReconcileQliksense{clients: clients}
+
+	if err := waitForInformer(func() error {
+		return r.updateClusterScopedResourceOwner(log, q, clusterScopedResources[0])
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(metadataClient.patches) != 2 {
+		t.Fatalf("expected the untracked and stale cluster roles to be patched, but got: %v", metadataClient.patches)
+	}
+	for _, name := range []string{"untracked", "stale"} {
+		patch := struct {
+			Metadata metav1.ObjectMeta `json:"metadata"`
+		}{}
+		if err := json.Unmarshal(metadataClient.patches[name], &patch); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		} else if !reflect.DeepEqual(patch.Metadata.Labels, map[string]string{ownerNamespaceLabel: q.Namespace}) ||
+			!reflect.DeepEqual(patch.Metadata.Annotations, map[string]string{ownerUidAnnotation: string(q.UID)}) {
+			t.Fatalf("expected %v to be tracked for the CR, but got: %v", name, string(metadataClient.patches[name]))
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/banzaicloud/k8s-objectmatcher/patch"
 	"github.com/go-logr/logr"
+	"github.com/operator-framework/operator-sdk/pkg/k8sutil"
 	operator_status "github.com/operator-framework/operator-sdk/pkg/status"
 	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
 	_ "gopkg.in/yaml.v2"
@@ -23,6 +24,7 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	_ "k8s.io/client-go/discovery"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -40,8 +42,11 @@ const (
 	qliksenseFinalizer     = "finalizer.qliksense.qlik.com"
 	searchingLabel         = "release"
 	opsRunnerJobNameSuffix = "-ops-runner"
-	maxDeletionWaitSeconds = 90 // 1.5 minutes
-	pullSecretName         = "artifactory-docker-secret"
+	// opsRunnerContainerAlias can be used in the pod template override to refer to the ops runner container
+	opsRunnerContainerAlias = "ops-runner"
+	pullSecretName          = "artifactory-docker-secret"
+	ownerNamespaceLabel     = "qlik.com/owner-namespace"
+	ownerUidAnnotation      = "qlik.com/owner-uid"
 )
 
 type OpsRunnerJobKind string
@@ -65,16 +70,60 @@ type OpsRunnerJob struct {
 // Add creates a new Qliksense Controller and adds it to the Manager. The Manager will set fields on the Controller
 // and Start it when the Manager is Started.
 func Add(mgr manager.Manager) error {
-	return add(mgr, newReconciler(mgr))
+	operatorConfig := getOperatorConfig()
+	if operatorConfigPath != "" && operatorConfig.ReloadPeriod.Duration > 0 {
+		reloader, err := newOperatorConfigReloader(operatorConfigPath, operatorFlags, operatorConfig)
+		if err != nil {
+			return err
+		} else if err := mgr.Add(reloader); err != nil {
+			return err
+		}
+	}
+	registryMirrors, err := loadRegistryMirrorsConfig(registryMirrorsConfigPath)
+	if err != nil {
+		return err
+	}
+	namespace, err := k8sutil.GetWatchNamespace()
+	if err != nil {
+		return err
+	}
+	clients, err := newSharedClients(mgr.GetConfig(), namespace)
+	if err != nil {
+		return err
+	} else if err := mgr.Add(clients); err != nil {
+		return err
+	}
+	cronJobGroupVersion, err := resolveCronJobGroupVersion(clients.discovery)
+	if err != nil {
+		return err
+	}
+	log.Info("Using CronJob version", "version", cronJobGroupVersion.String())
+	r := newReconciler(mgr, operatorConfig.CustomResources, registryMirrors, clients, cronJobGroupVersion)
+	if operatorConfig.Kuz.TLS.Enabled {
+		if r.kuzCABundleNamespace, _, err = getKuzCertificatesNamespace(namespace); err != nil {
+			return err
+		}
+	}
+	return add(mgr, r, cronJobGroupVersion)
 }
 
 // newReconciler returns a new reconcile.Reconciler
-func newReconciler(mgr manager.Manager) reconcile.Reconciler {
-	return &ReconcileQliksense{client: mgr.GetClient(), scheme: mgr.GetScheme(), qlikInstances: NewQIs()}
+func newReconciler(mgr manager.Manager, customResources *CustomResourcesConfig, registryMirrors *RegistryMirrorsConfig, clients *sharedClients, cronJobGroupVersion schema.GroupVersion) *ReconcileQliksense {
+	return &ReconcileQliksense{
+		client:          mgr.GetClient(),
+		scheme:          mgr.GetScheme(),
+		qlikInstances:   NewQIs(customResources, clients),
+		customResources: customResources,
+		registryMirrors: registryMirrors,
+		clients:         clients,
+		gitPoller:       newGitPoller(),
+
+		cronJobGroupVersion: cronJobGroupVersion,
+	}
 }
 
-// add adds a new Controller to mgr with r as the reconcile.Reconciler
-func add(mgr manager.Manager, r reconcile.Reconciler) error {
+// add adds a new Controller to mgr with r as the reconcile.Reconciler, CronJobs are watched in the served version
+func add(mgr manager.Manager, r *ReconcileQliksense, cronJobGroupVersion schema.GroupVersion) error {
 	logger := log.WithName("event watch")
 
 	// Create a new controller
@@ -105,9 +154,9 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	} else if err := c.Watch(&source.Kind{Type: &v1beta1.Ingress{}}, getEventHandler(), getPredicate(logger)); err != nil {
 		return err
-	} else if err := c.Watch(&source.Kind{Type: &batch_v1beta1.CronJob{}}, getEventHandler(), getPredicate(logger)); err != nil {
+	} else if err := c.Watch(&source.Kind{Type: newCronJobObject(cronJobGroupVersion)}, getEventHandler(), getPredicate(logger)); err != nil {
 		return err
-	} else if err := c.Watch(&source.Kind{Type: &batch_v1.Job{}}, getEventHandler(), getPredicate(logger)); err != nil {
+	} else if err := c.Watch(&source.Kind{Type: &batch_v1.Job{}}, getEventHandler(), getOpsRunnerJobPredicate()); err != nil {
 		return err
 	} else if err := c.Watch(&source.Kind{Type: &rbacv1.Role{}}, getEventHandler(), getPredicate(logger)); err != nil {
 		return err
@@ -115,6 +164,20 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	}
 
+	// Watch for changes to the Secrets referenced by a Qliksense, they are rendered into the ops runner config
+	if err := mgr.GetFieldIndexer().IndexField(&qlikv1.Qliksense{}, secretRefsIndex, getSecretRefs); err != nil {
+		return err
+	} else if err := c.Watch(&source.Kind{Type: &corev1.Secret{}}, getSecretRefsEventHandler(mgr.GetClient())); err != nil {
+		return err
+	}
+
+	// Watch for changes to the kustomize server CA bundle, it is copied to the namespaces of the other CRs
+	if r.kuzCABundleNamespace != "" {
+		if err := c.Watch(&source.Kind{Type: &corev1.ConfigMap{}}, getKuzCABundleEventHandler(mgr.GetClient(), r.kuzCABundleNamespace)); err != nil {
+			return err
+		}
+	}
+
 	//cannot watch engine resources. because we dont know the type yet
 	return nil
 }
@@ -152,9 +215,20 @@ var _ reconcile.Reconciler = &ReconcileQliksense{}
 type ReconcileQliksense struct {
 	// This client, initialized using mgr.Client() above, is a split client
 	// that reads objects from the cache and writes to the apiserver
-	client        client.Client
-	scheme        *runtime.Scheme
-	qlikInstances *QliksenseInstances
+	client          client.Client
+	scheme          *runtime.Scheme
+	qlikInstances   *QliksenseInstances
+	customResources *CustomResourcesConfig
+	registryMirrors *RegistryMirrorsConfig
+	// clients are shared informer-backed clients for resources that are not known to the scheme
+	clients *sharedClients
+	// gitPoller applies the git commits of the CRs in Poller mode
+	gitPoller *gitPoller
+	// cronJobGroupVersion is the version of CronJob served by the cluster, batch/v1beta1 when it is not set
+	cronJobGroupVersion schema.GroupVersion
+	// kuzCABundleNamespace is the namespace of the kustomize server CA bundle, it is copied to the namespaces of the
+	// other CRs
+	kuzCABundleNamespace string
 }
 
 // Reconcile reads that state of the cluster for a Qliksense object and makes changes based on the state read
@@ -193,7 +267,9 @@ func (r *ReconcileQliksense) Reconcile(request reconcile.Request) (reconcile.Res
 			// Run finalization logic for qliksenseFinalizer. If the
 			// finalization logic fails, don't remove the finalizer so
 			// that we can retry during the next reconciliation.
-			if err := r.finalizeQliksense(reqLogger, instance); err != nil {
+			if err := r.finalizeQliksense(reqLogger, instance); isInformerNotSynced(err) {
+				return reconcile.Result{RequeueAfter: informerSyncRequeue}, nil
+			} else if err != nil {
 				return reconcile.Result{}, err
 			}
 
@@ -216,16 +292,51 @@ func (r *ReconcileQliksense) Reconcile(request reconcile.Request) (reconcile.Res
 		}
 	*/
 
+	var requeueAfter time.Duration
 	if instance.Spec.OpsRunner != nil {
-		if err := r.setupOpsRunnerJob(reqLogger, instance); err != nil {
+		// the sync windows gate the changes applied by the ops runner and the git poller below
+		if instance.Status.SyncWindows, err = getSyncWindowsStatus(instance, time.Now()); err != nil {
+			r.setCrStatus(reqLogger, instance, "Valid", "Error", err.Error())
 			return reconcile.Result{}, err
 		}
+		if err := r.setupOpsRunnerRBAC(reqLogger, instance); err != nil {
+			return reconcile.Result{}, err
+		} else if err := r.publishKuzCABundle(reqLogger, instance); err != nil {
+			return reconcile.Result{}, err
+		} else if err := r.setupOpsRunnerConfigSecret(reqLogger, instance); err != nil {
+			return reconcile.Result{}, err
+		} else if err := r.setupOpsRunnerJob(reqLogger, instance); err != nil {
+			return reconcile.Result{}, err
+		}
+		if isGitPollerMode(instance) {
+			if requeueAfter, err = r.pollGitRepository(reqLogger, instance); err != nil {
+				return reconcile.Result{}, err
+			}
+		} else if getOperatorConfig().Features.SyncRequests {
+			if err := r.handleSyncRequest(reqLogger, instance); err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+		if wait := getSyncWindowRequeue(instance, time.Now()); wait > 0 && (requeueAfter == 0 || wait < requeueAfter) {
+			requeueAfter = wait
+		}
 		r.setCrStatus(reqLogger, instance, "Valid", "OpsRunnerMode", "")
+		if err := r.updateOpsRunnerStatus(reqLogger, instance); err != nil {
+			reqLogger.Error(err, "cannot update OpsRunner status")
+		}
 	} else {
+		instance.Status.SyncWindows = nil
 		r.setCrStatus(reqLogger, instance, "Valid", "CliMode", "")
 	}
 
-	if err := r.updateResourceOwner(reqLogger, instance); err != nil {
+	if err := r.setupScheduledOperations(reqLogger, instance); err != nil {
+		reqLogger.Error(err, "cannot set up the scheduled operations")
+		return reconcile.Result{}, err
+	}
+
+	if err := r.updateResourceOwner(reqLogger, instance); isInformerNotSynced(err) {
+		return reconcile.Result{RequeueAfter: informerSyncRequeue}, nil
+	} else if err != nil {
 		r.setCrStatus(reqLogger, instance, "Valid", "Error", err.Error())
 		return reconcile.Result{}, err
 	}
@@ -245,7 +356,7 @@ func (r *ReconcileQliksense) Reconcile(request reconcile.Request) (reconcile.Res
 		reqLogger.Info("Don't need to add a finalizer...")
 	}
 
-	return reconcile.Result{}, nil
+	return reconcile.Result{RequeueAfter: requeueAfter}, nil
 }
 
 func (r *ReconcileQliksense) finalizeQliksense(reqLogger logr.Logger, qlik *qlikv1.Qliksense) error {
@@ -282,22 +393,36 @@ func (r *ReconcileQliksense) finalizeQliksense(reqLogger logr.Logger, qlik *qlik
 		reqLogger.Error(err, "cannot delete Job. Finalizing anyway")
 		return nil
 	}
-	if err := r.deleteEngine(reqLogger, qlik); err != nil {
+	if err := r.deleteEngine(reqLogger, qlik); isInformerNotSynced(err) {
+		return err
+	} else if err != nil {
 		reqLogger.Error(err, "cannot delete Engine. Finalizing anyway")
 		return nil
 	}
+	if err := r.deleteClusterScopedResources(reqLogger, qlik); isInformerNotSynced(err) {
+		return err
+	} else if err != nil {
+		reqLogger.Error(err, "cannot delete cluster-scoped resources. Finalizing anyway")
+		return nil
+	}
 
 	if err := r.deletePods(reqLogger, qlik); err != nil {
 		reqLogger.Error(err, "cannot delete pods. Finalizing anyway")
 		return nil
 	}
+	if r.gitPoller != nil {
+		if err := r.gitPoller.remove(qlik); err != nil {
+			reqLogger.Error(err, "cannot remove the git poller repository")
+		}
+	}
 
+	maxDeletionWaitSeconds := int(getOperatorConfig().Timeouts.DeletionWait.Seconds())
 	waitTimeCounter := 0
 	for {
 		time.Sleep(1 * time.Second)
 		waitTimeCounter += 1
 		reqLogger.Info("Waiting to finish resource deletion: " + strconv.Itoa(waitTimeCounter) + " seconds")
-		if r.isAllPodsDeleted(reqLogger, qlik) || waitTimeCounter == maxDeletionWaitSeconds {
+		if r.isAllPodsDeleted(reqLogger, qlik) || waitTimeCounter >= maxDeletionWaitSeconds {
 			break
 		}
 	}
@@ -338,7 +463,10 @@ func remove(list []string, s string) []string {
 
 func getRequiredOpsRunnerJobKind(m *qlikv1.Qliksense) OpsRunnerJobKind {
 	if m.Spec.OpsRunner.Enabled == "yes" {
-		if m.Spec.OpsRunner.Schedule != "" {
+		if m.Spec.OpsRunner.Mode == qlikv1.OpsRunnerModePoller {
+			// the operator polls the git repository instead of the job
+			return OpsRunnerJobKindNone
+		} else if m.Spec.OpsRunner.Schedule != "" {
 			return OpsRunnerJobKindCronJob
 		}
 		return OpsRunnerJobKindRegularJob
@@ -349,7 +477,7 @@ func getRequiredOpsRunnerJobKind(m *qlikv1.Qliksense) OpsRunnerJobKind {
 func (r *ReconcileQliksense) getCurrentOpsRunnerJob(reqLogger logr.Logger, m *qlikv1.Qliksense) (*OpsRunnerJob, error) {
 	reqLogger.Info("Trying to fetch OpsRunner CronJob...")
 	cronJob := &batch_v1beta1.CronJob{}
-	if err := r.client.Get(context.TODO(), types.NamespacedName{Name: m.Name + opsRunnerJobNameSuffix, Namespace: m.Namespace}, cronJob); err == nil {
+	if err := r.getCronJob(types.NamespacedName{Name: m.Name + opsRunnerJobNameSuffix, Namespace: m.Namespace}, cronJob); err == nil {
 		return &OpsRunnerJob{
 			Kind: OpsRunnerJobKindCronJob,
 			Job:  cronJob,
@@ -379,7 +507,7 @@ func (r *ReconcileQliksense) getCurrentOpsRunnerJob(reqLogger logr.Logger, m *ql
 func (r *ReconcileQliksense) deleteCurrentOpsRunnerJob(reqLogger logr.Logger, opsRunnerJob *OpsRunnerJob) error {
 	if opsRunnerJob.Kind == OpsRunnerJobKindCronJob {
 		reqLogger.Info("Deleting OpsRunner CronJob")
-		return r.client.Delete(context.TODO(), opsRunnerJob.Job.(*batch_v1beta1.CronJob))
+		return r.deleteCronJobObject(opsRunnerJob.Job.(*batch_v1beta1.CronJob))
 	} else if opsRunnerJob.Kind == OpsRunnerJobKindRegularJob {
 		reqLogger.Info("Deleting OpsRunner Job")
 		return r.client.Delete(context.TODO(), opsRunnerJob.Job.(*batch_v1.Job))
@@ -438,6 +566,10 @@ func (r *ReconcileQliksense) applyOpsRunnerRegularJob(currentOpsRunnerJob *OpsRu
 		} else if patchResult.IsEmpty() {
 			reqLogger.Info("Existing OpsRunner regular Job does not need to be updated...")
 			return nil
+		} else if isSyncWindowClosed(m) {
+			reqLogger.Info("Existing OpsRunner regular Job will be updated when the sync windows open...")
+			addPendingChange(m, "ops runner job")
+			return nil
 		} else {
 			reqLogger.Info("Existing OpsRunner regular Job needs to be updated...")
 			if err := r.deleteCurrentOpsRunnerJob(reqLogger, currentOpsRunnerJob); err != nil {
@@ -446,6 +578,10 @@ func (r *ReconcileQliksense) applyOpsRunnerRegularJob(currentOpsRunnerJob *OpsRu
 				return err
 			}
 		}
+	} else if isSyncWindowClosed(m) {
+		reqLogger.Info("New OpsRunner regular Job will be created when the sync windows open...")
+		addPendingChange(m, "ops runner job")
+		return nil
 	} else {
 		reqLogger.Info("Configuring a new OpsRunner regular Job...")
 		if job, err = r.getOpsRunnerJob(reqLogger, m); err != nil {
@@ -463,7 +599,7 @@ func (r *ReconcileQliksense) applyK8sJobObject(reqLogger logr.Logger, job runtim
 
 	if !exists {
 		reqLogger.Info("Creating OpsRunner job...", "namespace", jobMetadata.Namespace, "name", jobMetadata.Name)
-		if err := r.client.Create(context.TODO(), job); err == nil {
+		if err := r.createJobObject(job); err == nil {
 			reqLogger.Info("Successfully created the OpsRunner job", "namespace", jobMetadata.Namespace, "name", jobMetadata.Name)
 			return nil
 		} else {
@@ -472,7 +608,7 @@ func (r *ReconcileQliksense) applyK8sJobObject(reqLogger logr.Logger, job runtim
 		}
 	} else {
 		reqLogger.Info("Updating OpsRunner job...", "namespace", jobMetadata.Namespace, "name", jobMetadata.Name)
-		if err := r.client.Update(context.TODO(), job); err == nil {
+		if err := r.updateJobObject(job); err == nil {
 			reqLogger.Info("Successfully updated the OpsRunner job", "namespace", jobMetadata.Namespace, "name", jobMetadata.Name)
 			return nil
 		} else {
@@ -482,6 +618,22 @@ func (r *ReconcileQliksense) applyK8sJobObject(reqLogger logr.Logger, job runtim
 	}
 }
 
+// createJobObject creates a job, or a CronJob in the served version
+func (r *ReconcileQliksense) createJobObject(job runtime.Object) error {
+	if cronJob, ok := job.(*batch_v1beta1.CronJob); ok {
+		return r.createCronJob(cronJob)
+	}
+	return r.client.Create(context.TODO(), job)
+}
+
+// updateJobObject updates a job, or a CronJob in the served version
+func (r *ReconcileQliksense) updateJobObject(job runtime.Object) error {
+	if cronJob, ok := job.(*batch_v1beta1.CronJob); ok {
+		return r.updateCronJob(cronJob)
+	}
+	return r.client.Update(context.TODO(), job)
+}
+
 // setupOpsRunnerJob create a new job if it did not exist before, and delete an existing job if enabled=no
 func (r *ReconcileQliksense) setupOpsRunnerJob(reqLogger logr.Logger, m *qlikv1.Qliksense) error {
 	requiredOpsRunnerJobKind := getRequiredOpsRunnerJobKind(m)
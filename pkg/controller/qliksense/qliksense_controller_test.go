@@ -8,6 +8,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 
 	batch_v1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
 
 	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -219,6 +220,111 @@ spec:
 				},
 			}
 		}(),
+		{
+			name: "pod template override set in CR",
+			cr: `
+apiVersion: qlik.com/v1
+kind: Qliksense
+metadata:
+  name: qlik-default
+spec:
+  profile: docker-desktop
+  git:
+    repository: https://github.com/my-org/qliksense-k8s
+  opsRunner:
+    enabled: "yes"
+    schedule: "*/10 * * * *"
+    watchBranch: master
+    image: qliksense-repo-watcher
+    podTemplate:
+      metadata:
+        annotations:
+          sidecar.istio.io/inject: "false"
+      spec:
+        nodeSelector:
+          kubernetes.io/os: linux
+        containers:
+        - name: ops-runner
+          resources:
+            limits:
+              memory: 256Mi
+          env:
+          - name: HTTPS_PROXY
+            value: http://proxy:3128
+        - name: sidecar
+          image: sidecar
+`,
+			verify: func(t *testing.T, cronJob *batch_v1beta1.CronJob) {
+				template := cronJob.Spec.JobTemplate.Spec.Template
+				if template.Annotations["sidecar.istio.io/inject"] != "false" {
+					t.Fatalf("expected the pod template annotation to be merged, but got: %v", template.Annotations)
+				}
+				if template.Spec.NodeSelector["kubernetes.io/os"] != "linux" {
+					t.Fatalf("expected the node selector to be merged, but got: %v", template.Spec.NodeSelector)
+				}
+				if template.Spec.ServiceAccountName == "" || template.Spec.RestartPolicy == "" {
+					t.Fatal("expected the generated pod spec fields to be kept")
+				}
+				if len(template.Spec.Containers) != 2 {
+					t.Fatalf("expected 2 containers, but got: %v", len(template.Spec.Containers))
+				}
+				container := template.Spec.Containers[0]
+				if container.Name != "qlik-default-ops-runner" || container.Image != "qliksense-repo-watcher" {
+					t.Fatalf("expected the ops runner container to be kept, but got: %v %v", container.Name, container.Image)
+				}
+				if memory := container.Resources.Limits.Memory().String(); memory != "256Mi" {
+					t.Fatalf("expected the memory limit to be merged, but got: %v", memory)
+				}
+				envVars := make(map[string]corev1.EnvVar)
+				for _, envVar := range container.Env {
+					envVars[envVar.Name] = envVar
+				}
+				if envVars["HTTPS_PROXY"].Value != "http://proxy:3128" || envVars["YAML_CONF"].ValueFrom == nil {
+					t.Fatalf("expected the env vars to be merged, but got: %v", envVars)
+				}
+				if template.Spec.Containers[1].Name != "sidecar" {
+					t.Fatalf("expected the sidecar container to be added, but got: %v", template.Spec.Containers[1].Name)
+				}
+			},
+		},
+		{
+			name: "job policies set in CR",
+			cr: `
+apiVersion: qlik.com/v1
+kind: Qliksense
+metadata:
+  name: qlik-default
+spec:
+  profile: docker-desktop
+  opsRunner:
+    enabled: "yes"
+    schedule: "*/10 * * * *"
+    watchBranch: master
+    image: qliksense-repo-watcher
+    concurrencyPolicy: Replace
+    successfulJobsHistoryLimit: 1
+    failedJobsHistoryLimit: 2
+    startingDeadlineSeconds: 300
+    backoffLimit: 0
+    activeDeadlineSeconds: 600
+    ttlSecondsAfterFinished: 3600
+`,
+			verify: func(t *testing.T, cronJob *batch_v1beta1.CronJob) {
+				spec := cronJob.Spec
+				if spec.ConcurrencyPolicy != batch_v1beta1.ReplaceConcurrent {
+					t.Fatalf("expected concurrency policy Replace, but got: %v", spec.ConcurrencyPolicy)
+				}
+				if *spec.SuccessfulJobsHistoryLimit != 1 || *spec.FailedJobsHistoryLimit != 2 || *spec.StartingDeadlineSeconds != 300 {
+					t.Fatalf("expected the CronJob policies to be set, but got: %v %v %v",
+						*spec.SuccessfulJobsHistoryLimit, *spec.FailedJobsHistoryLimit, *spec.StartingDeadlineSeconds)
+				}
+				jobSpec := spec.JobTemplate.Spec
+				if *jobSpec.BackoffLimit != 0 || *jobSpec.ActiveDeadlineSeconds != 600 || *jobSpec.TTLSecondsAfterFinished != 3600 {
+					t.Fatalf("expected the job policies to be set, but got: %v %v %v",
+						*jobSpec.BackoffLimit, *jobSpec.ActiveDeadlineSeconds, *jobSpec.TTLSecondsAfterFinished)
+				}
+			},
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -243,3 +349,54 @@ spec:
 		})
 	}
 }
+
+func Test_updateOpsRunnerCronJob_policyChanges(t *testing.T) {
+	cr := `
+apiVersion: qlik.com/v1
+kind: Qliksense
+metadata:
+  name: qlik-default
+spec:
+  profile: docker-desktop
+  opsRunner:
+    enabled: "yes"
+    schedule: "*/10 * * * *"
+    watchBranch: master
+    image: qliksense-repo-watcher
+    failedJobsHistoryLimit: 2
+`
+	m := &qlikv1.Qliksense{}
+	scheme := runtime.NewScheme()
+	scheme.AddKnownTypeWithName(schema.GroupVersion{Group: "qlik.com", Version: "v1"}.WithKind("Qliksense"), m)
+	reconcileQliksense := &ReconcileQliksense{
+		scheme: scheme,
+	}
+	reqLogger := log.WithName("test")
+	if err := yaml.Unmarshal([]byte(cr), m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cronJob, err := reconcileQliksense.getOpsRunnerCronJob(reqLogger, m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cronJob.Spec.ConcurrencyPolicy != batch_v1beta1.ForbidConcurrent {
+		t.Fatalf("expected concurrency policy Forbid by default, but got: %v", cronJob.Spec.ConcurrencyPolicy)
+	}
+
+	backoffLimit := int32(1)
+	m.Spec.OpsRunner.BackoffLimit = &backoffLimit
+	m.Spec.OpsRunner.FailedJobsHistoryLimit = nil
+	m.Spec.OpsRunner.ConcurrencyPolicy = batch_v1beta1.AllowConcurrent
+	if err := reconcileQliksense.updateOpsRunnerCronJob(cronJob, reqLogger, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cronJob.Spec.JobTemplate.Spec.BackoffLimit == nil || *cronJob.Spec.JobTemplate.Spec.BackoffLimit != 1 {
+		t.Fatalf("expected the backoff limit to be updated, but got: %v", cronJob.Spec.JobTemplate.Spec.BackoffLimit)
+	}
+	if cronJob.Spec.FailedJobsHistoryLimit != nil {
+		t.Fatalf("expected the failed jobs history limit to be cleared, but got: %v", *cronJob.Spec.FailedJobsHistoryLimit)
+	}
+	if cronJob.Spec.ConcurrencyPolicy != batch_v1beta1.AllowConcurrent {
+		t.Fatalf("expected concurrency policy Allow, but got: %v", cronJob.Spec.ConcurrencyPolicy)
+	}
+}
@@ -1,10 +1,9 @@
 package qliksense
 
 import (
+	"encoding/json"
 	"fmt"
-	"os"
 	"path"
-	"strings"
 
 	"sigs.k8s.io/yaml"
 
@@ -15,32 +14,36 @@ import (
 	batch_v1beta1 "k8s.io/api/batch/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
 func (r *ReconcileQliksense) getOpsRunnerCronJob(reqLogger logr.Logger, m *qlikv1.Qliksense) (*batch_v1beta1.CronJob, error) {
-	podSpec := corev1.PodSpec{}
-	if err := r.updateJobPodSpec(&podSpec, reqLogger, m); err != nil {
+	podTemplate, err := r.getOpsRunnerPodTemplate(reqLogger, m)
+	if err != nil {
 		return nil, err
 	}
 
 	objectMeta := metav1.ObjectMeta{}
 	updateJobMetadata(&objectMeta, m)
 
+	jobTemplateMeta := metav1.ObjectMeta{}
+	updateJobTemplateMetadata(&jobTemplateMeta, m)
+
 	cronJob := &batch_v1beta1.CronJob{
 		ObjectMeta: objectMeta,
 		Spec: batch_v1beta1.CronJobSpec{
-			Schedule:          m.Spec.OpsRunner.Schedule,
-			ConcurrencyPolicy: batch_v1beta1.ForbidConcurrent,
+			Schedule: m.Spec.OpsRunner.Schedule,
 			JobTemplate: batch_v1beta1.JobTemplateSpec{
+				ObjectMeta: jobTemplateMeta,
 				Spec: batch_v1.JobSpec{
-					Template: corev1.PodTemplateSpec{
-						Spec: podSpec,
-					},
+					Template: *podTemplate,
 				},
 			},
 		},
 	}
+	updateCronJobPolicy(&cronJob.Spec, &m.Spec.OpsRunner.JobPolicySpec)
+	updateCronJobSuspend(&cronJob.Spec, m)
 
 	if err := controllerutil.SetControllerReference(m, cronJob, r.scheme); err != nil {
 		reqLogger.Error(err, "Error setting controller reference for cronJob")
@@ -50,11 +53,16 @@ func (r *ReconcileQliksense) getOpsRunnerCronJob(reqLogger logr.Logger, m *qlikv
 }
 
 func (r *ReconcileQliksense) updateOpsRunnerCronJob(cronJob *batch_v1beta1.CronJob, reqLogger logr.Logger, m *qlikv1.Qliksense) error {
-	if err := r.updateJobPodSpec(&cronJob.Spec.JobTemplate.Spec.Template.Spec, reqLogger, m); err != nil {
+	podTemplate, err := r.getOpsRunnerPodTemplate(reqLogger, m)
+	if err != nil {
 		return err
 	}
+	cronJob.Spec.JobTemplate.Spec.Template = *podTemplate
 	updateJobMetadata(&cronJob.ObjectMeta, m)
+	updateJobTemplateMetadata(&cronJob.Spec.JobTemplate.ObjectMeta, m)
 	cronJob.Spec.Schedule = m.Spec.OpsRunner.Schedule
+	updateCronJobPolicy(&cronJob.Spec, &m.Spec.OpsRunner.JobPolicySpec)
+	updateCronJobSuspend(&cronJob.Spec, m)
 	if err := controllerutil.SetControllerReference(m, cronJob, r.scheme); err != nil {
 		reqLogger.Error(err, "Error setting controller reference for cronJob")
 		return err
@@ -63,8 +71,8 @@ func (r *ReconcileQliksense) updateOpsRunnerCronJob(cronJob *batch_v1beta1.CronJ
 }
 
 func (r *ReconcileQliksense) getOpsRunnerJob(reqLogger logr.Logger, m *qlikv1.Qliksense) (*batch_v1.Job, error) {
-	podSpec := corev1.PodSpec{}
-	if err := r.updateJobPodSpec(&podSpec, reqLogger, m); err != nil {
+	podTemplate, err := r.getOpsRunnerPodTemplate(reqLogger, m)
+	if err != nil {
 		return nil, err
 	}
 
@@ -74,11 +82,10 @@ func (r *ReconcileQliksense) getOpsRunnerJob(reqLogger logr.Logger, m *qlikv1.Ql
 	job := &batch_v1.Job{
 		ObjectMeta: objectMeta,
 		Spec: batch_v1.JobSpec{
-			Template: corev1.PodTemplateSpec{
-				Spec: podSpec,
-			},
+			Template: *podTemplate,
 		},
 	}
+	updateJobPolicy(&job.Spec, &m.Spec.OpsRunner.JobPolicySpec)
 
 	if err := controllerutil.SetControllerReference(m, job, r.scheme); err != nil {
 		reqLogger.Error(err, "Error setting controller reference for job")
@@ -88,9 +95,14 @@ func (r *ReconcileQliksense) getOpsRunnerJob(reqLogger logr.Logger, m *qlikv1.Ql
 }
 
 func (r *ReconcileQliksense) updateOpsRunnerJob(job *batch_v1.Job, reqLogger logr.Logger, m *qlikv1.Qliksense) error {
-	if err := r.updateJobPodSpec(&job.Spec.Template.Spec, reqLogger, m); err != nil {
+	podTemplate, err := r.getOpsRunnerPodTemplate(reqLogger, m)
+	if err != nil {
 		return err
 	}
+	// keep the controller-uid labels the API server added to the template of the job
+	podTemplate.Labels = mergeLabels(job.Spec.Template.Labels, podTemplate.Labels)
+	job.Spec.Template = *podTemplate
+	updateJobPolicy(&job.Spec, &m.Spec.OpsRunner.JobPolicySpec)
 	updateJobMetadata(&job.ObjectMeta, m)
 	if err := controllerutil.SetControllerReference(m, job, r.scheme); err != nil {
 		reqLogger.Error(err, "Error setting controller reference for job")
@@ -106,23 +118,152 @@ func updateJobMetadata(objectMeta *metav1.ObjectMeta, m *qlikv1.Qliksense) {
 		objectMeta.Labels = make(map[string]string)
 	}
 	objectMeta.Labels["release"] = m.Name
+	objectMeta.Labels[opsRunnerJobLabel] = m.Name
 }
 
-func (r *ReconcileQliksense) updateJobPodSpec(podSpec *corev1.PodSpec, reqLogger logr.Logger, m *qlikv1.Qliksense) error {
-	containerImagePullPolicy := os.Getenv("DEBUG_OPS_RUNNER_CONTAINER_IMAGE_PULL_POLICY")
-	if containerImagePullPolicy == "" {
-		containerImagePullPolicy = string(corev1.PullAlways)
+// updateJobTemplateMetadata labels the jobs spawned by the CronJob, so that their results can be watched
+func updateJobTemplateMetadata(objectMeta *metav1.ObjectMeta, m *qlikv1.Qliksense) {
+	if objectMeta.Labels == nil {
+		objectMeta.Labels = make(map[string]string)
+	}
+	objectMeta.Labels["release"] = m.Name
+	objectMeta.Labels[opsRunnerJobLabel] = m.Name
+}
+
+// updateCronJobPolicy sets the CronJob policies of the CR, including the ones of the jobs it spawns.
+// Unset policies are cleared, so that the API server defaults apply again when they are removed from the CR.
+func updateCronJobPolicy(cronJobSpec *batch_v1beta1.CronJobSpec, policy *qlikv1.JobPolicySpec) {
+	cronJobSpec.ConcurrencyPolicy = policy.ConcurrencyPolicy
+	if cronJobSpec.ConcurrencyPolicy == "" {
+		cronJobSpec.ConcurrencyPolicy = batch_v1beta1.ForbidConcurrent
+	}
+	cronJobSpec.SuccessfulJobsHistoryLimit = policy.SuccessfulJobsHistoryLimit
+	cronJobSpec.FailedJobsHistoryLimit = policy.FailedJobsHistoryLimit
+	cronJobSpec.StartingDeadlineSeconds = policy.StartingDeadlineSeconds
+	updateJobPolicy(&cronJobSpec.JobTemplate.Spec, policy)
+	cronJobSpec.JobTemplate.Spec.TTLSecondsAfterFinished = policy.TTLSecondsAfterFinished
+}
+
+// updateCronJobSuspend suspends the CronJob while the sync windows of the CR are closed
+func updateCronJobSuspend(cronJobSpec *batch_v1beta1.CronJobSpec, m *qlikv1.Qliksense) {
+	suspend := isSyncWindowClosed(m)
+	cronJobSpec.Suspend = &suspend
+}
+
+// updateJobPolicy sets the job policies of the CR
+func updateJobPolicy(jobSpec *batch_v1.JobSpec, policy *qlikv1.JobPolicySpec) {
+	jobSpec.BackoffLimit = policy.BackoffLimit
+	jobSpec.ActiveDeadlineSeconds = policy.ActiveDeadlineSeconds
+}
+
+// getOpsRunnerPodTemplate generates the ops runner pod template and strategic merges the pod template override of the CR into it
+func (r *ReconcileQliksense) getOpsRunnerPodTemplate(reqLogger logr.Logger, m *qlikv1.Qliksense) (*corev1.PodTemplateSpec, error) {
+	podTemplate := &corev1.PodTemplateSpec{}
+	if err := r.updateJobPodSpec(&podTemplate.Spec, reqLogger, m); err != nil {
+		return nil, err
+	}
+	config, err := r.renderOpsRunnerConfig(m)
+	if err != nil {
+		reqLogger.Error(err, "Error rendering the OpsRunner config")
+		return nil, err
+	}
+	podTemplate.Annotations = map[string]string{opsRunnerConfigHashAnnotation: getOpsRunnerConfigHash(config)}
+	if m.Spec.OpsRunner != nil {
+		if podTemplate, err = mergePodTemplateOverride(podTemplate, m.Spec.OpsRunner.PodTemplate); err != nil {
+			return nil, err
+		}
+	}
+	r.updatePodSpecForImageRegistry(m, &podTemplate.Spec, getOpsRunnerContainerName(m))
+	return podTemplate, nil
+}
+
+func mergePodTemplateOverride(podTemplate *corev1.PodTemplateSpec, override *corev1.PodTemplateSpec) (*corev1.PodTemplateSpec, error) {
+	if override == nil {
+		return podTemplate, nil
+	}
+	override = override.DeepCopy()
+	for i := range override.Spec.Containers {
+		if name := override.Spec.Containers[i].Name; name == "" || name == opsRunnerContainerAlias {
+			override.Spec.Containers[i].Name = podTemplate.Spec.Containers[0].Name
+		}
+	}
+
+	podTemplateBytes, err := json.Marshal(podTemplate)
+	if err != nil {
+		return nil, err
+	}
+	overrideMap := map[string]interface{}{}
+	if overrideBytes, err := json.Marshal(override); err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(overrideBytes, &overrideMap); err != nil {
+		return nil, err
+	}
+	// unset fields of the override are marshalled as null, which would delete them in a strategic merge patch
+	removeNullValues(overrideMap)
+	patchBytes, err := json.Marshal(overrideMap)
+	if err != nil {
+		return nil, err
+	}
+
+	mergedBytes, err := strategicpatch.StrategicMergePatch(podTemplateBytes, patchBytes, corev1.PodTemplateSpec{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot merge the ops runner pod template override: %w", err)
+	}
+	merged := &corev1.PodTemplateSpec{}
+	if err := json.Unmarshal(mergedBytes, merged); err != nil {
+		return nil, err
 	}
-	podSpecRestartPolicy := os.Getenv("DEBUG_OPS_RUNNER_POD_SPEC_RESTART_POLICY")
-	if podSpecRestartPolicy == "" {
-		podSpecRestartPolicy = string(corev1.RestartPolicyOnFailure)
+	return merged, nil
+}
+
+func removeNullValues(m map[string]interface{}) {
+	for key, value := range m {
+		switch typedValue := value.(type) {
+		case nil:
+			delete(m, key)
+		case map[string]interface{}:
+			removeNullValues(typedValue)
+		case []interface{}:
+			for _, item := range typedValue {
+				if itemMap, ok := item.(map[string]interface{}); ok {
+					removeNullValues(itemMap)
+				}
+			}
+		}
+	}
+}
+
+// mergeLabels returns the current labels overwritten by the desired ones, so that labels added by the API server are kept
+func mergeLabels(current, desired map[string]string) map[string]string {
+	if len(current) == 0 {
+		return desired
 	}
+	merged := make(map[string]string, len(current)+len(desired))
+	for key, value := range current {
+		merged[key] = value
+	}
+	for key, value := range desired {
+		merged[key] = value
+	}
+	return merged
+}
+
+// getOpsRunnerContainerName returns the name of the container of the ops runner generated by the operator
+func getOpsRunnerContainerName(m *qlikv1.Qliksense) string {
+	return fmt.Sprintf("%v%v", m.Name, opsRunnerJobNameSuffix)
+}
+
+func (r *ReconcileQliksense) updateJobPodSpec(podSpec *corev1.PodSpec, reqLogger logr.Logger, m *qlikv1.Qliksense) error {
+	opsRunnerConfig := getOperatorConfig().OpsRunner
 	if len(podSpec.Containers) == 0 {
 		podSpec.Containers = append(podSpec.Containers, corev1.Container{})
 	}
 	podSpec.Containers[0].Image = m.Spec.OpsRunner.Image
-	podSpec.Containers[0].ImagePullPolicy = corev1.PullPolicy(containerImagePullPolicy)
-	podSpec.Containers[0].Name = fmt.Sprintf("%v%v", m.Name, opsRunnerJobNameSuffix)
+	if podSpec.Containers[0].Image == "" {
+		podSpec.Containers[0].Image = opsRunnerConfig.DefaultImage
+	}
+	podSpec.Containers[0].ImagePullPolicy = opsRunnerConfig.ImagePullPolicy
+	podSpec.Containers[0].Name = getOpsRunnerContainerName(m)
 
 	if envVars, err := getEnvVars(podSpec, reqLogger, m); err != nil {
 		return err
@@ -131,9 +272,33 @@ func (r *ReconcileQliksense) updateJobPodSpec(podSpec *corev1.PodSpec, reqLogger
 		reqLogger.Info("job's new podSpec.Containers[0].Env", "vars", podSpec.Containers[0].Env)
 	}
 
-	podSpec.RestartPolicy = corev1.RestartPolicy(podSpecRestartPolicy)
-	podSpec.ServiceAccountName = "qliksense-operator"
-	updateJobPodSpecForImageRegistry(m, podSpec)
+	if getOperatorConfig().Kuz.TLS.Enabled {
+		if err := updatePodSpecForKuzCABundle(podSpec); err != nil {
+			return err
+		}
+	}
+
+	podSpec.RestartPolicy = opsRunnerConfig.RestartPolicy
+	podSpec.ServiceAccountName = getOpsRunnerServiceAccountName(m)
+	return nil
+}
+
+// updatePodSpecForKuzCABundle mounts the CAs of the kustomize build server in the first container, to verify the server
+func updatePodSpecForKuzCABundle(podSpec *corev1.PodSpec) error {
+	operatorName, err := k8sutil.GetOperatorName()
+	if err != nil {
+		return err
+	}
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: kuzCABundleVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: operatorName + kuzCABundleNameSuffix},
+			},
+		},
+	})
+	podSpec.Containers[0].VolumeMounts = append(podSpec.Containers[0].VolumeMounts,
+		corev1.VolumeMount{Name: kuzCABundleVolumeName, MountPath: kuzCABundleMountPath, ReadOnly: true})
 	return nil
 }
 
@@ -148,6 +313,7 @@ func crToYaml(m *qlikv1.Qliksense) ([]byte, error) {
 			"creationTimestamp",
 			"finalizers",
 			"generation",
+			"managedFields",
 			"resourceVersion",
 			"selfLink",
 			"uid",
@@ -159,6 +325,8 @@ func crToYaml(m *qlikv1.Qliksense) ([]byte, error) {
 		if _, ok := metadataMap["annotations"]; ok {
 			annotationsMap := metadataMap["annotations"].(map[string]interface{})
 			delete(annotationsMap, "kubectl.kubernetes.io/last-applied-configuration")
+			// a sync request must not roll out the ops runner job
+			delete(annotationsMap, syncRequestedAnnotation)
 			if len(annotationsMap) == 0 {
 				delete(metadataMap, "annotations")
 			}
@@ -175,17 +343,32 @@ func getEnvVars(podSpec *corev1.PodSpec, reqLogger logr.Logger, m *qlikv1.Qlikse
 		return nil, err
 	}
 
-	crYaml, err := crToYaml(m)
-	if err != nil {
-		reqLogger.Error(err, "Error marshalling CR to yaml")
-		return nil, err
+	// the CR is read from the ops runner config Secret, it may hold credentials
+	yamlConf := corev1.EnvVar{
+		Name: "YAML_CONF",
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: getOpsRunnerConfigSecretName(m)},
+				Key:                  opsRunnerConfigSecretKey,
+			},
+		},
 	}
-
-	updateVarNames := []string{"YAML_CONF", "OPERATOR_SERVICE_NAME", "OPERATOR_SERVICE_PORT"}
-	updateVarValues := map[string]string{
-		"YAML_CONF":             string(crYaml),
-		"OPERATOR_SERVICE_NAME": fmt.Sprintf("%s-kuztomize", operatorName),
-		"OPERATOR_SERVICE_PORT": fmt.Sprintf("%v", kuzServicePort),
+	kuzConfig := getOperatorConfig().Kuz
+	scheme := "http"
+	if kuzConfig.TLS.Enabled {
+		scheme = "https"
+	}
+	updateVarNames := []string{"YAML_CONF", "OPERATOR_SERVICE_NAME", "OPERATOR_SERVICE_PORT", "OPERATOR_SERVICE_SCHEME"}
+	updateVars := map[string]corev1.EnvVar{
+		"YAML_CONF":               yamlConf,
+		"OPERATOR_SERVICE_NAME":   {Name: "OPERATOR_SERVICE_NAME", Value: getKuzServiceName(operatorName)},
+		"OPERATOR_SERVICE_PORT":   {Name: "OPERATOR_SERVICE_PORT", Value: fmt.Sprintf("%v", kuzConfig.Port)},
+		"OPERATOR_SERVICE_SCHEME": {Name: "OPERATOR_SERVICE_SCHEME", Value: scheme},
+	}
+	if kuzConfig.TLS.Enabled {
+		// the CA bundle is mounted by updateJobPodSpec
+		updateVarNames = append(updateVarNames, "OPERATOR_SERVICE_CA_FILE")
+		updateVars["OPERATOR_SERVICE_CA_FILE"] = corev1.EnvVar{Name: "OPERATOR_SERVICE_CA_FILE", Value: path.Join(kuzCABundleMountPath, kuzCABundleKey)}
 	}
 	currentEnvVarNames := make(map[string]bool)
 	currentEnvVars := podSpec.Containers[0].Env
@@ -193,29 +376,15 @@ func getEnvVars(podSpec *corev1.PodSpec, reqLogger logr.Logger, m *qlikv1.Qlikse
 
 	for _, currentEnvVar := range currentEnvVars {
 		currentEnvVarNames[currentEnvVar.Name] = true
-		if updateVarValue, ok := updateVarValues[currentEnvVar.Name]; ok {
-			currentEnvVar.Value = updateVarValue
+		if updateVar, ok := updateVars[currentEnvVar.Name]; ok {
+			currentEnvVar = updateVar
 		}
 		newEnvVars = append(newEnvVars, currentEnvVar)
 	}
 	for _, updateVarName := range updateVarNames {
 		if _, present := currentEnvVarNames[updateVarName]; !present {
-			newEnvVars = append(newEnvVars, corev1.EnvVar{
-				Name:  updateVarName,
-				Value: updateVarValues[updateVarName],
-			})
+			newEnvVars = append(newEnvVars, updateVars[updateVarName])
 		}
 	}
 	return newEnvVars, nil
 }
-
-func updateJobPodSpecForImageRegistry(m *qlikv1.Qliksense, podTemplateSpec *corev1.PodSpec) {
-	if imageRegistry := m.Spec.GetImageRegistry(); imageRegistry != "" {
-		if currentImage := podTemplateSpec.Containers[0].Image; currentImage != "" {
-			imageSegments := strings.Split(currentImage, "/")
-			imageNameAndTag := imageSegments[len(imageSegments)-1]
-			podTemplateSpec.Containers[0].Image = path.Join(imageRegistry, imageNameAndTag)
-			podTemplateSpec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: pullSecretName}}
-		}
-	}
-}
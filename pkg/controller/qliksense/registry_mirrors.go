@@ -0,0 +1,198 @@
+package qliksense
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// anyRegistry is the source of a mirror rule matching every image
+const anyRegistry = "*"
+
+var registryMirrorsConfigPath string
+
+// RegistryMirror maps the images under a source prefix to a mirror registry
+type RegistryMirror struct {
+	// Source is the normalized image prefix the rule applies to, e.g. docker.io/library or
+	// qlik-docker-oss.bintray.io/qlik, "*" applies the rule to every image
+	Source string `json:"source"`
+	// Mirror replaces the source prefix of the image, e.g. my-registry.example.com/mirrors/qlik
+	Mirror string `json:"mirror"`
+	// StripPath keeps only the last segment of the image path below the source prefix
+	StripPath bool `json:"stripPath,omitempty"`
+	// Digests pins source images to digests, the keys are images with a tag (qliksense-repo-watcher:v1.0.0
+	// or docker.io/library/qliksense-repo-watcher:v1.0.0), the values are digests (sha256:...)
+	Digests map[string]string `json:"digests,omitempty"`
+	// PullSecretName is the image pull secret added to the pods using the mirror
+	PullSecretName string `json:"pullSecretName,omitempty"`
+}
+
+// RegistryMirrorsConfig declares how the images of the pods created by the operator are mirrored
+type RegistryMirrorsConfig struct {
+	Mirrors []RegistryMirror `json:"mirrors"`
+}
+
+// loadRegistryMirrorsConfig reads the config from the path given by the flag, or returns an empty config
+func loadRegistryMirrorsConfig(path string) (*RegistryMirrorsConfig, error) {
+	if path == "" {
+		return &RegistryMirrorsConfig{}, nil
+	}
+	configBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	registryMirrors := &RegistryMirrorsConfig{}
+	if err := yaml.UnmarshalStrict(configBytes, registryMirrors); err != nil {
+		return nil, fmt.Errorf("cannot parse registry mirrors config %v: %w", path, err)
+	}
+	if err := registryMirrors.validate(); err != nil {
+		return nil, fmt.Errorf("invalid registry mirrors config %v: %w", path, err)
+	}
+	return registryMirrors, nil
+}
+
+func (c *RegistryMirrorsConfig) validate() error {
+	for i, mirror := range c.Mirrors {
+		if err := mirror.validate(); err != nil {
+			return fmt.Errorf("mirrors[%v]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (m RegistryMirror) validate() error {
+	if m.Source == "" {
+		return errors.New("source must be set")
+	} else if m.Mirror == "" {
+		return errors.New("mirror must be set")
+	}
+	for image, digest := range m.Digests {
+		if _, err := reference.ParseNormalizedNamed(image); err != nil {
+			return fmt.Errorf("digests: invalid image %v: %w", image, err)
+		} else if !strings.HasPrefix(digest, "sha256:") {
+			return fmt.Errorf("digests: invalid digest %v of %v", digest, image)
+		}
+	}
+	return nil
+}
+
+// matches returns the image path below the source prefix, if the rule applies to the image
+func (m RegistryMirror) matches(named reference.Named) (string, bool) {
+	if m.Source == anyRegistry {
+		return reference.Path(named), true
+	}
+	source := strings.TrimSuffix(m.Source, "/")
+	if named.Name() == source {
+		return "", true
+	} else if strings.HasPrefix(named.Name(), source+"/") {
+		return strings.TrimPrefix(named.Name(), source+"/"), true
+	}
+	return "", false
+}
+
+// getDigest returns the digest the image is pinned to
+func (m RegistryMirror) getDigest(named reference.Named) string {
+	tagged := reference.TagNameOnly(named)
+	if digest, ok := m.Digests[tagged.String()]; ok {
+		return digest
+	}
+	return m.Digests[reference.FamiliarString(tagged)]
+}
+
+// mirrorImage returns the image mapped by the most specific matching rule, "*" rules are used last
+func mirrorImage(image string, mirrors []RegistryMirror) (string, *RegistryMirror) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return image, nil
+	}
+
+	var matched *RegistryMirror
+	var imagePath string
+	for i := range mirrors {
+		if p, ok := mirrors[i].matches(named); ok {
+			if matched == nil || matched.Source == anyRegistry ||
+				(mirrors[i].Source != anyRegistry && len(mirrors[i].Source) > len(matched.Source)) {
+				matched, imagePath = &mirrors[i], p
+			}
+		}
+	}
+	if matched == nil {
+		return image, nil
+	}
+
+	if matched.StripPath && imagePath != "" {
+		imagePath = path.Base(imagePath)
+	}
+	mirrored := path.Join(matched.Mirror, imagePath)
+	if digested, ok := named.(reference.Digested); ok {
+		return fmt.Sprintf("%v@%v", mirrored, digested.Digest()), matched
+	} else if digest := matched.getDigest(named); digest != "" {
+		return fmt.Sprintf("%v@%v", mirrored, digest), matched
+	} else if tagged, ok := named.(reference.Tagged); ok {
+		return fmt.Sprintf("%v:%v", mirrored, tagged.Tag()), matched
+	}
+	return mirrored, matched
+}
+
+// getRegistryMirrors returns the mirror rules of the operator config, followed by the imageRegistry of the CR when
+// withImageRegistry is set. The imageRegistry of the CR keeps only the last segment of the image path, like the images
+// of the release.
+func (r *ReconcileQliksense) getRegistryMirrors(m *qlikv1.Qliksense, withImageRegistry bool) []RegistryMirror {
+	var mirrors []RegistryMirror
+	if r.registryMirrors != nil {
+		mirrors = append(mirrors, r.registryMirrors.Mirrors...)
+	}
+	if imageRegistry := m.Spec.GetImageRegistry(); imageRegistry != "" && withImageRegistry {
+		mirrors = append(mirrors, RegistryMirror{
+			Source:         anyRegistry,
+			Mirror:         imageRegistry,
+			StripPath:      true,
+			PullSecretName: pullSecretName,
+		})
+	}
+	return mirrors
+}
+
+// updatePodSpecForImageRegistry mirrors the images of the containers of the pod and adds the pull secrets of the
+// mirrors. The imageRegistry of the CR only applies to the container generated by the operator, named containerName,
+// the containers added with a pod template override are mirrored by the rules of the operator config only.
+func (r *ReconcileQliksense) updatePodSpecForImageRegistry(m *qlikv1.Qliksense, podSpec *corev1.PodSpec, containerName string) {
+	mirrors := r.getRegistryMirrors(m, false)
+	generatedMirrors := r.getRegistryMirrors(m, true)
+	if len(generatedMirrors) == 0 {
+		return
+	}
+	pullSecrets := make(map[string]bool)
+	for _, pullSecret := range podSpec.ImagePullSecrets {
+		pullSecrets[pullSecret.Name] = true
+	}
+	mirrorContainers := func(containers []corev1.Container) {
+		for i := range containers {
+			if containers[i].Image == "" {
+				continue
+			}
+			containerMirrors := mirrors
+			if containers[i].Name == containerName {
+				containerMirrors = generatedMirrors
+			}
+			image, mirror := mirrorImage(containers[i].Image, containerMirrors)
+			if mirror == nil {
+				continue
+			}
+			containers[i].Image = image
+			if mirror.PullSecretName != "" && !pullSecrets[mirror.PullSecretName] {
+				pullSecrets[mirror.PullSecretName] = true
+				podSpec.ImagePullSecrets = append(podSpec.ImagePullSecrets, corev1.LocalObjectReference{Name: mirror.PullSecretName})
+			}
+		}
+	}
+	mirrorContainers(podSpec.InitContainers)
+	mirrorContainers(podSpec.Containers)
+}
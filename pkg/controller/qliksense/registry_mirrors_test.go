@@ -0,0 +1,167 @@
+package qliksense
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_mirrorImage(t *testing.T) {
+	mirrors := []RegistryMirror{
+		{Source: "qlik-docker-oss.bintray.io", Mirror: "registry.example.com/qlik", PullSecretName: "mirror-secret"},
+		{Source: "qlik-docker-oss.bintray.io/tools", Mirror: "registry.example.com/tools", StripPath: true},
+		{
+			Source: "docker.io/library",
+			Mirror: "registry.example.com/library",
+			Digests: map[string]string{
+				"busybox:1.31": "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			},
+		},
+		{Source: "*", Mirror: "registry.example.com/other"},
+	}
+	testCases := []struct {
+		image          string
+		expectedImage  string
+		expectedMirror string
+	}{
+		{
+			image:          "qlik-docker-oss.bintray.io/qliksense-repo-watcher:v1.0.0",
+			expectedImage:  "registry.example.com/qlik/qliksense-repo-watcher:v1.0.0",
+			expectedMirror: "registry.example.com/qlik",
+		},
+		{
+			image:          "qlik-docker-oss.bintray.io/project/nested/image",
+			expectedImage:  "registry.example.com/qlik/project/nested/image",
+			expectedMirror: "registry.example.com/qlik",
+		},
+		{
+			image:          "qlik-docker-oss.bintray.io/tools/nested/kubectl:1.16",
+			expectedImage:  "registry.example.com/tools/kubectl:1.16",
+			expectedMirror: "registry.example.com/tools",
+		},
+		{
+			image:          "busybox:1.31",
+			expectedImage:  "registry.example.com/library/busybox@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			expectedMirror: "registry.example.com/library",
+		},
+		{
+			image:          "busybox",
+			expectedImage:  "registry.example.com/library/busybox",
+			expectedMirror: "registry.example.com/library",
+		},
+		{
+			image:          "quay.io/org/image@sha256:1111111111111111111111111111111111111111111111111111111111111111",
+			expectedImage:  "registry.example.com/other/org/image@sha256:1111111111111111111111111111111111111111111111111111111111111111",
+			expectedMirror: "registry.example.com/other",
+		},
+		{
+			image:         "Invalid Image",
+			expectedImage: "Invalid Image",
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.image, func(t *testing.T) {
+			image, mirror := mirrorImage(testCase.image, mirrors)
+			if image != testCase.expectedImage {
+				t.Fatalf("expected image: %v, but got: %v", testCase.expectedImage, image)
+			}
+			if mirror == nil {
+				if testCase.expectedMirror != "" {
+					t.Fatalf("expected mirror: %v, but no mirror matched", testCase.expectedMirror)
+				}
+			} else if mirror.Mirror != testCase.expectedMirror {
+				t.Fatalf("expected mirror: %v, but got: %v", testCase.expectedMirror, mirror.Mirror)
+			}
+		})
+	}
+}
+
+func Test_updatePodSpecForImageRegistry(t *testing.T) {
+	r := &ReconcileQliksense{
+		registryMirrors: &RegistryMirrorsConfig{
+			Mirrors: []RegistryMirror{
+				{Source: "qlik-docker-oss.bintray.io", Mirror: "registry.example.com/qlik", PullSecretName: "mirror-secret"},
+			},
+		},
+	}
+	m := &qlikv1.Qliksense{Spec: &qlikv1.QliksenseSpec{}}
+	newPodSpec := func() *corev1.PodSpec {
+		return &corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Image: "qlik-docker-oss.bintray.io/init"}},
+			Containers: []corev1.Container{
+				{Name: "qlik-default-ops-runner", Image: "qlik-docker-oss.bintray.io/qliksense-repo-watcher"},
+				{Name: "sidecar", Image: "quay.io/org/sidecar"},
+			},
+		}
+	}
+	podSpec := newPodSpec()
+	r.updatePodSpecForImageRegistry(m, podSpec, "qlik-default-ops-runner")
+	if podSpec.InitContainers[0].Image != "registry.example.com/qlik/init" {
+		t.Fatalf("expected the init container image to be mirrored, but got: %v", podSpec.InitContainers[0].Image)
+	} else if podSpec.Containers[0].Image != "registry.example.com/qlik/qliksense-repo-watcher" {
+		t.Fatalf("expected the container image to be mirrored, but got: %v", podSpec.Containers[0].Image)
+	} else if podSpec.Containers[1].Image != "quay.io/org/sidecar" {
+		t.Fatalf("expected the sidecar image to be left unchanged, but got: %v", podSpec.Containers[1].Image)
+	} else if len(podSpec.ImagePullSecrets) != 1 || podSpec.ImagePullSecrets[0].Name != "mirror-secret" {
+		t.Fatalf("expected the mirror-secret pull secret once, but got: %v", podSpec.ImagePullSecrets)
+	}
+
+	// the imageRegistry of the CR only moves the image of the generated container, not the images of the sidecars
+	r.registryMirrors = nil
+	m.Spec.AddToConfigs("qliksense", "imageRegistry", "registry.example.com/private")
+	podSpec = newPodSpec()
+	r.updatePodSpecForImageRegistry(m, podSpec, "qlik-default-ops-runner")
+	if podSpec.Containers[0].Image != "registry.example.com/private/qliksense-repo-watcher" {
+		t.Fatalf("expected the container image to be moved to the imageRegistry, but got: %v", podSpec.Containers[0].Image)
+	} else if podSpec.InitContainers[0].Image != "qlik-docker-oss.bintray.io/init" {
+		t.Fatalf("expected the init container image to be left unchanged, but got: %v", podSpec.InitContainers[0].Image)
+	} else if podSpec.Containers[1].Image != "quay.io/org/sidecar" {
+		t.Fatalf("expected the sidecar image to be left unchanged, but got: %v", podSpec.Containers[1].Image)
+	} else if len(podSpec.ImagePullSecrets) != 1 || podSpec.ImagePullSecrets[0].Name != pullSecretName {
+		t.Fatalf("expected the %v pull secret once, but got: %v", pullSecretName, podSpec.ImagePullSecrets)
+	}
+}
+
+func Test_loadRegistryMirrorsConfig(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if registryMirrors, err := loadRegistryMirrorsConfig(""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(registryMirrors.Mirrors) != 0 {
+		t.Fatalf("expected no default mirrors, but got: %v", len(registryMirrors.Mirrors))
+	}
+
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	if err := ioutil.WriteFile(configPath, []byte(`
+mirrors:
+- source: qlik-docker-oss.bintray.io
+  mirror: registry.example.com/qlik
+  pullSecretName: mirror-secret
+`), os.ModePerm); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if registryMirrors, err := loadRegistryMirrorsConfig(configPath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(registryMirrors.Mirrors) != 1 || registryMirrors.Mirrors[0].PullSecretName != "mirror-secret" {
+		t.Fatalf("unexpected mirrors: %v", registryMirrors.Mirrors)
+	}
+
+	if err := ioutil.WriteFile(configPath, []byte(`
+mirrors:
+- source: docker.io/library
+  mirror: registry.example.com/library
+  digests:
+    busybox:1.31: latest
+`), os.ModePerm); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := loadRegistryMirrorsConfig(configPath); err == nil {
+		t.Fatal("expected an error for an invalid digest")
+	}
+}
@@ -6,12 +6,12 @@ import (
 	"github.com/go-logr/logr"
 	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
 	appsv1 "k8s.io/api/apps/v1"
+	batch_v1beta1 "k8s.io/api/batch/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/client-go/dynamic"
+	"k8s.io/apimachinery/pkg/labels"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/client/config"
 )
 
 func (r *ReconcileQliksense) deleteDeployments(reqLogger logr.Logger, q *qlikv1.Qliksense) error {
@@ -51,18 +51,17 @@ func (r *ReconcileQliksense) deleteStatefuleSet(reqLogger logr.Logger, q *qlikv1
 }
 
 func (r *ReconcileQliksense) deleteCronJob(reqLogger logr.Logger, q *qlikv1.Qliksense) error {
-	// opts := []client.DeleteAllOfOption{
-	// 	client.InNamespace(q.GetNamespace()),
-	// 	client.MatchingLabels{searchingLabel: q.GetName()},
-	// }
-	// if err := r.client.DeleteAllOf(context.TODO(), &batch_v1beta1.CronJob{}, opts...); err != nil {
-	// 	reqLogger.Error(err, "Cannot delete cronjob")
-	// 	return err
-	// }
-	if err := KubectlDeleteResourceOfRelease("cronjob", q.GetName()); err != nil {
-		reqLogger.Error(err, "Cannot delete CronJobs")
+	cronJobList := &batch_v1beta1.CronJobList{}
+	if err := r.listCronJobs(cronJobList, client.InNamespace(q.GetNamespace()), client.MatchingLabels{searchingLabel: q.GetName()}); err != nil {
+		reqLogger.Error(err, "Cannot list CronJobs")
 		return err
 	}
+	for i := range cronJobList.Items {
+		if err := r.deleteCronJobObject(&cronJobList.Items[i]); err != nil && !errors.IsNotFound(err) {
+			reqLogger.Error(err, "Cannot delete CronJobs")
+			return err
+		}
+	}
 	reqLogger.Info("Deleting CronJobs")
 	r.setCrStatus(reqLogger, q, "Valid", "DeletingCronJob", "User Initaited Action")
 	return nil
@@ -87,32 +86,24 @@ func (r *ReconcileQliksense) deleteJob(reqLogger logr.Logger, q *qlikv1.Qliksens
 }
 
 func (r *ReconcileQliksense) deleteEngine(reqLogger logr.Logger, q *qlikv1.Qliksense) error {
-
-	// Get a config to talk to the apiserver
-	cfg, err := config.GetConfig()
+	engineRes, served, err := r.clients.resolve(r.customResources.Engine)
 	if err != nil {
 		return err
+	} else if !served {
+		reqLogger.Info("WARNING: no version of the engine resource is served, nothing to delete", "GroupVersionsResource", r.customResources.Engine)
+		return nil
 	}
 
-	dynamicClient, err := dynamic.NewForConfig(cfg)
-	if err != nil {
-		return err
-	}
-
-	engineRes := schema.GroupVersionResource{Group: "qixmanager.qlik.com", Version: "v1", Resource: "engines"}
-
-	list, err := dynamicClient.Resource(engineRes).Namespace(q.Namespace).List(metav1.ListOptions{
-		LabelSelector: searchingLabel + "=" + q.GetName(),
-	})
+	list, err := r.clients.listReleaseMetadata(engineRes, q.Namespace, releaseSelector(q))
 	if err != nil {
 		return err
 	}
 	var graceSec int64 = 1
-	for _, d := range list.Items {
-		if deleteErr := dynamicClient.Resource(engineRes).Namespace(q.Namespace).Delete(d.GetName(), &metav1.DeleteOptions{
+	for _, d := range list {
+		if deleteErr := r.clients.metadata.Resource(engineRes).Namespace(q.Namespace).Delete(d.GetName(), &metav1.DeleteOptions{
 			GracePeriodSeconds: &graceSec,
-		}); deleteErr != nil {
-			return err
+		}); deleteErr != nil && !errors.IsNotFound(deleteErr) {
+			return deleteErr
 		}
 	}
 	reqLogger.Info("Deleting Engines")
@@ -120,6 +111,32 @@ func (r *ReconcileQliksense) deleteEngine(reqLogger logr.Logger, q *qlikv1.Qliks
 	return nil
 }
 
+// deleteClusterScopedResources deletes the cluster-scoped resources tracked for this instance by updateClusterScopedResourceOwner
+func (r *ReconcileQliksense) deleteClusterScopedResources(reqLogger logr.Logger, q *qlikv1.Qliksense) error {
+	selector := labels.SelectorFromSet(labels.Set{
+		searchingLabel:      q.GetName(),
+		ownerNamespaceLabel: q.GetNamespace(),
+	})
+	for _, clusterResource := range clusterScopedResources {
+		list, err := r.clients.listClusterScopedReleaseMetadata(clusterResource, selector)
+		if err != nil {
+			return err
+		}
+		for _, d := range list {
+			if uid, ok := d.GetAnnotations()[ownerUidAnnotation]; ok && uid != string(q.GetUID()) {
+				reqLogger.Info("skipping cluster-scoped resource tracked by another instance", "GroupVersionResource", clusterResource, "name", d.GetName())
+				continue
+			}
+			if err := r.clients.metadata.Resource(clusterResource).Delete(d.GetName(), &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+		}
+	}
+	reqLogger.Info("Deleting cluster-scoped resources")
+	r.setCrStatus(reqLogger, q, "Valid", "DeletingClusterScopedResources", "User Initaited Action")
+	return nil
+}
+
 func (r *ReconcileQliksense) deletePods(reqLogger logr.Logger, q *qlikv1.Qliksense) error {
 	// opts := []client.DeleteAllOfOption{
 	// 	client.InNamespace(q.GetNamespace()),
@@ -0,0 +1,283 @@
+package qliksense
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/banzaicloud/k8s-objectmatcher/patch"
+	"github.com/go-logr/logr"
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	batch_v1 "k8s.io/api/batch/v1"
+	batch_v1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// operationLabel labels the CronJob of a scheduled operation, and the jobs it spawns, with the name of the operation
+	operationLabel = "qlik.com/operation"
+	// maxCronJobNameLength leaves room for the suffix of the names of the jobs spawned by a CronJob
+	maxCronJobNameLength = 52
+)
+
+// reservedOperationNames would give the CronJob of an operation the name of the ops runner job, or of its sync jobs
+var reservedOperationNames = []string{
+	strings.TrimPrefix(opsRunnerJobNameSuffix, "-"),
+	strings.Trim(syncJobNameSuffix, "-"),
+}
+
+func getOperationCronJobName(m *qlikv1.Qliksense, operation *qlikv1.ScheduledOperation) string {
+	return fmt.Sprintf("%v-%v", m.Name, operation.Name)
+}
+
+func getOperationLabels(m *qlikv1.Qliksense, operation *qlikv1.ScheduledOperation) map[string]string {
+	return map[string]string{
+		searchingLabel: m.Name,
+		operationLabel: operation.Name,
+	}
+}
+
+// validateScheduledOperation checks the fields of the operation the API server does not validate
+func validateScheduledOperation(m *qlikv1.Qliksense, operation *qlikv1.ScheduledOperation) error {
+	if errs := validation.IsDNS1123Label(operation.Name); len(errs) > 0 {
+		return fmt.Errorf("invalid name %q: %v", operation.Name, strings.Join(errs, ", "))
+	} else if contains(reservedOperationNames, operation.Name) {
+		return fmt.Errorf("the name %q is reserved", operation.Name)
+	} else if name := getOperationCronJobName(m, operation); len(name) > maxCronJobNameLength {
+		return fmt.Errorf("the CronJob name %q is longer than %v characters", name, maxCronJobNameLength)
+	} else if operation.Schedule == "" {
+		return fmt.Errorf("missing schedule")
+	} else if operation.Image == "" {
+		return fmt.Errorf("missing image")
+	}
+	return nil
+}
+
+// setupScheduledOperations applies a CronJob for every scheduled operation of the CR, deletes the CronJobs of the
+// operations removed from the CR, and records the results of their jobs in the status of the CR
+func (r *ReconcileQliksense) setupScheduledOperations(reqLogger logr.Logger, m *qlikv1.Qliksense) error {
+	var operations []qlikv1.ScheduledOperation
+	if m.Spec != nil {
+		operations = m.Spec.Operations
+	}
+
+	cronJobList := &batch_v1beta1.CronJobList{}
+	if err := r.listCronJobs(cronJobList, client.InNamespace(m.Namespace), client.MatchingLabels{searchingLabel: m.Name}); err != nil {
+		return err
+	}
+	currentCronJobs := make(map[string]*batch_v1beta1.CronJob)
+	for i := range cronJobList.Items {
+		if name, ok := cronJobList.Items[i].Labels[operationLabel]; ok {
+			currentCronJobs[name] = &cronJobList.Items[i]
+		}
+	}
+
+	applyErrors := make(map[string]error)
+	names := make(map[string]bool)
+	for i := range operations {
+		operation := &operations[i]
+		if names[operation.Name] {
+			// the first operation of the name is applied, its error is more useful than the duplicate
+			if applyErrors[operation.Name] == nil {
+				applyErrors[operation.Name] = fmt.Errorf("duplicate operation %q", operation.Name)
+			}
+			continue
+		}
+		names[operation.Name] = true
+		if err := validateScheduledOperation(m, operation); err != nil {
+			applyErrors[operation.Name] = err
+		} else if err := r.applyOperationCronJob(reqLogger, m, operation, currentCronJobs[operation.Name]); err != nil {
+			reqLogger.Error(err, "Failed to apply the CronJob of the scheduled operation", "operation", operation.Name)
+			applyErrors[operation.Name] = err
+		}
+	}
+
+	for name, cronJob := range currentCronJobs {
+		if names[name] {
+			continue
+		}
+		reqLogger.Info("Deleting the CronJob of a removed scheduled operation", "operation", name, "CronJob.Name", cronJob.Name)
+		// the jobs spawned by the CronJob are deleted with it
+		if err := r.deleteCronJobObject(cronJob, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return r.updateScheduledOperationsStatus(m, operations, currentCronJobs, applyErrors)
+}
+
+func (r *ReconcileQliksense) applyOperationCronJob(reqLogger logr.Logger, m *qlikv1.Qliksense, operation *qlikv1.ScheduledOperation, current *batch_v1beta1.CronJob) error {
+	cronJob, err := r.getOperationCronJob(m, operation)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		reqLogger.Info("Creating the CronJob of a scheduled operation", "operation", operation.Name, "CronJob.Name", cronJob.Name)
+		return r.applyK8sJobObject(reqLogger, cronJob, &cronJob.ObjectMeta, false)
+	}
+	if patchResult, err := patch.DefaultPatchMaker.Calculate(current, cronJob); err != nil {
+		return err
+	} else if patchResult.IsEmpty() {
+		return nil
+	}
+	reqLogger.Info("Updating the CronJob of a scheduled operation", "operation", operation.Name, "CronJob.Name", cronJob.Name)
+	cronJob.ResourceVersion = current.ResourceVersion
+	return r.applyK8sJobObject(reqLogger, cronJob, &cronJob.ObjectMeta, true)
+}
+
+// getOperationCronJob generates the CronJob of the operation, and strategic merges the pod template override of the operation into it.
+// Unlike the ops runner CronJob, it is not suspended while the sync windows are closed: the windows gate the applies of
+// the release, not the maintenance work of the operations.
+func (r *ReconcileQliksense) getOperationCronJob(m *qlikv1.Qliksense, operation *qlikv1.ScheduledOperation) (*batch_v1beta1.CronJob, error) {
+	podTemplate := &corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    operation.Name,
+					Image:   operation.Image,
+					Command: operation.Command,
+					Args:    operation.Args,
+					Env:     operation.Env,
+				},
+			},
+			RestartPolicy:      getOperatorConfig().OpsRunner.RestartPolicy,
+			ServiceAccountName: operation.ServiceAccountName,
+		},
+	}
+	if podTemplate.Spec.ServiceAccountName == "" && m.Spec.OpsRunner != nil {
+		// the ServiceAccount of the ops runner only exists with an ops runner
+		podTemplate.Spec.ServiceAccountName = getOpsRunnerServiceAccountName(m)
+	}
+	podTemplate, err := mergePodTemplateOverride(podTemplate, operation.PodTemplate)
+	if err != nil {
+		return nil, err
+	}
+	r.updatePodSpecForImageRegistry(m, &podTemplate.Spec, operation.Name)
+
+	suspend := operation.Suspend
+	cronJob := &batch_v1beta1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getOperationCronJobName(m, operation),
+			Namespace: m.Namespace,
+			Labels:    getOperationLabels(m, operation),
+		},
+		Spec: batch_v1beta1.CronJobSpec{
+			Schedule: operation.Schedule,
+			Suspend:  &suspend,
+			JobTemplate: batch_v1beta1.JobTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: getOperationLabels(m, operation),
+				},
+				Spec: batch_v1.JobSpec{
+					Template: *podTemplate,
+				},
+			},
+		},
+	}
+	updateCronJobPolicy(&cronJob.Spec, &operation.JobPolicySpec)
+
+	if err := controllerutil.SetControllerReference(m, cronJob, r.scheme); err != nil {
+		return nil, err
+	}
+	return cronJob, nil
+}
+
+// updateScheduledOperationsStatus records the results of the jobs of the operations that finished since the last reconcile
+func (r *ReconcileQliksense) updateScheduledOperationsStatus(m *qlikv1.Qliksense, operations []qlikv1.ScheduledOperation, cronJobs map[string]*batch_v1beta1.CronJob, applyErrors map[string]error) error {
+	jobList := &batch_v1.JobList{}
+	if len(operations) > 0 {
+		if err := r.client.List(context.TODO(), jobList, client.InNamespace(m.Namespace), client.MatchingLabels{searchingLabel: m.Name}); err != nil {
+			return err
+		}
+	}
+	jobs := make(map[string][]batch_v1.Job)
+	for _, job := range jobList.Items {
+		if name, ok := job.Labels[operationLabel]; ok {
+			jobs[name] = append(jobs[name], job)
+		}
+	}
+
+	previousStatuses := make(map[string]*qlikv1.ScheduledOperationStatus)
+	for i := range m.Status.Operations {
+		previousStatuses[m.Status.Operations[i].Name] = &m.Status.Operations[i]
+	}
+	var statuses []qlikv1.ScheduledOperationStatus
+	recorded := make(map[string]bool)
+	for i := range operations {
+		operation := &operations[i]
+		if recorded[operation.Name] {
+			continue
+		}
+		recorded[operation.Name] = true
+		status := qlikv1.ScheduledOperationStatus{Name: operation.Name}
+		if previousStatus, ok := previousStatuses[operation.Name]; ok {
+			previousStatus.DeepCopyInto(&status)
+		}
+		status.Error = ""
+		if err := applyErrors[operation.Name]; err != nil {
+			status.Error = err.Error()
+		}
+		if cronJob, ok := cronJobs[operation.Name]; ok {
+			status.CronJobName = cronJob.Name
+			if cronJob.Status.LastScheduleTime != nil {
+				status.LastScheduleTime = cronJob.Status.LastScheduleTime.DeepCopy()
+			}
+		} else if status.Error == "" {
+			status.CronJobName = getOperationCronJobName(m, operation)
+		}
+		recordFinishedOperationJobs(&status, jobs[operation.Name])
+		statuses = append(statuses, status)
+	}
+
+	if equalScheduledOperationStatuses(m.Status.Operations, statuses) {
+		return nil
+	}
+	m.Status.Operations = statuses
+	return r.client.Status().Update(context.TODO(), m)
+}
+
+// recordFinishedOperationJobs updates the status with the jobs of the operation that finished after the last recorded one
+func recordFinishedOperationJobs(status *qlikv1.ScheduledOperationStatus, jobs []batch_v1.Job) {
+	for _, finished := range getFinishedJobs(jobs, status.LastFinishedTime) {
+		finishTime := finished.finishTime
+		status.LastJobName = finished.job.Name
+		status.LastFinishedTime = &finishTime
+		if startTime := finished.job.Status.StartTime; startTime != nil {
+			if status.LastScheduleTime == nil || status.LastScheduleTime.Before(startTime) {
+				status.LastScheduleTime = startTime.DeepCopy()
+			}
+		}
+		if finished.succeeded {
+			status.LastSuccessTime = &finishTime
+			status.ConsecutiveFailures = 0
+		} else {
+			status.LastFailureTime = &finishTime
+			status.LastExitReason = finished.reason
+			status.ConsecutiveFailures++
+		}
+	}
+}
+
+func equalScheduledOperationStatuses(a, b []qlikv1.ScheduledOperationStatus) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name ||
+			a[i].CronJobName != b[i].CronJobName ||
+			a[i].LastJobName != b[i].LastJobName ||
+			a[i].LastExitReason != b[i].LastExitReason ||
+			a[i].ConsecutiveFailures != b[i].ConsecutiveFailures ||
+			a[i].Error != b[i].Error ||
+			!equalTime(a[i].LastScheduleTime, b[i].LastScheduleTime) ||
+			!equalTime(a[i].LastFinishedTime, b[i].LastFinishedTime) {
+			return false
+		}
+	}
+	return true
+}
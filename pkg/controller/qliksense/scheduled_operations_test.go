@@ -0,0 +1,165 @@
+package qliksense
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/qlik-oss/qliksense-operator/pkg/apis"
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	batch_v1 "k8s.io/api/batch/v1"
+	batch_v1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func Test_getOperationCronJob(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := apis.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := &ReconcileQliksense{scheme: scheme}
+	m := &qlikv1.Qliksense{
+		ObjectMeta: metav1.ObjectMeta{Name: "qlik-default", Namespace: "default", UID: "qlik-default-uid"},
+		Spec:       &qlikv1.QliksenseSpec{OpsRunner: &qlikv1.OpsRunnerSpec{ServiceAccountName: "qlik-ops"}},
+	}
+	backoffLimit := int32(2)
+	operation := &qlikv1.ScheduledOperation{
+		Name:     "backup",
+		Schedule: "0 2 * * *",
+		Image:    "qlik/backup:1.0.0",
+		Args:     []string{"--bucket", "backups"},
+		Suspend:  true,
+		PodTemplate: &corev1.PodTemplateSpec{
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("256Mi")}}},
+				},
+			},
+		},
+	}
+	operation.BackoffLimit = &backoffLimit
+
+	cronJob, err := r.getOperationCronJob(m, operation)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cronJob.Name != "qlik-default-backup" || cronJob.Namespace != m.Namespace {
+		t.Fatalf("unexpected CronJob: %v/%v", cronJob.Namespace, cronJob.Name)
+	} else if cronJob.Labels[searchingLabel] != m.Name || cronJob.Labels[operationLabel] != "backup" {
+		t.Fatalf("unexpected labels: %v", cronJob.Labels)
+	} else if cronJob.Spec.JobTemplate.Labels[operationLabel] != "backup" {
+		t.Fatalf("expected the jobs to be labelled with the operation, but got: %v", cronJob.Spec.JobTemplate.Labels)
+	} else if len(cronJob.OwnerReferences) != 1 || cronJob.OwnerReferences[0].UID != m.UID {
+		t.Fatalf("expected the CronJob to be owned by the CR, but got: %v", cronJob.OwnerReferences)
+	}
+	if cronJob.Spec.Schedule != "0 2 * * *" || cronJob.Spec.Suspend == nil || !*cronJob.Spec.Suspend {
+		t.Fatalf("unexpected schedule: %v, suspend: %v", cronJob.Spec.Schedule, cronJob.Spec.Suspend)
+	} else if cronJob.Spec.ConcurrencyPolicy != batch_v1beta1.ForbidConcurrent {
+		t.Fatalf("expected the Forbid concurrency policy, but got: %v", cronJob.Spec.ConcurrencyPolicy)
+	} else if cronJob.Spec.JobTemplate.Spec.BackoffLimit == nil || *cronJob.Spec.JobTemplate.Spec.BackoffLimit != 2 {
+		t.Fatalf("expected the backoff limit of the operation, but got: %v", cronJob.Spec.JobTemplate.Spec.BackoffLimit)
+	}
+	podSpec := cronJob.Spec.JobTemplate.Spec.Template.Spec
+	if podSpec.ServiceAccountName != "qlik-ops" {
+		t.Fatalf("expected the ServiceAccount of the ops runner, but got: %v", podSpec.ServiceAccountName)
+	} else if len(podSpec.Containers) != 1 {
+		t.Fatalf("expected the override to be merged into the operation container, but got: %v", podSpec.Containers)
+	} else if container := podSpec.Containers[0]; container.Name != "backup" || container.Image != "qlik/backup:1.0.0" || len(container.Args) != 2 {
+		t.Fatalf("unexpected container: %v", container)
+	} else if memory := container.Resources.Limits[corev1.ResourceMemory]; memory.String() != "256Mi" {
+		t.Fatalf("expected the memory limit of the override, but got: %v", memory.String())
+	}
+
+	// the operations keep running while the sync windows are closed
+	operation.Suspend = false
+	m.Status.SyncWindows = &qlikv1.SyncWindowsStatus{Open: false}
+	if cronJob, err := r.getOperationCronJob(m, operation); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if cronJob.Spec.Suspend == nil || *cronJob.Spec.Suspend {
+		t.Fatalf("expected the CronJob not to be suspended by the sync windows, but got: %v", cronJob.Spec.Suspend)
+	}
+}
+
+func Test_setupScheduledOperations(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := apis.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m := &qlikv1.Qliksense{
+		ObjectMeta: metav1.ObjectMeta{Name: "qlik-default", Namespace: "default"},
+		Spec: &qlikv1.QliksenseSpec{
+			Operations: []qlikv1.ScheduledOperation{
+				{Name: "backup", Schedule: "0 2 * * *"},
+				{Name: "ops-runner", Schedule: "0 3 * * *", Image: "qlik/cleanup:1.0.0"},
+				{Name: "backup", Schedule: "0 4 * * *", Image: "qlik/backup:1.0.0"},
+			},
+		},
+	}
+	cronJob := func(name, operation string) *batch_v1beta1.CronJob {
+		labels := map[string]string{searchingLabel: m.Name}
+		if operation != "" {
+			labels[operationLabel] = operation
+		}
+		return &batch_v1beta1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: m.Namespace, Labels: labels}}
+	}
+	finishTime := metav1.NewTime(time.Now().Truncate(time.Second))
+	failedJob := &batch_v1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "qlik-default-backup-1591000000",
+			Namespace: m.Namespace,
+			Labels:    map[string]string{searchingLabel: m.Name, operationLabel: "backup"},
+		},
+		Status: batch_v1.JobStatus{
+			Conditions: []batch_v1.JobCondition{{Type: batch_v1.JobFailed, Status: corev1.ConditionTrue, LastTransitionTime: finishTime, Reason: "BackoffLimitExceeded"}},
+		},
+	}
+	r := &ReconcileQliksense{
+		client: fake.NewFakeClientWithScheme(scheme, m,
+			cronJob("qlik-default-backup", "backup"),
+			cronJob("qlik-default-cleanup", "cleanup"),
+			cronJob("qlik-default-ops-runner", ""),
+			failedJob,
+		),
+		scheme: scheme,
+	}
+
+	if err := r.setupScheduledOperations(log, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the CronJob of the removed operation is deleted, the ones of the ops runner and of the invalid operation are kept
+	if err := r.client.Get(context.TODO(), types.NamespacedName{Name: "qlik-default-cleanup", Namespace: m.Namespace}, &batch_v1beta1.CronJob{}); !errors.IsNotFound(err) {
+		t.Fatalf("expected the CronJob of the removed operation to be deleted, but got: %v", err)
+	}
+	for _, name := range []string{"qlik-default-backup", "qlik-default-ops-runner"} {
+		if err := r.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: m.Namespace}, &batch_v1beta1.CronJob{}); err != nil {
+			t.Fatalf("expected the CronJob %v to be kept, but got: %v", name, err)
+		}
+	}
+
+	current := &qlikv1.Qliksense{}
+	if err := r.client.Get(context.TODO(), types.NamespacedName{Name: m.Name, Namespace: m.Namespace}, current); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	statuses := current.Status.Operations
+	if len(statuses) != 2 || statuses[0].Name != "backup" || statuses[1].Name != "ops-runner" {
+		t.Fatalf("expected the status of every operation once, but got: %+v", statuses)
+	} else if statuses[0].Error != "missing image" || statuses[0].CronJobName != "qlik-default-backup" {
+		t.Fatalf("unexpected status of the backup operation: %+v", statuses[0])
+	} else if statuses[0].LastJobName != failedJob.Name || statuses[0].ConsecutiveFailures != 1 || statuses[0].LastExitReason != "BackoffLimitExceeded" {
+		t.Fatalf("expected the failed job of the backup operation to be recorded, but got: %+v", statuses[0])
+	} else if statuses[1].Error != `the name "ops-runner" is reserved` || statuses[1].CronJobName != "" {
+		t.Fatalf("unexpected status of the ops-runner operation: %+v", statuses[1])
+	}
+}
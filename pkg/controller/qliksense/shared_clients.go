@@ -0,0 +1,193 @@
+package qliksense
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+const informerSyncRequeue = time.Second
+
+var (
+	errInformersStopped = errors.New("informers are stopped")
+	// errInformerNotSynced is returned while an informer is syncing, the reconcile is requeued instead of waiting
+	errInformerNotSynced   = errors.New("informer is not synced yet")
+	errInformerSyncTimeout = errors.New("informer sync timed out")
+)
+
+// isInformerNotSynced tells whether err is returned because an informer is still syncing
+func isInformerNotSynced(err error) bool {
+	return errors.Is(err, errInformerNotSynced)
+}
+
+// sharedClients are created once for the operator and shared by all reconciles, so that every reconcile
+// does not need to create new clients and LIST resources from the API server
+type sharedClients struct {
+	dynamic   dynamic.Interface
+	metadata  metadata.Interface
+	discovery discovery.CachedDiscoveryInterface
+
+	// informers only cache the metadata of objects having the release label
+	namespacedInformers    metadatainformer.SharedInformerFactory
+	clusterScopedInformers metadatainformer.SharedInformerFactory
+
+	mu              sync.Mutex
+	lastInvalidated time.Time
+	stopCh          chan struct{}
+	// syncStarts are the times informers were started, until they are synced
+	syncStarts map[cache.SharedIndexInformer]time.Time
+	// syncErrors are the failures of the informers that did not sync within timeouts.informerSync
+	syncErrors map[cache.SharedIndexInformer]error
+}
+
+func newSharedClients(cfg *rest.Config, namespace string) (*sharedClients, error) {
+	dynamicClient, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	metadataClient, err := metadata.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newSharedClientsFor(dynamicClient, metadataClient, memory.NewMemCacheClient(discoveryClient), namespace), nil
+}
+
+func newSharedClientsFor(dynamicClient dynamic.Interface, metadataClient metadata.Interface, discoveryClient discovery.CachedDiscoveryInterface, namespace string) *sharedClients {
+	informerResyncPeriod := getOperatorConfig().Timeouts.InformerResync.Duration
+	releaseLabelled := func(options *metav1.ListOptions) {
+		options.LabelSelector = releaseLabelSelector().String()
+	}
+	return &sharedClients{
+		dynamic:                dynamicClient,
+		metadata:               metadataClient,
+		discovery:              discoveryClient,
+		namespacedInformers:    metadatainformer.NewFilteredSharedInformerFactory(metadataClient, informerResyncPeriod, namespace, releaseLabelled),
+		clusterScopedInformers: metadatainformer.NewFilteredSharedInformerFactory(metadataClient, informerResyncPeriod, metav1.NamespaceAll, releaseLabelled),
+		stopCh:                 make(chan struct{}),
+		syncStarts:             make(map[cache.SharedIndexInformer]time.Time),
+		syncErrors:             make(map[cache.SharedIndexInformer]error),
+	}
+}
+
+// Start implements manager.Runnable, informers are stopped together with the manager
+func (c *sharedClients) Start(stop <-chan struct{}) error {
+	<-stop
+	close(c.stopCh)
+	return nil
+}
+
+func releaseLabelSelector() labels.Selector {
+	requirement, _ := labels.NewRequirement(searchingLabel, selection.Exists, nil)
+	return labels.NewSelector().Add(*requirement)
+}
+
+// releaseSelector selects the objects of the release of the Qliksense CR
+func releaseSelector(q *qlikv1.Qliksense) labels.Selector {
+	return labels.SelectorFromSet(labels.Set{searchingLabel: q.GetName()})
+}
+
+// listReleaseMetadata returns the metadata of the namespaced objects of a release from the informer cache
+func (c *sharedClients) listReleaseMetadata(gvr schema.GroupVersionResource, namespace string, selector labels.Selector) ([]*metav1.PartialObjectMetadata, error) {
+	informer := c.namespacedInformers.ForResource(gvr)
+	if err := c.start(c.namespacedInformers, informer.Informer()); err != nil {
+		return nil, err
+	}
+	objs, err := informer.Lister().ByNamespace(namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+	return toPartialObjectMetadata(objs), nil
+}
+
+// listClusterScopedReleaseMetadata returns the metadata of the cluster-scoped objects of a release from the informer cache
+func (c *sharedClients) listClusterScopedReleaseMetadata(gvr schema.GroupVersionResource, selector labels.Selector) ([]*metav1.PartialObjectMetadata, error) {
+	informer := c.clusterScopedInformers.ForResource(gvr)
+	if err := c.start(c.clusterScopedInformers, informer.Informer()); err != nil {
+		return nil, err
+	}
+	objs, err := informer.Lister().List(selector)
+	if err != nil {
+		return nil, err
+	}
+	return toPartialObjectMetadata(objs), nil
+}
+
+// start starts informers that were added since the last call without waiting for them. It returns errInformerNotSynced
+// until the informer is synced, and the same failure once the informer did not sync within timeouts.informerSync.
+func (c *sharedClients) start(factory metadatainformer.SharedInformerFactory, informer cache.SharedIndexInformer) error {
+	factory.Start(c.stopCh)
+	select {
+	case <-c.stopCh:
+		return errInformersStopped
+	default:
+	}
+	if informer.HasSynced() {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err, ok := c.syncErrors[informer]; ok {
+		return err
+	}
+	started, ok := c.syncStarts[informer]
+	if !ok {
+		c.syncStarts[informer] = time.Now()
+		return errInformerNotSynced
+	} else if timeout := getOperatorConfig().Timeouts.InformerSync.Duration; time.Since(started) > timeout {
+		// the informer keeps retrying, it is used as soon as it is synced
+		c.syncErrors[informer] = fmt.Errorf("%w after %v", errInformerSyncTimeout, timeout)
+		return c.syncErrors[informer]
+	}
+	return errInformerNotSynced
+}
+
+// resolve resolves g with the cached discovery client. The discovery cache is invalidated, at most once
+// per timeouts.discoveryInvalidate of the operator config, when none of the versions are found, so that newly installed CRDs are picked up.
+func (c *sharedClients) resolve(g GroupVersionsResource) (schema.GroupVersionResource, bool, error) {
+	groupVersionResource, served, err := resolveGroupVersionResource(c.discovery, g)
+	if err != nil || served {
+		return groupVersionResource, served, err
+	}
+
+	c.mu.Lock()
+	invalidate := time.Since(c.lastInvalidated) > getOperatorConfig().Timeouts.DiscoveryInvalidate.Duration
+	if invalidate {
+		c.lastInvalidated = time.Now()
+	}
+	c.mu.Unlock()
+	if !invalidate {
+		return groupVersionResource, served, err
+	}
+	c.discovery.Invalidate()
+	return resolveGroupVersionResource(c.discovery, g)
+}
+
+func toPartialObjectMetadata(objs []runtime.Object) []*metav1.PartialObjectMetadata {
+	result := make([]*metav1.PartialObjectMetadata, 0, len(objs))
+	for _, obj := range objs {
+		if partialObjectMetadata, ok := obj.(*metav1.PartialObjectMetadata); ok {
+			result = append(result, partialObjectMetadata)
+		}
+	}
+	return result
+}
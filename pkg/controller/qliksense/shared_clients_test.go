@@ -0,0 +1,256 @@
+package qliksense
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery/cached/memory"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/metadata"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var testEngineGVR = schema.GroupVersionResource{Group: "qixengine.qlik.com", Version: "v1", Resource: "engines"}
+
+// countingMetadataClient serves a fixed set of objects and counts the calls made to the API server
+type countingMetadataClient struct {
+	objects []metav1.PartialObjectMetadata
+	calls   int64
+	// listErr fails the lists, the informers do not sync
+	listErr error
+	// patches are the patches of the objects by name, they are not applied to the objects
+	patches map[string][]byte
+}
+
+func (c *countingMetadataClient) Resource(schema.GroupVersionResource) metadata.Getter {
+	return &countingMetadataResource{client: c}
+}
+
+type countingMetadataResource struct {
+	client    *countingMetadataClient
+	namespace string
+}
+
+func (r *countingMetadataResource) Namespace(namespace string) metadata.ResourceInterface {
+	return &countingMetadataResource{client: r.client, namespace: namespace}
+}
+
+func (r *countingMetadataResource) Delete(string, *metav1.DeleteOptions, ...string) error {
+	atomic.AddInt64(&r.client.calls, 1)
+	return nil
+}
+
+func (r *countingMetadataResource) DeleteCollection(*metav1.DeleteOptions, metav1.ListOptions) error {
+	atomic.AddInt64(&r.client.calls, 1)
+	return nil
+}
+
+func (r *countingMetadataResource) Get(name string, _ metav1.GetOptions, _ ...string) (*metav1.PartialObjectMetadata, error) {
+	atomic.AddInt64(&r.client.calls, 1)
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (r *countingMetadataResource) List(opts metav1.ListOptions) (*metav1.PartialObjectMetadataList, error) {
+	atomic.AddInt64(&r.client.calls, 1)
+	if r.client.listErr != nil {
+		return nil, r.client.listErr
+	}
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &metav1.PartialObjectMetadataList{}
+	for _, obj := range r.client.objects {
+		if (r.namespace == "" || obj.Namespace == r.namespace) && selector.Matches(labels.Set(obj.Labels)) {
+			list.Items = append(list.Items, obj)
+		}
+	}
+	return list, nil
+}
+
+func (r *countingMetadataResource) Watch(metav1.ListOptions) (watch.Interface, error) {
+	atomic.AddInt64(&r.client.calls, 1)
+	return watch.NewFake(), nil
+}
+
+func (r *countingMetadataResource) Patch(name string, _ types.PatchType, data []byte, _ metav1.PatchOptions, _ ...string) (*metav1.PartialObjectMetadata, error) {
+	atomic.AddInt64(&r.client.calls, 1)
+	if r.client.patches == nil {
+		return nil, fmt.Errorf("not implemented")
+	}
+	r.client.patches[name] = data
+	return &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: name}}, nil
+}
+
+// testEngines returns total engines in the namespace, of which every tenth belongs to the release
+func testEngines(namespace, release string, total int) []metav1.PartialObjectMetadata {
+	engines := make([]metav1.PartialObjectMetadata, 0, total)
+	for i := 0; i < total; i++ {
+		engine := metav1.PartialObjectMetadata{
+			TypeMeta:   metav1.TypeMeta{APIVersion: testEngineGVR.GroupVersion().String(), Kind: "Engine"},
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("engine-%v", i), Namespace: namespace, Labels: map[string]string{}},
+		}
+		if i%10 == 0 {
+			engine.Labels[searchingLabel] = release
+		} else if i%2 == 0 {
+			engine.Labels[searchingLabel] = "other-release"
+		}
+		engines = append(engines, engine)
+	}
+	return engines
+}
+
+func newTestSharedClients(metadataClient metadata.Interface, namespace string) *sharedClients {
+	discoveryClient := &fakediscovery.FakeDiscovery{
+		Fake: &k8stesting.Fake{
+			Resources: []*metav1.APIResourceList{
+				{GroupVersion: testEngineGVR.GroupVersion().String(), APIResources: []metav1.APIResource{{Name: testEngineGVR.Resource, Namespaced: true}}},
+			},
+		},
+	}
+	return newSharedClientsFor(nil, metadataClient, memory.NewMemCacheClient(discoveryClient), namespace)
+}
+
+// waitForInformer calls list again while the informer it lists from is syncing
+func waitForInformer(list func() error) error {
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if err := list(); !isInformerNotSynced(err) || time.Since(start) > 10*time.Second {
+			return err
+		}
+	}
+}
+
+func Test_sharedClients_listReleaseMetadata(t *testing.T) {
+	q := &qlikv1.Qliksense{ObjectMeta: metav1.ObjectMeta{Name: "qlik-default", Namespace: "default"}}
+	metadataClient := &countingMetadataClient{objects: testEngines(q.Namespace, q.Name, 100)}
+	clients := newTestSharedClients(metadataClient, q.Namespace)
+	defer close(clients.stopCh)
+
+	groupVersionResource, served, err := clients.resolve(GroupVersionsResource{Group: testEngineGVR.Group, Versions: []string{"v1"}, Resource: testEngineGVR.Resource})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !served {
+		t.Fatal("expected engines to be served")
+	}
+
+	// the first list does not wait for the informer to sync
+	if _, err := clients.listReleaseMetadata(groupVersionResource, q.Namespace, releaseSelector(q)); !isInformerNotSynced(err) {
+		t.Fatalf("expected the informer not to be synced, but got: %v", err)
+	} else if err := waitForInformer(func() error {
+		_, err := clients.listReleaseMetadata(groupVersionResource, q.Namespace, releaseSelector(q))
+		return err
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if list, err := clients.listReleaseMetadata(groupVersionResource, q.Namespace, releaseSelector(q)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		} else if len(list) != 10 {
+			t.Fatalf("expected 10 engines of the release, but got: %v", len(list))
+		}
+	}
+	// one LIST and one WATCH to start the informer, no calls after that
+	if calls := atomic.LoadInt64(&metadataClient.calls); calls > 2 {
+		t.Fatalf("expected at most 2 API calls, but got: %v", calls)
+	}
+}
+
+func Test_sharedClients_listReleaseMetadata_timeout(t *testing.T) {
+	config := defaultOperatorConfig()
+	config.Timeouts.InformerSync = metav1.Duration{Duration: 50 * time.Millisecond}
+	setOperatorConfig(config)
+	defer setOperatorConfig(nil)
+
+	q := &qlikv1.Qliksense{ObjectMeta: metav1.ObjectMeta{Name: "qlik-default", Namespace: "default"}}
+	clients := newTestSharedClients(&countingMetadataClient{listErr: errors.New("forbidden")}, q.Namespace)
+	defer close(clients.stopCh)
+
+	if _, err := clients.listReleaseMetadata(testEngineGVR, q.Namespace, releaseSelector(q)); !isInformerNotSynced(err) {
+		t.Fatalf("expected the informer not to be synced, but got: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, err := clients.listReleaseMetadata(testEngineGVR, q.Namespace, releaseSelector(q))
+	if !errors.Is(err, errInformerSyncTimeout) {
+		t.Fatalf("expected the informer sync to time out, but got: %v", err)
+	}
+	// the failure is returned right away by the next reconciles
+	start := time.Now()
+	if _, cachedErr := clients.listReleaseMetadata(testEngineGVR, q.Namespace, releaseSelector(q)); cachedErr != err {
+		t.Fatalf("expected the cached failure, but got: %v", cachedErr)
+	} else if time.Since(start) > 10*time.Millisecond {
+		t.Fatalf("expected the failure not to wait, but waited: %v", time.Since(start))
+	}
+}
+
+// BenchmarkListReleaseObjects compares the reconcile cost of listing the engines of a release
+// with an uncached dynamic client LIST (the way it was done before the shared clients) to the shared informer cache
+func BenchmarkListReleaseObjects(b *testing.B) {
+	namespace, release := "default", "qlik-default"
+	q := &qlikv1.Qliksense{ObjectMeta: metav1.ObjectMeta{Name: release, Namespace: namespace}}
+	engines := testEngines(namespace, release, 1000)
+
+	b.Run("uncached-dynamic-list", func(b *testing.B) {
+		objs := make([]runtime.Object, 0, len(engines))
+		for _, engine := range engines {
+			u := &unstructured.Unstructured{}
+			u.SetAPIVersion(engine.APIVersion)
+			u.SetKind(engine.Kind)
+			u.SetName(engine.Name)
+			u.SetNamespace(engine.Namespace)
+			u.SetLabels(engine.Labels)
+			objs = append(objs, u)
+		}
+		dynamicClient := fakedynamic.NewSimpleDynamicClient(runtime.NewScheme(), objs...)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			list, err := dynamicClient.Resource(testEngineGVR).Namespace(namespace).List(metav1.ListOptions{})
+			if err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+			found := 0
+			for _, d := range list.Items {
+				if rls, _, _ := unstructured.NestedString(d.Object, "metadata", "labels", searchingLabel); rls == release {
+					found++
+				}
+			}
+			if found != 100 {
+				b.Fatalf("expected 100 engines of the release, but got: %v", found)
+			}
+		}
+		b.ReportMetric(float64(len(dynamicClient.Actions()))/float64(b.N), "api-calls/op")
+	})
+
+	b.Run("shared-informer-lister", func(b *testing.B) {
+		metadataClient := &countingMetadataClient{objects: engines}
+		clients := newTestSharedClients(metadataClient, namespace)
+		defer close(clients.stopCh)
+		if err := waitForInformer(func() error {
+			_, err := clients.listReleaseMetadata(testEngineGVR, namespace, releaseSelector(q))
+			return err
+		}); err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			list, err := clients.listReleaseMetadata(testEngineGVR, namespace, releaseSelector(q))
+			if err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			} else if len(list) != 100 {
+				b.Fatalf("expected 100 engines of the release, but got: %v", len(list))
+			}
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&metadataClient.calls))/float64(b.N), "api-calls/op")
+	})
+}
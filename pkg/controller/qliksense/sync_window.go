@@ -0,0 +1,181 @@
+package qliksense
+
+import (
+	"fmt"
+	"time"
+
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	"github.com/robfig/cron/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// syncWindowOverrideAnnotation set to "true" applies changes regardless of the sync windows
+	syncWindowOverrideAnnotation = "qlik.com/sync-window-override"
+
+	// syncWindowMaxTransitions and syncWindowMaxLookahead bound the search of the next time the sync windows open or
+	// close, windows that never open or close within them have no next transition
+	syncWindowMaxTransitions = 1000
+	syncWindowMaxLookahead   = 366 * 24 * time.Hour
+	// syncWindowMaxDuration is the longest duration of a sync window
+	syncWindowMaxDuration = 31 * 24 * time.Hour
+)
+
+// syncWindowSchedule is a sync window with its parsed schedule
+type syncWindowSchedule struct {
+	kind     qlikv1.SyncWindowKind
+	schedule cron.Schedule
+	duration time.Duration
+}
+
+// activeUntil returns the end of the window active at t, if any
+func (w *syncWindowSchedule) activeUntil(t time.Time) (time.Time, bool) {
+	// the first start after t - duration is the earliest start of a window that did not end yet
+	start := w.schedule.Next(t.Add(-w.duration))
+	if start.IsZero() || start.After(t) {
+		return time.Time{}, false
+	}
+	// the window ends with the latest start before t, it is bisected between start and t instead of iterating the
+	// starts, which would take a long time for frequent schedules: there is no start between high and t
+	for high := t; ; {
+		if next := w.schedule.Next(start); next.IsZero() || next.After(t) {
+			return start.Add(w.duration), true
+		}
+		middle := start.Add(high.Sub(start) / 2)
+		if next := w.schedule.Next(middle); !next.IsZero() && !next.After(t) {
+			start = next
+		} else {
+			high = middle
+		}
+	}
+}
+
+func parseSyncWindows(windows []qlikv1.SyncWindow) ([]syncWindowSchedule, error) {
+	schedules := make([]syncWindowSchedule, 0, len(windows))
+	for i, window := range windows {
+		if window.Kind != qlikv1.SyncWindowAllow && window.Kind != qlikv1.SyncWindowDeny {
+			return nil, fmt.Errorf("syncWindows[%v].kind must be allow or deny, but got: %v", i, window.Kind)
+		} else if window.Duration.Duration <= 0 {
+			return nil, fmt.Errorf("syncWindows[%v].duration must be positive, but got: %v", i, window.Duration.Duration)
+		} else if window.Duration.Duration > syncWindowMaxDuration {
+			return nil, fmt.Errorf("syncWindows[%v].duration must be at most %v, but got: %v", i, syncWindowMaxDuration, window.Duration.Duration)
+		}
+		spec := window.Schedule
+		if window.TimeZone != "" {
+			if _, err := time.LoadLocation(window.TimeZone); err != nil {
+				return nil, fmt.Errorf("syncWindows[%v].timeZone is invalid: %w", i, err)
+			}
+			spec = fmt.Sprintf("CRON_TZ=%v %v", window.TimeZone, spec)
+		}
+		schedule, err := cron.ParseStandard(spec)
+		if err != nil {
+			return nil, fmt.Errorf("syncWindows[%v].schedule is invalid: %w", i, err)
+		}
+		schedules = append(schedules, syncWindowSchedule{kind: window.Kind, schedule: schedule, duration: window.Duration.Duration})
+	}
+	return schedules, nil
+}
+
+// isSyncWindowOpen tells whether changes are applied at t: no deny window is active, and an allow window is active
+// when there are any
+func isSyncWindowOpen(schedules []syncWindowSchedule, t time.Time) bool {
+	hasAllow, allowed := false, false
+	for i := range schedules {
+		_, active := schedules[i].activeUntil(t)
+		if schedules[i].kind == qlikv1.SyncWindowDeny {
+			if active {
+				return false
+			}
+		} else {
+			hasAllow = true
+			allowed = allowed || active
+		}
+	}
+	return !hasAllow || allowed
+}
+
+// nextSyncWindowTransition returns the next time after t changes are applied, or not applied anymore, if any
+func nextSyncWindowTransition(schedules []syncWindowSchedule, t time.Time) (time.Time, bool) {
+	open := isSyncWindowOpen(schedules, t)
+	until := t.Add(syncWindowMaxLookahead)
+	for i := 0; i < syncWindowMaxTransitions && t.Before(until); i++ {
+		// the earliest start or end of a window after t
+		var next time.Time
+		for j := range schedules {
+			boundary, active := schedules[j].activeUntil(t)
+			if !active {
+				boundary = schedules[j].schedule.Next(t)
+			}
+			if !boundary.IsZero() && (next.IsZero() || boundary.Before(next)) {
+				next = boundary
+			}
+		}
+		if next.IsZero() {
+			return time.Time{}, false
+		}
+		t = next
+		if isSyncWindowOpen(schedules, t) != open {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// getSyncWindowsStatus returns whether the sync windows of the CR are open at now, and when they open or close next.
+// It returns nil when the CR has no sync windows.
+func getSyncWindowsStatus(m *qlikv1.Qliksense, now time.Time) (*qlikv1.SyncWindowsStatus, error) {
+	if len(m.Spec.SyncWindows) == 0 {
+		return nil, nil
+	}
+	schedules, err := parseSyncWindows(m.Spec.SyncWindows)
+	if err != nil {
+		return nil, err
+	}
+	syncWindows := &qlikv1.SyncWindowsStatus{Open: isSyncWindowOpen(schedules, now)}
+	if next, ok := nextSyncWindowTransition(schedules, now); ok {
+		if syncWindows.Open {
+			syncWindows.NextCloseTime = &metav1.Time{Time: next}
+		} else {
+			syncWindows.NextOpenTime = &metav1.Time{Time: next}
+		}
+	}
+	if m.GetAnnotations()[syncWindowOverrideAnnotation] == "true" {
+		syncWindows.Overridden = true
+		syncWindows.Open = true
+	}
+	return syncWindows, nil
+}
+
+// isSyncWindowClosed tells whether changes are held back by the sync windows. The status of the sync windows
+// is updated at the beginning of each reconcile.
+func isSyncWindowClosed(m *qlikv1.Qliksense) bool {
+	return m.Status.SyncWindows != nil && !m.Status.SyncWindows.Open
+}
+
+// addPendingChange records a change held back by the sync windows
+func addPendingChange(m *qlikv1.Qliksense, change string) {
+	for _, pendingChange := range m.Status.SyncWindows.PendingChanges {
+		if pendingChange == change {
+			return
+		}
+	}
+	m.Status.SyncWindows.PendingChanges = append(m.Status.SyncWindows.PendingChanges, change)
+}
+
+// getSyncWindowRequeue returns how long to wait until the sync windows open or close, 0 when they never do
+func getSyncWindowRequeue(m *qlikv1.Qliksense, now time.Time) time.Duration {
+	syncWindows := m.Status.SyncWindows
+	if syncWindows == nil {
+		return 0
+	}
+	next := syncWindows.NextOpenTime
+	if syncWindows.Open {
+		next = syncWindows.NextCloseTime
+	}
+	if next == nil {
+		return 0
+	} else if wait := next.Sub(now); wait > 0 {
+		return wait
+	}
+	return time.Second
+}
@@ -0,0 +1,239 @@
+package qliksense
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/qlik-oss/qliksense-operator/pkg/apis"
+	qlikv1 "github.com/qlik-oss/qliksense-operator/pkg/apis/qlik/v1"
+	batch_v1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func Test_getSyncWindowsStatus(t *testing.T) {
+	// a Monday
+	now := time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name              string
+		now               time.Time
+		windows           []qlikv1.SyncWindow
+		annotations       map[string]string
+		expectError       bool
+		expectedOpen      bool
+		expectedNextOpen  *time.Time
+		expectedNextClose *time.Time
+	}{
+		{
+			name: "no windows",
+			now:  now,
+		},
+		{
+			name: "outside of an allow window",
+			now:  now,
+			windows: []qlikv1.SyncWindow{
+				{Kind: qlikv1.SyncWindowAllow, Schedule: "0 22 * * *", Duration: metav1.Duration{Duration: 4 * time.Hour}},
+			},
+			expectedNextOpen: timePtr(time.Date(2020, 6, 1, 22, 0, 0, 0, time.UTC)),
+		},
+		{
+			name: "inside of an allow window",
+			now:  time.Date(2020, 6, 1, 23, 0, 0, 0, time.UTC),
+			windows: []qlikv1.SyncWindow{
+				{Kind: qlikv1.SyncWindowAllow, Schedule: "0 22 * * *", Duration: metav1.Duration{Duration: 4 * time.Hour}},
+			},
+			expectedOpen:      true,
+			expectedNextClose: timePtr(time.Date(2020, 6, 2, 2, 0, 0, 0, time.UTC)),
+		},
+		{
+			name: "inside of a deny window",
+			now:  now,
+			windows: []qlikv1.SyncWindow{
+				{Kind: qlikv1.SyncWindowDeny, Schedule: "0 9 * * 1-5", Duration: metav1.Duration{Duration: 8 * time.Hour}},
+			},
+			expectedNextOpen: timePtr(time.Date(2020, 6, 1, 17, 0, 0, 0, time.UTC)),
+		},
+		{
+			name: "outside of a deny window",
+			now:  time.Date(2020, 6, 6, 10, 0, 0, 0, time.UTC),
+			windows: []qlikv1.SyncWindow{
+				{Kind: qlikv1.SyncWindowDeny, Schedule: "0 9 * * 1-5", Duration: metav1.Duration{Duration: 8 * time.Hour}},
+			},
+			expectedOpen:      true,
+			expectedNextClose: timePtr(time.Date(2020, 6, 8, 9, 0, 0, 0, time.UTC)),
+		},
+		{
+			name: "deny window inside of an allow window",
+			now:  now,
+			windows: []qlikv1.SyncWindow{
+				{Kind: qlikv1.SyncWindowAllow, Schedule: "0 8 * * *", Duration: metav1.Duration{Duration: 12 * time.Hour}},
+				{Kind: qlikv1.SyncWindowDeny, Schedule: "0 9 * * *", Duration: metav1.Duration{Duration: 2 * time.Hour}},
+			},
+			expectedNextOpen: timePtr(time.Date(2020, 6, 1, 11, 0, 0, 0, time.UTC)),
+		},
+		{
+			name: "adjacent allow windows",
+			now:  now,
+			windows: []qlikv1.SyncWindow{
+				{Kind: qlikv1.SyncWindowAllow, Schedule: "0 8 * * *", Duration: metav1.Duration{Duration: 4 * time.Hour}},
+				{Kind: qlikv1.SyncWindowAllow, Schedule: "0 12 * * *", Duration: metav1.Duration{Duration: 4 * time.Hour}},
+			},
+			expectedOpen:      true,
+			expectedNextClose: timePtr(time.Date(2020, 6, 1, 16, 0, 0, 0, time.UTC)),
+		},
+		{
+			name: "time zone",
+			now:  time.Date(2020, 6, 1, 21, 0, 0, 0, time.UTC),
+			windows: []qlikv1.SyncWindow{
+				{Kind: qlikv1.SyncWindowAllow, Schedule: "0 22 * * *", Duration: metav1.Duration{Duration: 2 * time.Hour}, TimeZone: "Europe/Oslo"},
+			},
+			expectedOpen:      true,
+			expectedNextClose: timePtr(time.Date(2020, 6, 1, 22, 0, 0, 0, time.UTC)),
+		},
+		{
+			name: "override",
+			now:  now,
+			windows: []qlikv1.SyncWindow{
+				{Kind: qlikv1.SyncWindowAllow, Schedule: "0 22 * * *", Duration: metav1.Duration{Duration: 4 * time.Hour}},
+			},
+			annotations:      map[string]string{syncWindowOverrideAnnotation: "true"},
+			expectedOpen:     true,
+			expectedNextOpen: timePtr(time.Date(2020, 6, 1, 22, 0, 0, 0, time.UTC)),
+		},
+		{
+			name: "frequent starts",
+			now:  now,
+			windows: []qlikv1.SyncWindow{
+				{Kind: qlikv1.SyncWindowAllow, Schedule: "*/5 9-10 * * *", Duration: metav1.Duration{Duration: time.Hour}},
+			},
+			expectedOpen: true,
+			// the window started at 10:55 ends last
+			expectedNextClose: timePtr(time.Date(2020, 6, 1, 11, 55, 0, 0, time.UTC)),
+		},
+		{
+			name: "frequent starts of the longest window",
+			now:  now,
+			windows: []qlikv1.SyncWindow{
+				{Kind: qlikv1.SyncWindowDeny, Schedule: "* * * * *", Duration: metav1.Duration{Duration: syncWindowMaxDuration}},
+			},
+		},
+		{
+			name: "too long duration",
+			now:  now,
+			windows: []qlikv1.SyncWindow{
+				{Kind: qlikv1.SyncWindowDeny, Schedule: "0 0 1 1 *", Duration: metav1.Duration{Duration: syncWindowMaxDuration + time.Hour}},
+			},
+			expectError: true,
+		},
+		{
+			name: "invalid schedule",
+			now:  now,
+			windows: []qlikv1.SyncWindow{
+				{Kind: qlikv1.SyncWindowAllow, Schedule: "0 25 * * *", Duration: metav1.Duration{Duration: time.Hour}},
+			},
+			expectError: true,
+		},
+		{
+			name: "invalid time zone",
+			now:  now,
+			windows: []qlikv1.SyncWindow{
+				{Kind: qlikv1.SyncWindowAllow, Schedule: "0 22 * * *", Duration: metav1.Duration{Duration: time.Hour}, TimeZone: "Mars/Olympus"},
+			},
+			expectError: true,
+		},
+		{
+			name: "missing duration",
+			now:  now,
+			windows: []qlikv1.SyncWindow{
+				{Kind: qlikv1.SyncWindowDeny, Schedule: "0 22 * * *"},
+			},
+			expectError: true,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			m := &qlikv1.Qliksense{
+				ObjectMeta: metav1.ObjectMeta{Annotations: testCase.annotations},
+				Spec:       &qlikv1.QliksenseSpec{SyncWindows: testCase.windows},
+			}
+			syncWindows, err := getSyncWindowsStatus(m, testCase.now)
+			if testCase.expectError {
+				if err == nil {
+					t.Fatal("expected an error, but got none")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if len(testCase.windows) == 0 {
+				if syncWindows != nil {
+					t.Fatalf("expected no sync windows status, but got: %+v", syncWindows)
+				}
+				return
+			}
+			if syncWindows.Open != testCase.expectedOpen {
+				t.Fatalf("expected open: %v, but got: %v", testCase.expectedOpen, syncWindows.Open)
+			} else if !equalTime(syncWindows.NextOpenTime, metaTimePtr(testCase.expectedNextOpen)) {
+				t.Fatalf("expected the next open time: %v, but got: %v", testCase.expectedNextOpen, syncWindows.NextOpenTime)
+			} else if !equalTime(syncWindows.NextCloseTime, metaTimePtr(testCase.expectedNextClose)) {
+				t.Fatalf("expected the next close time: %v, but got: %v", testCase.expectedNextClose, syncWindows.NextCloseTime)
+			}
+		})
+	}
+}
+
+func Test_handleSyncRequest_closedSyncWindow(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := apis.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m := &qlikv1.Qliksense{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "qlik-default",
+			Namespace:   "default",
+			Annotations: map[string]string{syncRequestedAnnotation: "2020-06-01T10:00:00Z"},
+		},
+		Spec: &qlikv1.QliksenseSpec{OpsRunner: &qlikv1.OpsRunnerSpec{}},
+	}
+	m.Spec.OpsRunner.Enabled = "yes"
+	m.Spec.OpsRunner.Schedule = "0 * * * *"
+	m.Status.SyncWindows = &qlikv1.SyncWindowsStatus{}
+	r := &ReconcileQliksense{client: fake.NewFakeClientWithScheme(scheme, m), scheme: scheme}
+
+	if err := r.handleSyncRequest(log, m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if m.Status.OpsRunner != nil && m.Status.OpsRunner.LastSyncRequest != nil {
+		t.Fatalf("expected the sync request to wait for the sync windows, but got: %+v", m.Status.OpsRunner.LastSyncRequest)
+	} else if len(m.Status.SyncWindows.PendingChanges) != 1 || m.Status.SyncWindows.PendingChanges[0] != "sync request 2020-06-01T10:00:00Z" {
+		t.Fatalf("expected the sync request to be pending, but got: %v", m.Status.SyncWindows.PendingChanges)
+	}
+	jobList := &batch_v1.JobList{}
+	if err := r.client.List(context.TODO(), jobList, client.InNamespace(m.Namespace)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(jobList.Items) != 0 {
+		t.Fatalf("expected no sync job, but got: %v", len(jobList.Items))
+	}
+
+	cronJob, err := r.getOpsRunnerCronJob(log, m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if cronJob.Spec.Suspend == nil || !*cronJob.Spec.Suspend {
+		t.Fatal("expected the CronJob to be suspended while the sync windows are closed")
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func metaTimePtr(t *time.Time) *metav1.Time {
+	if t == nil {
+		return nil
+	}
+	return &metav1.Time{Time: *t}
+}